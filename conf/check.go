@@ -0,0 +1,290 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+// PathMTU is the outer link MTU assumed when judging whether obfuscation
+// packets get fragmented on the way, if the interface sets no MTU.
+const PathMTU = 1500
+
+// udpOverhead is what the outer IPv6 and UDP headers add to a UDP payload.
+const udpOverhead = 40 + 8
+
+// tunnelOverhead is what the outer headers and the transport message header
+// add to a tunneled packet, which makes the 1420 bytes that awg-quick(8)
+// picks for a 1500-byte link.
+const tunnelOverhead = udpOverhead + device.MessageTransportSize
+
+// pathMTU returns the outer link MTU implied by the MTU of the interface,
+// or PathMTU if it sets none.
+func (iface *Interface) pathMTU() uint32 {
+	if iface.MTU == 0 {
+		return PathMTU
+	}
+	return uint32(iface.MTU) + tunnelOverhead
+}
+
+type Severity int
+
+const (
+	SeverityWarning Severity = iota // DPI-risky or suspicious, but works
+	SeverityError                   // the tunnel will not come up
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// An Issue is a single finding of Check.
+type Issue struct {
+	Severity Severity
+	Side     string // "client", "server", or empty if it concerns both
+	Key      string // configuration key concerned, if any
+	Message  string
+}
+
+func (i Issue) String() string {
+	var b strings.Builder
+	b.WriteString(i.Severity.String())
+	b.WriteString(": ")
+	if i.Side != "" {
+		b.WriteString(i.Side)
+		b.WriteString(": ")
+	}
+	if i.Key != "" {
+		b.WriteString(i.Key)
+		b.WriteString(": ")
+	}
+	b.WriteString(i.Message)
+	return b.String()
+}
+
+// HasErrors reports whether any of issues is an error.
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type checker struct {
+	issues []Issue
+}
+
+func (c *checker) errorf(side, key, format string, args ...any) {
+	c.issues = append(c.issues, Issue{SeverityError, side, key, fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) warnf(side, key, format string, args ...any) {
+	c.issues = append(c.issues, Issue{SeverityWarning, side, key, fmt.Sprintf(format, args...)})
+}
+
+// headers returns H1-H4 as the device uses them: an unset header
+// keeps the standard WireGuard message type.
+func (iface *Interface) headers() [4]device.UintRange {
+	headers := [4]device.UintRange{iface.H1, iface.H2, iface.H3, iface.H4}
+	for i := range headers {
+		if headers[i].IsZero() {
+			headers[i].FromUint32(uint32(i+1), uint32(i+1))
+		}
+	}
+	return headers
+}
+
+func (iface *Interface) paddings() [4]uint32 {
+	return [4]uint32{iface.S1, iface.S2, iface.S3, iface.S4}
+}
+
+// Check lints a single configuration for settings that break the
+// tunnel or make it easy to fingerprint.
+func (conf *Config) Check() []Issue {
+	var c checker
+	c.checkInterface("", &conf.Interface)
+	return c.issues
+}
+
+// Check lints a client and a server configuration, both individually
+// and for compatibility with each other.
+func Check(client, server *Config) []Issue {
+	var c checker
+	c.checkInterface("client", &client.Interface)
+	c.checkInterface("server", &server.Interface)
+	c.checkPair(client, server)
+	return c.issues
+}
+
+func (c *checker) checkInterface(side string, iface *Interface) {
+	if iface.PrivateKey.IsZero() {
+		c.errorf(side, "PrivateKey", "no private key is set")
+	}
+
+	// junk packets
+
+	if iface.Jc > 0 && iface.Jmin > iface.Jmax {
+		c.errorf(side, "Jmin", "Jmin (%d) is larger than Jmax (%d)", iface.Jmin, iface.Jmax)
+	}
+	if iface.Jc > 0 && iface.Jmax == 0 {
+		c.warnf(side, "Jc", "%d junk packets are sent, but Jmax is 0 so they are all empty", iface.Jc)
+	}
+	pathMTU := iface.pathMTU()
+	if iface.Jmax+udpOverhead > pathMTU {
+		c.warnf(side, "Jmax", "junk packets up to %d bytes exceed the path MTU of %d with their IP and UDP headers and get fragmented, which looks suspicious", iface.Jmax, pathMTU)
+	}
+
+	// message types
+
+	headers := iface.headers()
+	for i := 0; i < len(headers); i++ {
+		for j := i + 1; j < len(headers); j++ {
+			if headers[i].Overlap(headers[j]) {
+				c.errorf(side, fmt.Sprintf("H%d", i+1), "range %s overlaps H%d (%s), so message types cannot be told apart; the device rejects this configuration",
+					headers[i].ToString(), j+1, headers[j].ToString())
+			}
+		}
+	}
+	if iface.HeaderProtectionKey.IsZero() {
+		for i, header := range headers {
+			for t := uint32(1); t <= 4; t++ {
+				if header.Contains(t) {
+					c.warnf(side, fmt.Sprintf("H%d", i+1), "range %s contains the WireGuard message type %d, which DPI recognizes", header.ToString(), t)
+					break
+				}
+			}
+		}
+	}
+
+	// message sizes
+
+	paddings := iface.paddings()
+	sizes := [3]uint32{
+		paddings[0] + device.MessageInitiationSize,
+		paddings[1] + device.MessageResponseSize,
+		paddings[2] + device.MessageCookieReplySize,
+	}
+	for i := 0; i < len(sizes); i++ {
+		for j := i + 1; j < len(sizes); j++ {
+			if sizes[i] == sizes[j] {
+				c.errorf(side, fmt.Sprintf("S%d", j+1), "S%d+%d equals S%d+%d (%d bytes), so these handshake messages have the same size",
+					i+1, sizes[i]-paddings[i], j+1, sizes[j]-paddings[j], sizes[i])
+			}
+		}
+	}
+	if sizes[0]+udpOverhead > pathMTU {
+		c.warnf(side, "S1", "handshake initiations of %d bytes exceed the path MTU of %d with their IP and UDP headers", sizes[0], pathMTU)
+	}
+	if !iface.HeaderProtectionKey.IsZero() {
+		for i, padding := range paddings {
+			if padding < device.HeaderCipherNonceSize {
+				c.errorf(side, fmt.Sprintf("S%d", i+1), "is %d, but header protection needs at least %d bytes of padding as nonce",
+					padding, device.HeaderCipherNonceSize)
+			}
+		}
+	}
+
+	// signature packets
+
+	for i, spec := range iface.I {
+		key := fmt.Sprintf("I%d", i+1)
+		if spec == "" {
+			continue
+		}
+		size, err := device.ObfChainSize(spec)
+		switch {
+		case err != nil:
+			c.errorf(side, key, "invalid tags: %v", err)
+		case !strings.Contains(spec, "<"):
+			c.warnf(side, key, "contains no tags and is ignored")
+		case size < 0:
+			c.errorf(side, key, "produces a packet of negative size %d", size)
+		case size+udpOverhead > int(pathMTU):
+			c.warnf(side, key, "produces %d-byte packets, which exceed the path MTU of %d with their IP and UDP headers and get fragmented", size, pathMTU)
+		}
+	}
+
+	if iface.Jc == 0 && paddings == [4]uint32{} && iface.I == [5]string{} &&
+		iface.HeaderProtectionKey.IsZero() && iface.H1.IsZero() && iface.H2.IsZero() && iface.H3.IsZero() && iface.H4.IsZero() {
+		c.warnf(side, "", "no obfuscation is configured; traffic is indistinguishable from plain WireGuard")
+	}
+}
+
+func (c *checker) checkPair(client, server *Config) {
+	ci, si := &client.Interface, &server.Interface
+
+	// Parameters that every packet is parsed with must be identical.
+
+	ch, sh := ci.headers(), si.headers()
+	for i := range ch {
+		if ch[i] != sh[i] {
+			c.errorf("", fmt.Sprintf("H%d", i+1), "client uses %s but server uses %s; messages sent with a type outside of the receiver's range are dropped",
+				ch[i].ToString(), sh[i].ToString())
+		}
+	}
+	cp, sp := ci.paddings(), si.paddings()
+	for i := range cp {
+		if cp[i] != sp[i] {
+			c.errorf("", fmt.Sprintf("S%d", i+1), "client uses %d but server uses %d; the receiver cannot locate the message header", cp[i], sp[i])
+		}
+	}
+	if ci.HeaderProtectionKey != si.HeaderProtectionKey {
+		c.errorf("", "HeaderProtectionKey", "differs between client and server; protected headers cannot be decrypted")
+	}
+	if ci.RandomTrailers != si.RandomTrailers {
+		c.errorf("", "RandomTrailers", "is only enabled on one side; handshake messages with trailers are dropped by the other")
+	}
+
+	// The peers must know each other.
+
+	clientPub, serverPub := ci.PrivateKey.PublicKey(), si.PrivateKey.PublicKey()
+	serverPeer := client.findPeer(serverPub)
+	if serverPeer == nil {
+		c.errorf("client", "PublicKey", "no [Peer] has the server's public key %s", serverPub)
+	} else if serverPeer.Endpoint == "" {
+		c.errorf("client", "Endpoint", "the server peer has no endpoint, so the client cannot initiate")
+	}
+	clientPeer := server.findPeer(clientPub)
+	if clientPeer == nil {
+		c.errorf("server", "PublicKey", "no [Peer] has the client's public key %s", clientPub)
+	}
+	if serverPeer == nil || clientPeer == nil {
+		return
+	}
+
+	if serverPeer.PresharedKey != clientPeer.PresharedKey {
+		c.errorf("", "PresharedKey", "differs between client and server; handshakes fail")
+	}
+	for _, addr := range ci.Addresses {
+		allowed := false
+		for _, prefix := range clientPeer.AllowedIPs {
+			if prefix.Contains(addr.Addr()) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			c.warnf("server", "AllowedIPs", "the client's address %s is not allowed; packets from it are dropped", addr.Addr())
+		}
+	}
+}
+
+func (conf *Config) findPeer(publicKey Key) *Peer {
+	for i := range conf.Peers {
+		if conf.Peers[i].PublicKey == publicKey {
+			return &conf.Peers[i]
+		}
+	}
+	return nil
+}
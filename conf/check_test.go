@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const (
+	checkClientKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	checkClientPub = "HIgo9xNzJMWLKASShiTqIybxZ0U3wGLiUeJ1PKf8ykw="
+	checkServerKey = "xDwB8S8zNBBmXyBG6lEo2Cj5D8DsBhAjUYDNwqGXZ0A="
+	checkServerPub = "jTdg4STLG5humpW/2wYVymzOBKQmpsLeteG8SMubWCQ="
+)
+
+const checkObfuscation = `
+Jc = 4
+Jmin = 40
+Jmax = 70
+S1 = 15
+S2 = 68
+S3 = 20
+S4 = 16
+H1 = 1020325451
+H2 = 3288052141
+H3 = 1766607858
+H4 = 2528465083
+`
+
+func checkPair(t *testing.T, clientExtra, serverExtra string) []Issue {
+	t.Helper()
+	client, err := FromString(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.0.0.2/32
+%s
+[Peer]
+PublicKey = %s
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 0.0.0.0/0
+`, checkClientKey, clientExtra, checkServerPub), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := FromString(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+ListenPort = 51820
+%s
+[Peer]
+PublicKey = %s
+AllowedIPs = 10.0.0.2/32
+`, checkServerKey, serverExtra, checkClientPub), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Check(client, server)
+}
+
+func expectIssue(t *testing.T, issues []Issue, severity Severity, substr string) {
+	t.Helper()
+	for _, issue := range issues {
+		if issue.Severity == severity && strings.Contains(issue.String(), substr) {
+			return
+		}
+	}
+	t.Errorf("expected %v containing %q, got %v", severity, substr, issues)
+}
+
+func TestKeyPublicKey(t *testing.T) {
+	priv, _ := ParseKey(checkClientKey)
+	if pub := priv.PublicKey().String(); pub != checkClientPub {
+		t.Errorf("wrong public key %s", pub)
+	}
+}
+
+func TestCheckClean(t *testing.T) {
+	if issues := checkPair(t, checkObfuscation, checkObfuscation); len(issues) != 0 {
+		t.Errorf("unexpected issues: %v", issues)
+	}
+}
+
+func TestCheckPlainWireGuard(t *testing.T) {
+	issues := checkPair(t, "", "")
+	if HasErrors(issues) {
+		t.Errorf("unexpected errors: %v", issues)
+	}
+	expectIssue(t, issues, SeverityWarning, "no obfuscation")
+}
+
+func TestCheckSingle(t *testing.T) {
+	for _, tc := range []struct {
+		extra    string
+		severity Severity
+		substr   string
+	}{
+		{"H1 = 10-20\nH2 = 15-30\n", SeverityError, "H1: range 10-20 overlaps H2"},
+		{"S1 = 0\nS2 = 56\n", SeverityError, "S1+148 equals S2+92"},
+		{"HeaderProtectionKey = GIArw6nZXDzwPlomwBnaQT+0JLtpbi4HTStdJ6JtM2Y=\nS1 = 4\n", SeverityError, "S1: is 4"},
+		{"Jc = 3\nJmin = 100\nJmax = 9000\n", SeverityWarning, "Jmax: junk packets up to 9000"},
+		{"MTU = 1280\nJc = 3\nJmin = 100\nJmax = 1400\n", SeverityWarning, "path MTU of 1360"},
+		{"Jc = 3\nJmin = 100\nJmax = 50\n", SeverityError, "Jmin (100) is larger"},
+		{"I1 = <b 0xc2><x 5>\n", SeverityError, "unknown tag <x>"},
+		{"I1 = <r 2000>\n", SeverityWarning, "2000-byte packets"},
+		{"I2 = nothing\n", SeverityWarning, "no tags"},
+		{"Jc = 3\nJmin = 100\nJmax = 1453\n", SeverityWarning, "Jmax: junk packets up to 1453"},
+		{"I1 = <r 1453>\n", SeverityWarning, "1453-byte packets"},
+	} {
+		config, err := FromString("[Interface]\nPrivateKey = "+checkClientKey+"\n"+tc.extra, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIssue(t, config.Check(), tc.severity, tc.substr)
+	}
+}
+
+func TestCheckPathMTUBoundary(t *testing.T) {
+	// 1452 bytes of UDP payload fill a 1500-byte link exactly.
+	config, err := FromString("[Interface]\nPrivateKey = "+checkClientKey+"\nJc = 3\nJmin = 100\nJmax = 1452\nI1 = <r 1452>\n", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range config.Check() {
+		if strings.Contains(issue.String(), "path MTU") {
+			t.Errorf("unexpected issue: %v", issue)
+		}
+	}
+}
+
+func TestCheckMismatch(t *testing.T) {
+	issues := checkPair(t, checkObfuscation, strings.Replace(checkObfuscation, "S2 = 68", "S2 = 69", 1)+"RandomTrailers = true\n")
+	expectIssue(t, issues, SeverityError, "S2: client uses 68 but server uses 69")
+	expectIssue(t, issues, SeverityError, "RandomTrailers")
+}
@@ -0,0 +1,112 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package conf reads and writes AmneziaWG configuration files in the
+// INI format understood by awg(8) and awg-quick(8).
+package conf
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+const KeyLength = 32
+
+// A Key is a Curve25519 key, preshared key or header protection key.
+// In configuration files it is encoded as base64.
+type Key [KeyLength]byte
+
+func ParseKey(s string) (Key, error) {
+	var key Key
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != KeyLength {
+		return key, errors.New("keys must decode to exactly 32 bytes")
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// HexString returns the key in the encoding used by the UAPI.
+func (k Key) HexString() string {
+	return hex.EncodeToString(k[:])
+}
+
+func (k Key) IsZero() bool {
+	var zero Key
+	return subtle.ConstantTimeCompare(k[:], zero[:]) == 1
+}
+
+// PublicKey derives the public key belonging to a private key.
+func (k Key) PublicKey() Key {
+	sk := device.NoisePrivateKey(k)
+	return Key(sk.PublicKey())
+}
+
+type Config struct {
+	Name      string
+	Interface Interface
+	Peers     []Peer
+}
+
+type Interface struct {
+	PrivateKey Key
+	ListenPort uint16
+	FwMark     uint32
+
+	// Addresses, DNS, DNSSearch and MTU are awg-quick(8) settings.
+	// They are not part of the UAPI and are kept for the caller.
+	Addresses []netip.Prefix
+	DNS       []netip.Addr
+	DNSSearch []string
+	MTU       uint16
+
+	Jc   uint32
+	Jmin uint32
+	Jmax uint32
+
+	S1 uint32
+	S2 uint32
+	S3 uint32
+	S4 uint32
+
+	H1 device.UintRange
+	H2 device.UintRange
+	H3 device.UintRange
+	H4 device.UintRange
+
+	I [5]string
+
+	HeaderProtectionKey    Key
+	ContentPaddingAddition device.UintRange
+
+	RekeyAfterTime       device.UintRange
+	RekeyTimeout         device.UintRange
+	RejectAfterTime      device.UintRange
+	KeepaliveTimeout     device.UintRange
+	MaxHandshakeAttempts device.UintRange
+
+	RandomTrailers bool
+	DisableCookies bool
+}
+
+type Peer struct {
+	PublicKey           Key
+	PresharedKey        Key
+	Endpoint            string
+	AllowedIPs          []netip.Prefix
+	PersistentKeepalive device.UintRange
+}
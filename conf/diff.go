@@ -0,0 +1,232 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+// A Diff holds the UAPI "set" operation that turns a running device
+// configuration into a desired one, touching only what differs.
+// Peers that do not change are not mentioned, so they keep their
+// current sessions.
+type Diff struct {
+	Interface    []string // changed device keys, e.g. "jc", "h1"
+	AddedPeers   []Key
+	RemovedPeers []Key
+	ChangedPeers []Key
+
+	uapi strings.Builder
+}
+
+func (d *Diff) sendf(format string, args ...any) {
+	fmt.Fprintf(&d.uapi, format, args...)
+	d.uapi.WriteByte('\n')
+}
+
+// IsEmpty reports whether the configurations are equivalent.
+func (d *Diff) IsEmpty() bool {
+	return d.uapi.Len() == 0
+}
+
+// UAPI returns the body of the "set" operation applying the diff.
+func (d *Diff) UAPI() string {
+	return d.uapi.String()
+}
+
+func (d *Diff) String() string {
+	if d.IsEmpty() {
+		return "no changes"
+	}
+	var parts []string
+	if len(d.Interface) > 0 {
+		parts = append(parts, "updated "+strings.Join(d.Interface, ", "))
+	}
+	if n := len(d.AddedPeers); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d peer(s) added", n))
+	}
+	if n := len(d.RemovedPeers); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d peer(s) removed", n))
+	}
+	if n := len(d.ChangedPeers); n > 0 {
+		parts = append(parts, fmt.Sprintf("%d peer(s) changed", n))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Compare computes the changes needed to turn the live configuration,
+// typically parsed with FromUAPI, into the desired one. Endpoints of
+// the desired configuration are resolved.
+//
+// Live peers missing from the desired configuration are only removed if
+// they are in previous, the configuration the desired one replaces, so
+// that peers added at runtime or restored from a state file survive. A nil
+// previous removes all of them.
+func Compare(live, previous, desired *Config) (*Diff, error) {
+	d := new(Diff)
+	d.compareInterface(&live.Interface, &desired.Interface)
+
+	for i := range live.Peers {
+		peer := &live.Peers[i]
+		if desired.findPeer(peer.PublicKey) == nil && (previous == nil || previous.findPeer(peer.PublicKey) != nil) {
+			d.RemovedPeers = append(d.RemovedPeers, peer.PublicKey)
+			d.sendf("public_key=%s", peer.PublicKey.HexString())
+			d.sendf("remove=true")
+		}
+	}
+
+	for i := range desired.Peers {
+		peer := &desired.Peers[i]
+		old := live.findPeer(peer.PublicKey)
+		if old == nil {
+			d.AddedPeers = append(d.AddedPeers, peer.PublicKey)
+			if err := peer.writeUAPI(d.sendf); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		changed, err := d.comparePeer(old, peer)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			d.ChangedPeers = append(d.ChangedPeers, peer.PublicKey)
+		}
+	}
+	return d, nil
+}
+
+func (d *Diff) compareInterface(live, desired *Interface) {
+	changed := func(key string, format string, args ...any) {
+		d.Interface = append(d.Interface, key)
+		d.sendf(key+"="+format, args...)
+	}
+
+	if live.PrivateKey != desired.PrivateKey {
+		changed("private_key", "%s", desired.PrivateKey.HexString())
+	}
+	// A zero port in the file asks for any port, which the live one is.
+	if desired.ListenPort != 0 && live.ListenPort != desired.ListenPort {
+		changed("listen_port", "%d", desired.ListenPort)
+	}
+	if live.FwMark != desired.FwMark {
+		changed("fwmark", "%d", desired.FwMark)
+	}
+
+	uints := []struct {
+		key           string
+		live, desired uint32
+	}{
+		{"jc", live.Jc, desired.Jc},
+		{"jmin", live.Jmin, desired.Jmin},
+		{"jmax", live.Jmax, desired.Jmax},
+		{"s1", live.S1, desired.S1},
+		{"s2", live.S2, desired.S2},
+		{"s3", live.S3, desired.S3},
+		{"s4", live.S4, desired.S4},
+	}
+	for _, v := range uints {
+		if v.live != v.desired {
+			changed(v.key, "%d", v.desired)
+		}
+	}
+
+	liveHeaders, desiredHeaders := live.headers(), desired.headers()
+	for i := range liveHeaders {
+		if liveHeaders[i] != desiredHeaders[i] {
+			changed(fmt.Sprintf("h%d", i+1), "%s", desiredHeaders[i].ToString())
+		}
+	}
+	for i := range live.I {
+		if live.I[i] != desired.I[i] {
+			changed(fmt.Sprintf("i%d", i+1), "%s", desired.I[i])
+		}
+	}
+	if live.HeaderProtectionKey != desired.HeaderProtectionKey {
+		changed("header_protection_key", "%s", desired.HeaderProtectionKey.HexString())
+	}
+
+	ranges := []struct {
+		key           string
+		live, desired device.UintRange
+	}{
+		{"content_padding_addition", live.ContentPaddingAddition, desired.ContentPaddingAddition},
+		{"rekey_after_time", live.RekeyAfterTime, desired.RekeyAfterTime},
+		{"rekey_timeout", live.RekeyTimeout, desired.RekeyTimeout},
+		{"reject_after_time", live.RejectAfterTime, desired.RejectAfterTime},
+		{"keepalive_timeout", live.KeepaliveTimeout, desired.KeepaliveTimeout},
+		{"max_handshake_attempts", live.MaxHandshakeAttempts, desired.MaxHandshakeAttempts},
+	}
+	for _, v := range ranges {
+		if v.live != v.desired {
+			changed(v.key, "%s", v.desired.ToString())
+		}
+	}
+
+	if live.RandomTrailers != desired.RandomTrailers {
+		changed("random_trailers", "%t", desired.RandomTrailers)
+	}
+	if live.DisableCookies != desired.DisableCookies {
+		changed("disable_cookies", "%t", desired.DisableCookies)
+	}
+}
+
+func (d *Diff) comparePeer(live, desired *Peer) (bool, error) {
+	var lines []string
+	linef := func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	if live.PresharedKey != desired.PresharedKey {
+		linef("preshared_key=%s", desired.PresharedKey.HexString())
+	}
+	// Without an endpoint in the file, the peer may have roamed anywhere.
+	if desired.Endpoint != "" {
+		endpoint, err := ResolveEndpoint(desired.Endpoint)
+		if err != nil {
+			return false, fmt.Errorf("unable to resolve endpoint of peer %s: %w", desired.PublicKey, err)
+		}
+		if liveEndpoint, err := netip.ParseAddrPort(live.Endpoint); err != nil || liveEndpoint != endpoint {
+			linef("endpoint=%s", endpoint)
+		}
+	}
+	if live.PersistentKeepalive != desired.PersistentKeepalive {
+		linef("persistent_keepalive_interval=%s", desired.PersistentKeepalive.ToString())
+	}
+
+	liveIPs := make([]netip.Prefix, len(live.AllowedIPs))
+	for i, prefix := range live.AllowedIPs {
+		liveIPs[i] = prefix.Masked()
+	}
+	desiredIPs := make([]netip.Prefix, len(desired.AllowedIPs))
+	for i, prefix := range desired.AllowedIPs {
+		desiredIPs[i] = prefix.Masked()
+	}
+	for _, prefix := range liveIPs {
+		if !slices.Contains(desiredIPs, prefix) {
+			linef("allowed_ip=-%s", prefix)
+		}
+	}
+	for _, prefix := range desiredIPs {
+		if !slices.Contains(liveIPs, prefix) {
+			linef("allowed_ip=%s", prefix)
+		}
+	}
+
+	if len(lines) == 0 {
+		return false, nil
+	}
+	d.sendf("public_key=%s", desired.PublicKey.HexString())
+	for _, line := range lines {
+		d.sendf("%s", line)
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	live, err := FromString(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+Jc = 4
+S1 = 10
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.0.0.2/32, 10.0.1.0/24
+
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.0.0.3/32
+`, "live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired, err := FromString(`[Interface]
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+Jc = 6
+H1 = 1000
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.0.0.2/32, 10.0.2.0/24
+
+[Peer]
+PublicKey = gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA=
+AllowedIPs = 10.0.0.4/32
+`, "desired")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := Compare(live, nil, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := diff.String(), "updated jc, s1, h1; 1 peer(s) added; 1 peer(s) removed; 1 peer(s) changed"; got != want {
+		t.Errorf("summary is %q, want %q", got, want)
+	}
+	uapi := diff.UAPI()
+	for _, line := range []string{
+		"jc=6\n", "s1=0\n", "h1=1000\n",
+		"public_key=4eb32f4a83f88d842563a448cc181bb2c42a637bf12363e2fb2ef594e5965d7d\nremove=true\n",
+		"allowed_ip=-10.0.1.0/24\nallowed_ip=10.0.2.0/24\n",
+		"public_key=80deb906420acb578213da4fd7075cf11394b641cb1763df02a61dc98073e840\nprotocol_version=1\n",
+	} {
+		if !strings.Contains(uapi, line) {
+			t.Errorf("missing %q in:\n%s", line, uapi)
+		}
+	}
+	for _, unwanted := range []string{"listen_port", "private_key", "endpoint"} {
+		if strings.Contains(uapi, unwanted) {
+			t.Errorf("unexpected %s in:\n%s", unwanted, uapi)
+		}
+	}
+
+	same, err := Compare(desired, nil, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.IsEmpty() {
+		t.Errorf("expected no changes, got:\n%s", same.UAPI())
+	}
+
+	// Peers that the replaced file did not have were added at runtime and
+	// stay.
+	kept, err := Compare(live, desired, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept.RemovedPeers) != 0 || strings.Contains(kept.UAPI(), "remove=true") {
+		t.Errorf("removed peers not from the file:\n%s", kept.UAPI())
+	}
+}
+
+func TestFromUAPI(t *testing.T) {
+	c, err := FromUAPI(strings.NewReader(`private_key=c809f3e5317e9575c9b5ed78b638b7ce530dabe85ddab614220241801ddf0669
+listen_port=51820
+jc=4
+h1=1
+h2=100-200
+i1=<r 10>
+random_trailers=1
+disable_cookies=0
+public_key=c5320103...
+`), "awg0")
+	if err == nil || c != nil {
+		t.Fatal("expected error for bad public key")
+	}
+
+	c, err = FromUAPI(strings.NewReader(`private_key=c809f3e5317e9575c9b5ed78b638b7ce530dabe85ddab614220241801ddf0669
+listen_port=51820
+jc=4
+h2=100-200
+i1=<r 10>
+random_trailers=1
+disable_cookies=0
+public_key=c5320103ae5ba14be71f886da1d8db7bbebded08cb111b7534007899aaa9f038
+preshared_key=0000000000000000000000000000000000000000000000000000000000000000
+protocol_version=1
+endpoint=192.95.5.67:1234
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.2/32
+
+`), "awg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Interface.ListenPort != 51820 || c.Interface.Jc != 4 || c.Interface.H2.ToString() != "100-200" ||
+		c.Interface.I[0] != "<r 10>" || !c.Interface.RandomTrailers {
+		t.Errorf("wrong interface: %+v", c.Interface)
+	}
+	if len(c.Peers) != 1 || c.Peers[0].Endpoint != "192.95.5.67:1234" ||
+		c.Peers[0].PersistentKeepalive.ToString() != "25" || len(c.Peers[0].AllowedIPs) != 1 {
+		t.Errorf("wrong peers: %+v", c.Peers)
+	}
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"crypto/rand"
+	"math"
+	mathrand "math/rand/v2"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+// NewPresharedKey generates a random preshared key, which may also be
+// used as a header protection key.
+func NewPresharedKey() (Key, error) {
+	var key Key
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+// NewPrivateKey generates a random private key.
+func NewPrivateKey() (Key, error) {
+	sk, err := device.NewPrivateKey()
+	return Key(sk), err
+}
+
+func randBetween(lo, hi uint32) uint32 {
+	return lo + mathrand.Uint32N(hi-lo+1)
+}
+
+// GenerateObfuscation returns an Interface holding a random set of
+// junk, padding, header and header protection settings that passes
+// Check. The same settings must be used on both sides, except for the
+// junk packet settings.
+func GenerateObfuscation() (*Interface, error) {
+	iface := new(Interface)
+
+	iface.Jc = randBetween(4, 12)
+	iface.Jmin = randBetween(40, 200)
+	iface.Jmax = randBetween(iface.Jmin+50, iface.Jmin+800)
+
+	// Every padding is large enough to serve as a header protection
+	// nonce, and no two handshake messages end up with the same size.
+	for {
+		iface.S1 = randBetween(device.HeaderCipherNonceSize, 150)
+		iface.S2 = randBetween(device.HeaderCipherNonceSize, 150)
+		iface.S3 = randBetween(device.HeaderCipherNonceSize, 150)
+		iface.S4 = randBetween(device.HeaderCipherNonceSize, 32)
+		sizes := []uint32{
+			iface.S1 + device.MessageInitiationSize,
+			iface.S2 + device.MessageResponseSize,
+			iface.S3 + device.MessageCookieReplySize,
+		}
+		if sizes[0] != sizes[1] && sizes[0] != sizes[2] && sizes[1] != sizes[2] {
+			break
+		}
+	}
+
+	// Header ranges are placed above the WireGuard message types and
+	// redrawn until they do not overlap.
+	var headers [4]device.UintRange
+	for i := range headers {
+		for {
+			width := randBetween(0, 1<<20)
+			lo := randBetween(5, math.MaxUint32-width)
+			headers[i].FromUint32(lo, lo+width)
+			overlaps := false
+			for j := 0; j < i; j++ {
+				overlaps = overlaps || headers[i].Overlap(headers[j])
+			}
+			if !overlaps {
+				break
+			}
+		}
+	}
+	iface.H1, iface.H2, iface.H3, iface.H4 = headers[0], headers[1], headers[2], headers[3]
+
+	var err error
+	iface.HeaderProtectionKey, err = NewPresharedKey()
+	if err != nil {
+		return nil, err
+	}
+	return iface, nil
+}
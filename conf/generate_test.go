@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenerateObfuscation(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		iface, err := GenerateObfuscation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		iface.PrivateKey, err = NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := &Config{Name: "awg0", Interface: *iface}
+		if issues := conf.Check(); len(issues) != 0 {
+			t.Fatalf("generated parameters have issues: %v\n%s", issues, conf.ToWgQuick())
+		}
+
+		parsed, err := FromString(conf.ToWgQuick(), "awg0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed.Interface, conf.Interface) {
+			t.Fatalf("round trip mismatch:\n%+v\n%+v", parsed.Interface, conf.Interface)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+var errUnknownKey = errors.New("unknown key")
+
+type ParseError struct {
+	Line int    // line number, starting at 1
+	Key  string // offending key, if any
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("line %d: invalid %s: %v", e.Line, e.Key, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Load reads the configuration file at path.
+// The configuration is named after the file, without the .conf suffix.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f, strings.TrimSuffix(filepath.Base(path), ".conf"))
+}
+
+// FromString parses a configuration held in memory.
+func FromString(s, name string) (*Config, error) {
+	return Parse(strings.NewReader(s), name)
+}
+
+// Parse parses a configuration in the format of awg-quick(8).
+// Keys and section names are case-insensitive, and "#" starts a comment.
+func Parse(r io.Reader, name string) (*Config, error) {
+	const (
+		sectionNone = iota
+		sectionInterface
+		sectionPeer
+	)
+
+	conf := &Config{Name: name}
+	section := sectionNone
+	lineNo := 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if line[0] == '[' {
+			switch strings.ToLower(line) {
+			case "[interface]":
+				section = sectionInterface
+			case "[peer]":
+				conf.Peers = append(conf.Peers, Peer{})
+				section = sectionPeer
+			default:
+				return nil, &ParseError{Line: lineNo, Err: fmt.Errorf("unknown section %s", line)}
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, &ParseError{Line: lineNo, Err: fmt.Errorf("expected key = value, got %q", line)}
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch section {
+		case sectionInterface:
+			err = conf.Interface.parseLine(strings.ToLower(key), value)
+		case sectionPeer:
+			err = conf.Peers[len(conf.Peers)-1].parseLine(strings.ToLower(key), value)
+		default:
+			err = errors.New("key outside of a section")
+		}
+		if err != nil {
+			return nil, &ParseError{Line: lineNo, Key: key, Err: err}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range conf.Peers {
+		if conf.Peers[i].PublicKey.IsZero() {
+			return nil, fmt.Errorf("peer %d is missing PublicKey", i+1)
+		}
+	}
+	return conf, nil
+}
+
+func splitList(value string) []string {
+	var out []string
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func parseUint32(value string) (uint32, error) {
+	v, err := strconv.ParseUint(value, 10, 32)
+	return uint32(v), err
+}
+
+func parsePadding(value string) (uint32, error) {
+	v, err := strconv.ParseUint(value, 10, 16)
+	return uint32(v), err
+}
+
+func parseRange(value string) (device.UintRange, error) {
+	var rang device.UintRange
+	if strings.EqualFold(value, "off") {
+		return rang, nil
+	}
+	err := rang.FromString(value)
+	return rang, err
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if strings.IndexByte(value, '/') < 0 {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(value)
+}
+
+func (iface *Interface) parseLine(key, value string) (err error) {
+	switch key {
+	case "privatekey":
+		iface.PrivateKey, err = ParseKey(value)
+
+	case "listenport":
+		var port uint64
+		port, err = strconv.ParseUint(value, 10, 16)
+		iface.ListenPort = uint16(port)
+
+	case "fwmark":
+		if strings.EqualFold(value, "off") {
+			iface.FwMark = 0
+			return nil
+		}
+		var mark uint64
+		mark, err = strconv.ParseUint(value, 0, 32)
+		iface.FwMark = uint32(mark)
+
+	case "address":
+		for _, s := range splitList(value) {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				return err
+			}
+			iface.Addresses = append(iface.Addresses, prefix)
+		}
+
+	case "dns":
+		for _, s := range splitList(value) {
+			if addr, err := netip.ParseAddr(s); err == nil {
+				iface.DNS = append(iface.DNS, addr)
+			} else {
+				iface.DNSSearch = append(iface.DNSSearch, s)
+			}
+		}
+
+	case "mtu":
+		var mtu uint64
+		mtu, err = strconv.ParseUint(value, 10, 16)
+		iface.MTU = uint16(mtu)
+
+	case "table", "preup", "postup", "predown", "postdown", "saveconfig":
+		// Handled by awg-quick(8) and meaningless to the daemon.
+
+	case "jc":
+		iface.Jc, err = parseUint32(value)
+	case "jmin":
+		iface.Jmin, err = parseUint32(value)
+	case "jmax":
+		iface.Jmax, err = parseUint32(value)
+
+	case "s1":
+		iface.S1, err = parsePadding(value)
+	case "s2":
+		iface.S2, err = parsePadding(value)
+	case "s3":
+		iface.S3, err = parsePadding(value)
+	case "s4":
+		iface.S4, err = parsePadding(value)
+
+	case "h1":
+		iface.H1, err = parseRange(value)
+	case "h2":
+		iface.H2, err = parseRange(value)
+	case "h3":
+		iface.H3, err = parseRange(value)
+	case "h4":
+		iface.H4, err = parseRange(value)
+
+	case "i1", "i2", "i3", "i4", "i5":
+		iface.I[key[1]-'1'] = value
+
+	case "headerprotectionkey":
+		iface.HeaderProtectionKey, err = ParseKey(value)
+	case "contentpaddingaddition":
+		iface.ContentPaddingAddition, err = parseRange(value)
+
+	case "rekeyaftertime":
+		iface.RekeyAfterTime, err = parseRange(value)
+	case "rekeytimeout":
+		iface.RekeyTimeout, err = parseRange(value)
+	case "rejectaftertime":
+		iface.RejectAfterTime, err = parseRange(value)
+	case "keepalivetimeout":
+		iface.KeepaliveTimeout, err = parseRange(value)
+	case "maxhandshakeattempts":
+		iface.MaxHandshakeAttempts, err = parseRange(value)
+
+	case "randomtrailers":
+		iface.RandomTrailers, err = strconv.ParseBool(value)
+	case "disablecookies":
+		iface.DisableCookies, err = strconv.ParseBool(value)
+
+	default:
+		return errUnknownKey
+	}
+	return err
+}
+
+func (peer *Peer) parseLine(key, value string) (err error) {
+	switch key {
+	case "publickey":
+		peer.PublicKey, err = ParseKey(value)
+
+	case "presharedkey":
+		peer.PresharedKey, err = ParseKey(value)
+
+	case "endpoint":
+		peer.Endpoint = value
+
+	case "allowedips":
+		for _, s := range splitList(value) {
+			prefix, err := parsePrefix(s)
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+		}
+
+	case "persistentkeepalive":
+		peer.PersistentKeepalive, err = parseRange(value)
+
+	default:
+		return errUnknownKey
+	}
+	return err
+}
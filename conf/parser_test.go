@@ -0,0 +1,140 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+const testInput = `
+[Interface]
+Address = 10.192.122.1/24, fd00::1/64
+ListenPort = 51820
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+DNS = 1.1.1.1, example.com
+MTU = 1380
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+Jc = 4
+Jmin = 40
+Jmax = 70
+S1 = 15
+S2 = 68
+S3 = 20
+S4 = 16
+H1 = 1020325451
+H2 = 3288052141-3288052150
+H3 = 1766607858
+H4 = 2528465083
+I1 = <b 0xc200000001><r 16><t>
+HeaderProtectionKey = GIArw6nZXDzwPlomwBnaQT+0JLtpbi4HTStdJ6JtM2Y=
+RandomTrailers = true
+KeepaliveTimeout = 10-15
+
+[Peer]
+# laptop
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = /UwcSPg38hW/D9Y3tcS1FOV0K1wuURMbS0sesJEP5ak=
+Endpoint = 192.95.5.67:1234
+AllowedIPs = 10.192.122.3/32, 10.192.124.1/24
+PersistentKeepalive = 22-30
+
+[peer]
+publickey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.10.10.230
+`
+
+func TestParse(t *testing.T) {
+	c, err := FromString(testInput, "awg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iface := &c.Interface
+	if iface.ListenPort != 51820 || iface.MTU != 1380 {
+		t.Errorf("wrong port %d or mtu %d", iface.ListenPort, iface.MTU)
+	}
+	if len(iface.Addresses) != 2 || iface.Addresses[1] != netip.MustParsePrefix("fd00::1/64") {
+		t.Errorf("wrong addresses: %v", iface.Addresses)
+	}
+	if len(iface.DNS) != 1 || len(iface.DNSSearch) != 1 || iface.DNSSearch[0] != "example.com" {
+		t.Errorf("wrong dns: %v %v", iface.DNS, iface.DNSSearch)
+	}
+	if iface.Jc != 4 || iface.Jmin != 40 || iface.Jmax != 70 {
+		t.Errorf("wrong junk parameters: %d %d %d", iface.Jc, iface.Jmin, iface.Jmax)
+	}
+	if iface.H2.Lo() != 3288052141 || iface.H2.Hi() != 3288052150 {
+		t.Errorf("wrong h2: %s", iface.H2.ToString())
+	}
+	if iface.I[0] != "<b 0xc200000001><r 16><t>" {
+		t.Errorf("wrong i1: %q", iface.I[0])
+	}
+	if !iface.RandomTrailers || iface.KeepaliveTimeout.ToString() != "10-15" {
+		t.Error("wrong timing options")
+	}
+
+	if len(c.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(c.Peers))
+	}
+	if c.Peers[0].PersistentKeepalive.ToString() != "22-30" {
+		t.Errorf("wrong persistent keepalive: %s", c.Peers[0].PersistentKeepalive.ToString())
+	}
+	if c.Peers[1].AllowedIPs[0] != netip.MustParsePrefix("10.10.10.230/32") {
+		t.Errorf("wrong allowed ip: %v", c.Peers[1].AllowedIPs)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, input := range []string{
+		"Jc = 4",
+		"[Interface]\nBogus = 1",
+		"[Interface]\nPrivateKey = abc",
+		"[Interface]\nS1 = 70000",
+		"[Interface]\nH1 = 5-1",
+		"[Peer]\nAllowedIPs = 10.0.0.0/8",
+		"[Wat]",
+	} {
+		_, err := FromString(input, "awg0")
+		if err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+
+	_, err := FromString("[Interface]\n\nListenPort = x", "awg0")
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 3 {
+		t.Errorf("expected parse error on line 3, got %v", err)
+	}
+}
+
+func TestToUAPI(t *testing.T) {
+	c, err := FromString(testInput, "awg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uapi, err := c.ToUAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"private_key=c809f3e5317e9575c9b5ed78b638b7ce530dabe85ddab614220241801ddf0669\n",
+		"listen_port=51820\n",
+		"h2=3288052141-3288052150\n",
+		"i1=<b 0xc200000001><r 16><t>\n",
+		"header_protection_key=18802bc3a9d95c3cf03e5a26c019da413fb424bb696e2e074d2b5d27a26d3366\n",
+		"random_trailers=true\n",
+		"replace_peers=true\npublic_key=c5320103",
+		"endpoint=192.95.5.67:1234\n",
+		"persistent_keepalive_interval=22-30\n",
+		"allowed_ip=10.192.124.1/24\n",
+	} {
+		if !strings.Contains(uapi, line) {
+			t.Errorf("missing %q in:\n%s", line, uapi)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ResolveEndpoint turns a host:port endpoint into the ip:port form
+// accepted by the UAPI, resolving host names if needed.
+func ResolveEndpoint(endpoint string) (netip.AddrPort, error) {
+	if addrPort, err := netip.ParseAddrPort(endpoint); err == nil {
+		return addrPort, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return addr.AddrPort(), nil
+}
+
+// ToUAPI renders the configuration as a UAPI "set" operation body that
+// replaces the whole device configuration, in the manner of awg setconf.
+// Endpoints given as host names are resolved.
+func (conf *Config) ToUAPI() (string, error) {
+	var b strings.Builder
+	sendf := func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+	}
+
+	iface := &conf.Interface
+	sendf("private_key=%s", iface.PrivateKey.HexString())
+	sendf("listen_port=%d", iface.ListenPort)
+	sendf("fwmark=%d", iface.FwMark)
+
+	iface.writeObfuscationUAPI(sendf)
+
+	sendf("replace_peers=true")
+	for i := range conf.Peers {
+		if err := conf.Peers[i].writeUAPI(sendf); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// ObfuscationUAPI renders only the AmneziaWG-specific device keys, such
+// as jc or h1, as UAPI "set" lines.
+func (iface *Interface) ObfuscationUAPI() string {
+	var b strings.Builder
+	iface.writeObfuscationUAPI(func(format string, args ...any) {
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+	})
+	return b.String()
+}
+
+func (iface *Interface) writeObfuscationUAPI(sendf func(format string, args ...any)) {
+	if iface.Jc != 0 {
+		sendf("jc=%d", iface.Jc)
+	}
+	if iface.Jmin != 0 {
+		sendf("jmin=%d", iface.Jmin)
+	}
+	if iface.Jmax != 0 {
+		sendf("jmax=%d", iface.Jmax)
+	}
+	if iface.S1 != 0 {
+		sendf("s1=%d", iface.S1)
+	}
+	if iface.S2 != 0 {
+		sendf("s2=%d", iface.S2)
+	}
+	if iface.S3 != 0 {
+		sendf("s3=%d", iface.S3)
+	}
+	if iface.S4 != 0 {
+		sendf("s4=%d", iface.S4)
+	}
+	if !iface.H1.IsZero() {
+		sendf("h1=%s", iface.H1.ToString())
+	}
+	if !iface.H2.IsZero() {
+		sendf("h2=%s", iface.H2.ToString())
+	}
+	if !iface.H3.IsZero() {
+		sendf("h3=%s", iface.H3.ToString())
+	}
+	if !iface.H4.IsZero() {
+		sendf("h4=%s", iface.H4.ToString())
+	}
+	for i, spec := range iface.I {
+		if spec != "" {
+			sendf("i%d=%s", i+1, spec)
+		}
+	}
+	if !iface.HeaderProtectionKey.IsZero() {
+		sendf("header_protection_key=%s", iface.HeaderProtectionKey.HexString())
+	}
+	if !iface.ContentPaddingAddition.IsZero() {
+		sendf("content_padding_addition=%s", iface.ContentPaddingAddition.ToString())
+	}
+	if !iface.RekeyAfterTime.IsZero() {
+		sendf("rekey_after_time=%s", iface.RekeyAfterTime.ToString())
+	}
+	if !iface.RekeyTimeout.IsZero() {
+		sendf("rekey_timeout=%s", iface.RekeyTimeout.ToString())
+	}
+	if !iface.RejectAfterTime.IsZero() {
+		sendf("reject_after_time=%s", iface.RejectAfterTime.ToString())
+	}
+	if !iface.KeepaliveTimeout.IsZero() {
+		sendf("keepalive_timeout=%s", iface.KeepaliveTimeout.ToString())
+	}
+	if !iface.MaxHandshakeAttempts.IsZero() {
+		sendf("max_handshake_attempts=%s", iface.MaxHandshakeAttempts.ToString())
+	}
+	if iface.RandomTrailers {
+		sendf("random_trailers=true")
+	}
+	if iface.DisableCookies {
+		sendf("disable_cookies=true")
+	}
+}
+
+func (peer *Peer) writeUAPI(sendf func(format string, args ...any)) error {
+	sendf("public_key=%s", peer.PublicKey.HexString())
+	sendf("protocol_version=1")
+	sendf("preshared_key=%s", peer.PresharedKey.HexString())
+	if peer.Endpoint != "" {
+		endpoint, err := ResolveEndpoint(peer.Endpoint)
+		if err != nil {
+			return fmt.Errorf("unable to resolve endpoint of peer %s: %w", peer.PublicKey, err)
+		}
+		sendf("endpoint=%s", endpoint)
+	}
+	sendf("persistent_keepalive_interval=%s", peer.PersistentKeepalive.ToString())
+	sendf("replace_allowed_ips=true")
+	for _, prefix := range peer.AllowedIPs {
+		sendf("allowed_ip=%s", prefix)
+	}
+	return nil
+}
+
+func parseHexKey(s string) (Key, error) {
+	var key Key
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != KeyLength {
+		return key, errors.New("keys must decode to exactly 32 bytes")
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// FromUAPI parses the output of a UAPI "get" operation, such as the one
+// returned by device.IpcGet. Runtime statistics and keys this package
+// does not know about are skipped.
+func FromUAPI(r io.Reader, name string) (*Config, error) {
+	conf := &Config{Name: name}
+	var peer *Peer
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("failed to parse line %q", line)
+		}
+
+		var err error
+		if key == "public_key" {
+			conf.Peers = append(conf.Peers, Peer{})
+			peer = &conf.Peers[len(conf.Peers)-1]
+			peer.PublicKey, err = parseHexKey(value)
+		} else if peer == nil {
+			err = conf.Interface.parseUAPILine(key, value)
+		} else {
+			err = peer.parseUAPILine(key, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (iface *Interface) parseUAPILine(key, value string) (err error) {
+	switch key {
+	case "private_key":
+		iface.PrivateKey, err = parseHexKey(value)
+	case "header_protection_key":
+		iface.HeaderProtectionKey, err = parseHexKey(value)
+	case "listen_port", "fwmark":
+		var v uint64
+		v, err = strconv.ParseUint(value, 10, 32)
+		if key == "listen_port" {
+			iface.ListenPort = uint16(v)
+		} else {
+			iface.FwMark = uint32(v)
+		}
+	default:
+		// The remaining device keys are spelled like the configuration
+		// file keys, with underscores, e.g. content_padding_addition.
+		err = iface.parseLine(strings.ReplaceAll(key, "_", ""), value)
+		if err == errUnknownKey {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (peer *Peer) parseUAPILine(key, value string) (err error) {
+	switch key {
+	case "preshared_key":
+		peer.PresharedKey, err = parseHexKey(value)
+	case "endpoint":
+		peer.Endpoint = value
+	case "allowed_ip":
+		var prefix netip.Prefix
+		prefix, err = netip.ParsePrefix(value)
+		peer.AllowedIPs = append(peer.AllowedIPs, prefix)
+	case "persistent_keepalive_interval":
+		peer.PersistentKeepalive, err = parseRange(value)
+	}
+	return err
+}
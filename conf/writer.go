@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package conf
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+func joinPrefixes(prefixes []netip.Prefix) string {
+	parts := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		parts[i] = prefix.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ToWgQuick renders the configuration in the format of awg-quick(8).
+// Unset values are omitted.
+func (conf *Config) ToWgQuick() string {
+	var b strings.Builder
+	linef := func(key, format string, args ...any) {
+		fmt.Fprintf(&b, "%s = "+format+"\n", append([]any{key}, args...)...)
+	}
+	rangef := func(key string, r device.UintRange) {
+		if !r.IsZero() {
+			linef(key, "%s", r.ToString())
+		}
+	}
+	uintf := func(key string, v uint32) {
+		if v != 0 {
+			linef(key, "%d", v)
+		}
+	}
+
+	iface := &conf.Interface
+	b.WriteString("[Interface]\n")
+	if !iface.PrivateKey.IsZero() {
+		linef("PrivateKey", "%s", iface.PrivateKey)
+	}
+	if iface.ListenPort != 0 {
+		linef("ListenPort", "%d", iface.ListenPort)
+	}
+	if iface.FwMark != 0 {
+		linef("FwMark", "0x%x", iface.FwMark)
+	}
+	if len(iface.Addresses) > 0 {
+		linef("Address", "%s", joinPrefixes(iface.Addresses))
+	}
+	if len(iface.DNS) > 0 || len(iface.DNSSearch) > 0 {
+		var dns []string
+		for _, addr := range iface.DNS {
+			dns = append(dns, addr.String())
+		}
+		linef("DNS", "%s", strings.Join(append(dns, iface.DNSSearch...), ", "))
+	}
+	if iface.MTU != 0 {
+		linef("MTU", "%d", iface.MTU)
+	}
+
+	uintf("Jc", iface.Jc)
+	uintf("Jmin", iface.Jmin)
+	uintf("Jmax", iface.Jmax)
+	uintf("S1", iface.S1)
+	uintf("S2", iface.S2)
+	uintf("S3", iface.S3)
+	uintf("S4", iface.S4)
+	rangef("H1", iface.H1)
+	rangef("H2", iface.H2)
+	rangef("H3", iface.H3)
+	rangef("H4", iface.H4)
+	for i, spec := range iface.I {
+		if spec != "" {
+			linef(fmt.Sprintf("I%d", i+1), "%s", spec)
+		}
+	}
+	if !iface.HeaderProtectionKey.IsZero() {
+		linef("HeaderProtectionKey", "%s", iface.HeaderProtectionKey)
+	}
+	rangef("ContentPaddingAddition", iface.ContentPaddingAddition)
+	rangef("RekeyAfterTime", iface.RekeyAfterTime)
+	rangef("RekeyTimeout", iface.RekeyTimeout)
+	rangef("RejectAfterTime", iface.RejectAfterTime)
+	rangef("KeepaliveTimeout", iface.KeepaliveTimeout)
+	rangef("MaxHandshakeAttempts", iface.MaxHandshakeAttempts)
+	if iface.RandomTrailers {
+		linef("RandomTrailers", "true")
+	}
+	if iface.DisableCookies {
+		linef("DisableCookies", "true")
+	}
+
+	for i := range conf.Peers {
+		peer := &conf.Peers[i]
+		b.WriteString("\n[Peer]\n")
+		linef("PublicKey", "%s", peer.PublicKey)
+		if !peer.PresharedKey.IsZero() {
+			linef("PresharedKey", "%s", peer.PresharedKey)
+		}
+		if peer.Endpoint != "" {
+			linef("Endpoint", "%s", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			linef("AllowedIPs", "%s", joinPrefixes(peer.AllowedIPs))
+		}
+		rangef("PersistentKeepalive", peer.PersistentKeepalive)
+	}
+	return b.String()
+}
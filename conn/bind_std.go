@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"runtime"
 	"strconv"
 	"sync"
@@ -21,7 +22,8 @@ import (
 )
 
 var (
-	_ Bind = (*StdNetBind)(nil)
+	_ Bind          = (*StdNetBind)(nil)
+	_ SocketHandoff = (*StdNetBind)(nil)
 )
 
 // StdNetBind implements Bind for all platforms. While Windows has its own Bind
@@ -46,6 +48,8 @@ type StdNetBind struct {
 
 	blackhole4 bool
 	blackhole6 bool
+
+	adopted []*os.File // sockets for the next Open, from another process
 }
 
 func NewStdNetBind() Bind {
@@ -148,13 +152,25 @@ func (s *StdNetBind) Open(uport uint16) ([]ReceiveFunc, uint16, error) {
 		return nil, 0, ErrBindAlreadyOpen
 	}
 
+	if s.adopted != nil {
+		files := s.adopted
+		s.adopted = nil
+		v4conn, v6conn, port, err := adoptConns(files)
+		if err != nil {
+			return nil, 0, err
+		}
+		fns, err := s.startConns(v4conn, v6conn)
+		if err != nil {
+			return nil, 0, err
+		}
+		return fns, uint16(port), nil
+	}
+
 	// Attempt to open ipv4 and ipv6 listeners on the same port.
 	// If uport is 0, we can retry on failure.
 again:
 	port := int(uport)
 	var v4conn, v6conn *net.UDPConn
-	var v4pc *ipv4.PacketConn
-	var v6pc *ipv6.PacketConn
 
 	v4conn, port, err = listenNet("udp4", port)
 	if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
@@ -172,6 +188,18 @@ again:
 		v4conn.Close()
 		return nil, 0, err
 	}
+	fns, err := s.startConns(v4conn, v6conn)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fns, uint16(port), nil
+}
+
+// startConns sets up v4conn and v6conn, either of which may be nil, as the
+// sockets of the bind.
+func (s *StdNetBind) startConns(v4conn, v6conn *net.UDPConn) ([]ReceiveFunc, error) {
+	var v4pc *ipv4.PacketConn
+	var v6pc *ipv6.PacketConn
 	var fns []ReceiveFunc
 	if v4conn != nil {
 		s.ipv4TxOffload, s.ipv4RxOffload = supportsUDPOffload(v4conn)
@@ -192,10 +220,91 @@ again:
 		s.ipv6 = v6conn
 	}
 	if len(fns) == 0 {
-		return nil, 0, syscall.EAFNOSUPPORT
+		return nil, syscall.EAFNOSUPPORT
 	}
+	return fns, nil
+}
 
-	return fns, uint16(port), nil
+// SocketFiles returns duplicates of the open IPv4 and IPv6 sockets.
+func (s *StdNetBind) SocketFiles() ([]*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var files []*os.File
+	for _, conn := range []*net.UDPConn{s.ipv4, s.ipv6} {
+		if conn == nil {
+			continue
+		}
+		file, err := conn.File()
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil, net.ErrClosed
+	}
+	return files, nil
+}
+
+// AdoptSocketFiles makes the next Open use the sockets in files instead of
+// opening new ones, regardless of the port it is asked for.
+func (s *StdNetBind) AdoptSocketFiles(files []*os.File) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ipv4 != nil || s.ipv6 != nil {
+		return ErrBindAlreadyOpen
+	}
+	for _, file := range s.adopted {
+		file.Close()
+	}
+	s.adopted = files
+	return nil
+}
+
+// adoptConns turns the adopted socket files into connections, and returns
+// them with their port.
+func adoptConns(files []*os.File) (v4conn, v6conn *net.UDPConn, port int, err error) {
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+		if err != nil {
+			if v4conn != nil {
+				v4conn.Close()
+			}
+			if v6conn != nil {
+				v6conn.Close()
+			}
+		}
+	}()
+	for _, file := range files {
+		pc, err := net.FilePacketConn(file)
+		if err != nil {
+			return v4conn, v6conn, 0, err
+		}
+		conn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			return v4conn, v6conn, 0, fmt.Errorf("adopted socket is not UDP: %v", pc.LocalAddr())
+		}
+		laddr := conn.LocalAddr().(*net.UDPAddr)
+		if port != 0 && laddr.Port != port {
+			conn.Close()
+			return v4conn, v6conn, 0, fmt.Errorf("adopted sockets on different ports %d and %d", port, laddr.Port)
+		}
+		port = laddr.Port
+		if laddr.IP.To4() != nil {
+			v4conn = conn
+		} else {
+			v6conn = conn
+		}
+	}
+	return v4conn, v6conn, port, nil
 }
 
 func (s *StdNetBind) putMessages(msgs *[]ipv6.Message) {
@@ -27,6 +27,51 @@ func TestStdNetBindReceiveFuncAfterClose(t *testing.T) {
 	}
 }
 
+func TestStdNetBindAdoptSocketFiles(t *testing.T) {
+	old := NewStdNetBind().(*StdNetBind)
+	_, port, err := old.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := old.SocketFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	bind := NewStdNetBind().(*StdNetBind)
+	if err := bind.AdoptSocketFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	fns, adoptedPort, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	if adoptedPort != port {
+		t.Fatalf("adopted port %d, want %d", adoptedPort, port)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write([]byte("adopted")); err != nil {
+		t.Fatal(err)
+	}
+	bufs := make([][]byte, bind.BatchSize())
+	for i := range bufs {
+		bufs[i] = make([]byte, 1500)
+	}
+	sizes := make([]int, len(bufs))
+	eps := make([]Endpoint, len(bufs))
+	n, err := fns[0](bufs, sizes, eps)
+	if err != nil || n != 1 || string(bufs[0][:sizes[0]]) != "adopted" {
+		t.Fatalf("received %q, %v", bufs[0][:sizes[0]], err)
+	}
+}
+
 func mockSetGSOSize(control *[]byte, gsoSize uint16) {
 	*control = (*control)[:cap(*control)]
 	binary.LittleEndian.PutUint16(*control, gsoSize)
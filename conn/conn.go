@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"net/netip"
+	"os"
 	"reflect"
 	"runtime"
 	"strings"
@@ -71,6 +72,19 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// SocketHandoff is implemented by Bind objects whose sockets can be passed
+// to another process, which takes them over without losing the packets
+// queued on them. Used for daemon upgrades.
+type SocketHandoff interface {
+	// SocketFiles returns duplicates of the open sockets.
+	SocketFiles() ([]*os.File, error)
+
+	// AdoptSocketFiles makes the next Open use files, as returned by
+	// SocketFiles in another process, instead of opening new sockets.
+	// The Bind takes ownership of files.
+	AdoptSocketFiles(files []*os.File) error
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
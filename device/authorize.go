@@ -0,0 +1,327 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tai64n"
+)
+
+const (
+	MaxPendingAuthorizations = 256
+	AuthorizationTimeout     = 10 * time.Second
+
+	// authorizationReplayWindow is how long the timestamp of the latest
+	// initiation asked about is remembered for each unknown key, so that
+	// replays of it do not ask again.
+	authorizationReplayWindow = 5 * time.Minute
+	maxAskedInitiators        = 4 * MaxPendingAuthorizations
+)
+
+// An unknownInitiator is the initiator of a handshake initiation whose
+// public key is not one of the device's peers.
+type unknownInitiator struct {
+	publicKey NoisePublicKey
+	timestamp tai64n.Timestamp
+}
+
+// An askedInitiation is the latest initiation of an unknown key that the
+// authorizer was asked about.
+type askedInitiation struct {
+	timestamp tai64n.Timestamp
+	at        time.Time
+}
+
+// A PeerAuthorizer admits initiators whose public key is not configured as
+// a peer of the device.
+type PeerAuthorizer interface {
+	// AuthorizePeer is called with the public key of an unknown initiator,
+	// which has proven that it holds the matching private key, and the
+	// endpoint its initiation came from. It returns whether to admit the
+	// initiator and, if so, the configuration of the peer to create as UAPI
+	// lines that would follow public_key= in a set operation. The
+	// initiation is answered once the peer has been created.
+	//
+	// AuthorizePeer is called from its own goroutine and may block, but
+	// the initiation is dropped if the device is closed in the meantime.
+	AuthorizePeer(publicKey NoisePublicKey, endpoint conn.Endpoint) (config string, ok bool)
+}
+
+// SetPeerAuthorizer installs the authorizer consulted for initiations from
+// unknown public keys, replacing any previous one. A nil authorizer, the
+// default, drops these initiations.
+func (device *Device) SetPeerAuthorizer(authorizer PeerAuthorizer) {
+	device.authorization.Lock()
+	defer device.authorization.Unlock()
+	device.authorization.authorizer = authorizer
+}
+
+// clearPeerAuthorizer removes authorizer if it is still installed.
+func (device *Device) clearPeerAuthorizer(authorizer PeerAuthorizer) {
+	device.authorization.Lock()
+	defer device.authorization.Unlock()
+	if device.authorization.authorizer == authorizer {
+		device.authorization.authorizer = nil
+	}
+}
+
+// hasPeerAuthorizer reports whether an authorizer is installed, so that
+// initiations from unknown keys are worth verifying.
+func (device *Device) hasPeerAuthorizer() bool {
+	device.authorization.Lock()
+	defer device.authorization.Unlock()
+	return device.authorization.authorizer != nil
+}
+
+// authorizeInitiator asks the authorizer, if any, whether to admit the
+// initiator of msg. It reports false if there is no authorizer, in which
+// case the initiation is invalid.
+func (device *Device) authorizeInitiator(initiator *unknownInitiator, msg *MessageInitiation, endpoint conn.Endpoint, size int) bool {
+	pk := initiator.publicKey
+	auth := &device.authorization
+	auth.Lock()
+	authorizer := auth.authorizer
+	if authorizer == nil {
+		auth.Unlock()
+		return false
+	}
+	now := time.Now()
+	if asked, ok := auth.asked[pk]; ok && now.Sub(asked.at) < authorizationReplayWindow && !initiator.timestamp.After(asked.timestamp) {
+		auth.Unlock()
+		device.log.Verbosef("Received replayed handshake initiation from unknown key %x", pk[:])
+		return true
+	}
+	if _, ok := auth.pending[pk]; ok {
+		// The initiator retries, and the pending request covers it.
+		auth.asked[pk] = askedInitiation{initiator.timestamp, now}
+		auth.Unlock()
+		return true
+	}
+	if len(auth.pending) >= MaxPendingAuthorizations || !device.rememberAsked(pk, initiator.timestamp, now) {
+		auth.Unlock()
+		auth.dropped.Add(1)
+		device.log.Verbosef("Dropped handshake initiation from unknown key %x: too many pending authorizations", pk[:])
+		return true
+	}
+	if auth.pending == nil {
+		auth.pending = make(map[NoisePublicKey]struct{})
+	}
+	auth.pending[pk] = struct{}{}
+	auth.Unlock()
+
+	device.log.Verbosef("Received handshake initiation from unknown key %x at %s, asking for authorization", pk[:], endpoint.DstToString())
+	initiation := *msg
+	go func() {
+		defer func() {
+			auth.Lock()
+			delete(auth.pending, pk)
+			auth.Unlock()
+		}()
+
+		config, ok := authorizer.AuthorizePeer(pk, endpoint)
+		if !ok {
+			device.log.Verbosef("Authorization denied for key %x", pk[:])
+			return
+		}
+		if err := device.createAuthorizedPeer(pk, config); err != nil {
+			device.log.Errorf("Failed to create authorized peer %x: %v", pk[:], err)
+			return
+		}
+		if peer := device.ConsumeMessageInitiation(&initiation); peer != nil {
+			device.log.Verbosef("%v - Created by authorization", peer)
+			device.acceptInitiation(peer, endpoint, size)
+		}
+	}()
+	return true
+}
+
+// rememberAsked records the timestamp of an initiation about to be asked
+// about. It makes room by forgetting the entries past the replay window,
+// and reports false if there is still none.
+// Must hold device.authorization.
+func (device *Device) rememberAsked(pk NoisePublicKey, timestamp tai64n.Timestamp, now time.Time) bool {
+	auth := &device.authorization
+	if auth.asked == nil {
+		auth.asked = make(map[NoisePublicKey]askedInitiation)
+	}
+	if _, ok := auth.asked[pk]; !ok && len(auth.asked) >= maxAskedInitiators {
+		for key, asked := range auth.asked {
+			if now.Sub(asked.at) >= authorizationReplayWindow {
+				delete(auth.asked, key)
+			}
+		}
+		if len(auth.asked) >= maxAskedInitiators {
+			return false
+		}
+	}
+	auth.asked[pk] = askedInitiation{timestamp, now}
+	return true
+}
+
+// createAuthorizedPeer configures the peer pk with the UAPI lines in config.
+func (device *Device) createAuthorizedPeer(pk NoisePublicKey, config string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "public_key=%x\n", pk[:])
+	for _, line := range strings.Split(config, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "public_key=") {
+			return errors.New("configuration must not select another peer")
+		}
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	return device.IpcSet(b.String())
+}
+
+// A uapiAuthorizer forwards authorization requests to a UAPI client as
+// events, and waits for its replies.
+type uapiAuthorizer struct {
+	mu      sync.Mutex // protects all below
+	w       *bufio.Writer
+	nextID  uint64
+	waiting map[uint64]chan uapiAuthorization
+	closed  chan struct{}
+}
+
+type uapiAuthorization struct {
+	config string
+	ok     bool
+}
+
+func (a *uapiAuthorizer) AuthorizePeer(publicKey NoisePublicKey, endpoint conn.Endpoint) (string, bool) {
+	reply := make(chan uapiAuthorization, 1)
+	a.mu.Lock()
+	a.nextID++
+	id := a.nextID
+	a.waiting[id] = reply
+	fmt.Fprintf(a.w, "event=authorize\nid=%d\npublic_key=%x\nendpoint=%s\n\n", id, publicKey[:], endpoint.DstToString())
+	err := a.w.Flush()
+	a.mu.Unlock()
+
+	defer func() {
+		a.mu.Lock()
+		delete(a.waiting, id)
+		a.mu.Unlock()
+	}()
+	if err != nil {
+		return "", false
+	}
+
+	timer := time.NewTimer(AuthorizationTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-reply:
+		return r.config, r.ok
+	case <-a.closed:
+	case <-timer.C:
+	}
+	return "", false
+}
+
+// readReply reads a reply of the form
+//
+//	id=ID
+//	allow=true|false
+//	[peer configuration lines]
+//
+// terminated by a blank line, and passes it to the waiting request.
+func (a *uapiAuthorizer) readReply(r *bufio.Reader) error {
+	var (
+		id     uint64
+		reply  uapiAuthorization
+		config strings.Builder
+		lines  int
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("failed to parse line %q", line)
+		}
+		switch {
+		case lines == 0:
+			if key != "id" {
+				return fmt.Errorf("expected id, got %q", key)
+			}
+			if id, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return fmt.Errorf("invalid id: %w", err)
+			}
+		case lines == 1:
+			if key != "allow" {
+				return fmt.Errorf("expected allow, got %q", key)
+			}
+			if reply.ok, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid allow: %w", err)
+			}
+		default:
+			config.WriteString(line)
+			config.WriteByte('\n')
+		}
+		lines++
+	}
+	if lines < 2 {
+		return errors.New("incomplete reply")
+	}
+	reply.config = config.String()
+
+	a.mu.Lock()
+	waiting, ok := a.waiting[id]
+	a.mu.Unlock()
+	if ok {
+		select {
+		case waiting <- reply:
+		default:
+		}
+	}
+	return nil
+}
+
+// ipcHandleAuthorize turns the connection into an authorization event
+// stream, until the client disconnects.
+func (device *Device) ipcHandleAuthorize(buffered *bufio.ReadWriter) {
+	a := &uapiAuthorizer{
+		w:       buffered.Writer,
+		waiting: make(map[uint64]chan uapiAuthorization),
+		closed:  make(chan struct{}),
+	}
+	defer close(a.closed)
+
+	a.mu.Lock()
+	fmt.Fprintf(a.w, "errno=0\n\n")
+	err := a.w.Flush()
+	a.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	device.log.Verbosef("UAPI: Registered peer authorizer")
+	device.SetPeerAuthorizer(a)
+	defer device.clearPeerAuthorizer(a)
+
+	for {
+		if err := a.readReply(buffered.Reader); err != nil {
+			device.log.Verbosef("UAPI: Peer authorizer stopped: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tai64n"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+type authorizerFunc func(NoisePublicKey, conn.Endpoint) (string, bool)
+
+func (f authorizerFunc) AuthorizePeer(pk NoisePublicKey, endpoint conn.Endpoint) (string, bool) {
+	return f(pk, endpoint)
+}
+
+func TestPeerAuthorizer(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+
+	pk := pair[1].dev.staticIdentity.publicKey
+	publicKey := hex.EncodeToString(pk[:])
+	if err := pair[0].dev.IpcSet(uapiCfg("public_key", publicKey, "remove", "true")); err != nil {
+		t.Fatal(err)
+	}
+
+	asked := make(chan NoisePublicKey, 1)
+	pair[0].dev.SetPeerAuthorizer(authorizerFunc(func(pk NoisePublicKey, endpoint conn.Endpoint) (string, bool) {
+		asked <- pk
+		return "", false
+	}))
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	pair[1].tun.Outbound <- ping
+	select {
+	case got := <-asked:
+		if got != pk {
+			t.Fatalf("asked about %x, want %x", got[:], pk[:])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("authorizer was not asked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if pair[0].dev.LookupPeer(pk) != nil {
+		t.Fatal("denied initiator was added as a peer")
+	}
+
+	// Hand the decision for the retried initiation to a UAPI client.
+	client, server := net.Pipe()
+	go pair[0].dev.IpcHandle(server)
+	defer client.Close()
+	reader := bufio.NewReader(client)
+	go client.Write([]byte("authorize=1\n\n"))
+	readBlock := func() string {
+		t.Helper()
+		var block bytes.Buffer
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return block.String()
+			}
+			block.WriteString(line)
+		}
+	}
+	if got := readBlock(); got != "errno=0\n" {
+		t.Fatalf("unexpected response %q", got)
+	}
+
+	event := readBlock()
+	want := fmt.Sprintf("event=authorize\nid=1\npublic_key=%s\nendpoint=", publicKey)
+	if !bytes.HasPrefix([]byte(event), []byte(want)) {
+		t.Fatalf("unexpected event %q", event)
+	}
+	go client.Write([]byte("id=1\nallow=true\nallowed_ip=1.0.0.2/32\n\n"))
+
+	select {
+	case got := <-pair[0].tun.Inbound:
+		if !bytes.Equal(got, ping) {
+			t.Fatal("ping did not transit correctly")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ping did not transit after authorization")
+	}
+	if pair[0].dev.LookupPeer(pk) == nil {
+		t.Fatal("authorized initiator was not added as a peer")
+	}
+	pair.Send(t, Pong, nil)
+}
+
+func TestAuthorizeInitiatorLimits(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	var msg MessageInitiation
+	endpoint := bindtest.ChannelEndpoint(1)
+	initiator := &unknownInitiator{timestamp: tai64n.Now()}
+	initiator.publicKey[0] = 1
+	if dev.authorizeInitiator(initiator, &msg, endpoint, 0) {
+		t.Fatal("initiation accepted without an authorizer")
+	}
+
+	asked := make(chan NoisePublicKey, 1)
+	dev.SetPeerAuthorizer(authorizerFunc(func(pk NoisePublicKey, endpoint conn.Endpoint) (string, bool) {
+		asked <- pk
+		return "", false
+	}))
+	waitAsked := func(want bool) {
+		t.Helper()
+		timeout := 2 * time.Second
+		if !want {
+			timeout = 100 * time.Millisecond
+		}
+		select {
+		case <-asked:
+			if !want {
+				t.Fatal("authorizer asked again")
+			}
+		case <-time.After(timeout):
+			if want {
+				t.Fatal("authorizer was not asked")
+			}
+		}
+		// Let the denial clear the pending request.
+		for i := 0; i < 100; i++ {
+			dev.authorization.Lock()
+			n := len(dev.authorization.pending)
+			dev.authorization.Unlock()
+			if n == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A replayed initiation is not asked about again, a new one is.
+	dev.authorizeInitiator(initiator, &msg, endpoint, 0)
+	waitAsked(true)
+	dev.authorizeInitiator(initiator, &msg, endpoint, 0)
+	waitAsked(false)
+	retry := *initiator
+	retry.timestamp = tai64n.Now()
+	dev.authorizeInitiator(&retry, &msg, endpoint, 0)
+	waitAsked(true)
+
+	// Initiations beyond the pending requests are dropped and counted.
+	release := make(chan struct{})
+	defer close(release)
+	dev.SetPeerAuthorizer(authorizerFunc(func(pk NoisePublicKey, endpoint conn.Endpoint) (string, bool) {
+		<-release
+		return "", false
+	}))
+	for i := 0; i <= MaxPendingAuthorizations; i++ {
+		initiator := &unknownInitiator{timestamp: tai64n.Now()}
+		initiator.publicKey[0], initiator.publicKey[1] = 2, byte(i)
+		initiator.publicKey[2] = byte(i >> 8)
+		dev.authorizeInitiator(initiator, &msg, endpoint, 0)
+	}
+	if got := dev.authorization.dropped.Load(); got != 1 {
+		t.Errorf("dropped %d initiations, want 1", got)
+	}
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(state, "dropped_authorizations=1\n") {
+		t.Errorf("missing dropped_authorizations in:\n%s", state)
+	}
+}
@@ -37,5 +37,5 @@ const (
 
 const (
 	UnderLoadAfterTime = time.Second // how long does the device remain under load after detected
-	MaxPeers           = 1 << 16     // maximum number of configured peers
+	MaxPeers           = 1 << 20     // maximum number of configured peers
 )
@@ -54,8 +54,8 @@ type Device struct {
 	}
 
 	peers struct {
-		sync.RWMutex // protects keyMap
-		keyMap       map[NoisePublicKey]*Peer
+		sync.RWMutex // serializes changes to keyMap
+		keyMap       peerTable
 	}
 
 	rate struct {
@@ -79,6 +79,7 @@ type Device struct {
 		encryption *outboundQueue
 		decryption *inboundQueue
 		handshake  *handshakeQueue
+		sequential []sequentialLane
 	}
 
 	tun struct {
@@ -127,8 +128,47 @@ type Device struct {
 		maxHandshakeAttemps AtomicUintRange
 	}
 
-	randomTrailers atomic.Bool
-	disableCookies atomic.Bool
+	randomTrailers  atomic.Bool
+	disableCookies  atomic.Bool
+	keepSessionKeys atomic.Bool // whether keypairs keep their keys for Detach
+
+	forwarding struct {
+		enabled atomic.Bool
+		packets atomic.Uint64 // packets forwarded between peers
+		bytes   atomic.Uint64
+		dropped atomic.Uint64 // packets not forwarded by TTL or the target's filters and limits
+	}
+
+	pskProvider struct {
+		sync.Mutex
+		provider PresharedKeyProvider
+	}
+
+	stackStats struct {
+		sync.Mutex
+		provider StackStatsProvider
+	}
+
+	authorization struct {
+		sync.Mutex
+		authorizer PeerAuthorizer
+		pending    map[NoisePublicKey]struct{}
+		asked      map[NoisePublicKey]askedInitiation
+		dropped    atomic.Uint64 // initiations dropped with too many requests pending
+	}
+
+	peerExpiry struct {
+		idleTimeout atomic.Int64 // seconds without a handshake before a peer is removed, 0 to keep
+		sync.Mutex               // protects removed
+		removed     []RemovedPeer
+	}
+
+	savedState struct {
+		sync.Mutex                                       // protects path and pending
+		path       string                                // state file, empty for none
+		pending    map[NoisePublicKey]*restoredPeerState // loaded state of peers not configured yet
+		writing    sync.Mutex                            // serializes state file writes
+	}
 }
 
 // deviceState represents the state of a Device.
@@ -172,7 +212,7 @@ func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	peer.Stop()
 
 	// remove from peer map
-	delete(device.peers.keyMap, key)
+	device.peers.keyMap.delete(key)
 }
 
 // changeState attempts to change the device state to match want.
@@ -221,7 +261,7 @@ func (device *Device) upLocked() error {
 	defer device.ipcMutex.Unlock()
 
 	device.peers.RLock()
-	for _, peer := range device.peers.keyMap {
+	for _, peer := range device.peers.keyMap.all() {
 		peer.Start()
 		if !peer.persistentKeepaliveInterval.Load().IsZero() {
 			peer.SendKeepalive()
@@ -240,7 +280,7 @@ func (device *Device) downLocked() error {
 	}
 
 	device.peers.RLock()
-	for _, peer := range device.peers.keyMap {
+	for _, peer := range device.peers.keyMap.all() {
 		peer.Stop()
 	}
 	device.peers.RUnlock()
@@ -280,8 +320,8 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
-	lockedPeers := make([]*Peer, 0, len(device.peers.keyMap))
-	for _, peer := range device.peers.keyMap {
+	lockedPeers := make([]*Peer, 0, device.peers.keyMap.len())
+	for _, peer := range device.peers.keyMap.all() {
 		peer.handshake.mutex.RLock()
 		lockedPeers = append(lockedPeers, peer)
 	}
@@ -289,7 +329,7 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 	// remove peers with matching public keys
 
 	publicKey := sk.publicKey()
-	for key, peer := range device.peers.keyMap {
+	for key, peer := range device.peers.keyMap.all() {
 		if peer.handshake.remoteStatic.Equals(publicKey) {
 			peer.handshake.mutex.RUnlock()
 			removePeerLocked(device, peer, key)
@@ -305,8 +345,8 @@ func (device *Device) SetPrivateKey(sk NoisePrivateKey) error {
 
 	// do static-static DH pre-computations
 
-	expiredPeers := make([]*Peer, 0, len(device.peers.keyMap))
-	for _, peer := range device.peers.keyMap {
+	expiredPeers := make([]*Peer, 0, device.peers.keyMap.len())
+	for _, peer := range device.peers.keyMap.all() {
 		handshake := &peer.handshake
 		handshake.precomputedStaticStatic, _ = device.staticIdentity.privateKey.sharedSecret(handshake.remoteStatic)
 		expiredPeers = append(expiredPeers, peer)
@@ -337,7 +377,6 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 		mtu = DefaultMTU
 	}
 	device.tun.mtu.Store(int32(mtu))
-	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 	device.rate.limiter.Init()
 	device.indexTable.Init()
 
@@ -357,6 +396,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.queue.handshake = newHandshakeQueue()
 	device.queue.encryption = newOutboundQueue()
 	device.queue.decryption = newInboundQueue()
+	device.startSequentialLanes()
 
 	// start workers
 
@@ -373,6 +413,7 @@ func NewDevice(tunDevice tun.Device, bind conn.Bind, logger *Logger) *Device {
 	device.queue.encryption.wg.Add(1) // RoutineReadFromTUN
 	go device.RoutineReadFromTUN()
 	go device.RoutineTUNEventReader()
+	go device.RoutinePeerGC()
 
 	return device
 }
@@ -391,10 +432,7 @@ func (device *Device) BatchSize() int {
 }
 
 func (device *Device) LookupPeer(pk NoisePublicKey) *Peer {
-	device.peers.RLock()
-	defer device.peers.RUnlock()
-
-	return device.peers.keyMap[pk]
+	return device.peers.keyMap.load(pk)
 }
 
 func (device *Device) RemovePeer(key NoisePublicKey) {
@@ -402,8 +440,8 @@ func (device *Device) RemovePeer(key NoisePublicKey) {
 	defer device.peers.Unlock()
 	// stop peer and remove from routing
 
-	peer, ok := device.peers.keyMap[key]
-	if ok {
+	peer := device.peers.keyMap.load(key)
+	if peer != nil {
 		removePeerLocked(device, peer, key)
 	}
 }
@@ -412,11 +450,9 @@ func (device *Device) RemoveAllPeers() {
 	device.peers.Lock()
 	defer device.peers.Unlock()
 
-	for key, peer := range device.peers.keyMap {
+	for key, peer := range device.peers.keyMap.all() {
 		removePeerLocked(device, peer, key)
 	}
-
-	device.peers.keyMap = make(map[NoisePublicKey]*Peer)
 }
 
 func (device *Device) Close() {
@@ -433,6 +469,9 @@ func (device *Device) Close() {
 	device.tun.device.Close()
 	device.downLocked()
 
+	// Save the learned peer state while the peers are still there.
+	device.writeStateFile(true)
+
 	// Remove peers before closing queues,
 	// because peers assume that queues are active.
 	device.RemoveAllPeers()
@@ -463,7 +502,7 @@ func (device *Device) SendKeepalivesToPeersWithCurrentKeypair() {
 	timeout := device.keychainExpireTime()
 
 	device.peers.RLock()
-	for _, peer := range device.peers.keyMap {
+	for _, peer := range device.peers.keyMap.all() {
 		peer.keypairs.RLock()
 		sendKeepalive := peer.keypairs.current != nil && !peer.keypairs.current.created.Add(timeout).Before(time.Now())
 		peer.keypairs.RUnlock()
@@ -514,7 +553,7 @@ func (device *Device) BindSetMark(mark uint32) error {
 
 	// clear cached source addresses
 	device.peers.RLock()
-	for _, peer := range device.peers.keyMap {
+	for _, peer := range device.peers.keyMap.all() {
 		peer.markEndpointSrcForClearing()
 	}
 	device.peers.RUnlock()
@@ -564,7 +603,7 @@ func (device *Device) BindUpdate() error {
 
 	// clear cached source addresses
 	device.peers.RLock()
-	for _, peer := range device.peers.keyMap {
+	for _, peer := range device.peers.keyMap.all() {
 		peer.markEndpointSrcForClearing()
 	}
 	device.peers.RUnlock()
@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	PeerGCInterval     = 10 * time.Second
+	RemovedPeerHistory = 128 // removals kept for UAPI get
+	peerGCBatchSize    = 64  // peers removed per hold of the IPC lock
+)
+
+// A RemovedPeer records a peer removed by the garbage collector.
+type RemovedPeer struct {
+	PublicKey NoisePublicKey
+	Reason    string // "expired" or "idle"
+	Time      time.Time
+}
+
+func (removed RemovedPeer) String() string {
+	return fmt.Sprintf("%x %s %d", removed.PublicKey[:], removed.Reason, removed.Time.Unix())
+}
+
+// expiryReason returns why the peer should be removed at now, or the empty
+// string if it should be kept.
+func (peer *Peer) expiryReason(now time.Time, idleTimeout time.Duration) string {
+	if at := peer.expiresAt.Load(); at != 0 && now.Unix() >= at {
+		return "expired"
+	}
+	if idleTimeout > 0 {
+		last := peer.lastHandshakeNano.Load()
+		if last == 0 {
+			last = peer.createdNano
+		}
+		if now.Sub(time.Unix(0, last)) >= idleTimeout {
+			return "idle"
+		}
+	}
+	return ""
+}
+
+// removeExpiredPeers removes the peers past their expiry time, and the
+// peers without a handshake within the idle timeout. Nothing is removed
+// while the device is down.
+//
+// The peers are scanned under a read lock, and removed in batches of
+// peerGCBatchSize, so that a large peer table does not hold off the data
+// path and configuration changes for the whole scan.
+func (device *Device) removeExpiredPeers(now time.Time) {
+	if device.isClosed() || !device.isUp() {
+		return
+	}
+	idleTimeout := time.Duration(device.peerExpiry.idleTimeout.Load()) * time.Second
+
+	var candidates []*Peer
+	device.peers.RLock()
+	for _, peer := range device.peers.keyMap.all() {
+		if peer.expiryReason(now, idleTimeout) != "" {
+			candidates = append(candidates, peer)
+		}
+	}
+	device.peers.RUnlock()
+
+	for len(candidates) > 0 {
+		n := min(len(candidates), peerGCBatchSize)
+		device.removeExpiredBatch(now, idleTimeout, candidates[:n])
+		candidates = candidates[n:]
+	}
+}
+
+// removeExpiredBatch removes the peers of batch that are still in the
+// device and still past their expiry time or idle timeout, which
+// configuration changes since the scan may have extended.
+func (device *Device) removeExpiredBatch(now time.Time, idleTimeout time.Duration, batch []*Peer) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	if device.isClosed() {
+		return
+	}
+
+	device.peers.Lock()
+	defer device.peers.Unlock()
+
+	for _, peer := range batch {
+		key := peer.handshake.remoteStatic
+		if device.peers.keyMap.load(key) != peer {
+			continue
+		}
+		reason := peer.expiryReason(now, idleTimeout)
+		if reason == "" {
+			continue
+		}
+		device.log.Verbosef("%v - Removing %s peer", peer, reason)
+		removePeerLocked(device, peer, key)
+
+		device.peerExpiry.Lock()
+		removed := append(device.peerExpiry.removed, RemovedPeer{PublicKey: key, Reason: reason, Time: now})
+		if len(removed) > RemovedPeerHistory {
+			removed = removed[len(removed)-RemovedPeerHistory:]
+		}
+		device.peerExpiry.removed = removed
+		device.peerExpiry.Unlock()
+	}
+}
+
+// RemovedPeers returns the most recent peers removed by the garbage
+// collector, oldest first.
+func (device *Device) RemovedPeers() []RemovedPeer {
+	device.peerExpiry.Lock()
+	defer device.peerExpiry.Unlock()
+	return append([]RemovedPeer(nil), device.peerExpiry.removed...)
+}
+
+func (device *Device) RoutinePeerGC() {
+	device.log.Verbosef("Routine: peer garbage collector - started")
+	defer device.log.Verbosef("Routine: peer garbage collector - stopped")
+
+	ticker := time.NewTicker(PeerGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.closed:
+			return
+		case now := <-ticker.C:
+			device.removeExpiredPeers(now)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestRemoveExpiredPeers(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys [3]NoisePublicKey
+	for i := range keys {
+		sk, err := NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = sk.PublicKey()
+	}
+	now := time.Now()
+	err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(keys[0][:]),
+		"expires_at", fmt.Sprint(now.Add(time.Hour).Unix()),
+		"public_key", hex.EncodeToString(keys[1][:]),
+		"public_key", hex.EncodeToString(keys[2][:]),
+		"expires_at", fmt.Sprint(now.Add(time.Minute).Unix()),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev.LookupPeer(keys[1]).lastHandshakeNano.Store(now.Add(time.Hour).UnixNano())
+
+	// Nothing is removed while the device is down.
+	later := now.Add(2 * time.Minute)
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	dev.removeExpiredPeers(later)
+	if dev.LookupPeer(keys[2]) == nil {
+		t.Fatal("peer removed while the device is down")
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an idle timeout, only the expiry time counts.
+	dev.removeExpiredPeers(later)
+	if dev.LookupPeer(keys[0]) == nil || dev.LookupPeer(keys[1]) == nil || dev.LookupPeer(keys[2]) != nil {
+		t.Fatal("wrong peers removed after expiry")
+	}
+
+	// keys[0] never completed a handshake, keys[1] did recently.
+	if err := dev.IpcSet(uapiCfg("idle_peer_timeout", "60")); err != nil {
+		t.Fatal(err)
+	}
+	dev.removeExpiredPeers(later)
+	if dev.LookupPeer(keys[0]) != nil || dev.LookupPeer(keys[1]) == nil {
+		t.Fatal("wrong peers removed after idle timeout")
+	}
+
+	removed := dev.RemovedPeers()
+	if len(removed) != 2 || removed[0].PublicKey != keys[2] || removed[0].Reason != "expired" ||
+		removed[1].PublicKey != keys[0] || removed[1].Reason != "idle" {
+		t.Errorf("wrong removed peers: %v", removed)
+	}
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"idle_peer_timeout=60\n",
+		fmt.Sprintf("removed_peer=%x expired %d\n", keys[2][:], later.Unix()),
+		fmt.Sprintf("removed_peer=%x idle %d\n", keys[0][:], later.Unix()),
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+
+	d, err := dev.IpcGetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.RemovedPeers) != 2 || d.RemovedPeers[1].Reason != "idle" || d.RemovedPeers[1].Time != later.Unix() {
+		t.Errorf("wrong removed peers in JSON: %+v", d.RemovedPeers)
+	}
+
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(keys[1][:]), "expires_at", "-1")); err == nil {
+		t.Error("expected error for negative expiry time")
+	}
+}
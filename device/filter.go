@@ -0,0 +1,318 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A FilterRule matches packets exchanged with a peer. Addresses and ports
+// are those of the far side: the destination of packets received from
+// the peer and the source of packets sent to it, so that one rule covers
+// both directions of a flow.
+type FilterRule struct {
+	deny      bool
+	direction filterDirection
+	proto     int          // IP protocol number, or -1 for any
+	prefix    netip.Prefix // invalid for any address
+	ports     UintRange    // zero for any port
+	hits      atomic.Uint64
+}
+
+type filterDirection uint8
+
+const (
+	filterBoth filterDirection = iota
+	filterIn                   // packets received from the peer
+	filterOut                  // packets sent to the peer
+)
+
+var filterProtocols = map[string]int{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+	"sctp":   132,
+}
+
+// ParseFilterRule parses a rule of the form
+//
+//	allow|deny [dir=in|out] [proto=NAME|NUMBER] [dst=PREFIX] [port=LO[-HI]]
+//
+// where omitted fields match anything.
+func ParseFilterRule(s string) (*FilterRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, errors.New("empty rule")
+	}
+	rule := &FilterRule{proto: -1}
+	switch fields[0] {
+	case "allow":
+	case "deny":
+		rule.deny = true
+	default:
+		return nil, fmt.Errorf("invalid action %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		switch key {
+		case "dir":
+			switch value {
+			case "in":
+				rule.direction = filterIn
+			case "out":
+				rule.direction = filterOut
+			default:
+				return nil, fmt.Errorf("invalid direction %q", value)
+			}
+
+		case "proto":
+			proto, ok := filterProtocols[value]
+			if !ok {
+				n, err := strconv.ParseUint(value, 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid protocol %q", value)
+				}
+				proto = int(n)
+			}
+			rule.proto = proto
+
+		case "dst":
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, err
+			}
+			rule.prefix = prefix.Masked()
+
+		case "port":
+			if err := rule.ports.FromString(value); err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %w", value, err)
+			}
+			if rule.ports.Hi() > 0xffff {
+				return nil, fmt.Errorf("invalid port range %q", value)
+			}
+
+		default:
+			return nil, fmt.Errorf("unknown field %q", key)
+		}
+	}
+
+	if !rule.ports.IsZero() && rule.proto != -1 && !hasPorts(rule.proto) {
+		return nil, fmt.Errorf("protocol %d has no ports", rule.proto)
+	}
+	return rule, nil
+}
+
+// String returns the rule in the form accepted by ParseFilterRule.
+func (rule *FilterRule) String() string {
+	var b strings.Builder
+	if rule.deny {
+		b.WriteString("deny")
+	} else {
+		b.WriteString("allow")
+	}
+	switch rule.direction {
+	case filterIn:
+		b.WriteString(" dir=in")
+	case filterOut:
+		b.WriteString(" dir=out")
+	}
+	if rule.proto != -1 {
+		name := strconv.Itoa(rule.proto)
+		for n, proto := range filterProtocols {
+			if proto == rule.proto {
+				name = n
+			}
+		}
+		b.WriteString(" proto=" + name)
+	}
+	if rule.prefix.IsValid() {
+		b.WriteString(" dst=" + rule.prefix.String())
+	}
+	if !rule.ports.IsZero() {
+		b.WriteString(" port=" + rule.ports.ToString())
+	}
+	return b.String()
+}
+
+// Hits returns the number of packets the rule has matched.
+func (rule *FilterRule) Hits() uint64 {
+	return rule.hits.Load()
+}
+
+func hasPorts(proto int) bool {
+	return proto == 6 || proto == 17 || proto == 132 || proto == 136
+}
+
+// A filterSet is the immutable list of rules of a peer. Rules are
+// evaluated in order and the first match decides; packets matching no
+// rule are dropped if deny is set.
+type filterSet struct {
+	rules []*FilterRule
+	deny  bool
+}
+
+// with returns a copy of the set with rule appended. Existing rules are
+// shared so that they keep their hit counters, and a rule that is
+// already present is not added again.
+func (set *filterSet) with(rule *FilterRule) *filterSet {
+	for _, existing := range set.rules {
+		if existing.String() == rule.String() {
+			return set
+		}
+	}
+	next := &filterSet{deny: set.deny}
+	next.rules = append(append(next.rules, set.rules...), rule)
+	return next
+}
+
+// filterPacket holds the fields of a packet that rules match on.
+type filterPacket struct {
+	proto int
+	addr  netip.Addr // far side address
+	port  uint16     // far side port, if ports is set
+	ports bool
+	short bool // first fragment too short to carry the ports of its protocol
+}
+
+// parseFilterPacket extracts the far side of an IP packet. ingress is
+// true for packets received from the peer.
+func parseFilterPacket(packet []byte, ingress bool) (p filterPacket, ok bool) {
+	var transport []byte
+	switch packet[0] >> 4 {
+	case 4:
+		if len(packet) < ipv4.HeaderLen {
+			return p, false
+		}
+		ihl := int(packet[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || ihl > len(packet) {
+			return p, false
+		}
+		p.proto = int(packet[9])
+		offset := IPv4offsetDst
+		if !ingress {
+			offset = IPv4offsetSrc
+		}
+		p.addr = netip.AddrFrom4([4]byte(packet[offset : offset+net.IPv4len]))
+		// Only the first fragment carries the transport header.
+		if binary.BigEndian.Uint16(packet[6:8])&0x1fff == 0 {
+			transport = packet[ihl:]
+		}
+
+	case 6:
+		if len(packet) < ipv6.HeaderLen {
+			return p, false
+		}
+		offset := IPv6offsetDst
+		if !ingress {
+			offset = IPv6offsetSrc
+		}
+		p.addr = netip.AddrFrom16([16]byte(packet[offset : offset+net.IPv6len]))
+		p.proto, transport = skipIPv6ExtensionHeaders(packet[6], packet[ipv6.HeaderLen:])
+
+	default:
+		return p, false
+	}
+
+	if hasPorts(p.proto) && transport != nil {
+		if len(transport) < 4 {
+			p.short = true
+			return p, true
+		}
+		offset := 2
+		if !ingress {
+			offset = 0
+		}
+		p.port = binary.BigEndian.Uint16(transport[offset : offset+2])
+		p.ports = true
+	}
+	return p, true
+}
+
+// skipIPv6ExtensionHeaders returns the upper layer protocol and its
+// header, which is nil for non-first fragments.
+func skipIPv6ExtensionHeaders(next byte, payload []byte) (int, []byte) {
+	for {
+		switch next {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(payload) < 8 {
+				return int(next), nil
+			}
+			length := (int(payload[1]) + 1) * 8
+			if length > len(payload) {
+				return int(next), nil
+			}
+			next, payload = payload[0], payload[length:]
+		case 44: // fragment
+			if len(payload) < 8 {
+				return int(next), nil
+			}
+			if binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				return int(payload[0]), nil
+			}
+			next, payload = payload[0], payload[8:]
+		default:
+			return int(next), payload
+		}
+	}
+}
+
+func (rule *FilterRule) match(p *filterPacket, ingress bool) bool {
+	if rule.direction == filterIn && !ingress || rule.direction == filterOut && ingress {
+		return false
+	}
+	if rule.proto != -1 && rule.proto != p.proto {
+		return false
+	}
+	if rule.prefix.IsValid() && !rule.prefix.Contains(p.addr.Unmap()) {
+		return false
+	}
+	if !rule.ports.IsZero() && (!p.ports || !rule.ports.Contains(uint32(p.port))) {
+		return false
+	}
+	return true
+}
+
+// allow reports whether the packet may pass. First fragments too short to
+// carry ports are dropped, as a later fragment overlapping them could
+// supply ports that port rules never saw (RFC 1858).
+func (set *filterSet) allow(packet []byte, ingress bool) bool {
+	p, ok := parseFilterPacket(packet, ingress)
+	if !ok {
+		return !set.deny
+	}
+	if p.short {
+		return false
+	}
+	for _, rule := range set.rules {
+		if rule.match(&p, ingress) {
+			rule.hits.Add(1)
+			return !rule.deny
+		}
+	}
+	return !set.deny
+}
+
+// filterAllows reports whether the peer's filter rules let the packet
+// through. ingress is true for packets received from the peer.
+func (peer *Peer) filterAllows(packet []byte, ingress bool) bool {
+	set := peer.filters.Load()
+	return set == nil || set.allow(packet, ingress)
+}
@@ -0,0 +1,249 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestParseFilterRule(t *testing.T) {
+	for _, s := range []string{
+		"allow",
+		"deny dir=in",
+		"allow proto=tcp dst=10.0.0.0/24 port=80-443",
+		"deny dir=out proto=47 dst=fd00::/8",
+		"allow proto=udp port=53",
+	} {
+		rule, err := ParseFilterRule(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if got := rule.String(); got != s {
+			t.Errorf("%q formatted as %q", s, got)
+		}
+	}
+
+	rule, err := ParseFilterRule("  deny   dst=10.1.2.3/16  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rule.String(), "deny dst=10.1.0.0/16"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, s := range []string{
+		"",
+		"drop",
+		"allow dir=both",
+		"allow proto=foo",
+		"allow proto=256",
+		"allow dst=10.0.0.0",
+		"allow port=80-70000",
+		"allow port=443-80",
+		"allow proto=icmp port=1",
+		"allow src=10.0.0.0/8",
+		"allow tcp",
+	} {
+		if _, err := ParseFilterRule(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func filterTestPacket(proto byte, src, dst netip.Addr, srcPort, dstPort uint16) []byte {
+	var packet []byte
+	if src.Is4() {
+		packet = make([]byte, 20+8)
+		packet[0] = 0x45
+		packet[9] = proto
+		copy(packet[IPv4offsetSrc:], src.AsSlice())
+		copy(packet[IPv4offsetDst:], dst.AsSlice())
+	} else {
+		packet = make([]byte, 40+8)
+		packet[0] = 0x60
+		packet[6] = proto
+		copy(packet[IPv6offsetSrc:], src.AsSlice())
+		copy(packet[IPv6offsetDst:], dst.AsSlice())
+	}
+	transport := packet[len(packet)-8:]
+	binary.BigEndian.PutUint16(transport[0:], srcPort)
+	binary.BigEndian.PutUint16(transport[2:], dstPort)
+	return packet
+}
+
+func TestFilterSet(t *testing.T) {
+	set := new(filterSet)
+	for _, s := range []string{
+		"allow proto=tcp dst=10.0.0.0/24 port=80",
+		"allow dir=in proto=udp dst=fd00::1/128 port=53",
+		"deny dst=10.0.0.0/8",
+	} {
+		rule, err := ParseFilterRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set = set.with(rule)
+	}
+	rule, _ := ParseFilterRule("deny dst=10.0.0.0/8")
+	if set.with(rule) != set {
+		t.Error("duplicate rule was added")
+	}
+
+	peer4 := netip.MustParseAddr("192.168.0.2")
+	peer6 := netip.MustParseAddr("fd00::2")
+	web := netip.MustParseAddr("10.0.0.5")
+	dns := netip.MustParseAddr("fd00::1")
+	other := netip.MustParseAddr("10.1.0.1")
+
+	tests := []struct {
+		name    string
+		packet  []byte
+		ingress bool
+		allow   bool
+	}{
+		{"request to web", filterTestPacket(6, peer4, web, 40000, 80), true, true},
+		{"reply from web", filterTestPacket(6, web, peer4, 80, 40000), false, true},
+		{"request to other port", filterTestPacket(6, peer4, web, 40000, 22), true, false},
+		{"udp to web", filterTestPacket(17, peer4, web, 40000, 80), true, false},
+		{"request to other host", filterTestPacket(6, peer4, other, 40000, 80), true, false},
+		{"request to dns", filterTestPacket(17, peer6, dns, 40000, 53), true, true},
+		{"reply from dns", filterTestPacket(17, dns, peer6, 53, 40000), false, true},
+		{"unmatched", filterTestPacket(6, peer4, netip.MustParseAddr("192.168.1.1"), 1, 2), true, true},
+	}
+	for _, test := range tests {
+		if got := set.allow(test.packet, test.ingress); got != test.allow {
+			t.Errorf("%s: allow = %v, want %v", test.name, got, test.allow)
+		}
+	}
+
+	// Replies from dns only match the default action, as its rule
+	// only applies to packets from the peer.
+	if got := set.rules[1].Hits(); got != 1 {
+		t.Errorf("dns rule has %d hits, want 1", got)
+	}
+	if got := set.rules[0].Hits(); got != 2 {
+		t.Errorf("web rule has %d hits, want 2", got)
+	}
+
+	set = &filterSet{rules: set.rules, deny: true}
+	if set.allow(tests[len(tests)-1].packet, true) {
+		t.Error("unmatched packet allowed with default deny")
+	}
+}
+
+func TestFilterTinyFragment(t *testing.T) {
+	rule, err := ParseFilterRule("deny proto=tcp port=22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := new(filterSet).with(rule)
+	peer4 := netip.MustParseAddr("192.168.0.2")
+	peer6 := netip.MustParseAddr("fd00::2")
+	host4 := netip.MustParseAddr("10.0.0.5")
+	host6 := netip.MustParseAddr("fd00::1")
+
+	// A first fragment with only part of the source port.
+	tiny4 := filterTestPacket(6, peer4, host4, 40000, 22)[:20+2]
+	binary.BigEndian.PutUint16(tiny4[6:], 0x2000) // more fragments
+	// The same behind an IPv6 fragment header.
+	tiny6 := filterTestPacket(44, peer6, host6, 0, 0)
+	tiny6[40] = 6
+	binary.BigEndian.PutUint16(tiny6[40+2:], 1) // more fragments
+	tiny6 = append(tiny6, 0x9c, 0x40)
+	// A later fragment, which carries no ports.
+	later4 := filterTestPacket(6, peer4, host4, 40000, 22)
+	binary.BigEndian.PutUint16(later4[6:], 1)
+
+	tests := []struct {
+		name   string
+		packet []byte
+		allow  bool
+	}{
+		{"ssh", filterTestPacket(6, peer4, host4, 40000, 22), false},
+		{"web", filterTestPacket(6, peer4, host4, 40000, 80), true},
+		{"tiny first fragment", tiny4, false},
+		{"tiny first ipv6 fragment", tiny6, false},
+		{"later fragment", later4, true},
+	}
+	for _, test := range tests {
+		if got := set.allow(test.packet, true); got != test.allow {
+			t.Errorf("%s: allow = %v, want %v", test.name, got, test.allow)
+		}
+	}
+}
+
+func TestFilterDevice(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	pk := pair[1].dev.staticIdentity.publicKey
+	publicKey := hex.EncodeToString(pk[:])
+	blocked := func(p0, p1 testPeer) bool {
+		t.Helper()
+		p1.tun.Outbound <- tuntest.Ping(p0.ip, p1.ip)
+		select {
+		case <-p0.tun.Inbound:
+			return false
+		case <-time.After(200 * time.Millisecond):
+			return true
+		}
+	}
+
+	// Packets from the peer are dropped before they reach the TUN.
+	err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"filter", "deny dir=in proto=icmp dst=1.0.0.1/32",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(pair[0], pair[1]) {
+		t.Error("ping from peer was not filtered")
+	}
+	pair.Send(t, Pong, nil)
+
+	// Packets to the peer are dropped before they are encrypted.
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"replace_filters", "true",
+		"filter_default", "deny",
+		"filter", "allow dir=in",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked(pair[1], pair[0]) {
+		t.Error("ping to peer was not filtered")
+	}
+	pair.Send(t, Ping, nil)
+
+	state, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(state, "filter_default=deny\nfilter=allow dir=in\nfilter_hits=1\n") {
+		t.Errorf("wrong filter state:\n%s", state)
+	}
+
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"replace_filters", "true",
+		"filter_default", "allow",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Pong, nil)
+}
@@ -0,0 +1,121 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+/* Peer forwarding
+ *
+ * With peer forwarding on, the device acts as a hub: a packet received from
+ * one peer for an address in the allowed IPs of another peer is sent on to
+ * that peer directly, instead of being written to the TUN device for the
+ * host to route. Forwarded packets pass the receiving peer's inbound filter
+ * and receive limit, then the target peer's outbound filter and transmit
+ * limit, like packets routed through the host would. When both limits hold
+ * a packet back, it is sent once it conforms to both.
+ */
+
+// forwardTarget returns the peer to forward packet, received from peer, to,
+// or nil if it is for the host.
+func (device *Device) forwardTarget(packet []byte, peer *Peer) *Peer {
+	if !device.forwarding.enabled.Load() {
+		return nil
+	}
+	var target *Peer
+	switch packet[0] >> 4 {
+	case 4:
+		target = device.allowedips.Lookup(packet[IPv4offsetDst : IPv4offsetDst+net.IPv4len])
+	case 6:
+		target = device.allowedips.Lookup(packet[IPv6offsetDst : IPv6offsetDst+net.IPv6len])
+	}
+	if target == peer {
+		return nil
+	}
+	return target
+}
+
+// forward queues a copy of packet for target in elemsByPeer, with its time
+// to live decremented. rxWait is how long the receive limit of the peer the
+// packet came from holds it back. The copy is dropped if the time to live
+// runs out or target's filters or rate limit do not allow it.
+func (device *Device) forward(elemsByPeer map[*Peer]*QueueOutboundElementsContainer, target *Peer, packet []byte, rxWait time.Duration) {
+	if !decrementTTL(packet) || !target.filterAllows(packet, false) {
+		device.forwarding.dropped.Add(1)
+		return
+	}
+
+	elem := device.NewOutboundElement()
+	elem.padding = device.paddings.transport.Load()
+	offset := MessageTransportHeaderSize + int(elem.padding)
+	elem.packet = elem.buffer[offset : offset+copy(elem.buffer[offset:], packet)]
+	if rxWait > 0 {
+		elem.sendAfter = time.Now().Add(rxWait)
+	}
+	if !target.rateLimitTx(elem) {
+		device.forwarding.dropped.Add(1)
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+		return
+	}
+
+	device.forwarding.packets.Add(1)
+	device.forwarding.bytes.Add(uint64(len(packet)))
+	elemsForPeer, ok := elemsByPeer[target]
+	if !ok {
+		elemsForPeer = device.GetOutboundElementsContainer()
+		elemsByPeer[target] = elemsForPeer
+	}
+	elemsForPeer.elems = append(elemsForPeer.elems, elem)
+}
+
+// sendForwarded sends the packets queued by forward, and empties
+// elemsByPeer. Packets for a peer whose queues are full are dropped rather
+// than holding up the lane of the peer they came from.
+func (device *Device) sendForwarded(elemsByPeer map[*Peer]*QueueOutboundElementsContainer) {
+	for peer, elemsForPeer := range elemsByPeer {
+		if peer.isRunning.Load() {
+			peer.StagePackets(elemsForPeer)
+			if dropped := peer.sendStagedPackets(false); dropped > 0 {
+				device.forwarding.dropped.Add(uint64(dropped))
+			}
+		} else {
+			for _, elem := range elemsForPeer.elems {
+				device.PutMessageBuffer(elem.buffer)
+				device.PutOutboundElement(elem)
+			}
+			device.PutOutboundElementsContainer(elemsForPeer)
+		}
+		delete(elemsByPeer, peer)
+	}
+}
+
+// decrementTTL decrements the time to live of an IPv4 packet, or the hop
+// limit of an IPv6 packet, as a router would. It reports false if the
+// packet must not be forwarded any further.
+func decrementTTL(packet []byte) bool {
+	switch packet[0] >> 4 {
+	case 4:
+		if packet[IPv4offsetTTL] <= 1 {
+			return false
+		}
+		packet[IPv4offsetTTL]--
+		// Incremental checksum update, as in RFC 1141.
+		sum := uint32(binary.BigEndian.Uint16(packet[IPv4offsetChecksum:])) + 0x0100
+		binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], uint16(sum+sum>>16))
+	case 6:
+		if packet[IPv6offsetHopLimit] <= 1 {
+			return false
+		}
+		packet[IPv6offsetHopLimit]--
+	default:
+		return false
+	}
+	return true
+}
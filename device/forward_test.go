@@ -0,0 +1,205 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func ipv4HeaderChecksumValid(packet []byte) bool {
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum == 0xffff
+}
+
+func TestDecrementTTL(t *testing.T) {
+	packet := tuntest.Ping(netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.2"))
+	for ttl := 255; ttl > 1; ttl-- {
+		packet[IPv4offsetTTL] = byte(ttl)
+		binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], 0)
+		sum := uint32(0)
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+		}
+		sum = sum>>16 + sum&0xffff
+		binary.BigEndian.PutUint16(packet[IPv4offsetChecksum:], ^uint16(sum+sum>>16))
+
+		if !decrementTTL(packet) {
+			t.Fatalf("TTL %d: packet not forwarded", ttl)
+		}
+		if packet[IPv4offsetTTL] != byte(ttl-1) || !ipv4HeaderChecksumValid(packet) {
+			t.Fatalf("TTL %d: wrong TTL %d or checksum", ttl, packet[IPv4offsetTTL])
+		}
+	}
+	packet[IPv4offsetTTL] = 1
+	if decrementTTL(packet) {
+		t.Error("packet with TTL 1 forwarded")
+	}
+
+	packet = make([]byte, 40)
+	packet[0] = 6 << 4
+	packet[IPv6offsetHopLimit] = 2
+	if !decrementTTL(packet) || packet[IPv6offsetHopLimit] != 1 || decrementTTL(packet) {
+		t.Error("wrong IPv6 hop limit handling")
+	}
+}
+
+func TestPeerForwarding(t *testing.T) {
+	goroutineLeakCheck(t)
+
+	// A hub and two spokes, which route the whole subnet through the hub.
+	type node struct {
+		tun *tuntest.ChannelTUN
+		dev *Device
+		key NoisePrivateKey
+		ip  netip.Addr
+	}
+	var hub, a, b node
+	for i, n := range []*node{&hub, &a, &b} {
+		var err error
+		n.key, err = NewPrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ip = netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)})
+		n.tun = tuntest.NewChannelTUN()
+		n.dev = NewDevice(n.tun.TUN(), conn.NewDefaultBind(), NewLogger(LogLevelError, ""))
+		if err := n.dev.IpcSet(uapiCfg("private_key", hex.EncodeToString(n.key[:]), "listen_port", "0")); err != nil {
+			t.Fatal(err)
+		}
+		if err := n.dev.Up(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(n.dev.Close)
+	}
+	endpoint := func(n *node) string {
+		return fmt.Sprintf("127.0.0.1:%d", n.dev.net.port)
+	}
+	publicKey := func(n *node) string {
+		pk := n.key.PublicKey()
+		return hex.EncodeToString(pk[:])
+	}
+	err := hub.dev.IpcSet(uapiCfg(
+		"peer_forwarding", "1",
+		"public_key", publicKey(&a),
+		"endpoint", endpoint(&a),
+		"allowed_ip", a.ip.String()+"/32",
+		"public_key", publicKey(&b),
+		"endpoint", endpoint(&b),
+		"allowed_ip", b.ip.String()+"/32",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []*node{&a, &b} {
+		err := n.dev.IpcSet(uapiCfg(
+			"public_key", publicKey(&hub),
+			"endpoint", endpoint(&hub),
+			"allowed_ip", "10.0.0.0/24",
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send := func(from, to *node) []byte {
+		t.Helper()
+		from.tun.Outbound <- tuntest.Ping(to.ip, from.ip)
+		select {
+		case packet := <-to.tun.Inbound:
+			return packet
+		case packet := <-hub.tun.Inbound:
+			t.Fatalf("packet for %v delivered to the hub: %x", to.ip, packet)
+		case <-time.After(6 * time.Second):
+			t.Fatalf("packet from %v to %v did not transit", from.ip, to.ip)
+		}
+		return nil
+	}
+	packet := send(&a, &b)
+	want := tuntest.Ping(b.ip, a.ip)
+	decrementTTL(want)
+	if !bytes.Equal(packet, want) {
+		t.Errorf("forwarded packet %x, want %x", packet, want)
+	}
+	send(&b, &a)
+
+	// The target peer's filters apply to forwarded packets.
+	err = hub.dev.IpcSet(uapiCfg(
+		"public_key", publicKey(&b),
+		"filter", "deny dir=out proto=icmp",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.tun.Outbound <- tuntest.Ping(b.ip, a.ip)
+	select {
+	case <-b.tun.Inbound:
+		t.Error("packet denied by the filter was forwarded")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	state, err := hub.dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"peer_forwarding=1\n",
+		"forwarded_packets=2\n",
+		fmt.Sprintf("forwarded_bytes=%d\n", 2*len(want)),
+		"forwarding_dropped_packets=1\n",
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+
+	// The receive limit of the peer a packet comes from holds forwarded
+	// packets back too.
+	ping := tuntest.Ping(b.ip, a.ip)
+	err = hub.dev.IpcSet(uapiCfg(
+		"public_key", publicKey(&b),
+		"replace_filters", "true",
+		"public_key", publicKey(&a),
+		"rate_limit_rx", fmt.Sprintf("%d/%d", 2*len(ping), len(ping)),
+		"rate_limit_policy", "delay",
+		"rate_limit_max_delay", "1000",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(&a, &b)
+	start := time.Now()
+	send(&a, &b)
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("packet over the receive limit was forwarded after %v", d)
+	}
+
+	// Without forwarding, the hub's host gets the packets.
+	if err := hub.dev.IpcSet(uapiCfg("peer_forwarding", "0")); err != nil {
+		t.Fatal(err)
+	}
+	a.tun.Outbound <- tuntest.Ping(b.ip, a.ip)
+	select {
+	case <-hub.tun.Inbound:
+	case <-time.After(6 * time.Second):
+		t.Error("packet was not delivered to the hub without forwarding")
+	}
+}
@@ -0,0 +1,341 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+/* Session handoff
+ *
+ * To upgrade a daemon without dropping its tunnels, the running device is
+ * detached: it goes down and hands over its configuration and its live
+ * sessions, meaning the keypairs with their nonces, replay windows and
+ * receiver indices, together with each peer's endpoint. A device in the
+ * new process, which takes over the TUN device and the UDP sockets,
+ * resumes the sessions, so that peers notice nothing but a short pause and
+ * no new handshake is needed. Handshakes in progress are not handed over:
+ * the new device drops responses to initiations of the old one, so they are
+ * retried as if the messages had been lost.
+ *
+ * Keypairs only keep the keys needed for this while KeepSessionKeys is on,
+ * which a daemon does for as long as it accepts handoffs.
+ */
+
+// A SessionState holds the configuration and live sessions of a detached
+// device. It is encoded as JSON to be passed to another process, and holds
+// secret key material.
+type SessionState struct {
+	Config *IpcJSONDevice
+	peers  []peerSession
+}
+
+type peerSession struct {
+	savedPeerState
+	Keypairs []keypairSession `json:"keypairs,omitempty"`
+}
+
+const (
+	keypairCurrent  = "current"
+	keypairPrevious = "previous"
+	keypairNext     = "next"
+)
+
+type keypairSession struct {
+	Slot         string `json:"slot"` // keypairCurrent, keypairPrevious or keypairNext
+	SendKey      []byte `json:"send_key"`
+	ReceiveKey   []byte `json:"receive_key"`
+	SendNonce    uint64 `json:"send_nonce"`
+	ReplayFilter []byte `json:"replay_filter"`
+	IsInitiator  bool   `json:"is_initiator,omitempty"`
+	Created      int64  `json:"created_nsec"` // nano seconds since epoch
+	LocalIndex   uint32 `json:"local_index"`
+	RemoteIndex  uint32 `json:"remote_index"`
+}
+
+type sessionStateJSON struct {
+	Config *IpcJSONDevice `json:"config"`
+	Peers  []peerSession  `json:"peers"`
+}
+
+func (state *SessionState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(sessionStateJSON{Config: state.Config, Peers: state.peers})
+}
+
+func (state *SessionState) UnmarshalJSON(b []byte) error {
+	var decoded sessionStateJSON
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	state.Config, state.peers = decoded.Config, decoded.Peers
+	return nil
+}
+
+// A sessionKeys holds the keys behind the AEADs of a keypair.
+type sessionKeys struct {
+	send    [chacha20poly1305.KeySize]byte
+	receive [chacha20poly1305.KeySize]byte
+}
+
+func (keys *sessionKeys) zero() {
+	setZero(keys.send[:])
+	setZero(keys.receive[:])
+}
+
+// KeepSessionKeys sets whether keypairs keep their keys, which Detach
+// needs to hand their sessions over. Sessions established while keys are
+// not kept are not handed over, and turning it off forgets the keys of all
+// sessions.
+func (device *Device) KeepSessionKeys(keep bool) {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	device.keepSessionKeys.Store(keep)
+	if keep {
+		return
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap.all() {
+		peer.keypairs.RLock()
+		for _, keypair := range []*Keypair{peer.keypairs.current, peer.keypairs.previous, peer.keypairs.next.Load()} {
+			if keypair != nil {
+				keypair.forgetKeys()
+			}
+		}
+		peer.keypairs.RUnlock()
+	}
+}
+
+// keepKeys has keypair keep keys if the device keeps session keys, and
+// zeroes them otherwise.
+//
+// Must hold peer.keypairs.Lock() of the peer keypair is installed for, so
+// that KeepSessionKeys does not miss it.
+func (device *Device) keepKeys(keypair *Keypair, keys *sessionKeys) {
+	if device.keepSessionKeys.Load() {
+		keypair.keys.Store(keys)
+		return
+	}
+	keys.zero()
+}
+
+func (keypair *Keypair) forgetKeys() {
+	if keys := keypair.keys.Swap(nil); keys != nil {
+		keys.zero()
+	}
+}
+
+// A liveKeypair is a keypair in a slot of a peer, with the keys taken from
+// it before the peer flushes it.
+type liveKeypair struct {
+	slot    string
+	keypair *Keypair
+	keys    *sessionKeys
+}
+
+// liveKeypairs are the keypairs of a peer that kept their keys.
+type liveKeypairs struct {
+	pk       NoisePublicKey
+	peer     *Peer
+	keypairs []liveKeypair
+}
+
+// liveKeypairs takes the keys of the keypairs of the peer with public key
+// pk, which flushing them would zero.
+func (peer *Peer) liveKeypairs(pk NoisePublicKey) liveKeypairs {
+	l := liveKeypairs{pk: pk, peer: peer}
+	peer.keypairs.RLock()
+	defer peer.keypairs.RUnlock()
+	for _, slot := range []liveKeypair{
+		{slot: keypairCurrent, keypair: peer.keypairs.current},
+		{slot: keypairPrevious, keypair: peer.keypairs.previous},
+		{slot: keypairNext, keypair: peer.keypairs.next.Load()},
+	} {
+		if slot.keypair == nil {
+			continue
+		}
+		if slot.keys = slot.keypair.keys.Swap(nil); slot.keys != nil {
+			l.keypairs = append(l.keypairs, slot)
+		}
+	}
+	return l
+}
+
+// sessions encodes the keypairs in live, once their peers have stopped
+// using them.
+func (device *Device) sessions(live []liveKeypairs) []peerSession {
+	sessions := make([]peerSession, 0, len(live))
+	for _, l := range live {
+		session := peerSession{savedPeerState: l.peer.savedState(l.pk)}
+		for _, keypair := range l.keypairs {
+			if keypair.keypair.sendNonce.Load() >= RejectAfterMessages {
+				keypair.keys.zero()
+				continue
+			}
+			session.Keypairs = append(session.Keypairs, keypair.keypair.session(keypair.slot, keypair.keys))
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (keypair *Keypair) session(slot string, keys *sessionKeys) keypairSession {
+	replayFilter, _ := keypair.replayFilter.MarshalBinary()
+	return keypairSession{
+		Slot:         slot,
+		SendKey:      keys.send[:],
+		ReceiveKey:   keys.receive[:],
+		SendNonce:    keypair.sendNonce.Load(),
+		ReplayFilter: replayFilter,
+		IsInitiator:  keypair.isInitiator,
+		Created:      keypair.created.UnixNano(),
+		LocalIndex:   keypair.localIndex,
+		RemoteIndex:  keypair.remoteIndex,
+	}
+}
+
+func (session *keypairSession) keypair() (*Keypair, *sessionKeys, error) {
+	if len(session.SendKey) != chacha20poly1305.KeySize || len(session.ReceiveKey) != chacha20poly1305.KeySize {
+		return nil, nil, errors.New("invalid key length")
+	}
+	keypair := new(Keypair)
+	keys := new(sessionKeys)
+	copy(keys.send[:], session.SendKey)
+	copy(keys.receive[:], session.ReceiveKey)
+	keypair.send, _ = chacha20poly1305.New(keys.send[:])
+	keypair.receive, _ = chacha20poly1305.New(keys.receive[:])
+	if err := keypair.replayFilter.UnmarshalBinary(session.ReplayFilter); err != nil {
+		keys.zero()
+		return nil, nil, err
+	}
+	keypair.sendNonce.Store(session.SendNonce)
+	keypair.isInitiator = session.IsInitiator
+	keypair.created = time.Unix(0, session.Created)
+	keypair.localIndex = session.LocalIndex
+	keypair.remoteIndex = session.RemoteIndex
+	return keypair, keys, nil
+}
+
+// Detach brings the device down and returns its configuration and
+// sessions for a device in another process to resume. The peers stop
+// before their sessions are read, and the device forgets them, so the
+// nonces handed over are never used twice. Once the other device took
+// over, the detached one is closed; if the handoff fails, Up brings it
+// back with new sessions. Either way, the caller zeroes the state.
+func (device *Device) Detach() (*SessionState, error) {
+	config, err := device.IpcGetJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	device.state.Lock()
+	defer device.state.Unlock()
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+	if device.isClosed() {
+		return nil, errors.New("device closed")
+	}
+	device.log.Verbosef("Detaching device")
+	device.state.state.Store(uint32(deviceStateDown))
+	if err := device.BindClose(); err != nil {
+		device.log.Errorf("Bind close failed: %v", err)
+	}
+	// Unlike downLocked, take the keys of each peer once it stopped, so
+	// that no keypair rotates after they are read.
+	var live []liveKeypairs
+	device.peers.RLock()
+	for pk, peer := range device.peers.keyMap.all() {
+		peer.stop(func() { live = append(live, peer.liveKeypairs(pk)) })
+	}
+	device.peers.RUnlock()
+	return &SessionState{Config: config, peers: device.sessions(live)}, nil
+}
+
+// Zero zeroes the session keys in state, once it has been handed over or
+// the handoff failed.
+func (state *SessionState) Zero() {
+	for i := range state.peers {
+		for j := range state.peers[i].Keypairs {
+			clear(state.peers[i].Keypairs[j].SendKey)
+			clear(state.peers[i].Keypairs[j].ReceiveKey)
+		}
+	}
+}
+
+// ResumeSessions takes over the sessions of a detached device. The device
+// must have been configured with state.Config first; sessions of peers it
+// does not have are skipped, and so are keypairs of peers that established
+// new ones in the meantime.
+func (device *Device) ResumeSessions(state *SessionState) error {
+	for _, session := range state.peers {
+		pk, restored, err := device.parsePeerState(session.savedPeerState)
+		if err != nil {
+			return fmt.Errorf("failed to resume session: %w", err)
+		}
+		peer := device.LookupPeer(pk)
+		if peer == nil {
+			continue
+		}
+		peer.restoreState(restored)
+
+		resumed := 0
+		for i := range session.Keypairs {
+			keypairSession := &session.Keypairs[i]
+			keypair, keys, err := keypairSession.keypair()
+			if err != nil {
+				return fmt.Errorf("failed to resume session of %v: %w", peer, err)
+			}
+			if peer.resumeKeypair(keypairSession.Slot, keypair, keys) {
+				resumed++
+			}
+		}
+		if resumed > 0 {
+			device.log.Verbosef("%v - Resumed %d keypairs", peer, resumed)
+			peer.timersSessionDerived()
+		}
+	}
+	return nil
+}
+
+// resumeKeypair installs keypair with keys in slot, if the slot is empty
+// and its receiver index is free.
+func (peer *Peer) resumeKeypair(slot string, keypair *Keypair, keys *sessionKeys) bool {
+	keypairs := &peer.keypairs
+	keypairs.Lock()
+	defer keypairs.Unlock()
+
+	var occupied bool
+	switch slot {
+	case keypairCurrent:
+		occupied = keypairs.current != nil
+	case keypairPrevious:
+		occupied = keypairs.previous != nil
+	case keypairNext:
+		occupied = keypairs.next.Load() != nil
+	default:
+		keys.zero()
+		return false
+	}
+	if occupied || !peer.device.indexTable.InsertKeypair(keypair.localIndex, peer, keypair) {
+		keys.zero()
+		return false
+	}
+	peer.device.keepKeys(keypair, keys)
+	switch slot {
+	case keypairCurrent:
+		keypairs.current = keypair
+	case keypairPrevious:
+		keypairs.previous = keypair
+	case keypairNext:
+		keypairs.next.Store(keypair)
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestSessionHandoff(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, true)
+	pair[0].dev.KeepSessionKeys(true)
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if pair[1].dev.LookupPeer(pair[0].dev.staticIdentity.publicKey).keypairs.Current().keys.Load() != nil {
+		t.Error("keys kept without KeepSessionKeys")
+	}
+
+	port := pair[0].dev.net.port
+	files, err := pair[0].dev.net.bind.(conn.SocketHandoff).SocketFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	detached := pair[0].dev
+	state, err := detached.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detached.isUp() || detached.isClosed() {
+		t.Error("detached device not down")
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handedOver SessionState
+	if err := json.Unmarshal(b, &handedOver); err != nil {
+		t.Fatal(err)
+	}
+	state.Zero()
+	for _, session := range state.peers {
+		for _, keypair := range session.Keypairs {
+			if !isZero(keypair.SendKey) || !isZero(keypair.ReceiveKey) {
+				t.Error("session keys not zeroed")
+			}
+		}
+	}
+
+	bind := conn.NewDefaultBind()
+	if err := bind.(conn.SocketHandoff).AdoptSocketFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	tun := tuntest.NewChannelTUN()
+	dev := NewDevice(tun.TUN(), bind, NewLogger(LogLevelVerbose, "dev0': "))
+	t.Cleanup(dev.Close)
+	if err := dev.IpcSetJSON(handedOver.Config); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.ResumeSessions(&handedOver); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dev.net.port != port {
+		t.Fatalf("listening on port %d after handoff, want %d", dev.net.port, port)
+	}
+	detached.Close()
+
+	peer := pair[1].dev.LookupPeer(dev.staticIdentity.publicKey)
+	lastHandshake := peer.lastHandshakeNano.Load()
+	pair[0].tun, pair[0].dev = tun, dev
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Pong, nil)
+	if peer.lastHandshakeNano.Load() != lastHandshake {
+		t.Error("handshake after handoff")
+	}
+}
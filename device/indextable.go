@@ -17,7 +17,16 @@ type IndexTableEntry struct {
 	keypair   *Keypair
 }
 
+const indexTableShards = 256
+
+// An IndexTable maps the receiver indices of handshakes and keypairs to
+// their peers. Indices are random, so spreading them over shards by their
+// low bits keeps lookups on the receive path from contending on one lock.
 type IndexTable struct {
+	shards [indexTableShards]indexTableShard
+}
+
+type indexTableShard struct {
 	sync.RWMutex
 	table map[uint32]IndexTableEntry
 }
@@ -29,32 +38,57 @@ func randUint32() (uint32, error) {
 	return binary.LittleEndian.Uint32(integer[:]), err
 }
 
+func (table *IndexTable) shard(index uint32) *indexTableShard {
+	return &table.shards[index%indexTableShards]
+}
+
 func (table *IndexTable) Init() {
-	table.Lock()
-	defer table.Unlock()
-	table.table = make(map[uint32]IndexTableEntry)
+	for i := range table.shards {
+		shard := &table.shards[i]
+		shard.Lock()
+		shard.table = make(map[uint32]IndexTableEntry)
+		shard.Unlock()
+	}
 }
 
 func (table *IndexTable) Delete(index uint32) {
-	table.Lock()
-	defer table.Unlock()
-	delete(table.table, index)
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.table, index)
 }
 
 func (table *IndexTable) SwapIndexForKeypair(index uint32, keypair *Keypair) {
-	table.Lock()
-	defer table.Unlock()
-	entry, ok := table.table[index]
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	entry, ok := shard.table[index]
 	if !ok {
 		return
 	}
-	table.table[index] = IndexTableEntry{
+	shard.table[index] = IndexTableEntry{
 		peer:      entry.peer,
 		keypair:   keypair,
 		handshake: nil,
 	}
 }
 
+// InsertKeypair maps index to a keypair taken over from another process.
+// It reports false if the index is in use.
+func (table *IndexTable) InsertKeypair(index uint32, peer *Peer, keypair *Keypair) bool {
+	shard := table.shard(index)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.table[index]; ok {
+		return false
+	}
+	shard.table[index] = IndexTableEntry{
+		peer:    peer,
+		keypair: keypair,
+	}
+	return true
+}
+
 func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake) (uint32, error) {
 	for {
 		// generate random index
@@ -63,36 +97,38 @@ func (table *IndexTable) NewIndexForHandshake(peer *Peer, handshake *Handshake)
 		if err != nil {
 			return index, err
 		}
+		shard := table.shard(index)
 
 		// check if index used
 
-		table.RLock()
-		_, ok := table.table[index]
-		table.RUnlock()
+		shard.RLock()
+		_, ok := shard.table[index]
+		shard.RUnlock()
 		if ok {
 			continue
 		}
 
 		// check again while locked
 
-		table.Lock()
-		_, found := table.table[index]
+		shard.Lock()
+		_, found := shard.table[index]
 		if found {
-			table.Unlock()
+			shard.Unlock()
 			continue
 		}
-		table.table[index] = IndexTableEntry{
+		shard.table[index] = IndexTableEntry{
 			peer:      peer,
 			handshake: handshake,
 			keypair:   nil,
 		}
-		table.Unlock()
+		shard.Unlock()
 		return index, nil
 	}
 }
 
 func (table *IndexTable) Lookup(id uint32) IndexTableEntry {
-	table.RLock()
-	defer table.RUnlock()
-	return table.table[id]
+	shard := table.shard(id)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.table[id]
 }
@@ -11,12 +11,15 @@ import (
 
 const (
 	IPv4offsetTotalLength = 2
+	IPv4offsetTTL         = 8
+	IPv4offsetChecksum    = 10
 	IPv4offsetSrc         = 12
 	IPv4offsetDst         = IPv4offsetSrc + net.IPv4len
 )
 
 const (
 	IPv6offsetPayloadLength = 4
+	IPv6offsetHopLimit      = 7
 	IPv6offsetSrc           = 8
 	IPv6offsetDst           = IPv6offsetSrc + net.IPv6len
 )
@@ -30,6 +30,11 @@ type Keypair struct {
 	created      time.Time
 	localIndex   uint32
 	remoteIndex  uint32
+	presharedKey atomic.Pointer[NoisePresharedKey] // staged preshared key of the session, until the peer confirms it
+
+	// The keys behind send and receive, kept only while the device keeps
+	// session keys to hand the session over to another process.
+	keys atomic.Pointer[sessionKeys]
 }
 
 type Keypairs struct {
@@ -48,5 +53,6 @@ func (kp *Keypairs) Current() *Keypair {
 func (device *Device) DeleteKeypair(key *Keypair) {
 	if key != nil {
 		device.indexTable.Delete(key.localIndex)
+		key.forgetKeys()
 	}
 }
@@ -95,6 +95,16 @@ func (sk *NoisePrivateKey) publicKey() (pk NoisePublicKey) {
 	return
 }
 
+// NewPrivateKey generates a random, clamped Curve25519 private key.
+func NewPrivateKey() (NoisePrivateKey, error) {
+	return newPrivateKey()
+}
+
+// PublicKey derives the public key belonging to sk.
+func (sk *NoisePrivateKey) PublicKey() NoisePublicKey {
+	return sk.publicKey()
+}
+
 var errInvalidPublicKey = errors.New("invalid public key")
 
 func (sk *NoisePrivateKey) sharedSecret(pk NoisePublicKey) (ss [NoisePublicKeySize]byte, err error) {
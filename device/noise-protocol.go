@@ -124,6 +124,9 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte       // hash value
 	chainKey                  [blake2s.Size]byte       // chain key
 	presharedKey              NoisePresharedKey        // psk
+	nextPresharedKey          *NoisePresharedKey       // psk staged by a rotation, until a session confirms it
+	triedNextPresharedKey     bool                     // the last response used nextPresharedKey
+	sessionPresharedKey       *NoisePresharedKey       // nextPresharedKey, if the session being established uses it
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
@@ -250,13 +253,21 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 }
 
 func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
+	peer, _ := device.consumeMessageInitiation(msg)
+	return peer
+}
+
+// consumeMessageInitiation is ConsumeMessageInitiation, but also returns the
+// initiator if it decrypted correctly, is not one of the device's peers, and
+// there is a PeerAuthorizer to ask about it.
+func (device *Device) consumeMessageInitiation(msg *MessageInitiation) (*Peer, *unknownInitiator) {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
 	)
 
 	if msg.Type != MessageInitiationType {
-		return nil
+		return nil, nil
 	}
 
 	device.staticIdentity.RLock()
@@ -271,21 +282,38 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	var key [chacha20poly1305.KeySize]byte
 	ss, err := device.staticIdentity.privateKey.sharedSecret(msg.Ephemeral)
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	KDF2(&chainKey, &key, chainKey[:], ss[:])
 	aead, _ := chacha20poly1305.New(key[:])
 	_, err = aead.Open(peerPK[:0], ZeroNonce[:], msg.Static[:], hash[:])
 	if err != nil {
-		return nil
+		return nil, nil
 	}
 	mixHash(&hash, &hash, msg.Static[:])
 
 	// lookup peer
 
 	peer := device.LookupPeer(peerPK)
-	if peer == nil || !peer.isRunning.Load() {
-		return nil
+	if peer == nil {
+		if !device.hasPeerAuthorizer() {
+			return nil, nil
+		}
+		// Only report initiators that prove they hold the private key.
+		ss, err := device.staticIdentity.privateKey.sharedSecret(peerPK)
+		if err != nil {
+			return nil, nil
+		}
+		initiator := &unknownInitiator{publicKey: peerPK}
+		KDF2(&chainKey, &key, chainKey[:], ss[:])
+		aead, _ = chacha20poly1305.New(key[:])
+		if _, err = aead.Open(initiator.timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:]); err != nil {
+			return nil, nil
+		}
+		return nil, initiator
+	}
+	if !peer.isRunning.Load() {
+		return nil, nil
 	}
 
 	handshake := &peer.handshake
@@ -298,7 +326,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 
 	if isZero(handshake.precomputedStaticStatic[:]) {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	KDF2(
 		&chainKey,
@@ -310,7 +338,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	_, err = aead.Open(timestamp[:0], ZeroNonce[:], msg.Timestamp[:], hash[:])
 	if err != nil {
 		handshake.mutex.RUnlock()
-		return nil
+		return nil, nil
 	}
 	mixHash(&hash, &hash, msg.Timestamp[:])
 
@@ -321,11 +349,11 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	handshake.mutex.RUnlock()
 	if replay {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake replay @ %v", peer, timestamp)
-		return nil
+		return nil, nil
 	}
 	if flood {
 		device.log.Verbosef("%v - ConsumeMessageInitiation: handshake flood", peer)
-		return nil
+		return nil, nil
 	}
 
 	// update handshake state
@@ -350,7 +378,7 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	setZero(hash[:])
 	setZero(chainKey[:])
 
-	return peer
+	return peer, nil
 }
 
 func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error) {
@@ -399,6 +427,20 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 
 	// add preshared key
 
+	// The initiator may not have the staged key yet, so alternate between
+	// it and the current key until a session confirms the staged one. When
+	// only one end has the key staged, every other handshake fails, and
+	// the initiator retries after REKEY_TIMEOUT.
+	presharedKey := &handshake.presharedKey
+	handshake.sessionPresharedKey = nil
+	if next := handshake.nextPresharedKey; next != nil {
+		if !handshake.triedNextPresharedKey {
+			presharedKey = next
+			handshake.sessionPresharedKey = next
+		}
+		handshake.triedNextPresharedKey = !handshake.triedNextPresharedKey
+	}
+
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
 
@@ -407,7 +449,7 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		presharedKey[:],
 	)
 
 	handshake.mixHash(tau[:])
@@ -435,8 +477,9 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	}
 
 	var (
-		hash     [blake2s.Size]byte
-		chainKey [blake2s.Size]byte
+		hash         [blake2s.Size]byte
+		chainKey     [blake2s.Size]byte
+		presharedKey *NoisePresharedKey // the staged key, if the responder used it
 	)
 
 	ok := func() bool {
@@ -473,28 +516,36 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 		mixKey(&chainKey, &chainKey, ss[:])
 		setZero(ss[:])
 
-		// add preshared key (psk)
-
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
-
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err = aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		// add preshared key (psk) and authenticate transcript, trying the
+		// staged key, which the responder uses once it has it, first
+
+		authenticate := func(psk *NoisePresharedKey) bool {
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			pskChainKey, pskHash := chainKey, hash
+			KDF3(
+				&pskChainKey,
+				&tau,
+				&key,
+				pskChainKey[:],
+				psk[:],
+			)
+			mixHash(&pskHash, &pskHash, tau[:])
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], pskHash[:])
+			if err != nil {
+				return false
+			}
+			mixHash(&hash, &pskHash, msg.Empty[:])
+			chainKey = pskChainKey
+			return true
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		if next := handshake.nextPresharedKey; next != nil && authenticate(next) {
+			presharedKey = next
+			return true
+		}
+		return authenticate(&handshake.presharedKey)
 	}()
 
 	if !ok {
@@ -509,6 +560,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	handshake.chainKey = chainKey
 	handshake.remoteIndex = msg.Sender
 	handshake.state = handshakeResponseConsumed
+	handshake.sessionPresharedKey = presharedKey
 
 	handshake.mutex.Unlock()
 
@@ -565,6 +617,7 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair := new(Keypair)
 	keypair.send, _ = chacha20poly1305.New(sendKey[:])
 	keypair.receive, _ = chacha20poly1305.New(recvKey[:])
+	keys := &sessionKeys{send: sendKey, receive: recvKey}
 
 	setZero(sendKey[:])
 	setZero(recvKey[:])
@@ -572,6 +625,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypair.created = time.Now()
 	keypair.replayFilter.Reset()
 	keypair.isInitiator = isInitiator
+	keypair.presharedKey.Store(handshake.sessionPresharedKey)
+	handshake.sessionPresharedKey = nil
 	keypair.localIndex = peer.handshake.localIndex
 	keypair.remoteIndex = peer.handshake.remoteIndex
 
@@ -586,6 +641,8 @@ func (peer *Peer) BeginSymmetricSession() error {
 	keypairs.Lock()
 	defer keypairs.Unlock()
 
+	device.keepKeys(keypair, keys)
+
 	previous := keypairs.previous
 	next := keypairs.next.Load()
 	current := keypairs.current
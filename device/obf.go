@@ -141,3 +141,14 @@ func (c *obfChain) DeobfuscatedLen(n int) int {
 	}
 	return total
 }
+
+// ObfChainSize parses an I1-I5 packet specification and reports the size
+// of the packets it generates. A specification without tags is ignored by
+// the device and yields a size of zero.
+func ObfChainSize(spec string) (int, error) {
+	chain, err := newObfChain(spec)
+	if err != nil || chain == nil {
+		return 0, err
+	}
+	return chain.ObfuscatedLen(0), nil
+}
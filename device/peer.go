@@ -20,16 +20,19 @@ type Peer struct {
 	keypairs          Keypairs
 	handshake         Handshake
 	device            *Device
-	stopping          sync.WaitGroup // routines pending stop
+	stopping          sync.WaitGroup // delayed deliveries pending stop
 	txBytes           atomic.Uint64  // bytes send to peer (endpoint)
 	rxBytes           atomic.Uint64  // bytes received from peer
 	lastHandshakeNano atomic.Int64   // nano seconds since epoch
+	createdNano       int64          // nano seconds since epoch
+	expiresAt         atomic.Int64   // seconds since epoch, 0 for never
 
 	endpoint struct {
 		sync.Mutex
 		val            conn.Endpoint
 		clearSrcOnTx   bool // signal to val.ClearSrc() prior to next packet transmission
 		disableRoaming bool
+		roaming        roamingPolicy
 	}
 
 	timers struct {
@@ -49,15 +52,26 @@ type Peer struct {
 	}
 
 	queue struct {
-		staged   chan *QueueOutboundElementsContainer // staged packets before a handshake is available
-		outbound *autodrainingOutboundQueue           // sequential ordering of udp transmission
-		inbound  *autodrainingInboundQueue            // sequential ordering of tun writing
+		staged atomic.Pointer[chan *QueueOutboundElementsContainer] // staged packets before a handshake is available, created on first use
+		lane   *sequentialLane                                      // sequential ordering of udp transmission and tun writing
+		inLane sync.RWMutex                                         // read locked by the lane routines while handling the peer's packets
 	}
 
 	cookieGenerator             CookieGenerator
 	trieEntries                 list.List
 	persistentKeepaliveInterval AtomicUintRange
 	udpWindow                   atomic.Uint32
+	filters                     atomic.Pointer[filterSet]
+	rateLimit                   peerRateLimit
+
+	pskRotation struct {
+		handshakes atomic.Uint32 // handshakes between rotations, 0 for no limit
+		interval   atomic.Int64  // nano seconds between rotations, 0 for no limit
+		count      atomic.Uint32 // handshakes since the last rotation
+		last       atomic.Int64  // nano seconds since epoch of the last rotation
+		running    atomic.Bool
+		rotations  atomic.Uint64 // staged preshared keys put into use
+	}
 }
 
 func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
@@ -73,7 +87,7 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	defer device.peers.Unlock()
 
 	// check if over limit
-	if len(device.peers.keyMap) >= MaxPeers {
+	if device.peers.keyMap.len() >= MaxPeers {
 		return nil, errors.New("too many peers")
 	}
 
@@ -81,16 +95,15 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	peer := new(Peer)
 
 	peer.udpWindow.Store(DefaultUdpWindow)
+	peer.createdNano = time.Now().UnixNano()
+	peer.rateLimit.window.Store(int64(DefaultRateLimitMaxDelay))
 
 	peer.cookieGenerator.Init(pk)
 	peer.device = device
-	peer.queue.outbound = newAutodrainingOutboundQueue(device)
-	peer.queue.inbound = newAutodrainingInboundQueue(device)
-	peer.queue.staged = make(chan *QueueOutboundElementsContainer, QueueStagedSize)
+	peer.queue.lane = device.sequentialLane(pk)
 
 	// map public key
-	_, ok := device.peers.keyMap[pk]
-	if ok {
+	if device.peers.keyMap.load(pk) != nil {
 		return nil, errors.New("adding existing peer")
 	}
 
@@ -111,12 +124,37 @@ func (device *Device) NewPeer(pk NoisePublicKey) (*Peer, error) {
 	// init timers
 	peer.timersInit()
 
+	// restore what was learned about the peer before a restart
+	device.restoreSavedState(pk, peer)
+
 	// add
-	device.peers.keyMap[pk] = peer
+	device.peers.keyMap.store(pk, peer)
 
 	return peer, nil
 }
 
+// staged returns the queue of packets waiting for a handshake, or nil if no
+// packets were ever staged for the peer.
+func (peer *Peer) staged() chan *QueueOutboundElementsContainer {
+	if staged := peer.queue.staged.Load(); staged != nil {
+		return *staged
+	}
+	return nil
+}
+
+// stagingQueue returns the queue of packets waiting for a handshake,
+// creating it on first use, so that idle peers do not pay for it.
+func (peer *Peer) stagingQueue() chan *QueueOutboundElementsContainer {
+	if staged := peer.staged(); staged != nil {
+		return staged
+	}
+	staged := make(chan *QueueOutboundElementsContainer, QueueStagedSize)
+	if !peer.queue.staged.CompareAndSwap(nil, &staged) {
+		return peer.staged()
+	}
+	return staged
+}
+
 func (peer *Peer) SendBuffers(buffers [][]byte) error {
 	peer.device.net.RLock()
 	defer peer.device.net.RUnlock()
@@ -191,9 +229,8 @@ func (peer *Peer) Start() {
 	device := peer.device
 	device.log.Verbosef("%v - Starting", peer)
 
-	// reset routine state
+	// wait for deliveries delayed before the last stop
 	peer.stopping.Wait()
-	peer.stopping.Add(2)
 
 	peer.handshake.mutex.Lock()
 	peer.handshake.lastSentHandshake = time.Now().Add(-(peer.device.rekeyMinTimeout() + time.Second))
@@ -203,15 +240,6 @@ func (peer *Peer) Start() {
 
 	peer.timersStart()
 
-	device.flushInboundQueue(peer.queue.inbound)
-	device.flushOutboundQueue(peer.queue.outbound)
-
-	// Use the device batch size, not the bind batch size, as the device size is
-	// the size of the batch pools.
-	batchSize := peer.device.BatchSize()
-	go peer.RoutineSequentialSender(batchSize)
-	go peer.RoutineSequentialReceiver(batchSize)
-
 	peer.isRunning.Store(true)
 }
 
@@ -261,29 +289,43 @@ func (peer *Peer) ExpireCurrentKeypairs() {
 }
 
 func (peer *Peer) Stop() {
+	peer.stop(nil)
+}
+
+// stop stops the peer, and calls detach, unless nil, once the peer no
+// longer uses its keypairs but before they are flushed.
+func (peer *Peer) stop(detach func()) {
 	peer.state.Lock()
 	defer peer.state.Unlock()
 
 	if !peer.isRunning.Swap(false) {
+		if detach != nil {
+			detach()
+		}
 		return
 	}
 
 	peer.device.log.Verbosef("%v - Stopping", peer)
 
 	peer.timersStop()
-	// Signal that RoutineSequentialSender and RoutineSequentialReceiver should exit.
-	peer.queue.inbound.c <- nil
-	peer.queue.outbound.c <- nil
+	// The lane routines drop the packets they get to from now on, as the
+	// peer is not running. Wait for those they are handling, and for the
+	// ones held back, but not for the rest of the shared lanes.
+	peer.queue.inLane.Lock()
+	peer.queue.inLane.Unlock()
 	peer.stopping.Wait()
 	peer.device.queue.encryption.wg.Done() // no more writes to encryption queue from us
 
+	if detach != nil {
+		detach()
+	}
 	peer.ZeroAndFlushAll()
 }
 
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	peer.endpoint.Lock()
 	defer peer.endpoint.Unlock()
-	if peer.endpoint.disableRoaming {
+	if peer.endpoint.disableRoaming || !peer.roamingAllows(endpoint) {
 		return
 	}
 	if peer.endpoint.val != endpoint {
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"iter"
+	"sync"
+)
+
+const peerTableShards = 256
+
+// A peerTable maps public keys to peers. It is split into shards, so that
+// handshakes for different peers do not contend on the same lock.
+//
+// Adding and removing peers requires holding device.peers.Lock, in addition
+// to the shard lock taken by the table itself. Consequently, lookups need
+// only the shard lock, and iterating needs only device.peers.RLock.
+type peerTable struct {
+	count  int
+	shards [peerTableShards]peerTableShard
+}
+
+type peerTableShard struct {
+	sync.RWMutex
+	m map[NoisePublicKey]*Peer
+}
+
+func (table *peerTable) shard(pk NoisePublicKey) *peerTableShard {
+	return &table.shards[pk[0]]
+}
+
+// load returns the peer with public key pk, or nil.
+func (table *peerTable) load(pk NoisePublicKey) *Peer {
+	shard := table.shard(pk)
+	shard.RLock()
+	defer shard.RUnlock()
+	return shard.m[pk]
+}
+
+// Must hold device.peers.Lock()
+func (table *peerTable) store(pk NoisePublicKey, peer *Peer) {
+	shard := table.shard(pk)
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.m == nil {
+		shard.m = make(map[NoisePublicKey]*Peer)
+	}
+	if _, ok := shard.m[pk]; !ok {
+		table.count++
+	}
+	shard.m[pk] = peer
+}
+
+// Must hold device.peers.Lock()
+func (table *peerTable) delete(pk NoisePublicKey) {
+	shard := table.shard(pk)
+	shard.Lock()
+	defer shard.Unlock()
+	if _, ok := shard.m[pk]; ok {
+		table.count--
+		delete(shard.m, pk)
+	}
+}
+
+// Must hold device.peers.RLock()
+func (table *peerTable) len() int {
+	return table.count
+}
+
+// all iterates over the peers. The table must not be modified meanwhile,
+// except through the iterator's removals.
+//
+// Must hold device.peers.RLock(), or device.peers.Lock() to remove peers.
+func (table *peerTable) all() iter.Seq2[NoisePublicKey, *Peer] {
+	return func(yield func(NoisePublicKey, *Peer) bool) {
+		for i := range table.shards {
+			for pk, peer := range table.shards[i].m {
+				if !yield(pk, peer) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+// countingWriter counts the writes made to it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestManyPeers(t *testing.T) {
+	const numPeers = 5000
+
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	goroutines := runtime.NumGoroutine()
+
+	keys := make([]NoisePublicKey, numPeers)
+	var cfg strings.Builder
+	for i := range keys {
+		rand.Read(keys[i][:])
+		fmt.Fprintf(&cfg, "public_key=%x\nallowed_ip=10.%d.%d.0/24\n", keys[i][:], i>>8, i&0xff)
+	}
+	if err := dev.IpcSet(cfg.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Running peers share the sequential routines.
+	if n := runtime.NumGoroutine(); n > goroutines+10 {
+		t.Errorf("%d goroutines for %d peers, %d before", n, numPeers, goroutines)
+	}
+	for _, key := range keys {
+		if peer := dev.LookupPeer(key); peer == nil || !peer.isRunning.Load() {
+			t.Fatalf("peer %x missing or not running", key[:])
+		}
+	}
+
+	var w countingWriter
+	if err := dev.IpcGetOperation(&w); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(w.String(), "public_key="); n != numPeers {
+		t.Errorf("get reported %d peers, want %d", n, numPeers)
+	}
+	if w.writes < 2 {
+		t.Errorf("get output was not streamed: %d bytes in %d writes", w.Len(), w.writes)
+	}
+
+	dev.RemoveAllPeers()
+	if dev.LookupPeer(keys[0]) != nil || dev.peers.keyMap.len() != 0 {
+		t.Error("peers left after removing all of them")
+	}
+}
+
+func TestIndexTable(t *testing.T) {
+	var table IndexTable
+	table.Init()
+	peer := new(Peer)
+	indices := make(map[uint32]bool)
+	for range 1000 {
+		index, err := table.NewIndexForHandshake(peer, &peer.handshake)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if indices[index] {
+			t.Fatalf("index %d handed out twice", index)
+		}
+		indices[index] = true
+	}
+	keypair := new(Keypair)
+	for index := range indices {
+		if entry := table.Lookup(index); entry.peer != peer || entry.handshake != &peer.handshake {
+			t.Fatalf("wrong entry for index %d", index)
+		}
+		table.SwapIndexForKeypair(index, keypair)
+		if entry := table.Lookup(index); entry.keypair != keypair || entry.handshake != nil {
+			t.Fatalf("wrong entry for index %d after swap", index)
+		}
+		table.Delete(index)
+		if entry := table.Lookup(index); entry.peer != nil {
+			t.Fatalf("index %d still present after delete", index)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"time"
+)
+
+// A PresharedKeyProvider derives fresh preshared keys together with a peer,
+// for instance by running a post-quantum key encapsulation mechanism such
+// as ML-KEM with the peer through the tunnel.
+type PresharedKeyProvider interface {
+	// RotatePresharedKey runs an exchange with the peer and returns the
+	// new preshared key, which both ends must arrive at. It is called from
+	// its own goroutine, at most once at a time per peer, and ctx is done
+	// when the device is closed.
+	//
+	// Both ends call their provider when a rotation is due by their own
+	// configuration, so providers typically let one end start the exchange,
+	// such as the one with the lower public key, and the other wait for it.
+	RotatePresharedKey(ctx context.Context, publicKey NoisePublicKey) (NoisePresharedKey, error)
+}
+
+// SetPresharedKeyProvider installs the provider of preshared keys for peers
+// with a rotation schedule. A nil provider, the default, disables rotation.
+func (device *Device) SetPresharedKeyProvider(provider PresharedKeyProvider) {
+	device.pskProvider.Lock()
+	defer device.pskProvider.Unlock()
+	device.pskProvider.provider = provider
+}
+
+// SetNextPresharedKey stages key to replace the preshared key of the peer.
+// The handshakes that follow try the staged key, and the first transport
+// packet received in a session established with it, which proves that the
+// peer has it too, puts it into use. Until then, the current key keeps
+// working.
+//
+// As a responder cannot tell which key the initiator uses, it alternates
+// between them, so while only one end has the key staged, about every
+// other handshake fails and costs a retry after REKEY_TIMEOUT.
+func (peer *Peer) SetNextPresharedKey(key NoisePresharedKey) {
+	peer.handshake.mutex.Lock()
+	defer peer.handshake.mutex.Unlock()
+	peer.handshake.nextPresharedKey = &key
+	peer.handshake.triedNextPresharedKey = false
+}
+
+// commitPresharedKey puts the staged preshared key into use, if key is
+// still the staged one.
+//
+// Must hold peer.handshake.mutex.Lock()
+func (peer *Peer) commitPresharedKey(key *NoisePresharedKey) {
+	handshake := &peer.handshake
+	if key == nil || handshake.nextPresharedKey != key {
+		return
+	}
+	handshake.presharedKey = *key
+	handshake.nextPresharedKey = nil
+	handshake.triedNextPresharedKey = false
+	peer.pskRotation.rotations.Add(1)
+	peer.device.log.Verbosef("%v - Rotated preshared key", peer)
+}
+
+// confirmPresharedKey puts the staged preshared key into use if the
+// session of keypair, from which an authenticated packet was just
+// received, was established with it.
+func (peer *Peer) confirmPresharedKey(keypair *Keypair) {
+	if keypair.presharedKey.Load() == nil {
+		return
+	}
+	key := keypair.presharedKey.Swap(nil)
+	if key == nil {
+		return
+	}
+	peer.handshake.mutex.Lock()
+	defer peer.handshake.mutex.Unlock()
+	peer.commitPresharedKey(key)
+}
+
+// presharedKeyRotationDue reports whether the peer's rotation schedule asks
+// for a new preshared key at now. It is called for each completed
+// handshake.
+func (peer *Peer) presharedKeyRotationDue(now time.Time) bool {
+	rotation := &peer.pskRotation
+	count := rotation.count.Add(1)
+	if n := rotation.handshakes.Load(); n != 0 && count >= n {
+		return true
+	}
+	if interval := rotation.interval.Load(); interval != 0 {
+		last := rotation.last.Load()
+		if last == 0 {
+			last = peer.createdNano
+		}
+		if now.Sub(time.Unix(0, last)) >= time.Duration(interval) {
+			return true
+		}
+	}
+	return false
+}
+
+// maybeRotatePresharedKey asks the provider for a new preshared key, if one
+// is installed and the peer's rotation schedule calls for it.
+func (peer *Peer) maybeRotatePresharedKey() {
+	device := peer.device
+	now := time.Now()
+	if !peer.presharedKeyRotationDue(now) {
+		return
+	}
+	device.pskProvider.Lock()
+	provider := device.pskProvider.provider
+	device.pskProvider.Unlock()
+	if provider == nil || !peer.pskRotation.running.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer peer.pskRotation.running.Store(false)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-device.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		device.log.Verbosef("%v - Requesting preshared key rotation", peer)
+		key, err := provider.RotatePresharedKey(ctx, peer.handshake.remoteStatic)
+		if err != nil {
+			// Retried with the next handshake.
+			device.log.Errorf("%v - Failed to rotate preshared key: %v", peer, err)
+			return
+		}
+		peer.pskRotation.count.Store(0)
+		peer.pskRotation.last.Store(now.UnixNano())
+		peer.SetNextPresharedKey(key)
+	}()
+}
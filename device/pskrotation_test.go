@@ -0,0 +1,131 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+type presharedKeyProviderFunc func(context.Context, NoisePublicKey) (NoisePresharedKey, error)
+
+func (f presharedKeyProviderFunc) RotatePresharedKey(ctx context.Context, pk NoisePublicKey) (NoisePresharedKey, error) {
+	return f(ctx, pk)
+}
+
+func TestPresharedKeyRotation(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	pk0 := pair[0].dev.staticIdentity.publicKey
+	pk1 := pair[1].dev.staticIdentity.publicKey
+	peer0 := pair[1].dev.LookupPeer(pk0) // pair[0], as seen by pair[1]
+	peer1 := pair[0].dev.LookupPeer(pk1) // pair[1], as seen by pair[0]
+	rehandshake := func() {
+		t.Helper()
+		// Initiations within the timestamp granularity are replays.
+		time.Sleep(50 * time.Millisecond)
+		peer0.ExpireCurrentKeypairs()
+		pair.Send(t, Ping, nil)
+	}
+	presharedKeys := func() (current, next NoisePresharedKey, staged bool) {
+		peer1.handshake.mutex.RLock()
+		defer peer1.handshake.mutex.RUnlock()
+		if next := peer1.handshake.nextPresharedKey; next != nil {
+			return peer1.handshake.presharedKey, *next, true
+		}
+		return peer1.handshake.presharedKey, next, false
+	}
+
+	var key NoisePresharedKey
+	key[0] = 1
+
+	// A key staged by the initiator only is not used yet.
+	peer0.SetNextPresharedKey(key)
+	rehandshake()
+	if current, _, _ := presharedKeys(); current != (NoisePresharedKey{}) {
+		t.Fatal("key staged by one end was put into use")
+	}
+
+	// Once both ends have it, the next handshake switches to it.
+	err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk1[:]),
+		"next_preshared_key", hex.EncodeToString(key[:]),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rehandshake()
+	if current, _, staged := presharedKeys(); current != key || staged {
+		t.Fatal("staged key was not put into use by the responder")
+	}
+	// The initiator waits for a packet of the session from the responder.
+	peer0.handshake.mutex.RLock()
+	staged := peer0.handshake.nextPresharedKey != nil
+	peer0.handshake.mutex.RUnlock()
+	if !staged {
+		t.Fatal("staged key was put into use by the initiator before the responder confirmed it")
+	}
+	pair.Send(t, Pong, nil)
+	peer0.handshake.mutex.RLock()
+	current, staged := peer0.handshake.presharedKey, peer0.handshake.nextPresharedKey != nil
+	peer0.handshake.mutex.RUnlock()
+	if current != key || staged {
+		t.Fatal("staged key was not put into use by the initiator")
+	}
+
+	// The provider is asked for a key after the configured handshakes.
+	key[0] = 2
+	asked := make(chan NoisePublicKey, 1)
+	pair[0].dev.SetPresharedKeyProvider(presharedKeyProviderFunc(func(ctx context.Context, pk NoisePublicKey) (NoisePresharedKey, error) {
+		asked <- pk
+		return key, nil
+	}))
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk1[:]),
+		"psk_rotation_handshakes", "1",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rehandshake()
+	select {
+	case pk := <-asked:
+		if pk != pk1 {
+			t.Fatalf("provider asked about %x, want %x", pk[:], pk1[:])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("provider was not asked for a key")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, next, staged := presharedKeys(); staged && next == key {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("key from the provider was not staged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	state, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"next_preshared_key=" + hex.EncodeToString(key[:]) + "\n",
+		"psk_rotation_handshakes=1\n",
+		"psk_rotations=1\n",
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
@@ -263,7 +264,7 @@ func (device *Device) RoutineReceiveIncoming(
 		}
 		for peer, elemsContainer := range elemsByPeer {
 			if peer.isRunning.Load() {
-				peer.queue.inbound.c <- elemsContainer
+				peer.queue.lane.inbound <- sequentialInbound{peer: peer, elemsContainer: elemsContainer}
 				device.queue.decryption.c <- elemsContainer
 			} else {
 				for _, elem := range elemsContainer.elems {
@@ -407,24 +408,15 @@ func (device *Device) RoutineHandshake(id int) {
 			msg.Type = elem.msgType
 
 			// consume initiation
-			peer := device.ConsumeMessageInitiation(&msg)
+			peer, unknown := device.consumeMessageInitiation(&msg)
 			if peer == nil {
+				if unknown != nil && device.authorizeInitiator(unknown, &msg, elem.endpoint, len(elem.packet)) {
+					goto skip
+				}
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
 				goto skip
 			}
-
-			// update timers
-
-			peer.timersAnyAuthenticatedPacketTraversal()
-			peer.timersAnyAuthenticatedPacketReceived()
-
-			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
-
-			device.log.Verbosef("%v - Received handshake initiation", peer)
-			peer.rxBytes.Add(uint64(len(elem.packet)))
-
-			peer.SendHandshakeResponse()
+			device.acceptInitiation(peer, elem.endpoint, len(elem.packet))
 
 		case MessageResponseType:
 
@@ -478,24 +470,44 @@ func (device *Device) RoutineHandshake(id int) {
 	}
 }
 
-func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
-	device := peer.device
-	defer func() {
-		device.log.Verbosef("%v - Routine: sequential receiver - stopped", peer)
-		peer.stopping.Done()
-	}()
-	device.log.Verbosef("%v - Routine: sequential receiver - started", peer)
+// acceptInitiation answers an initiation consumed from peer.
+func (device *Device) acceptInitiation(peer *Peer, endpoint conn.Endpoint, size int) {
+	// update timers
+
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketReceived()
+
+	// update endpoint
+	peer.SetEndpointFromPacket(endpoint)
+
+	device.log.Verbosef("%v - Received handshake initiation", peer)
+	peer.rxBytes.Add(uint64(size))
+
+	peer.SendHandshakeResponse()
+}
+
+func (device *Device) RoutineSequentialReceiver(id int, lane *sequentialLane, maxBatchSize int) {
+	defer device.log.Verbosef("Routine: sequential receiver %d - stopped", id)
+	device.log.Verbosef("Routine: sequential receiver %d - started", id)
 
 	bufs := make([][]byte, 0, maxBatchSize)
+	forwarded := make(map[*Peer]*QueueOutboundElementsContainer)
 
-	for elemsContainer := range peer.queue.inbound.c {
-		if elemsContainer == nil {
-			return
-		}
+	for item := range lane.inbound {
+		peer, elemsContainer := item.peer, item.elemsContainer
 		elemsContainer.Lock()
+		peer.queue.inLane.RLock()
+		if !peer.isRunning.Load() {
+			// peer has been stopped; return re-usable elems to the shared pool.
+			peer.queue.inLane.RUnlock()
+			device.deliver(elemsContainer, nil)
+			continue
+		}
 		validTailPacket := -1
 		dataPacketReceived := false
+		keypairConfirmed := false
 		rxBytesLen := uint64(0)
+		rxWait := time.Duration(0)
 		for i, elem := range elemsContainer.elems {
 			if elem.packet == nil {
 				// decryption failed
@@ -507,10 +519,11 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 			}
 
 			validTailPacket = i
+			peer.confirmPresharedKey(elem.keypair)
 			if peer.ReceivedWithKeypair(elem.keypair) {
 				peer.SetEndpointFromPacket(elem.endpoint)
 				peer.timersHandshakeComplete()
-				peer.SendStagedPackets()
+				keypairConfirmed = true
 			}
 			rxBytesLen += uint64(len(elem.packet) + MinMessageSize)
 
@@ -567,6 +580,19 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 				continue
 			}
 
+			if !peer.filterAllows(elem.packet, true) {
+				continue
+			}
+			wait, ok := peer.rateLimitRx(elem.packet)
+			if !ok {
+				continue
+			}
+			if target := device.forwardTarget(elem.packet, peer); target != nil {
+				device.forward(forwarded, target, elem.packet, wait)
+				continue
+			}
+			rxWait = max(rxWait, wait)
+
 			bufs = append(bufs, elem.buffer[int(elem.padding):int(elem.padding)+MessageTransportHeaderSize+len(elem.packet)])
 		}
 
@@ -580,19 +606,45 @@ func (peer *Peer) RoutineSequentialReceiver(maxBatchSize int) {
 		if dataPacketReceived {
 			peer.timersDataReceived()
 		}
-		if len(bufs) > 0 {
-			_, err := device.tun.device.Write(bufs, MessageTransportOffsetContent)
-			if err != nil && !device.isClosed() {
-				device.log.Errorf("Failed to write packets to TUN device: %v", err)
+		device.sendForwarded(forwarded)
+		// Hold back packets that exceed the peer's rate limit, without
+		// holding up the other peers of the lane.
+		held := false
+		if line := &peer.rateLimit.rxDelayed; rxWait > 0 || line.active.Load() {
+			delayed := slices.Clone(bufs)
+			due := time.Time{}
+			if rxWait > 0 {
+				due = time.Now().Add(rxWait)
 			}
+			held = line.hold(due, func() { device.deliver(elemsContainer, delayed) }, &peer.stopping)
 		}
-		for _, elem := range elemsContainer.elems {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutInboundElement(elem)
+		if !held {
+			device.deliver(elemsContainer, bufs)
 		}
+		peer.queue.inLane.RUnlock()
 		bufs = bufs[:0]
-		device.PutInboundElementsContainer(elemsContainer)
+		// Sending the staged packets may wait for room in the lane, which
+		// must not happen while Peer.Stop waits for the lock.
+		if keypairConfirmed {
+			peer.SendStagedPackets()
+		}
+	}
+}
+
+// deliver writes bufs, the packets of elemsContainer that passed the
+// checks, to the TUN device, and returns the elements to the pools.
+func (device *Device) deliver(elemsContainer *QueueInboundElementsContainer, bufs [][]byte) {
+	if len(bufs) > 0 {
+		_, err := device.tun.device.Write(bufs, MessageTransportOffsetContent)
+		if err != nil && !device.isClosed() {
+			device.log.Errorf("Failed to write packets to TUN device: %v", err)
+		}
+	}
+	for _, elem := range elemsContainer.elems {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutInboundElement(elem)
 	}
+	device.PutInboundElementsContainer(elemsContainer)
 }
 
 func applyHash(dst, src, hash []byte) {
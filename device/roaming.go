@@ -0,0 +1,130 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+)
+
+/* Roaming policy
+ *
+ * By default, a peer's endpoint follows the source address of its latest
+ * authenticated packet. The roaming policy of a peer limits that: with
+ * roaming off, the endpoint is only learned while the peer has none, and
+ * with roaming restricted, it may only move to addresses within the peer's
+ * allowed prefixes. Independently, a hysteresis makes the endpoint move
+ * only after several consecutive authenticated receptions from the new
+ * address, so that a single replayed or redirected packet cannot divert
+ * the peer's traffic.
+ */
+
+type roamingMode int
+
+const (
+	roamingOn roamingMode = iota
+	roamingOff
+	roamingRestricted
+)
+
+func (mode roamingMode) String() string {
+	switch mode {
+	case roamingOff:
+		return "off"
+	case roamingRestricted:
+		return "restricted"
+	}
+	return "on"
+}
+
+func parseRoamingMode(s string) (roamingMode, error) {
+	switch s {
+	case "on":
+		return roamingOn, nil
+	case "off":
+		return roamingOff, nil
+	case "restricted":
+		return roamingRestricted, nil
+	}
+	return roamingOn, fmt.Errorf("invalid roaming mode %q", s)
+}
+
+type roamingPolicy struct {
+	mode       roamingMode
+	prefixes   []netip.Prefix // addresses the endpoint may move to when restricted
+	hysteresis uint32         // receptions from a new address before moving, 0 or 1 to move at once
+
+	candidate     conn.Endpoint // new address the endpoint is about to move to
+	candidateSeen uint32        // consecutive receptions from candidate
+}
+
+func (policy *roamingPolicy) allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range policy.prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPrefix adds prefix to the allowed prefixes, if it is not there yet.
+func (policy *roamingPolicy) addPrefix(prefix netip.Prefix) {
+	prefix = prefix.Masked()
+	if !slices.Contains(policy.prefixes, prefix) {
+		policy.prefixes = append(policy.prefixes, prefix)
+	}
+}
+
+func sameEndpointAddress(a, b conn.Endpoint) bool {
+	return bytes.Equal(a.DstToBytes(), b.DstToBytes())
+}
+
+// roamingAllows reports whether the endpoint of the peer may be set to
+// endpoint, the source of an authenticated packet, and keeps track of the
+// hysteresis.
+//
+// Must hold peer.endpoint.Lock()
+func (peer *Peer) roamingAllows(endpoint conn.Endpoint) bool {
+	policy := &peer.endpoint.roaming
+	if policy.mode == roamingOn && policy.hysteresis <= 1 {
+		return true
+	}
+	current := peer.endpoint.val
+	if current != nil && sameEndpointAddress(current, endpoint) {
+		// Refreshes the sticky source of the current address.
+		policy.candidate = nil
+		return true
+	}
+	switch policy.mode {
+	case roamingOff:
+		if current != nil {
+			return false
+		}
+	case roamingRestricted:
+		if !policy.allows(endpoint.DstIP()) {
+			return false
+		}
+	}
+	if current == nil || policy.hysteresis <= 1 {
+		return true
+	}
+
+	if policy.candidate == nil || !sameEndpointAddress(policy.candidate, endpoint) {
+		policy.candidate = endpoint
+		policy.candidateSeen = 0
+	}
+	policy.candidateSeen++
+	if policy.candidateSeen < policy.hysteresis {
+		return false
+	}
+	policy.candidate = nil
+	return true
+}
@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestRoamingPolicy(t *testing.T) {
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := sk.PublicKey()
+	err = dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk[:]),
+		"endpoint", "127.0.0.1:1",
+		"roaming", "restricted",
+		"roaming_allowed_prefix", "198.51.100.0/24",
+		"roaming_hysteresis", "3",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := dev.LookupPeer(pk)
+
+	bind := conn.NewStdNetBind()
+	receive := func(addr string) {
+		t.Helper()
+		endpoint, err := bind.ParseEndpoint(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.SetEndpointFromPacket(endpoint)
+	}
+	endpoint := func() string {
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		return peer.endpoint.val.DstToString()
+	}
+
+	// Addresses outside the allowed prefixes are ignored.
+	for range 3 {
+		receive("203.0.113.5:51820")
+	}
+	if got := endpoint(); got != "127.0.0.1:1" {
+		t.Fatalf("endpoint moved outside the allowed prefixes to %s", got)
+	}
+
+	// Within them, the endpoint moves after three consecutive packets.
+	receive("198.51.100.7:51820")
+	receive("198.51.100.7:51820")
+	receive("198.51.100.8:51820")
+	receive("198.51.100.7:51820")
+	receive("198.51.100.7:51820")
+	if got := endpoint(); got != "127.0.0.1:1" {
+		t.Fatalf("endpoint moved to %s before the hysteresis", got)
+	}
+	receive("198.51.100.7:51820")
+	if got := endpoint(); got != "198.51.100.7:51820" {
+		t.Fatalf("endpoint %s, want 198.51.100.7:51820", got)
+	}
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"roaming=restricted\n",
+		"roaming_allowed_prefix=198.51.100.0/24\n",
+		"roaming_hysteresis=3\n",
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+
+	// Without roaming, the endpoint stays where it is.
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk[:]), "roaming", "off")); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		receive("198.51.100.8:51820")
+	}
+	if got := endpoint(); got != "198.51.100.7:51820" {
+		t.Fatalf("endpoint moved to %s with roaming off", got)
+	}
+}
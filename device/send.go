@@ -55,6 +55,7 @@ type QueueOutboundElement struct {
 	peer        *Peer                 // related peer
 	padding     uint32
 	isKeepalive bool
+	sendAfter   time.Time // when the peer's rate limit lets the packet go
 }
 
 type QueueOutboundElementsContainer struct {
@@ -68,6 +69,7 @@ func (device *Device) NewOutboundElement() *QueueOutboundElement {
 	elem.nonce = 0
 	elem.padding = device.paddings.transport.Load()
 	elem.isKeepalive = false
+	elem.sendAfter = time.Time{}
 	// keypair and peer were cleared (if necessary) by clearPointers.
 	return elem
 }
@@ -86,13 +88,13 @@ func (elem *QueueOutboundElement) clearPointers() {
 /* Queues a keepalive if no packets are queued for peer
  */
 func (peer *Peer) SendKeepalive() {
-	if len(peer.queue.staged) == 0 && peer.isRunning.Load() {
+	if len(peer.staged()) == 0 && peer.isRunning.Load() {
 		elem := peer.device.NewOutboundElement()
 		elem.isKeepalive = true
 		elemsContainer := peer.device.GetOutboundElementsContainer()
 		elemsContainer.elems = append(elemsContainer.elems, elem)
 		select {
-		case peer.queue.staged <- elemsContainer:
+		case peer.stagingQueue() <- elemsContainer:
 			peer.device.log.Verbosef("%v - Sending keepalive packet", peer)
 		default:
 			peer.device.PutMessageBuffer(elem.buffer)
@@ -368,7 +370,11 @@ func (device *Device) RoutineReadFromTUN() {
 				device.log.Verbosef("Received packet with unknown IP version")
 			}
 
-			if peer == nil {
+			if peer == nil || !peer.filterAllows(elem.packet, false) {
+				continue
+			}
+			elem.sendAfter = time.Time{}
+			if !peer.rateLimitTx(elem) {
 				continue
 			}
 			elemsForPeer, ok := elemsByPeer[peer]
@@ -415,14 +421,15 @@ func (device *Device) RoutineReadFromTUN() {
 }
 
 func (peer *Peer) StagePackets(elems *QueueOutboundElementsContainer) {
+	staged := peer.stagingQueue()
 	for {
 		select {
-		case peer.queue.staged <- elems:
+		case staged <- elems:
 			return
 		default:
 		}
 		select {
-		case tooOld := <-peer.queue.staged:
+		case tooOld := <-staged:
 			for _, elem := range tooOld.elems {
 				peer.device.PutMessageBuffer(elem.buffer)
 				peer.device.PutOutboundElement(elem)
@@ -434,8 +441,16 @@ func (peer *Peer) StagePackets(elems *QueueOutboundElementsContainer) {
 }
 
 func (peer *Peer) SendStagedPackets() {
+	peer.sendStagedPackets(true)
+}
+
+// sendStagedPackets queues the staged packets for encryption and sending.
+// Unless wait is set, packets are dropped instead of waiting for room in a
+// full lane, and it returns how many.
+func (peer *Peer) sendStagedPackets(wait bool) (dropped int) {
 top:
-	if len(peer.queue.staged) == 0 || !peer.device.isUp() {
+	staged := peer.staged()
+	if len(staged) == 0 || !peer.device.isUp() {
 		return
 	}
 
@@ -448,7 +463,7 @@ top:
 	for {
 		var elemsContainerOOO *QueueOutboundElementsContainer
 		select {
-		case elemsContainer := <-peer.queue.staged:
+		case elemsContainer := <-staged:
 			i := 0
 			for _, elem := range elemsContainer.elems {
 				elem.peer = peer
@@ -480,8 +495,21 @@ top:
 			}
 
 			// add to parallel and sequential queue
-			if peer.isRunning.Load() {
-				peer.queue.outbound.c <- elemsContainer
+			queued := peer.isRunning.Load()
+			if queued {
+				item := sequentialOutbound{peer: peer, elemsContainer: elemsContainer}
+				if wait {
+					peer.queue.lane.outbound <- item
+				} else {
+					select {
+					case peer.queue.lane.outbound <- item:
+					default:
+						queued = false
+						dropped += len(elemsContainer.elems)
+					}
+				}
+			}
+			if queued {
 				peer.device.queue.encryption.c <- elemsContainer
 			} else {
 				for _, elem := range elemsContainer.elems {
@@ -501,9 +529,10 @@ top:
 }
 
 func (peer *Peer) FlushStagedPackets() {
+	staged := peer.staged()
 	for {
 		select {
-		case elemsContainer := <-peer.queue.staged:
+		case elemsContainer := <-staged:
 			for _, elem := range elemsContainer.elems {
 				peer.device.PutMessageBuffer(elem.buffer)
 				peer.device.PutOutboundElement(elem)
@@ -649,29 +678,20 @@ func (device *Device) RoutineEncryption(id int) {
 	}
 }
 
-func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
-	device := peer.device
-	defer func() {
-		defer device.log.Verbosef("%v - Routine: sequential sender - stopped", peer)
-		peer.stopping.Done()
-	}()
-	device.log.Verbosef("%v - Routine: sequential sender - started", peer)
+func (device *Device) RoutineSequentialSender(id int, lane *sequentialLane, maxBatchSize int) {
+	defer device.log.Verbosef("Routine: sequential sender %d - stopped", id)
+	device.log.Verbosef("Routine: sequential sender %d - started", id)
 
 	bufs := make([][]byte, 0, maxBatchSize)
 
-	for elemsContainer := range peer.queue.outbound.c {
+	for item := range lane.outbound {
+		peer, elemsContainer := item.peer, item.elemsContainer
 		bufs = bufs[:0]
-		if elemsContainer == nil {
-			return
-		}
+		elemsContainer.Lock()
+		peer.queue.inLane.RLock()
 		if !peer.isRunning.Load() {
 			// peer has been stopped; return re-usable elems to the shared pool.
-			// This is an optimization only. It is possible for the peer to be stopped
-			// immediately after this check, in which case, elem will get processed.
-			// The timers and SendBuffers code are resilient to a few stragglers.
-			// TODO: rework peer shutdown order to ensure
-			// that we never accidentally keep timers alive longer than necessary.
-			elemsContainer.Lock()
+			peer.queue.inLane.RUnlock()
 			for _, elem := range elemsContainer.elems {
 				device.PutMessageBuffer(elem.buffer)
 				device.PutOutboundElement(elem)
@@ -680,40 +700,61 @@ func (peer *Peer) RoutineSequentialSender(maxBatchSize int) {
 			continue
 		}
 		dataSent := false
-		elemsContainer.Lock()
+		var sendAfter time.Time
 		for _, elem := range elemsContainer.elems {
 			if !elem.isKeepalive {
 				dataSent = true
 			}
+			if elem.sendAfter.After(sendAfter) {
+				sendAfter = elem.sendAfter
+			}
 
 			bufs = append(bufs, elem.packet)
 		}
 
-		peer.timersAnyAuthenticatedPacketTraversal()
-		peer.timersAnyAuthenticatedPacketSent()
-
-		err := peer.SendBuffers(bufs)
-		if dataSent {
-			peer.timersDataSent()
-		}
-
-		for _, elem := range elemsContainer.elems {
-			device.PutMessageBuffer(elem.buffer)
-			device.PutOutboundElement(elem)
-		}
-		device.PutOutboundElementsContainer(elemsContainer)
-		if err != nil {
-			var errGSO conn.ErrUDPGSODisabled
-			if errors.As(err, &errGSO) {
-				device.log.Verbosef(err.Error())
-				err = errGSO.RetryErr
+		// Hold back packets that exceed the peer's rate limit, without
+		// holding up the other peers of the lane.
+		if line := &peer.rateLimit.txDelayed; !sendAfter.IsZero() || line.active.Load() {
+			held := slices.Clone(bufs)
+			if line.hold(sendAfter, func() { peer.transmit(elemsContainer, held, dataSent) }, &peer.stopping) {
+				peer.queue.inLane.RUnlock()
+				continue
 			}
 		}
-		if err != nil {
-			device.log.Errorf("%v - Failed to send data packets: %v", peer, err)
-			continue
-		}
+		peer.transmit(elemsContainer, bufs, dataSent)
+		peer.queue.inLane.RUnlock()
+	}
+}
+
+// transmit sends the packets of elemsContainer, whose buffers are bufs, and
+// returns the elements to the pools.
+func (peer *Peer) transmit(elemsContainer *QueueOutboundElementsContainer, bufs [][]byte, dataSent bool) {
+	device := peer.device
 
-		peer.keepKeyFreshSending()
+	peer.timersAnyAuthenticatedPacketTraversal()
+	peer.timersAnyAuthenticatedPacketSent()
+
+	err := peer.SendBuffers(bufs)
+	if dataSent {
+		peer.timersDataSent()
+	}
+
+	for _, elem := range elemsContainer.elems {
+		device.PutMessageBuffer(elem.buffer)
+		device.PutOutboundElement(elem)
+	}
+	device.PutOutboundElementsContainer(elemsContainer)
+	if err != nil {
+		var errGSO conn.ErrUDPGSODisabled
+		if errors.As(err, &errGSO) {
+			device.log.Verbosef(err.Error())
+			err = errGSO.RetryErr
+		}
 	}
+	if err != nil {
+		device.log.Errorf("%v - Failed to send data packets: %v", peer, err)
+		return
+	}
+
+	peer.keepKeyFreshSending()
 }
@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"runtime"
+)
+
+/* Sequential lanes
+ *
+ * The packets of a peer are encrypted and decrypted in parallel, but must
+ * be transmitted and written to the TUN device in the order they were
+ * queued. Rather than running a sender and a receiver routine per peer,
+ * each peer is assigned to one of runtime.NumCPU() lanes, whose routines
+ * handle the packets of all the lane's peers in order. While handling a
+ * peer's packets, they hold its queue.inLane lock for reading, which
+ * Peer.Stop takes to wait for them once the peer is no longer running.
+ */
+
+type sequentialOutbound struct {
+	peer           *Peer
+	elemsContainer *QueueOutboundElementsContainer
+}
+
+type sequentialInbound struct {
+	peer           *Peer
+	elemsContainer *QueueInboundElementsContainer
+}
+
+type sequentialLane struct {
+	outbound chan sequentialOutbound // sequential ordering of udp transmission
+	inbound  chan sequentialInbound  // sequential ordering of tun writing
+}
+
+// startSequentialLanes creates the lanes and starts their routines. It
+// must be called after creating the encryption and decryption queues.
+func (device *Device) startSequentialLanes() {
+	// Use the device batch size, not the bind batch size, as the device size is
+	// the size of the batch pools.
+	batchSize := device.BatchSize()
+	lanes := make([]sequentialLane, runtime.NumCPU())
+	for i := range lanes {
+		lane := &lanes[i]
+		lane.outbound = make(chan sequentialOutbound, QueueOutboundSize)
+		lane.inbound = make(chan sequentialInbound, QueueInboundSize)
+		go device.RoutineSequentialSender(i+1, lane, batchSize)
+		go device.RoutineSequentialReceiver(i+1, lane, batchSize)
+	}
+	device.queue.sequential = lanes
+
+	// Everything written to a lane is also written to the encryption or
+	// decryption queue, by the same writers, so the lanes can be closed
+	// along with those queues.
+	go func() {
+		device.queue.encryption.wg.Wait()
+		for i := range lanes {
+			close(lanes[i].outbound)
+		}
+	}()
+	go func() {
+		device.queue.decryption.wg.Wait()
+		for i := range lanes {
+			close(lanes[i].inbound)
+		}
+	}()
+}
+
+// sequentialLane returns the lane for the peer with public key pk.
+func (device *Device) sequentialLane(pk NoisePublicKey) *sequentialLane {
+	lanes := device.queue.sequential
+	return &lanes[binary.LittleEndian.Uint32(pk[:4])%uint32(len(lanes))]
+}
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TestRemovePeerWithFullLane removes a peer while the receiver of its lane
+// waits for room in the lane to send the packets staged for a keypair just
+// confirmed.
+func TestRemovePeerWithFullLane(t *testing.T) {
+	pair := genTestPair(t, true)
+	dev := pair[0].dev
+	peer := dev.LookupPeer(pair[1].dev.staticIdentity.publicKey)
+
+	// Replace the lane of the peer with one that has no sender, and fill
+	// it up.
+	lane := &sequentialLane{
+		outbound: make(chan sequentialOutbound, 1),
+		inbound:  make(chan sequentialInbound, 1),
+	}
+	lane.outbound <- sequentialOutbound{}
+	peer.queue.lane = lane
+	done := make(chan struct{})
+	go func() {
+		dev.RoutineSequentialReceiver(0, lane, 1)
+		close(done)
+	}()
+
+	elems := dev.GetOutboundElementsContainer()
+	elem := dev.NewOutboundElement()
+	elem.packet = elem.buffer[MessageTransportOffsetContent : MessageTransportOffsetContent+1]
+	elems.elems = append(elems.elems, elem)
+	peer.StagePackets(elems)
+
+	// A keepalive with the next keypair confirms it and sends the staged
+	// packets.
+	keypair := &Keypair{created: time.Now()}
+	keypair.send, _ = chacha20poly1305.New(make([]byte, chacha20poly1305.KeySize))
+	peer.keypairs.next.Store(keypair)
+	inbound := dev.GetInboundElementsContainer()
+	in := dev.GetInboundElement()
+	in.buffer = dev.GetMessageBuffer()
+	in.packet = in.buffer[MessageTransportOffsetContent:MessageTransportOffsetContent]
+	in.keypair = keypair
+	peer.endpoint.Lock()
+	in.endpoint = peer.endpoint.val
+	peer.endpoint.Unlock()
+	inbound.elems = append(inbound.elems, in)
+	lane.inbound <- sequentialInbound{peer: peer, elemsContainer: inbound}
+	for len(peer.staged()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	removed := make(chan struct{})
+	go func() {
+		dev.RemovePeer(peer.handshake.remoteStatic)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("removing the peer blocked on its full lane")
+	}
+
+	for range 2 {
+		<-lane.outbound
+	}
+	close(lane.inbound)
+	<-done
+}
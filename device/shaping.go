@@ -0,0 +1,218 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultRateLimitMaxDelay = 100 * time.Millisecond
+	MaxRateLimitMaxDelay     = time.Second
+)
+
+// A tokenBucket limits a peer's traffic in one direction. Tokens are kept
+// in nanoseconds of transmission time at the configured rate, so that a
+// packet of n bytes costs n/rate seconds. The balance may go negative by
+// up to the maximum delay, which is how much packets are held back.
+type tokenBucket struct {
+	rate atomic.Uint64 // bytes per second, zero for no limit
+
+	mu       sync.Mutex
+	burst    uint64
+	tokens   int64
+	lastTime time.Time
+	dropped  atomic.Uint64 // bytes dropped for exceeding the limit
+}
+
+// set changes the limit and refills the bucket.
+func (bucket *tokenBucket) set(rate, burst uint64) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	if burst == 0 {
+		burst = rate
+	}
+	bucket.burst = burst
+	bucket.tokens = bucket.capacity(rate)
+	bucket.lastTime = time.Now()
+	bucket.rate.Store(rate)
+}
+
+// capacity returns the burst in nanoseconds at rate, saturating for bursts
+// of more than about 292 years of traffic.
+func (bucket *tokenBucket) capacity(rate uint64) int64 {
+	if rate == 0 {
+		return 0
+	}
+	hi, lo := bits.Mul64(bucket.burst, uint64(time.Second))
+	if hi >= rate {
+		return math.MaxInt64
+	}
+	if quo, _ := bits.Div64(hi, lo, rate); quo <= math.MaxInt64 {
+		return int64(quo)
+	}
+	return math.MaxInt64
+}
+
+// reserve takes the tokens for size bytes and returns how long the packet
+// has to wait before it conforms to the limit. ok is false, and nothing is
+// taken, if that would be longer than maxDelay.
+func (bucket *tokenBucket) reserve(size int, maxDelay time.Duration) (wait time.Duration, ok bool) {
+	rate := bucket.rate.Load()
+	if rate == 0 {
+		return 0, true
+	}
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	now := time.Now()
+	elapsed := int64(now.Sub(bucket.lastTime))
+	bucket.lastTime = now
+	if capacity := bucket.capacity(rate); bucket.tokens > capacity-elapsed {
+		bucket.tokens = capacity
+	} else {
+		bucket.tokens += elapsed
+	}
+
+	cost := int64(uint64(size) * uint64(time.Second) / rate)
+	if bucket.tokens-cost < -int64(maxDelay) {
+		bucket.dropped.Add(uint64(size))
+		return 0, false
+	}
+	bucket.tokens -= cost
+	if bucket.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-bucket.tokens), true
+}
+
+// String returns the limit in the form accepted by parseRateLimit.
+func (bucket *tokenBucket) String() string {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	rate := bucket.rate.Load()
+	if bucket.burst == rate {
+		return strconv.FormatUint(rate, 10)
+	}
+	return fmt.Sprintf("%d/%d", rate, bucket.burst)
+}
+
+// parseRateLimit parses a limit of the form BYTES_PER_SECOND[/BURST_BYTES].
+// The burst defaults to one second worth of traffic.
+func parseRateLimit(s string) (rate, burst uint64, err error) {
+	rateStr, burstStr, hasBurst := strings.Cut(s, "/")
+	rate, err = strconv.ParseUint(rateStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if hasBurst {
+		burst, err = strconv.ParseUint(burstStr, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return rate, burst, nil
+}
+
+// rateLimitTx applies the peer's transmit limit to a packet read from the
+// TUN device or forwarded. It reports whether the packet may be sent, and
+// records when, unless it is already held back for longer.
+func (peer *Peer) rateLimitTx(elem *QueueOutboundElement) bool {
+	wait, ok := peer.rateLimit.tx.reserve(len(elem.packet), peer.rateLimit.maxDelay())
+	if due := time.Now().Add(wait); wait > 0 && due.After(elem.sendAfter) {
+		elem.sendAfter = due
+	}
+	return ok
+}
+
+// rateLimitRx applies the peer's receive limit to a decrypted packet. It
+// reports whether the packet may be written to the TUN device, and how
+// long to hold it back first.
+func (peer *Peer) rateLimitRx(packet []byte) (time.Duration, bool) {
+	return peer.rateLimit.rx.reserve(len(packet), peer.rateLimit.maxDelay())
+}
+
+// peerRateLimit holds the transmit and receive limits of a peer.
+type peerRateLimit struct {
+	tx, rx tokenBucket
+	delay  atomic.Bool  // hold back packets over the limit instead of dropping them
+	window atomic.Int64 // how long packets may be held back, when delay is set
+
+	txDelayed, rxDelayed delayLine
+}
+
+// maxDelay returns how long packets over the limit may be held back; zero
+// means they are dropped.
+func (limit *peerRateLimit) maxDelay() time.Duration {
+	if !limit.delay.Load() {
+		return 0
+	}
+	return time.Duration(limit.window.Load())
+}
+
+// A delayLine holds back packets over a peer's rate limit, so that the
+// sequential routines can go on with the other peers of their lane. Once
+// it holds packets, the peer's later packets queue up behind them, and a
+// goroutine, running only while the line is not empty, delivers them in
+// order when they are due.
+type delayLine struct {
+	active  atomic.Bool // packets are held
+	mu      sync.Mutex
+	pending []delayedPackets
+}
+
+type delayedPackets struct {
+	due     time.Time
+	deliver func()
+}
+
+// hold arranges for deliver to run at due, after the packets held before.
+// It reports false, and does nothing, if deliver may run right away.
+// The goroutine delivering held packets is counted in stopping.
+func (line *delayLine) hold(due time.Time, deliver func(), stopping *sync.WaitGroup) bool {
+	line.mu.Lock()
+	defer line.mu.Unlock()
+	if !line.active.Load() {
+		if !time.Now().Before(due) {
+			return false
+		}
+		line.active.Store(true)
+		stopping.Add(1)
+		go line.run(stopping)
+	}
+	line.pending = append(line.pending, delayedPackets{due: due, deliver: deliver})
+	return true
+}
+
+func (line *delayLine) run(stopping *sync.WaitGroup) {
+	defer stopping.Done()
+	for {
+		line.mu.Lock()
+		if len(line.pending) == 0 {
+			line.pending = nil
+			line.active.Store(false)
+			line.mu.Unlock()
+			return
+		}
+		next := line.pending[0]
+		line.pending[0] = delayedPackets{}
+		line.pending = line.pending[1:]
+		line.mu.Unlock()
+
+		if wait := time.Until(next.due); wait > 0 {
+			time.Sleep(wait)
+		}
+		next.deliver()
+	}
+}
@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	for _, s := range []string{"0", "125000", "125000/15000", "1000/5000000000"} {
+		rate, burst, err := parseRateLimit(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		var bucket tokenBucket
+		bucket.set(rate, burst)
+		if got := bucket.String(); got != s {
+			t.Errorf("%q formatted as %q", s, got)
+		}
+	}
+	for _, s := range []string{"", "fast", "-1", "1000/", "1000/-5", "1000/1/2"} {
+		if _, _, err := parseRateLimit(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	var bucket tokenBucket
+	if _, ok := bucket.reserve(1<<20, 0); !ok {
+		t.Fatal("packet dropped without a limit")
+	}
+
+	bucket.set(1000, 1500)
+	if wait, ok := bucket.reserve(1500, 0); !ok || wait != 0 {
+		t.Fatalf("burst not allowed: wait %v, ok %v", wait, ok)
+	}
+	if _, ok := bucket.reserve(500, 0); ok {
+		t.Fatal("packet over the limit allowed")
+	}
+	if got := bucket.dropped.Load(); got != 500 {
+		t.Errorf("dropped %d bytes, want 500", got)
+	}
+
+	wait, ok := bucket.reserve(500, time.Second)
+	if !ok || wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("expected a delay of about 500ms, got %v, ok %v", wait, ok)
+	}
+	if _, ok := bucket.reserve(1000, time.Second); ok {
+		t.Error("packet beyond the maximum delay allowed")
+	}
+	if got := bucket.dropped.Load(); got != 1500 {
+		t.Errorf("dropped %d bytes, want 1500", got)
+	}
+	// A burst whose duration does not fit in nanoseconds saturates.
+	bucket.set(1, 1<<40)
+	if wait, ok := bucket.reserve(1500, 0); !ok || wait != 0 {
+		t.Errorf("huge burst not allowed: wait %v, ok %v", wait, ok)
+	}
+	if wait, ok := bucket.reserve(1500, 0); !ok || wait != 0 {
+		t.Errorf("huge burst not refilled: wait %v, ok %v", wait, ok)
+	}
+}
+
+func TestRateLimitDevice(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	pk := pair[1].dev.staticIdentity.publicKey
+	publicKey := hex.EncodeToString(pk[:])
+	ping := tuntest.Ping(pair[0].ip, pair[1].ip)
+	arrival := func() time.Duration {
+		t.Helper()
+		start := time.Now()
+		pair[1].tun.Outbound <- ping
+		select {
+		case <-pair[0].tun.Inbound:
+			return time.Since(start)
+		case <-time.After(2 * time.Second):
+			return -1
+		}
+	}
+
+	// One ping per second.
+	err := pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"rate_limit_rx", "32",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arrival() < 0 {
+		t.Fatal("first ping was dropped")
+	}
+	if arrival() >= 0 {
+		t.Error("second ping was not dropped")
+	}
+
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"rate_limit_policy", "delay",
+		"rate_limit_max_delay", "1000",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bucket refilled while waiting for the dropped ping.
+	if arrival() < 0 {
+		t.Fatal("ping within the limit was dropped")
+	}
+	if d := arrival(); d < 300*time.Millisecond {
+		t.Errorf("ping over the limit was not delayed: %v", d)
+	}
+
+	state, err := pair[0].dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"rate_limit_rx=32\n",
+		"rate_limit_policy=delay\n",
+		"rate_limit_max_delay=1000\n",
+		"rate_limited_rx_bytes=32\n",
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+	if strings.Contains(state, "rate_limit_tx") {
+		t.Errorf("unexpected transmit limit in:\n%s", state)
+	}
+
+	err = pair[0].dev.IpcSet(uapiCfg(
+		"public_key", publicKey,
+		"rate_limit_rx", "0",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair.Send(t, Ping, nil)
+	pair.Send(t, Ping, nil)
+}
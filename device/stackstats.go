@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// A StackStatsProvider reports on the network stack behind the TUN device,
+// such as the userspace one of tun/netstack, so that a get includes its
+// counters and connections.
+type StackStatsProvider interface {
+	StackCounters() []StackCounter
+	StackConnections() []StackConnection
+}
+
+// A StackCounter is a named counter of a network stack, reported by a get
+// as a stack_stat=NAME VALUE line.
+type StackCounter struct {
+	Name  string
+	Value uint64
+}
+
+func (counter StackCounter) String() string {
+	return fmt.Sprintf("%s %d", counter.Name, counter.Value)
+}
+
+// A StackConnection is a TCP or UDP endpoint of a network stack, reported
+// by a get as a stack_connection=NETWORK LOCAL REMOTE STATE TX RX line.
+type StackConnection struct {
+	Network          string // "tcp" or "udp"
+	Local, Remote    netip.AddrPort
+	State            string
+	TxBytes, RxBytes uint64
+}
+
+func (conn StackConnection) String() string {
+	return fmt.Sprintf("%s %s %s %s %d %d", conn.Network, conn.Local, conn.Remote, conn.State, conn.TxBytes, conn.RxBytes)
+}
+
+// SetStackStatsProvider installs the provider of network stack statistics.
+// A nil provider, the default, leaves them out of a get.
+func (device *Device) SetStackStatsProvider(provider StackStatsProvider) {
+	device.stackStats.Lock()
+	defer device.stackStats.Unlock()
+	device.stackStats.provider = provider
+}
+
+func (device *Device) stackStatsProvider() StackStatsProvider {
+	device.stackStats.Lock()
+	defer device.stackStats.Unlock()
+	return device.stackStats.provider
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+type testStackStats struct{}
+
+func (testStackStats) StackCounters() []StackCounter {
+	return []StackCounter{{"tcp_retransmits", 3}, {"udp_checksum_errors", 0}}
+}
+
+func (testStackStats) StackConnections() []StackConnection {
+	return []StackConnection{{
+		Network: "tcp",
+		Local:   netip.MustParseAddrPort("10.0.0.1:40000"),
+		Remote:  netip.MustParseAddrPort("[fd00::2]:443"),
+		State:   "ESTABLISHED",
+		TxBytes: 100,
+		RxBytes: 2000,
+	}}
+}
+
+func TestStackStats(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(state, "stack_") {
+		t.Errorf("stack statistics without a provider:\n%s", state)
+	}
+
+	dev.SetStackStatsProvider(testStackStats{})
+	state, err = dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"stack_stat=tcp_retransmits 3\n",
+		"stack_stat=udp_checksum_errors 0\n",
+		"stack_connection=tcp 10.0.0.1:40000 [fd00::2]:443 ESTABLISHED 100 2000\n",
+	} {
+		if !strings.Contains(state, line) {
+			t.Errorf("missing %q in:\n%s", line, state)
+		}
+	}
+
+	d, err := dev.IpcGetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.StackStats) != 2 || d.StackStats["tcp_retransmits"] != 3 {
+		t.Errorf("wrong stack stats in JSON: %v", d.StackStats)
+	}
+	want := IpcJSONStackConnection{Network: "tcp", Local: "10.0.0.1:40000", Remote: "[fd00::2]:443", State: "ESTABLISHED", TxBytes: 100, RxBytes: 2000}
+	if len(d.StackConnections) != 1 || d.StackConnections[0] != want {
+		t.Errorf("wrong stack connections in JSON: %+v", d.StackConnections)
+	}
+	if err := dev.IpcSetJSON(d); err != nil {
+		t.Error(err)
+	}
+
+	// Updates do not list the stack.
+	err = dev.IpcUpdate(func(config string) (string, error) {
+		if strings.Contains(config, "stack_") {
+			t.Errorf("stack statistics in update:\n%s", config)
+		}
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
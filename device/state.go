@@ -0,0 +1,283 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tai64n"
+)
+
+/* Learned peer state
+ *
+ * What a device learns about its peers at run time, rather than from its
+ * configuration, is lost on restart: the endpoints that roaming peers were
+ * last seen at, when the last handshakes happened, the packet size window
+ * used for padding, and the newest handshake initiation timestamp of each
+ * peer. The last one matters most, as a restarted responder would otherwise
+ * accept a captured initiation replayed by an attacker.
+ *
+ * SaveState writes this state as JSON, and LoadState restores it, keeping
+ * what the running device already knows when it is more recent.
+ */
+
+const StateSaveInterval = time.Minute
+
+type savedPeerState struct {
+	PublicKey      string `json:"public_key"`
+	Endpoint       string `json:"endpoint,omitempty"`
+	LastHandshake  int64  `json:"last_handshake_time_nsec,omitempty"` // nano seconds since epoch
+	UDPWindow      uint32 `json:"udp_window,omitempty"`
+	LastInitiation string `json:"last_initiation_timestamp,omitempty"` // TAI64N, hex
+}
+
+type savedState struct {
+	Peers []savedPeerState `json:"peers"`
+}
+
+// restoredPeerState is the loaded state of a peer.
+type restoredPeerState struct {
+	saved             savedPeerState
+	endpoint          conn.Endpoint
+	lastHandshakeNano int64
+	udpWindow         uint32
+	lastTimestamp     tai64n.Timestamp
+}
+
+func (device *Device) parsePeerState(saved savedPeerState) (NoisePublicKey, *restoredPeerState, error) {
+	var pk NoisePublicKey
+	if err := pk.FromHex(saved.PublicKey); err != nil {
+		return pk, nil, fmt.Errorf("invalid public key %q: %w", saved.PublicKey, err)
+	}
+	state := &restoredPeerState{
+		saved:             saved,
+		lastHandshakeNano: saved.LastHandshake,
+		udpWindow:         saved.UDPWindow,
+	}
+	if saved.Endpoint != "" {
+		endpoint, err := device.net.bind.ParseEndpoint(saved.Endpoint)
+		if err != nil {
+			return pk, nil, fmt.Errorf("invalid endpoint %q: %w", saved.Endpoint, err)
+		}
+		state.endpoint = endpoint
+	}
+	if saved.LastInitiation != "" {
+		timestamp, err := hex.DecodeString(saved.LastInitiation)
+		if err != nil || len(timestamp) != tai64n.TimestampSize {
+			return pk, nil, fmt.Errorf("invalid initiation timestamp %q", saved.LastInitiation)
+		}
+		copy(state.lastTimestamp[:], timestamp)
+	}
+	return pk, state, nil
+}
+
+// savedState returns the learned state of the peer with public key pk.
+func (peer *Peer) savedState(pk NoisePublicKey) savedPeerState {
+	saved := savedPeerState{
+		PublicKey:     hex.EncodeToString(pk[:]),
+		LastHandshake: peer.lastHandshakeNano.Load(),
+		UDPWindow:     peer.udpWindow.Load(),
+	}
+	peer.endpoint.Lock()
+	if peer.endpoint.val != nil {
+		saved.Endpoint = peer.endpoint.val.DstToString()
+	}
+	peer.endpoint.Unlock()
+	peer.handshake.mutex.RLock()
+	if timestamp := peer.handshake.lastTimestamp; timestamp != (tai64n.Timestamp{}) {
+		saved.LastInitiation = hex.EncodeToString(timestamp[:])
+	}
+	peer.handshake.mutex.RUnlock()
+	return saved
+}
+
+// restoreState applies state to the peer where it adds to what the peer
+// already knows: an endpoint only if the peer has none, and times and
+// windows only if they are newer or larger.
+func (peer *Peer) restoreState(state *restoredPeerState) {
+	if state.endpoint != nil {
+		peer.endpoint.Lock()
+		if peer.endpoint.val == nil {
+			peer.endpoint.val = state.endpoint
+		}
+		peer.endpoint.Unlock()
+	}
+	if state.udpWindow > peer.udpWindow.Load() {
+		peer.udpWindow.Store(state.udpWindow)
+	}
+	if state.lastHandshakeNano > peer.lastHandshakeNano.Load() {
+		peer.lastHandshakeNano.Store(state.lastHandshakeNano)
+	}
+	peer.handshake.mutex.Lock()
+	if state.lastTimestamp.After(peer.handshake.lastTimestamp) {
+		peer.handshake.lastTimestamp = state.lastTimestamp
+	}
+	peer.handshake.mutex.Unlock()
+}
+
+// restoreSavedState applies the loaded state of a peer that was not
+// configured at the time, if any.
+//
+// Must hold device.peers.Lock()
+func (device *Device) restoreSavedState(pk NoisePublicKey, peer *Peer) {
+	device.savedState.Lock()
+	state, ok := device.savedState.pending[pk]
+	delete(device.savedState.pending, pk)
+	device.savedState.Unlock()
+	if ok {
+		peer.restoreState(state)
+	}
+}
+
+// SaveState writes the state learned about the device's peers to w. The
+// state of peers loaded by LoadState but not configured since is carried
+// over.
+func (device *Device) SaveState(w io.Writer) error {
+	var state savedState
+	device.peers.RLock()
+	for pk, peer := range device.peers.keyMap.all() {
+		state.Peers = append(state.Peers, peer.savedState(pk))
+	}
+	device.peers.RUnlock()
+
+	device.savedState.Lock()
+	for _, pending := range device.savedState.pending {
+		state.Peers = append(state.Peers, pending.saved)
+	}
+	device.savedState.Unlock()
+
+	return json.NewEncoder(w).Encode(&state)
+}
+
+// LoadState restores the peer state written by SaveState. The state of
+// configured peers is applied where it is more recent than what the device
+// has learned since; the state of other peers is kept and applied when they
+// are added.
+func (device *Device) LoadState(r io.Reader) error {
+	var state savedState
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return fmt.Errorf("failed to decode peer state: %w", err)
+	}
+	restored := make(map[NoisePublicKey]*restoredPeerState, len(state.Peers))
+	for _, saved := range state.Peers {
+		pk, peerState, err := device.parsePeerState(saved)
+		if err != nil {
+			return fmt.Errorf("failed to load peer state: %w", err)
+		}
+		restored[pk] = peerState
+	}
+
+	for pk, peerState := range restored {
+		if peer := device.LookupPeer(pk); peer != nil {
+			peer.restoreState(peerState)
+			delete(restored, pk)
+		}
+	}
+
+	device.savedState.Lock()
+	defer device.savedState.Unlock()
+	if device.savedState.pending == nil {
+		device.savedState.pending = restored
+	} else {
+		for pk, peerState := range restored {
+			device.savedState.pending[pk] = peerState
+		}
+	}
+	return nil
+}
+
+// SetStateFile loads the peer state from the file at path, if it exists,
+// and then keeps it up to date: the device saves its state there every
+// StateSaveInterval and when it is closed. A file that fails to load is
+// replaced with the next save.
+func (device *Device) SetStateFile(path string) error {
+	if device.isClosed() {
+		return errors.New("device closed")
+	}
+	var err error
+	if f, openErr := os.Open(path); openErr == nil {
+		err = device.LoadState(f)
+		f.Close()
+	} else if !errors.Is(openErr, os.ErrNotExist) {
+		err = openErr
+	}
+
+	device.savedState.Lock()
+	started := device.savedState.path != ""
+	device.savedState.path = path
+	device.savedState.Unlock()
+	if !started {
+		go device.RoutineSaveState()
+	}
+	return err
+}
+
+// writeStateFile saves the peer state to the state file, if one is set.
+// Periodic saves stop once the device is closing, so that the final save
+// made by Close, before its peers are removed, is the one that remains.
+func (device *Device) writeStateFile(closing bool) {
+	device.savedState.writing.Lock()
+	defer device.savedState.writing.Unlock()
+	if !closing && device.isClosed() {
+		return
+	}
+	device.savedState.Lock()
+	path := device.savedState.path
+	device.savedState.Unlock()
+	if path == "" {
+		return
+	}
+	if err := writeFileAtomic(path, device.SaveState); err != nil {
+		device.log.Errorf("Failed to save peer state to %s: %v", path, err)
+	}
+}
+
+// writeFileAtomic replaces the file at path with what write produces, so
+// that readers see either the old or the new contents in full.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (device *Device) RoutineSaveState() {
+	device.log.Verbosef("Routine: peer state saver - started")
+	defer device.log.Verbosef("Routine: peer state saver - stopped")
+
+	ticker := time.NewTicker(StateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-device.closed:
+			return
+		case <-ticker.C:
+			device.writeStateFile(false)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestStateFile(t *testing.T) {
+	goroutineLeakCheck(t)
+	pair := genTestPair(t, false)
+	pair.Send(t, Ping, nil)
+
+	path := filepath.Join(t.TempDir(), "wg0.state")
+	if err := pair[0].dev.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	sk := pair[0].dev.staticIdentity.privateKey
+	pk1 := pair[1].dev.staticIdentity.publicKey
+	peer := pair[0].dev.LookupPeer(pk1)
+	peer.udpWindow.Store(1400)
+	endpoint := peer.endpoint.val.DstToString()
+	lastHandshake := peer.lastHandshakeNano.Load()
+	lastTimestamp := peer.handshake.lastTimestamp
+	if lastHandshake == 0 || lastTimestamp == [12]byte{} {
+		t.Fatal("no handshake recorded")
+	}
+	pair[0].dev.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("state file not saved on close: %v", err)
+	}
+
+	newDevice := func() *Device {
+		dev := NewDevice(tuntest.NewChannelTUN().TUN(), bindtest.NewChannelBinds()[0], NewLogger(LogLevelError, ""))
+		t.Cleanup(dev.Close)
+		if err := dev.IpcSet(uapiCfg("private_key", hex.EncodeToString(sk[:]))); err != nil {
+			t.Fatal(err)
+		}
+		return dev
+	}
+
+	// Peers added after loading get their state when they are created.
+	dev := newDevice()
+	if err := dev.SetStateFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.IpcSet(uapiCfg("public_key", hex.EncodeToString(pk1[:]))); err != nil {
+		t.Fatal(err)
+	}
+	peer = dev.LookupPeer(pk1)
+	if peer.endpoint.val == nil || peer.endpoint.val.DstToString() != endpoint {
+		t.Errorf("endpoint not restored, got %v, want %s", peer.endpoint.val, endpoint)
+	}
+	if got := peer.lastHandshakeNano.Load(); got != lastHandshake {
+		t.Errorf("last handshake %d, want %d", got, lastHandshake)
+	}
+	if got := peer.udpWindow.Load(); got != 1400 {
+		t.Errorf("UDP window %d, want 1400", got)
+	}
+	if peer.handshake.lastTimestamp != lastTimestamp {
+		t.Error("initiation timestamp not restored")
+	}
+
+	// Configured endpoints take precedence over restored ones.
+	dev = newDevice()
+	err := dev.IpcSet(uapiCfg(
+		"public_key", hex.EncodeToString(pk1[:]),
+		"endpoint", "127.0.0.1:9",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := dev.LoadState(f); err != nil {
+		t.Fatal(err)
+	}
+	peer = dev.LookupPeer(pk1)
+	if got := peer.endpoint.val.DstToString(); got != "127.0.0.1:9" {
+		t.Errorf("configured endpoint replaced with %s", got)
+	}
+	if peer.handshake.lastTimestamp != lastTimestamp {
+		t.Error("initiation timestamp not restored")
+	}
+}
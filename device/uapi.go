@@ -46,43 +46,97 @@ var byteBufferPool = &sync.Pool{
 	New: func() any { return new(bytes.Buffer) },
 }
 
+// ipcGetChunkSize is how much output IpcGetOperation buffers before
+// writing it out, so that large peer lists are streamed.
+const ipcGetChunkSize = 64 << 10
+
 // IpcGetOperation implements the WireGuard configuration protocol "get" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
 func (device *Device) IpcGetOperation(w io.Writer) error {
 	device.ipcMutex.RLock()
 	defer device.ipcMutex.RUnlock()
+	return device.ipcGetText(w, true)
+}
 
-	buf := byteBufferPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer byteBufferPool.Put(buf)
-	sendf := func(format string, args ...any) {
-		fmt.Fprintf(buf, format, args...)
-		buf.WriteByte('\n')
-	}
-	keyf := func(prefix string, key *[32]byte) {
-		buf.Grow(len(key)*2 + 2 + len(prefix))
-		buf.WriteString(prefix)
-		buf.WriteByte('=')
+// An ipcGetWriter receives the lines of a "get" operation as ipcGet walks
+// the device. Values keep their types, so that the JSON encoding is built
+// from them directly rather than by parsing the text one.
+type ipcGetWriter interface {
+	line(key string, value any)
+
+	// flush is called between peers, without device locks held, to pass
+	// on what is buffered so far.
+	flush() error
+}
+
+// ipcTextWriter writes the lines of a "get" operation in the text
+// protocol, in chunks of about ipcGetChunkSize.
+type ipcTextWriter struct {
+	w   io.Writer
+	buf *bytes.Buffer
+}
+
+func (t *ipcTextWriter) line(key string, value any) {
+	buf := t.buf
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	switch v := value.(type) {
+	case *[32]byte:
 		const hex = "0123456789abcdef"
-		for i := 0; i < len(key); i++ {
-			buf.WriteByte(hex[key[i]>>4])
-			buf.WriteByte(hex[key[i]&0xf])
+		buf.Grow(len(v)*2 + 1)
+		for i := 0; i < len(v); i++ {
+			buf.WriteByte(hex[v[i]>>4])
+			buf.WriteByte(hex[v[i]&0xf])
 		}
-		buf.WriteByte('\n')
-	}
-	boolf := func(prefix string, val bool) {
-		buf.Grow(3 + len(prefix))
-		buf.WriteString(prefix)
-		buf.WriteByte('=')
-		if val {
+	case bool:
+		if v {
 			buf.WriteByte('1')
 		} else {
 			buf.WriteByte('0')
 		}
-		buf.WriteByte('\n')
+	case string:
+		buf.WriteString(v)
+	default:
+		fmt.Fprint(buf, v)
+	}
+	buf.WriteByte('\n')
+}
+
+func (t *ipcTextWriter) flush() error {
+	if t.buf.Len() < ipcGetChunkSize {
+		return nil
+	}
+	return t.write()
+}
+
+func (t *ipcTextWriter) write() error {
+	if _, err := t.w.Write(t.buf.Bytes()); err != nil {
+		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+	}
+	t.buf.Reset()
+	return nil
+}
 
+// ipcGetText serializes the configuration of the device in the text
+// protocol.
+// Must hold device.ipcMutex.
+func (device *Device) ipcGetText(w io.Writer, stack bool) error {
+	buf := byteBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer byteBufferPool.Put(buf)
+	t := &ipcTextWriter{w: w, buf: buf}
+	if err := device.ipcGet(t, stack); err != nil {
+		return err
 	}
+	return t.write()
+}
 
+// ipcGet walks the configuration of the device. The counters and
+// connections of the network stack, which are costly to list, are only
+// reported if stack is set.
+// Must hold device.ipcMutex.
+func (device *Device) ipcGet(out ipcGetWriter, stack bool) error {
+	var peers []*Peer
 	func() {
 		// lock required resources
 
@@ -101,129 +155,217 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 		// serialize device related values
 
 		if !device.staticIdentity.privateKey.IsZero() {
-			keyf("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
+			out.line("private_key", (*[32]byte)(&device.staticIdentity.privateKey))
 		}
 
 		if device.net.port != 0 {
-			sendf("listen_port=%d", device.net.port)
+			out.line("listen_port", device.net.port)
 		}
 
 		if device.net.fwmark != 0 {
-			sendf("fwmark=%d", device.net.fwmark)
+			out.line("fwmark", device.net.fwmark)
 		}
 
 		if count := device.junk.count.Load(); count != 0 {
-			sendf("jc=%d", count)
+			out.line("jc", count)
 		}
 
 		if min := device.junk.min.Load(); min != 0 {
-			sendf("jmin=%d", min)
+			out.line("jmin", min)
 		}
 
 		if max := device.junk.max.Load(); max != 0 {
-			sendf("jmax=%d", max)
+			out.line("jmax", max)
 		}
 
 		if padding := device.paddings.init.Load(); padding != 0 {
-			sendf("s1=%d", padding)
+			out.line("s1", padding)
 		}
 
 		if padding := device.paddings.response.Load(); padding != 0 {
-			sendf("s2=%d", padding)
+			out.line("s2", padding)
 		}
 
 		if padding := device.paddings.cookie.Load(); padding != 0 {
-			sendf("s3=%d", padding)
+			out.line("s3", padding)
 		}
 
 		if padding := device.paddings.transport.Load(); padding != 0 {
-			sendf("s4=%d", padding)
+			out.line("s4", padding)
 		}
 
 		if header := device.headers.init.Load(); !header.IsZero() {
-			sendf("h1=%s", header.ToString())
+			out.line("h1", header.ToString())
 		}
 
 		if header := device.headers.response.Load(); !header.IsZero() {
-			sendf("h2=%s", header.ToString())
+			out.line("h2", header.ToString())
 		}
 
 		if header := device.headers.cookie.Load(); !header.IsZero() {
-			sendf("h3=%s", header.ToString())
+			out.line("h3", header.ToString())
 		}
 
 		if header := device.headers.transport.Load(); !header.IsZero() {
-			sendf("h4=%s", header.ToString())
+			out.line("h4", header.ToString())
 		}
 
 		for i, ipacket := range device.ipackets {
 			if ipacket != nil {
-				sendf("i%d=%s", i+1, ipacket.Spec)
+				out.line(fmt.Sprintf("i%d", i+1), ipacket.Spec)
 			}
 		}
 
 		if !device.headerProtection.key.IsZero() {
-			keyf("header_protection_key", (*[32]byte)(&device.headerProtection.key))
+			out.line("header_protection_key", (*[32]byte)(&device.headerProtection.key))
 		}
 
 		if addition := device.contentPaddingAddition.Load(); !addition.IsZero() {
-			sendf("content_padding_addition=%s", addition.ToString())
+			out.line("content_padding_addition", addition.ToString())
 		}
 
 		if timing := device.timings.rekeyAfterTimeSec.Load(); !timing.IsZero() {
-			sendf("rekey_after_time=%s", timing.ToString())
+			out.line("rekey_after_time", timing.ToString())
 		}
 		if timing := device.timings.rekeyTimeoutSec.Load(); !timing.IsZero() {
-			sendf("rekey_timeout=%s", timing.ToString())
+			out.line("rekey_timeout", timing.ToString())
 		}
 		if timing := device.timings.rejectAfterTimeSec.Load(); !timing.IsZero() {
-			sendf("reject_after_time=%s", timing.ToString())
+			out.line("reject_after_time", timing.ToString())
 		}
 		if timing := device.timings.keepaliveTimeoutSec.Load(); !timing.IsZero() {
-			sendf("keepalive_timeout=%s", timing.ToString())
+			out.line("keepalive_timeout", timing.ToString())
 		}
 		if rang := device.timings.maxHandshakeAttemps.Load(); !rang.IsZero() {
-			sendf("max_handshake_attempts=%s", rang.ToString())
-		}
-		boolf("random_trailers", device.randomTrailers.Load())
-		boolf("disable_cookies", device.disableCookies.Load())
-
-		for _, peer := range device.peers.keyMap {
-			// Serialize peer state.
-			peer.handshake.mutex.RLock()
-			keyf("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
-			keyf("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
-			peer.handshake.mutex.RUnlock()
-			sendf("protocol_version=1")
-			peer.endpoint.Lock()
-			if peer.endpoint.val != nil {
-				sendf("endpoint=%s", peer.endpoint.val.DstToString())
+			out.line("max_handshake_attempts", rang.ToString())
+		}
+		out.line("random_trailers", device.randomTrailers.Load())
+		out.line("disable_cookies", device.disableCookies.Load())
+		if forwarding := &device.forwarding; forwarding.enabled.Load() {
+			out.line("peer_forwarding", true)
+			out.line("forwarded_packets", forwarding.packets.Load())
+			out.line("forwarded_bytes", forwarding.bytes.Load())
+			out.line("forwarding_dropped_packets", forwarding.dropped.Load())
+		}
+
+		if timeout := device.peerExpiry.idleTimeout.Load(); timeout != 0 {
+			out.line("idle_peer_timeout", timeout)
+		}
+		if dropped := device.authorization.dropped.Load(); dropped != 0 {
+			out.line("dropped_authorizations", dropped)
+		}
+		for _, removed := range device.RemovedPeers() {
+			out.line("removed_peer", removed)
+		}
+		if provider := device.stackStatsProvider(); provider != nil && stack {
+			for _, counter := range provider.StackCounters() {
+				out.line("stack_stat", counter)
 			}
-			peer.endpoint.Unlock()
+			for _, conn := range provider.StackConnections() {
+				out.line("stack_connection", conn)
+			}
+		}
+
+		// Peers are serialized without holding the locks above.
+		peers = make([]*Peer, 0, device.peers.keyMap.len())
+		for _, peer := range device.peers.keyMap.all() {
+			peers = append(peers, peer)
+		}
+	}()
+
+	for _, peer := range peers {
+		if err := out.flush(); err != nil {
+			return err
+		}
+
+		// Serialize peer state.
+		peer.handshake.mutex.RLock()
+		out.line("public_key", (*[32]byte)(&peer.handshake.remoteStatic))
+		out.line("preshared_key", (*[32]byte)(&peer.handshake.presharedKey))
+		if next := peer.handshake.nextPresharedKey; next != nil {
+			out.line("next_preshared_key", (*[32]byte)(next))
+		}
+		peer.handshake.mutex.RUnlock()
+		out.line("protocol_version", 1)
+		peer.endpoint.Lock()
+		if peer.endpoint.val != nil {
+			out.line("endpoint", peer.endpoint.val.DstToString())
+		}
+		peer.endpoint.Unlock()
 
-			nano := peer.lastHandshakeNano.Load()
-			secs := nano / time.Second.Nanoseconds()
-			nano %= time.Second.Nanoseconds()
+		nano := peer.lastHandshakeNano.Load()
+		secs := nano / time.Second.Nanoseconds()
+		nano %= time.Second.Nanoseconds()
 
-			sendf("last_handshake_time_sec=%d", secs)
-			sendf("last_handshake_time_nsec=%d", nano)
-			sendf("tx_bytes=%d", peer.txBytes.Load())
-			sendf("rx_bytes=%d", peer.rxBytes.Load())
+		out.line("last_handshake_time_sec", secs)
+		out.line("last_handshake_time_nsec", nano)
+		out.line("tx_bytes", peer.txBytes.Load())
+		out.line("rx_bytes", peer.rxBytes.Load())
 
-			if keepalive := peer.persistentKeepaliveInterval.Load(); !keepalive.IsZero() {
-				sendf("persistent_keepalive_interval=%s", keepalive.ToString())
+		if keepalive := peer.persistentKeepaliveInterval.Load(); !keepalive.IsZero() {
+			out.line("persistent_keepalive_interval", keepalive.ToString())
+		}
+
+		peer.endpoint.Lock()
+		if roaming := &peer.endpoint.roaming; roaming.mode != roamingOn || roaming.hysteresis != 0 || len(roaming.prefixes) != 0 {
+			if roaming.mode != roamingOn {
+				out.line("roaming", roaming.mode)
+			}
+			for _, prefix := range roaming.prefixes {
+				out.line("roaming_allowed_prefix", prefix)
+			}
+			if roaming.hysteresis != 0 {
+				out.line("roaming_hysteresis", roaming.hysteresis)
 			}
+		}
+		peer.endpoint.Unlock()
 
-			device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
-				sendf("allowed_ip=%s", prefix.String())
-				return true
-			})
+		if expiresAt := peer.expiresAt.Load(); expiresAt != 0 {
+			out.line("expires_at", expiresAt)
 		}
-	}()
 
-	// send lines (does not require resource locks)
-	if _, err := w.Write(buf.Bytes()); err != nil {
-		return ipcErrorf(ipc.IpcErrorIO, "failed to write output: %w", err)
+		if handshakes := peer.pskRotation.handshakes.Load(); handshakes != 0 {
+			out.line("psk_rotation_handshakes", handshakes)
+		}
+		if interval := peer.pskRotation.interval.Load(); interval != 0 {
+			out.line("psk_rotation_interval", int64(time.Duration(interval)/time.Second))
+		}
+		if rotations := peer.pskRotation.rotations.Load(); rotations != 0 {
+			out.line("psk_rotations", rotations)
+		}
+
+		device.allowedips.EntriesForPeer(peer, func(prefix netip.Prefix) bool {
+			out.line("allowed_ip", prefix.String())
+			return true
+		})
+
+		limit := &peer.rateLimit
+		if limit.tx.rate.Load() != 0 {
+			out.line("rate_limit_tx", &limit.tx)
+		}
+		if limit.rx.rate.Load() != 0 {
+			out.line("rate_limit_rx", &limit.rx)
+		}
+		if limit.delay.Load() {
+			out.line("rate_limit_policy", "delay")
+			out.line("rate_limit_max_delay", time.Duration(limit.window.Load()).Milliseconds())
+		}
+		if dropped := limit.tx.dropped.Load(); dropped != 0 || limit.tx.rate.Load() != 0 {
+			out.line("rate_limited_tx_bytes", dropped)
+		}
+		if dropped := limit.rx.dropped.Load(); dropped != 0 || limit.rx.rate.Load() != 0 {
+			out.line("rate_limited_rx_bytes", dropped)
+		}
+
+		if filters := peer.filters.Load(); filters != nil {
+			if filters.deny {
+				out.line("filter_default", "deny")
+			}
+			for _, rule := range filters.rules {
+				out.line("filter", rule)
+				out.line("filter_hits", rule.Hits())
+			}
+		}
 	}
 
 	return nil
@@ -231,10 +373,15 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 
 // IpcSetOperation implements the WireGuard configuration protocol "set" operation.
 // See https://www.wireguard.com/xplatform/#configuration-protocol for details.
-func (device *Device) IpcSetOperation(r io.Reader) (err error) {
+func (device *Device) IpcSetOperation(r io.Reader) error {
 	device.ipcMutex.Lock()
 	defer device.ipcMutex.Unlock()
+	return device.ipcSet(r)
+}
 
+// ipcSet applies a "set" operation.
+// Must hold device.ipcMutex.Lock().
+func (device *Device) ipcSet(r io.Reader) (err error) {
 	defer func() {
 		if err != nil {
 			device.log.Errorf("%v", err)
@@ -543,6 +690,22 @@ func (device *Device) handleDeviceLine(ipcDev *ipcSetDevice, key, value string)
 		device.log.Verbosef("UAPI: Updating disable cookies")
 		device.disableCookies.Store(val)
 
+	case "peer_forwarding":
+		val, err := strconv.ParseBool(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse peer forwarding: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating peer forwarding")
+		device.forwarding.enabled.Store(val)
+
+	case "idle_peer_timeout":
+		timeout, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to parse idle peer timeout: %w", err)
+		}
+		device.log.Verbosef("UAPI: Updating idle peer timeout")
+		device.peerExpiry.idleTimeout.Store(int64(timeout))
+
 	default:
 		return ipcErrorf(ipc.IpcErrorInvalid, "invalid UAPI device key: %v", key)
 	}
@@ -644,12 +807,37 @@ func (device *Device) handlePeerLine(
 
 		peer.handshake.mutex.Lock()
 		err := peer.handshake.presharedKey.FromHex(value)
+		peer.handshake.nextPresharedKey = nil
 		peer.handshake.mutex.Unlock()
 
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w", err)
 		}
 
+	case "next_preshared_key":
+		device.log.Verbosef("%v - UAPI: Staging next preshared key", peer.Peer)
+		var key NoisePresharedKey
+		if err := key.FromHex(value); err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set next preshared key: %w", err)
+		}
+		peer.SetNextPresharedKey(key)
+
+	case "psk_rotation_handshakes":
+		device.log.Verbosef("%v - UAPI: Updating preshared key rotation handshakes", peer.Peer)
+		handshakes, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set psk_rotation_handshakes, invalid value: %v", value)
+		}
+		peer.pskRotation.handshakes.Store(uint32(handshakes))
+
+	case "psk_rotation_interval":
+		device.log.Verbosef("%v - UAPI: Updating preshared key rotation interval", peer.Peer)
+		secs, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set psk_rotation_interval, invalid value: %v", value)
+		}
+		peer.pskRotation.interval.Store(int64(secs) * int64(time.Second))
+
 	case "endpoint":
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
 		endpoint, err := device.net.bind.ParseEndpoint(value)
@@ -659,6 +847,52 @@ func (device *Device) handlePeerLine(
 		peer.endpoint.Lock()
 		defer peer.endpoint.Unlock()
 		peer.endpoint.val = endpoint
+		peer.endpoint.roaming.candidate = nil
+
+	case "roaming":
+		device.log.Verbosef("%v - UAPI: Updating roaming policy", peer.Peer)
+		mode, err := parseRoamingMode(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set roaming: %w", err)
+		}
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		peer.endpoint.roaming.mode = mode
+		peer.endpoint.roaming.candidate = nil
+
+	case "replace_roaming_allowed_prefixes":
+		device.log.Verbosef("%v - UAPI: Removing all roaming prefixes", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(
+				ipc.IpcErrorInvalid,
+				"failed to replace roaming prefixes, invalid value: %v",
+				value,
+			)
+		}
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		peer.endpoint.roaming.prefixes = nil
+
+	case "roaming_allowed_prefix":
+		device.log.Verbosef("%v - UAPI: Adding roaming prefix", peer.Peer)
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set roaming prefix: %w", err)
+		}
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		peer.endpoint.roaming.addPrefix(prefix)
+
+	case "roaming_hysteresis":
+		device.log.Verbosef("%v - UAPI: Updating roaming hysteresis", peer.Peer)
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set roaming_hysteresis, invalid value: %v", value)
+		}
+		peer.endpoint.Lock()
+		defer peer.endpoint.Unlock()
+		peer.endpoint.roaming.hysteresis = uint32(n)
+		peer.endpoint.roaming.candidate = nil
 
 	case "persistent_keepalive_interval":
 		device.log.Verbosef("%v - UAPI: Updating persistent keepalive interval", peer.Peer)
@@ -709,6 +943,91 @@ func (device *Device) handlePeerLine(
 			device.allowedips.Remove(prefix, peer.Peer)
 		}
 
+	case "replace_filters":
+		device.log.Verbosef("%v - UAPI: Removing all filter rules", peer.Peer)
+		if value != "true" {
+			return ipcErrorf(
+				ipc.IpcErrorInvalid,
+				"failed to replace filters, invalid value: %v",
+				value,
+			)
+		}
+		if old := peer.filters.Load(); old != nil {
+			peer.filters.Store(&filterSet{deny: old.deny})
+		}
+
+	case "filter":
+		device.log.Verbosef("%v - UAPI: Adding filter rule", peer.Peer)
+		rule, err := ParseFilterRule(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set filter %q: %w", value, err)
+		}
+		filters := peer.filters.Load()
+		if filters == nil {
+			filters = new(filterSet)
+		}
+		peer.filters.Store(filters.with(rule))
+
+	case "filter_default":
+		device.log.Verbosef("%v - UAPI: Updating default filter action", peer.Peer)
+		var deny bool
+		switch value {
+		case "allow":
+		case "deny":
+			deny = true
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set filter default, invalid value: %v", value)
+		}
+		filters := new(filterSet)
+		if old := peer.filters.Load(); old != nil {
+			*filters = *old
+		}
+		filters.deny = deny
+		peer.filters.Store(filters)
+
+	case "expires_at":
+		device.log.Verbosef("%v - UAPI: Updating expiry time", peer.Peer)
+		expiresAt, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || expiresAt < 0 {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set expiry time, invalid value: %v", value)
+		}
+		peer.expiresAt.Store(expiresAt)
+
+	case "rate_limit_tx", "rate_limit_rx":
+		device.log.Verbosef("%v - UAPI: Updating %s", peer.Peer, key)
+		rate, burst, err := parseRateLimit(value)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set %s: %w", key, err)
+		}
+		if key == "rate_limit_tx" {
+			peer.rateLimit.tx.set(rate, burst)
+		} else {
+			peer.rateLimit.rx.set(rate, burst)
+		}
+
+	case "rate_limit_policy":
+		device.log.Verbosef("%v - UAPI: Updating rate limit policy", peer.Peer)
+		switch value {
+		case "drop":
+			peer.rateLimit.delay.Store(false)
+		case "delay":
+			peer.rateLimit.delay.Store(true)
+		default:
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set rate limit policy, invalid value: %v", value)
+		}
+
+	case "rate_limit_max_delay":
+		device.log.Verbosef("%v - UAPI: Updating rate limit maximum delay", peer.Peer)
+		ms, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set rate limit maximum delay: %w", err)
+		}
+		delay := time.Duration(ms) * time.Millisecond
+		if delay == 0 || delay > MaxRateLimitMaxDelay {
+			return ipcErrorf(ipc.IpcErrorInvalid, "rate limit maximum delay must be between 1 and %d ms", MaxRateLimitMaxDelay.Milliseconds())
+		}
+		peer.rateLimit.window.Store(int64(delay))
+
 	case "protocol_version":
 		if value != "1" {
 			return ipcErrorf(ipc.IpcErrorInvalid, "invalid protocol version: %v", value)
@@ -733,6 +1052,26 @@ func (device *Device) IpcSet(uapiConf string) error {
 	return device.IpcSetOperation(strings.NewReader(uapiConf))
 }
 
+// IpcUpdate passes the configuration of the device, as IpcGet returns it
+// but without the state of the network stack, to update, and applies the
+// "set" operation that update returns, if any. No other configuration
+// change happens in between, so that update can decide on the current
+// state.
+func (device *Device) IpcUpdate(update func(config string) (string, error)) error {
+	device.ipcMutex.Lock()
+	defer device.ipcMutex.Unlock()
+
+	buf := new(strings.Builder)
+	if err := device.ipcGetText(buf, false); err != nil {
+		return err
+	}
+	uapiConf, err := update(buf.String())
+	if err != nil || uapiConf == "" {
+		return err
+	}
+	return device.ipcSet(strings.NewReader(uapiConf))
+}
+
 func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
@@ -767,6 +1106,25 @@ func (device *Device) IpcHandle(socket net.Conn) {
 				break
 			}
 			err = device.IpcGetOperation(buffered.Writer)
+		case "authorize=1\n":
+			var nextByte byte
+			nextByte, err = buffered.ReadByte()
+			if err != nil {
+				return
+			}
+			if nextByte != '\n' {
+				err = ipcErrorf(
+					ipc.IpcErrorInvalid,
+					"trailing character in UAPI authorize: %q",
+					nextByte,
+				)
+				break
+			}
+			device.ipcHandleAuthorize(buffered)
+			return
+		case "get=json\n", "set=json\n":
+			device.ipcHandleJSON(buffered, op[:3])
+			continue
 		default:
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
@@ -0,0 +1,499 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/ipc"
+)
+
+// IpcJSONDevice is the JSON encoding of the device configuration used by
+// the "get=json" and "set=json" UAPI operations. Every field carries the
+// name and value format of the corresponding UAPI key: keys are hex
+// encoded and ranges are written as "lo-hi".
+//
+// When setting, fields that are absent are left unchanged and peer
+// statistics are ignored, so the output of a get may be modified and
+// sent back as is.
+type IpcJSONDevice struct {
+	PrivateKey   string  `json:"private_key,omitempty"`
+	ListenPort   *uint16 `json:"listen_port,omitempty"`
+	FwMark       *uint32 `json:"fwmark,omitempty"`
+	ReplacePeers bool    `json:"replace_peers,omitempty"`
+
+	Jc   *uint32 `json:"jc,omitempty"`
+	Jmin *uint32 `json:"jmin,omitempty"`
+	Jmax *uint32 `json:"jmax,omitempty"`
+	S1   *uint32 `json:"s1,omitempty"`
+	S2   *uint32 `json:"s2,omitempty"`
+	S3   *uint32 `json:"s3,omitempty"`
+	S4   *uint32 `json:"s4,omitempty"`
+	H1   string  `json:"h1,omitempty"`
+	H2   string  `json:"h2,omitempty"`
+	H3   string  `json:"h3,omitempty"`
+	H4   string  `json:"h4,omitempty"`
+	I1   *string `json:"i1,omitempty"`
+	I2   *string `json:"i2,omitempty"`
+	I3   *string `json:"i3,omitempty"`
+	I4   *string `json:"i4,omitempty"`
+	I5   *string `json:"i5,omitempty"`
+
+	HeaderProtectionKey    string `json:"header_protection_key,omitempty"`
+	ContentPaddingAddition string `json:"content_padding_addition,omitempty"`
+	RekeyAfterTime         string `json:"rekey_after_time,omitempty"`
+	RekeyTimeout           string `json:"rekey_timeout,omitempty"`
+	RejectAfterTime        string `json:"reject_after_time,omitempty"`
+	KeepaliveTimeout       string `json:"keepalive_timeout,omitempty"`
+	MaxHandshakeAttempts   string `json:"max_handshake_attempts,omitempty"`
+	RandomTrailers         *bool  `json:"random_trailers,omitempty"`
+	DisableCookies         *bool  `json:"disable_cookies,omitempty"`
+
+	PeerForwarding           *bool  `json:"peer_forwarding,omitempty"`
+	ForwardedPackets         uint64 `json:"forwarded_packets,omitempty"`          // reported by get only
+	ForwardedBytes           uint64 `json:"forwarded_bytes,omitempty"`            // reported by get only
+	ForwardingDroppedPackets uint64 `json:"forwarding_dropped_packets,omitempty"` // reported by get only
+
+	DroppedAuthorizations uint64 `json:"dropped_authorizations,omitempty"` // reported by get only
+
+	IdlePeerTimeout *uint32              `json:"idle_peer_timeout,omitempty"`
+	RemovedPeers    []IpcJSONRemovedPeer `json:"removed_peers,omitempty"` // reported by get only
+
+	StackStats       map[string]uint64        `json:"stack_stats,omitempty"`       // reported by get only
+	StackConnections []IpcJSONStackConnection `json:"stack_connections,omitempty"` // reported by get only
+
+	Peers []IpcJSONPeer `json:"peers,omitempty"`
+}
+
+// IpcJSONPeer is the JSON encoding of a peer section. AllowedIPs holds
+// one entry per allowed_ip line; when setting, a "-" prefix removes the
+// prefix from the peer.
+type IpcJSONPeer struct {
+	PublicKey                   string   `json:"public_key"`
+	Remove                      bool     `json:"remove,omitempty"`
+	UpdateOnly                  bool     `json:"update_only,omitempty"`
+	PresharedKey                string   `json:"preshared_key,omitempty"`
+	NextPresharedKey            string   `json:"next_preshared_key,omitempty"`
+	ProtocolVersion             int      `json:"protocol_version,omitempty"`
+	Endpoint                    string   `json:"endpoint,omitempty"`
+	PersistentKeepaliveInterval string   `json:"persistent_keepalive_interval,omitempty"`
+	ReplaceAllowedIPs           bool     `json:"replace_allowed_ips,omitempty"`
+	AllowedIPs                  []string `json:"allowed_ips,omitempty"`
+	ExpiresAt                   *int64   `json:"expires_at,omitempty"`
+
+	Roaming                       string   `json:"roaming,omitempty"`
+	ReplaceRoamingAllowedPrefixes bool     `json:"replace_roaming_allowed_prefixes,omitempty"`
+	RoamingAllowedPrefixes        []string `json:"roaming_allowed_prefixes,omitempty"`
+	RoamingHysteresis             *uint32  `json:"roaming_hysteresis,omitempty"`
+
+	PSKRotationHandshakes *uint32 `json:"psk_rotation_handshakes,omitempty"`
+	PSKRotationInterval   *uint32 `json:"psk_rotation_interval,omitempty"`
+
+	RateLimitTx       string  `json:"rate_limit_tx,omitempty"`
+	RateLimitRx       string  `json:"rate_limit_rx,omitempty"`
+	RateLimitPolicy   string  `json:"rate_limit_policy,omitempty"`
+	RateLimitMaxDelay *uint32 `json:"rate_limit_max_delay,omitempty"`
+
+	FilterDefault  string          `json:"filter_default,omitempty"`
+	ReplaceFilters bool            `json:"replace_filters,omitempty"`
+	Filters        []IpcJSONFilter `json:"filters,omitempty"`
+
+	// Statistics, reported by get only.
+	LastHandshakeTimeSec  int64  `json:"last_handshake_time_sec"`
+	LastHandshakeTimeNsec int64  `json:"last_handshake_time_nsec"`
+	TxBytes               uint64 `json:"tx_bytes"`
+	RxBytes               uint64 `json:"rx_bytes"`
+	RateLimitedTxBytes    uint64 `json:"rate_limited_tx_bytes,omitempty"`
+	RateLimitedRxBytes    uint64 `json:"rate_limited_rx_bytes,omitempty"`
+	PSKRotations          uint64 `json:"psk_rotations,omitempty"`
+}
+
+// IpcJSONFilter is a filter line of a peer, in the syntax accepted by
+// ParseFilterRule, along with its hit counter.
+type IpcJSONFilter struct {
+	Rule string `json:"rule"`
+	Hits uint64 `json:"hits"`
+}
+
+// IpcJSONRemovedPeer is a peer removed by the garbage collector, as
+// reported by a removed_peer line.
+type IpcJSONRemovedPeer struct {
+	PublicKey string `json:"public_key"`
+	Reason    string `json:"reason"`
+	Time      int64  `json:"time"`
+}
+
+// IpcJSONStackConnection is a connection of the network stack behind the
+// device, as reported by a stack_connection line.
+type IpcJSONStackConnection struct {
+	Network string `json:"network"`
+	Local   string `json:"local"`
+	Remote  string `json:"remote"`
+	State   string `json:"state"`
+	TxBytes uint64 `json:"tx_bytes"`
+	RxBytes uint64 `json:"rx_bytes"`
+}
+
+// IpcJSONResponse is the reply to a JSON UAPI operation. Errno is zero
+// on success and carries the same value as the errno= line of the text
+// protocol otherwise, with Error describing what went wrong.
+type IpcJSONResponse struct {
+	Errno  int64          `json:"errno"`
+	Error  string         `json:"error,omitempty"`
+	Device *IpcJSONDevice `json:"device,omitempty"`
+}
+
+// An ipcJSONField maps a UAPI key to the struct field holding its value.
+// Read-only fields are only filled in by get.
+type ipcJSONField struct {
+	key      string
+	ptr      any
+	readOnly bool
+}
+
+func (d *IpcJSONDevice) fields() []ipcJSONField {
+	return []ipcJSONField{
+		{key: "private_key", ptr: &d.PrivateKey},
+		{key: "listen_port", ptr: &d.ListenPort},
+		{key: "fwmark", ptr: &d.FwMark},
+		{key: "replace_peers", ptr: &d.ReplacePeers},
+		{key: "jc", ptr: &d.Jc},
+		{key: "jmin", ptr: &d.Jmin},
+		{key: "jmax", ptr: &d.Jmax},
+		{key: "s1", ptr: &d.S1},
+		{key: "s2", ptr: &d.S2},
+		{key: "s3", ptr: &d.S3},
+		{key: "s4", ptr: &d.S4},
+		{key: "h1", ptr: &d.H1},
+		{key: "h2", ptr: &d.H2},
+		{key: "h3", ptr: &d.H3},
+		{key: "h4", ptr: &d.H4},
+		{key: "i1", ptr: &d.I1},
+		{key: "i2", ptr: &d.I2},
+		{key: "i3", ptr: &d.I3},
+		{key: "i4", ptr: &d.I4},
+		{key: "i5", ptr: &d.I5},
+		{key: "header_protection_key", ptr: &d.HeaderProtectionKey},
+		{key: "content_padding_addition", ptr: &d.ContentPaddingAddition},
+		{key: "rekey_after_time", ptr: &d.RekeyAfterTime},
+		{key: "rekey_timeout", ptr: &d.RekeyTimeout},
+		{key: "reject_after_time", ptr: &d.RejectAfterTime},
+		{key: "keepalive_timeout", ptr: &d.KeepaliveTimeout},
+		{key: "max_handshake_attempts", ptr: &d.MaxHandshakeAttempts},
+		{key: "random_trailers", ptr: &d.RandomTrailers},
+		{key: "disable_cookies", ptr: &d.DisableCookies},
+		{key: "peer_forwarding", ptr: &d.PeerForwarding},
+		{key: "forwarded_packets", ptr: &d.ForwardedPackets, readOnly: true},
+		{key: "forwarded_bytes", ptr: &d.ForwardedBytes, readOnly: true},
+		{key: "forwarding_dropped_packets", ptr: &d.ForwardingDroppedPackets, readOnly: true},
+		{key: "dropped_authorizations", ptr: &d.DroppedAuthorizations, readOnly: true},
+		{key: "idle_peer_timeout", ptr: &d.IdlePeerTimeout},
+	}
+}
+
+// fields does not include public_key, allowed_ip and filter, which need
+// special handling in both directions.
+func (p *IpcJSONPeer) fields() []ipcJSONField {
+	return []ipcJSONField{
+		{key: "remove", ptr: &p.Remove},
+		{key: "update_only", ptr: &p.UpdateOnly},
+		{key: "preshared_key", ptr: &p.PresharedKey},
+		{key: "next_preshared_key", ptr: &p.NextPresharedKey},
+		{key: "protocol_version", ptr: &p.ProtocolVersion},
+		{key: "endpoint", ptr: &p.Endpoint},
+		{key: "persistent_keepalive_interval", ptr: &p.PersistentKeepaliveInterval},
+		{key: "replace_allowed_ips", ptr: &p.ReplaceAllowedIPs},
+		{key: "expires_at", ptr: &p.ExpiresAt},
+		{key: "roaming", ptr: &p.Roaming},
+		{key: "replace_roaming_allowed_prefixes", ptr: &p.ReplaceRoamingAllowedPrefixes},
+		{key: "roaming_hysteresis", ptr: &p.RoamingHysteresis},
+		{key: "psk_rotation_handshakes", ptr: &p.PSKRotationHandshakes},
+		{key: "psk_rotation_interval", ptr: &p.PSKRotationInterval},
+		{key: "rate_limit_tx", ptr: &p.RateLimitTx},
+		{key: "rate_limit_rx", ptr: &p.RateLimitRx},
+		{key: "rate_limit_policy", ptr: &p.RateLimitPolicy},
+		{key: "rate_limit_max_delay", ptr: &p.RateLimitMaxDelay},
+		{key: "filter_default", ptr: &p.FilterDefault},
+		{key: "replace_filters", ptr: &p.ReplaceFilters},
+		{key: "last_handshake_time_sec", ptr: &p.LastHandshakeTimeSec, readOnly: true},
+		{key: "last_handshake_time_nsec", ptr: &p.LastHandshakeTimeNsec, readOnly: true},
+		{key: "tx_bytes", ptr: &p.TxBytes, readOnly: true},
+		{key: "rx_bytes", ptr: &p.RxBytes, readOnly: true},
+		{key: "rate_limited_tx_bytes", ptr: &p.RateLimitedTxBytes, readOnly: true},
+		{key: "rate_limited_rx_bytes", ptr: &p.RateLimitedRxBytes, readOnly: true},
+		{key: "psk_rotations", ptr: &p.PSKRotations, readOnly: true},
+	}
+}
+
+// format returns the UAPI value of the field, and false if the field is
+// unset and has to be left out.
+func (f ipcJSONField) format() (string, bool) {
+	switch ptr := f.ptr.(type) {
+	case *string:
+		return *ptr, *ptr != ""
+	case **string:
+		if *ptr == nil {
+			return "", false
+		}
+		return **ptr, true
+	case *bool:
+		// Flags such as replace_peers only accept "true".
+		return "true", *ptr
+	case **bool:
+		if *ptr == nil {
+			return "", false
+		}
+		return strconv.FormatBool(**ptr), true
+	case *int:
+		return strconv.Itoa(*ptr), *ptr != 0
+	case **int64:
+		if *ptr == nil {
+			return "", false
+		}
+		return strconv.FormatInt(**ptr, 10), true
+	case **uint16:
+		if *ptr == nil {
+			return "", false
+		}
+		return strconv.FormatUint(uint64(**ptr), 10), true
+	case **uint32:
+		if *ptr == nil {
+			return "", false
+		}
+		return strconv.FormatUint(uint64(**ptr), 10), true
+	default:
+		panic(fmt.Sprintf("unsupported field type %T", f.ptr))
+	}
+}
+
+// UAPI renders the configuration as the body of a text "set" operation.
+func (d *IpcJSONDevice) UAPI() (string, error) {
+	var b strings.Builder
+	var err error
+	sendf := func(key, value string) {
+		if err == nil && strings.ContainsAny(value, "\r\n") {
+			err = fmt.Errorf("invalid %s: value contains a line break", key)
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	send := func(fields []ipcJSONField) {
+		for _, field := range fields {
+			if field.readOnly {
+				continue
+			}
+			if value, ok := field.format(); ok {
+				sendf(field.key, value)
+			}
+		}
+	}
+
+	send(d.fields())
+	for i := range d.Peers {
+		peer := &d.Peers[i]
+		if peer.PublicKey == "" {
+			return "", errors.New("peer without public_key")
+		}
+		sendf("public_key", peer.PublicKey)
+		send(peer.fields())
+		for _, prefix := range peer.AllowedIPs {
+			sendf("allowed_ip", prefix)
+		}
+		for _, prefix := range peer.RoamingAllowedPrefixes {
+			sendf("roaming_allowed_prefix", prefix)
+		}
+		for _, filter := range peer.Filters {
+			sendf("filter", filter.Rule)
+		}
+	}
+	return b.String(), err
+}
+
+// set stores a value of the device, as passed to ipcGetWriter.line, in
+// the field.
+func (f ipcJSONField) set(value any) error {
+	switch v := value.(type) {
+	case *[32]byte:
+		value = hex.EncodeToString(v[:])
+	case fmt.Stringer:
+		value = v.String()
+	}
+	dst := reflect.ValueOf(f.ptr).Elem()
+	if dst.Kind() == reflect.Pointer {
+		dst.Set(reflect.New(dst.Type().Elem()))
+		dst = dst.Elem()
+	}
+	src := reflect.ValueOf(value)
+	if (src.Kind() == reflect.String) != (dst.Kind() == reflect.String) || !src.CanConvert(dst.Type()) {
+		return fmt.Errorf("cannot store %T in %s", value, dst.Type())
+	}
+	dst.Set(src.Convert(dst.Type()))
+	return nil
+}
+
+func setJSONField(fields []ipcJSONField, key string, value any) error {
+	for _, field := range fields {
+		if field.key == key {
+			return field.set(value)
+		}
+	}
+	return fmt.Errorf("unknown key %q", key)
+}
+
+// ipcJSONWriter builds the JSON encoding of a "get" operation.
+type ipcJSONWriter struct {
+	d    IpcJSONDevice
+	peer *IpcJSONPeer
+	err  error
+}
+
+func (j *ipcJSONWriter) line(key string, value any) {
+	if j.err != nil {
+		return
+	}
+	d, peer := &j.d, j.peer
+	var err error
+	switch v := value.(type) {
+	case RemovedPeer:
+		d.RemovedPeers = append(d.RemovedPeers, IpcJSONRemovedPeer{
+			PublicKey: hex.EncodeToString(v.PublicKey[:]),
+			Reason:    v.Reason,
+			Time:      v.Time.Unix(),
+		})
+	case StackCounter:
+		if d.StackStats == nil {
+			d.StackStats = make(map[string]uint64)
+		}
+		d.StackStats[v.Name] = v.Value
+	case StackConnection:
+		d.StackConnections = append(d.StackConnections, IpcJSONStackConnection{
+			Network: v.Network,
+			Local:   v.Local.String(),
+			Remote:  v.Remote.String(),
+			State:   v.State,
+			TxBytes: v.TxBytes,
+			RxBytes: v.RxBytes,
+		})
+	default:
+		switch {
+		case key == "public_key":
+			d.Peers = append(d.Peers, IpcJSONPeer{})
+			j.peer = &d.Peers[len(d.Peers)-1]
+			err = setJSONField([]ipcJSONField{{key: key, ptr: &j.peer.PublicKey}}, key, value)
+		case peer == nil:
+			err = setJSONField(d.fields(), key, value)
+		case key == "allowed_ip":
+			peer.AllowedIPs = append(peer.AllowedIPs, fmt.Sprint(value))
+		case key == "roaming_allowed_prefix":
+			peer.RoamingAllowedPrefixes = append(peer.RoamingAllowedPrefixes, fmt.Sprint(value))
+		case key == "filter":
+			peer.Filters = append(peer.Filters, IpcJSONFilter{Rule: fmt.Sprint(value)})
+		case key == "filter_hits" && len(peer.Filters) > 0:
+			peer.Filters[len(peer.Filters)-1].Hits = value.(uint64)
+		default:
+			err = setJSONField(peer.fields(), key, value)
+		}
+	}
+	if err != nil {
+		j.err = fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+}
+
+func (j *ipcJSONWriter) flush() error {
+	return nil
+}
+
+// IpcGetJSON returns the device configuration and peer statistics in
+// their JSON form.
+func (device *Device) IpcGetJSON() (*IpcJSONDevice, error) {
+	device.ipcMutex.RLock()
+	defer device.ipcMutex.RUnlock()
+
+	var j ipcJSONWriter
+	if err := device.ipcGet(&j, true); err != nil {
+		return nil, err
+	}
+	if j.err != nil {
+		return nil, ipcErrorf(ipc.IpcErrorUnknown, "failed to encode configuration: %w", j.err)
+	}
+	return &j.d, nil
+}
+
+// IpcSetJSON applies a configuration in its JSON form, with the same
+// semantics as IpcSet.
+func (device *Device) IpcSetJSON(d *IpcJSONDevice) error {
+	uapiConf, err := d.UAPI()
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "failed to decode configuration: %w", err)
+	}
+	return device.IpcSet(uapiConf)
+}
+
+// ipcHandleJSON serves a "get=json" or "set=json" operation. Requests and
+// replies are single JSON documents, each followed by a newline.
+func (device *Device) ipcHandleJSON(buffered *bufio.ReadWriter, op string) {
+	var resp IpcJSONResponse
+	var err error
+	switch op {
+	case "get":
+		var nextByte byte
+		nextByte, err = buffered.ReadByte()
+		if err != nil {
+			return
+		}
+		if nextByte != '\n' {
+			err = ipcErrorf(
+				ipc.IpcErrorInvalid,
+				"trailing character in UAPI get: %q",
+				nextByte,
+			)
+			break
+		}
+		resp.Device, err = device.IpcGetJSON()
+	case "set":
+		var d IpcJSONDevice
+		decoder := json.NewDecoder(buffered.Reader)
+		err = decoder.Decode(&d)
+		// Skip the newline that terminates the document and give back
+		// whatever the decoder read past it.
+		rest, _ := io.ReadAll(decoder.Buffered())
+		if len(rest) == 0 {
+			if next, peekErr := buffered.Peek(1); peekErr == nil && next[0] == '\n' {
+				buffered.Discard(1)
+			}
+		} else if rest = bytes.TrimPrefix(rest, []byte{'\n'}); len(rest) > 0 {
+			buffered.Reader = bufio.NewReader(io.MultiReader(bytes.NewReader(rest), buffered.Reader))
+		}
+		if err != nil {
+			err = ipcErrorf(ipc.IpcErrorProtocol, "failed to parse JSON: %w", err)
+		} else {
+			err = device.IpcSetJSON(&d)
+		}
+	}
+
+	if err != nil {
+		var status *IPCError
+		if !errors.As(err, &status) {
+			// shouldn't happen
+			status = ipcErrorf(ipc.IpcErrorUnknown, "other UAPI error: %w", err)
+		}
+		device.log.Errorf("%v", status)
+		resp = IpcJSONResponse{Errno: status.ErrorCode(), Error: status.err.Error()}
+	}
+	json.NewEncoder(buffered).Encode(&resp)
+	buffered.Flush()
+}
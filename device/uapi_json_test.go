@@ -0,0 +1,202 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/ipc"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+)
+
+func TestIpcJSON(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	sk, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerSK, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPK := peerSK.PublicKey()
+	publicKey := hex.EncodeToString(peerPK[:])
+
+	jc, s1 := uint32(4), uint32(20)
+	trailers := true
+	i1 := "<r 10>"
+	err = dev.IpcSetJSON(&IpcJSONDevice{
+		PrivateKey:     hex.EncodeToString(sk[:]),
+		ReplacePeers:   true,
+		Jc:             &jc,
+		S1:             &s1,
+		H1:             "100-200",
+		I1:             &i1,
+		RandomTrailers: &trailers,
+		Peers: []IpcJSONPeer{{
+			PublicKey:                   publicKey,
+			ProtocolVersion:             1,
+			PersistentKeepaliveInterval: "25",
+			AllowedIPs:                  []string{"10.0.0.2/32", "10.0.1.0/24"},
+			TxBytes:                     1234,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := dev.IpcGetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Jc == nil || *d.Jc != jc || d.S1 == nil || *d.S1 != s1 || d.H1 != "100-200" ||
+		d.I1 == nil || *d.I1 != i1 || d.RandomTrailers == nil || !*d.RandomTrailers ||
+		d.DisableCookies == nil || *d.DisableCookies {
+		t.Errorf("wrong device: %+v", d)
+	}
+	if len(d.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(d.Peers))
+	}
+	peer := d.Peers[0]
+	if peer.PublicKey != publicKey || peer.ProtocolVersion != 1 || peer.PersistentKeepaliveInterval != "25" ||
+		len(peer.AllowedIPs) != 2 || peer.TxBytes != 0 {
+		t.Errorf("wrong peer: %+v", peer)
+	}
+
+	// The output of get can be sent back unchanged.
+	if err := dev.IpcSetJSON(d); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := "10.0.0.3/32\npublic_key=" + publicKey
+	err = dev.IpcSetJSON(&IpcJSONDevice{Peers: []IpcJSONPeer{{PublicKey: publicKey, AllowedIPs: []string{bad}}}})
+	if err == nil {
+		t.Error("expected error for value containing a line break")
+	}
+}
+
+func TestIpcJSONMatchesText(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelError, ""))
+	defer dev.Close()
+
+	peerSK, err := NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerPK := peerSK.PublicKey()
+	publicKey := hex.EncodeToString(peerPK[:])
+	err = dev.IpcSet(uapiCfg(
+		"peer_forwarding", "true",
+		"idle_peer_timeout", "600",
+		"public_key", publicKey,
+		"allowed_ip", "10.0.0.2/32",
+		"roaming", "restricted",
+		"roaming_allowed_prefix", "198.51.100.0/24",
+		"psk_rotation_interval", "3600",
+		"rate_limit_tx", "1000/2000",
+		"rate_limit_max_delay", "250",
+		"rate_limit_policy", "delay",
+		"filter", "allow dir=in",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := dev.IpcGetJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.PeerForwarding == nil || !*d.PeerForwarding || d.IdlePeerTimeout == nil || *d.IdlePeerTimeout != 600 {
+		t.Errorf("wrong device: %+v", d)
+	}
+	if len(d.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(d.Peers))
+	}
+	peer := d.Peers[0]
+	if peer.Roaming != "restricted" || len(peer.RoamingAllowedPrefixes) != 1 || peer.RoamingAllowedPrefixes[0] != "198.51.100.0/24" ||
+		peer.PSKRotationInterval == nil || *peer.PSKRotationInterval != 3600 ||
+		peer.RateLimitPolicy != "delay" || peer.RateLimitMaxDelay == nil || *peer.RateLimitMaxDelay != 250 ||
+		len(peer.Filters) != 1 || peer.Filters[0].Rule != "allow dir=in" {
+		t.Errorf("wrong peer: %+v", peer)
+	}
+	if line := "rate_limit_tx=" + peer.RateLimitTx + "\n"; peer.RateLimitTx == "" || !strings.Contains(state, line) {
+		t.Errorf("rate_limit_tx %q does not match:\n%s", peer.RateLimitTx, state)
+	}
+}
+
+func TestIpcHandleJSON(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	dev := NewDevice(tuntest.NewChannelTUN().TUN(), binds[0], NewLogger(LogLevelSilent, ""))
+	defer dev.Close()
+
+	client, server := net.Pipe()
+	go dev.IpcHandle(server)
+	defer client.Close()
+	reader := bufio.NewReader(client)
+
+	roundTrip := func(request string) IpcJSONResponse {
+		t.Helper()
+		go client.Write([]byte(request))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp IpcJSONResponse
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("invalid response %q: %v", line, err)
+		}
+		return resp
+	}
+
+	resp := roundTrip("set=json\n{\"jc\": 5, \"h2\": \"1000-2000\"}\n")
+	if resp.Errno != 0 || resp.Error != "" {
+		t.Fatalf("set failed: %+v", resp)
+	}
+
+	resp = roundTrip("set=json\n{\"jc\": \"five\"}\n")
+	if resp.Errno != ipc.IpcErrorProtocol || resp.Error == "" {
+		t.Errorf("expected protocol error, got %+v", resp)
+	}
+
+	resp = roundTrip("set=json\n{\"h1\": \"3000-1000\"}\n")
+	if resp.Errno != ipc.IpcErrorInvalid || !strings.Contains(resp.Error, "H1") {
+		t.Errorf("expected invalid argument error, got %+v", resp)
+	}
+
+	resp = roundTrip("get=json\n\n")
+	if resp.Errno != 0 || resp.Device == nil {
+		t.Fatalf("get failed: %+v", resp)
+	}
+	if resp.Device.Jc == nil || *resp.Device.Jc != 5 || resp.Device.H2 != "1000-2000" {
+		t.Errorf("wrong device: %+v", resp.Device)
+	}
+
+	// The text protocol still works on the same connection.
+	go client.Write([]byte("get=1\n\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "errno=0\n" {
+			break
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package dnsforward
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// A cache keeps answers until the lowest TTL of their records expires, and
+// answers without records as long as the SOA record of the zone says, as
+// in RFC 2308.
+type cache struct {
+	sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+func (c *cache) put(key cacheKey, reply []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	ttl, ok := cacheTTL(&msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[cacheKey]*cacheEntry)
+	}
+	now := time.Now()
+	if len(c.entries) >= maxCacheEntries {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = &cacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// get returns the cached answer for key with the given ID, and with the
+// time it spent in the cache taken off its TTLs.
+func (c *cache) get(key cacheKey, id uint16) ([]byte, bool) {
+	c.Lock()
+	entry, ok := c.entries[key]
+	now := time.Now()
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	msg := entry.msg
+	msg.ID = id
+	msg.Answers = aged(msg.Answers, age)
+	msg.Authorities = aged(msg.Authorities, age)
+	msg.Additionals = aged(msg.Additionals, age)
+	reply, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return reply, true
+}
+
+// aged returns a copy of records with age taken off their TTLs.
+func aged(records []dnsmessage.Resource, age uint32) []dnsmessage.Resource {
+	if len(records) == 0 {
+		return nil
+	}
+	out := make([]dnsmessage.Resource, len(records))
+	for i, rr := range records {
+		if rr.Header.Type != dnsmessage.TypeOPT {
+			rr.Header.TTL -= min(age, rr.Header.TTL)
+		}
+		out[i] = rr
+	}
+	return out
+}
+
+// cacheTTL returns how long msg may be cached.
+func cacheTTL(msg *dnsmessage.Message) (uint32, bool) {
+	if len(msg.Answers) == 0 {
+		for _, rr := range msg.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				return min(rr.Header.TTL, soa.MinTTL), true
+			}
+		}
+		return 0, false
+	}
+	ttl, ok := uint32(0), false
+	for _, records := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range records {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header.TTL < ttl {
+				ttl, ok = rr.Header.TTL, true
+			}
+		}
+	}
+	return ttl, ok
+}
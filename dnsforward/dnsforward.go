@@ -0,0 +1,388 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package dnsforward implements a DNS server for the host, which forwards
+// queries to the DNS servers of a tunnel, and optionally the queries for
+// names outside of some domains to other servers.
+package dnsforward
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	queryTimeout    = 5 * time.Second
+	tcpIdleTimeout  = 10 * time.Second
+	maxMessageSize  = 65535
+	minUDPSize      = 512
+	maxCacheEntries = 4096
+	maxUDPQueries   = 256 // queries answered at a time on each packet conn
+)
+
+// A Dialer connects to DNS servers. *net.Dialer and *netstack.Net are
+// Dialers.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Config selects where a Server forwards queries.
+type Config struct {
+	// Tunnel reaches Servers: the *netstack.Net of a tunnel, or a
+	// *net.Dialer if the routes of its TUN device lead to them.
+	Tunnel  Dialer
+	Servers []netip.AddrPort
+
+	// Domains, if not empty, limit the queries sent through the tunnel
+	// to names within them. Other queries go to the Direct servers,
+	// through the host network.
+	Domains []string
+	Direct  []netip.AddrPort
+}
+
+// A Server answers DNS queries over UDP and TCP, from its cache or from
+// the servers it forwards them to.
+type Server struct {
+	tunnel  upstream
+	direct  upstream
+	domains []string
+	log     *device.Logger
+	cache   cache
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[io.Closer]struct{}
+}
+
+// An upstream is a list of servers tried in order, and how to reach them.
+type upstream struct {
+	dialer  Dialer
+	servers []netip.AddrPort
+}
+
+// New returns a server forwarding queries as config says. logger may be
+// nil.
+func New(config Config, logger *device.Logger) (*Server, error) {
+	if logger == nil {
+		logger = device.NewLogger(device.LogLevelSilent, "")
+	}
+	if config.Tunnel == nil || len(config.Servers) == 0 {
+		return nil, errors.New("no tunnel DNS servers")
+	}
+	if len(config.Domains) > 0 && len(config.Direct) == 0 {
+		return nil, errors.New("split DNS requires direct DNS servers")
+	}
+	s := &Server{
+		tunnel: upstream{config.Tunnel, config.Servers},
+		direct: upstream{&net.Dialer{}, config.Direct},
+		log:    logger,
+		conns:  make(map[io.Closer]struct{}),
+	}
+	for _, domain := range config.Domains {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, err := dnsmessage.NewName(domain + "."); err != nil || domain == "" {
+			return nil, fmt.Errorf("invalid domain %q", domain)
+		}
+		s.domains = append(s.domains, domain)
+	}
+	return s, nil
+}
+
+// Serve answers queries from TCP clients accepted on l, until it fails or
+// the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	if !s.track(l) {
+		return net.ErrClosed
+	}
+	defer s.untrack(l)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if !s.track(c) {
+			return net.ErrClosed
+		}
+		go func() {
+			defer s.untrack(c)
+			s.serveConn(c)
+		}()
+	}
+}
+
+// ServePacket answers the queries received on pc, until it fails or the
+// server is closed. Queries beyond maxUDPQueries waiting for an answer are
+// dropped, for the clients to retry.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	if !s.track(pc) {
+		return net.ErrClosed
+	}
+	defer s.untrack(pc)
+	queries := make(chan struct{}, maxUDPQueries)
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		select {
+		case queries <- struct{}{}:
+		default:
+			continue
+		}
+		query := bytes.Clone(buf[:n])
+		go func() {
+			defer func() { <-queries }()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*queryTimeout)
+			defer cancel()
+			if reply := s.answer(ctx, query, true); reply != nil {
+				pc.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// Close stops serving, and closes all listeners and connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// track registers c to be closed with the server, or closes it right away
+// if the server is closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	for {
+		c.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*queryTimeout)
+		reply := s.answer(ctx, query, false)
+		cancel()
+		if reply == nil {
+			return
+		}
+		c.SetWriteDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := c.Write(appendMessage(nil, reply)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the reply to query, or nil if query is not one. Replies
+// over UDP are truncated to the size the client accepts.
+func (s *Server) answer(ctx context.Context, query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || msg.Response {
+		return nil
+	}
+	if msg.OpCode != 0 || len(msg.Questions) != 1 {
+		return errorReply(msg, dnsmessage.RCodeNotImplemented)
+	}
+	q := msg.Questions[0]
+	key := cacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+
+	reply, ok := s.cache.get(key, msg.ID)
+	if !ok {
+		up := s.upstreamFor(key.name)
+		var err error
+		reply, err = up.exchange(ctx, query, msg.ID)
+		if err != nil {
+			s.log.Verbosef("DNS forwarder: %s %v: %v", q.Name, q.Type, err)
+			return errorReply(msg, dnsmessage.RCodeServerFailure)
+		}
+		s.cache.put(key, reply)
+	}
+
+	if udp {
+		size := minUDPSize
+		for _, rr := range msg.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT && int(rr.Header.Class) > size {
+				size = int(rr.Header.Class)
+			}
+		}
+		if len(reply) > size {
+			reply = truncate(reply)
+		}
+	}
+	return reply
+}
+
+// upstreamFor returns the servers to forward queries for name, given in
+// lower case with a trailing dot.
+func (s *Server) upstreamFor(name string) *upstream {
+	if len(s.domains) == 0 {
+		return &s.tunnel
+	}
+	name = strings.TrimSuffix(name, ".")
+	for _, domain := range s.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return &s.tunnel
+		}
+	}
+	return &s.direct
+}
+
+// exchange sends query to the servers in order, and returns the first
+// answer that is not a server failure. Queries go over UDP, and over TCP
+// if the answer is truncated.
+func (up *upstream) exchange(ctx context.Context, query []byte, id uint16) ([]byte, error) {
+	var reply []byte
+	var lastErr error
+	for _, server := range up.servers {
+		r, err := up.exchangeWith(ctx, server, query, id)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply = r
+		if rcode := dnsmessage.RCode(r[3] & 0xf); rcode != dnsmessage.RCodeServerFailure && rcode != dnsmessage.RCodeRefused {
+			break
+		}
+	}
+	if reply == nil {
+		return nil, lastErr
+	}
+	return reply, nil
+}
+
+func (up *upstream) exchangeWith(ctx context.Context, server netip.AddrPort, query []byte, id uint16) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	c, err := up.dialer.DialContext(ctx, "udp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(deadline)
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams and answers to other queries.
+		if n < 12 || binary.BigEndian.Uint16(buf) != id || buf[2]&0x80 == 0 {
+			continue
+		}
+		if buf[2]&0x02 == 0 {
+			return buf[:n], nil
+		}
+		break
+	}
+
+	// The answer is truncated.
+	tc, err := up.dialer.DialContext(ctx, "tcp", server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	tc.SetDeadline(deadline)
+	if _, err := tc.Write(appendMessage(nil, query)); err != nil {
+		return nil, err
+	}
+	reply, err := readMessage(tc)
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 12 || binary.BigEndian.Uint16(reply) != id {
+		return nil, errors.New("invalid DNS response")
+	}
+	return reply, nil
+}
+
+// readMessage reads a message with a length prefix, as sent over TCP.
+func readMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func appendMessage(b, msg []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(msg)))
+	return append(b, msg...)
+}
+
+// errorReply returns a reply to query without records.
+func errorReply(query dnsmessage.Message, rcode dnsmessage.RCode) []byte {
+	reply := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               query.ID,
+			Response:         true,
+			OpCode:           query.OpCode,
+			RecursionDesired: query.RecursionDesired,
+			RCode:            rcode,
+		},
+		Questions: query.Questions,
+	}
+	b, err := reply.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// truncate returns reply without records and with the truncated bit set,
+// so that the client retries over TCP.
+func truncate(reply []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		return nil
+	}
+	msg.Truncated = true
+	msg.Answers, msg.Authorities, msg.Additionals = nil, nil, nil
+	b, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return b
+}
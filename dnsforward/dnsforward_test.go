@@ -0,0 +1,176 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package dnsforward
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveDirect runs a DNS server on the host for hosts, and returns its
+// address and the number of queries it has answered.
+func serveDirect(t *testing.T, hosts map[string][]netip.Addr) (netip.AddrPort, *atomic.Int32) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			pc.WriteTo(netstacktest.AnswerDNS(buf[:n], hosts), from)
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).AddrPort(), &queries
+}
+
+// startServer runs a forwarder on the host, with the tunnel's DNS server
+// knowing names in corp.test and a direct server knowing others, and
+// returns a resolver using the forwarder over network.
+func startServer(t *testing.T, network string) (*net.Resolver, *atomic.Int32) {
+	nets := netstacktest.NewPair(t)
+	netstacktest.ServeDNS(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 53), map[string][]netip.Addr{
+		"web.corp.test.":   {netip.MustParseAddr("10.0.1.1")},
+		"www.public.test.": {netip.MustParseAddr("10.0.1.2")},
+	})
+	direct, queries := serveDirect(t, map[string][]netip.Addr{
+		"www.public.test.": {netip.MustParseAddr("192.0.2.1")},
+	})
+	s, err := New(Config{
+		Tunnel:  nets[0],
+		Servers: []netip.AddrPort{netip.AddrPortFrom(netstacktest.Addrs[1], 53)},
+		Domains: []string{"Corp.Test."},
+		Direct:  []netip.AddrPort{direct},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	var addr string
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.ServePacket(pc)
+		addr = pc.LocalAddr().String()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(l)
+		addr = l.Addr().String()
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}, queries
+}
+
+func TestForward(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			resolver, queries := startServer(t, network)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			for host, want := range map[string]string{
+				"web.corp.test":   "10.0.1.1",  // through the tunnel
+				"www.public.test": "192.0.2.1", // direct
+			} {
+				addrs, err := resolver.LookupNetIP(ctx, "ip4", host)
+				if err != nil || len(addrs) != 1 || addrs[0].String() != want {
+					t.Errorf("%s: %v, %v, want %s", host, addrs, err, want)
+				}
+			}
+			if _, err := resolver.LookupNetIP(ctx, "ip4", "missing.corp.test"); err == nil {
+				t.Error("resolved an unknown name")
+			}
+
+			// The second lookup is answered from the cache.
+			n := queries.Load()
+			if _, err := resolver.LookupNetIP(ctx, "ip4", "www.public.test"); err != nil {
+				t.Fatal(err)
+			}
+			if queries.Load() != n {
+				t.Error("cached answer was not used")
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	name := dnsmessage.MustNewName("a.test.")
+	q := dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	key := cacheKey{"a.test.", dnsmessage.TypeA, dnsmessage.ClassINET}
+	pack := func(msg dnsmessage.Message) []byte {
+		b, err := msg.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	var c cache
+	c.put(key, pack(dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1, Response: true},
+		Questions: []dnsmessage.Question{q},
+		Answers: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300}, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}},
+			{Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60}, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}},
+		},
+	}))
+	c.entries[key].stored = c.entries[key].stored.Add(-10 * time.Second)
+	reply, ok := c.get(key, 2)
+	if !ok {
+		t.Fatal("answer was not cached")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 2 || len(msg.Answers) != 2 || msg.Answers[0].Header.TTL != 290 || msg.Answers[1].Header.TTL != 50 {
+		t.Errorf("got ID %d, answers %v", msg.ID, msg.Answers)
+	}
+	if ttl := time.Until(c.entries[key].expires); ttl > 60*time.Second || ttl < 50*time.Second {
+		t.Errorf("expires in %v, want the lowest TTL", ttl)
+	}
+
+	// Negative answers are kept as long as the SOA record allows.
+	c.put(key, pack(dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Questions: []dnsmessage.Question{q},
+		Authorities: []dnsmessage.Resource{
+			{Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600}, Body: &dnsmessage.SOAResource{NS: name, MBox: name, MinTTL: 30}},
+		},
+	}))
+	if ttl := time.Until(c.entries[key].expires); ttl > 30*time.Second || ttl < 25*time.Second {
+		t.Errorf("negative answer expires in %v, want the SOA minimum", ttl)
+	}
+
+	// Failures are not cached.
+	other := cacheKey{"b.test.", dnsmessage.TypeA, dnsmessage.ClassINET}
+	c.put(other, pack(dnsmessage.Message{Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}, Questions: []dnsmessage.Question{q}}))
+	if _, ok := c.get(other, 1); ok {
+		t.Error("cached a server failure")
+	}
+}
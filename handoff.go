@@ -0,0 +1,291 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/ipc"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"golang.org/x/sys/unix"
+)
+
+/* Daemon handoff
+ *
+ * A new daemon started with --handoff takes the tunnel over from the one
+ * running the interface, without dropping its sessions. It connects to the
+ * handoff socket of the running daemon, which detaches its device and
+ * writes the length of the JSON-encoded session state, carrying the TUN
+ * device, the UAPI listener and the UDP sockets as SCM_RIGHTS, followed by
+ * the state itself. The new daemon acknowledges them with a single byte,
+ * after which the running daemon exits. Without the acknowledgement, the
+ * running daemon brings its device back up and goes on.
+ */
+
+const (
+	handoffTimeout  = 10 * time.Second
+	maxHandoffFiles = 8
+	maxHandoffState = 64 << 20
+	handoffAck      = 1
+)
+
+// A handoff is the tunnel taken over from a running daemon.
+type handoff struct {
+	tun     *os.File
+	uapi    *os.File
+	sockets []*os.File
+	state   device.SessionState
+}
+
+// receiveHandoff takes the tunnel over from the daemon running
+// interfaceName.
+func receiveHandoff(interfaceName string) (*handoff, error) {
+	c, err := ipc.HandoffDial(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(handoffTimeout))
+
+	var header [4]byte
+	oob := make([]byte, unix.CmsgSpace(maxHandoffFiles*4))
+	n, oobn, _, _, err := c.ReadMsgUnix(header[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := func() (*handoff, error) {
+		if len(files) < 3 {
+			return nil, errors.New("handoff without TUN device, UAPI listener and UDP sockets")
+		}
+		if _, err := io.ReadFull(c, header[n:]); err != nil {
+			return nil, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxHandoffState {
+			return nil, fmt.Errorf("session state too large: %d bytes", size)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(c, body); err != nil {
+			return nil, err
+		}
+		h := &handoff{tun: files[0], uapi: files[1], sockets: files[2:]}
+		err := json.Unmarshal(body, &h.state)
+		clear(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode session state: %w", err)
+		}
+		if _, err := c.Write([]byte{handoffAck}); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}()
+	if err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	return h, err
+}
+
+// adoptSockets has bind use the UDP sockets of the handoff, which must
+// happen before it is opened.
+func (h *handoff) adoptSockets(bind conn.Bind) error {
+	handoff, ok := bind.(conn.SocketHandoff)
+	if !ok {
+		return errors.New("bind cannot adopt sockets")
+	}
+	return handoff.AdoptSocketFiles(h.sockets)
+}
+
+// resume configures dev like the device it replaces, and takes over its
+// sessions.
+func (h *handoff) resume(dev *device.Device) error {
+	defer h.state.Zero()
+	if err := dev.IpcSetJSON(h.state.Config); err != nil {
+		return err
+	}
+	return dev.ResumeSessions(&h.state)
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for i := range msgs {
+		fds, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			unix.SetNonblock(fd, true)
+			files = append(files, os.NewFile(uintptr(fd), "handoff"))
+		}
+	}
+	return files, nil
+}
+
+// A handoffServer hands the tunnel of this daemon over to a successor.
+type handoffServer struct {
+	listener *net.UnixListener
+	conns    chan *net.UnixConn
+	bind     conn.Bind
+	tun      tun.Device
+	uapi     *os.File
+}
+
+func listenHandoff(interfaceName string, bind conn.Bind, tdev tun.Device, fileUAPI *os.File) (*handoffServer, error) {
+	listener, err := ipc.HandoffListen(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	s := &handoffServer{
+		listener: listener,
+		conns:    make(chan *net.UnixConn),
+		bind:     bind,
+		tun:      tdev,
+		uapi:     fileUAPI,
+	}
+	go func() {
+		for {
+			c, err := listener.AcceptUnix()
+			if err != nil {
+				return
+			}
+			s.conns <- c
+		}
+	}()
+	return s, nil
+}
+
+func (s *handoffServer) Close() error {
+	return s.listener.Close()
+}
+
+// handOver detaches dev and passes its tunnel to the successor on c. If
+// the successor does not acknowledge it, dev is brought back up on the
+// same sockets, with new sessions, and the handoff socket stays open.
+func (s *handoffServer) handOver(c *net.UnixConn, dev *device.Device) error {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(handoffTimeout))
+
+	handoff, ok := s.bind.(conn.SocketHandoff)
+	if !ok {
+		return errors.New("bind cannot hand sockets over")
+	}
+	sockets, err := handoff.SocketFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range sockets {
+			file.Close()
+		}
+	}()
+	tunFile, err := dupFile(s.tun.File())
+	if err != nil {
+		return err
+	}
+	defer tunFile.Close()
+
+	state, err := dev.Detach()
+	if err != nil {
+		return err
+	}
+	defer state.Zero()
+	if err := s.send(c, state, append([]*os.File{tunFile, s.uapi}, sockets...)); err != nil {
+		// The sockets are still bound, here and maybe in the successor, so
+		// the device takes them back rather than binding its port again.
+		if errAdopt := handoff.AdoptSocketFiles(sockets); errAdopt == nil {
+			sockets = nil
+		}
+		if errUp := dev.Up(); errUp != nil {
+			return fmt.Errorf("%w, and failed to bring the device back up: %v", err, errUp)
+		}
+		return err
+	}
+
+	// The successor listens on the handoff socket once it took over, so
+	// closing ours must not remove it.
+	s.listener.SetUnlinkOnClose(false)
+	s.listener.Close()
+	return nil
+}
+
+// send writes state and files to the successor on c, and waits for it to
+// acknowledge them.
+func (s *handoffServer) send(c *net.UnixConn, state *device.SessionState, files []*os.File) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	defer clear(body)
+
+	var fds []int
+	for _, file := range files {
+		rc, err := file.SyscallConn()
+		if err != nil {
+			return err
+		}
+		// Taking the descriptor through Fd would put it into blocking mode.
+		rc.Control(func(fd uintptr) {
+			fds = append(fds, int(fd))
+		})
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(body)))
+	if _, _, err := c.WriteMsgUnix(header[:], unix.UnixRights(fds...), nil); err != nil {
+		return err
+	}
+	if _, err := c.Write(body); err != nil {
+		return err
+	}
+	var ack [1]byte
+	if _, err := io.ReadFull(c, ack[:]); err != nil {
+		return fmt.Errorf("no acknowledgement from successor: %w", err)
+	}
+	if ack[0] != handoffAck {
+		return fmt.Errorf("unexpected acknowledgement %d from successor", ack[0])
+	}
+	return nil
+}
+
+// dupFile duplicates the descriptor of file without changing its mode.
+func dupFile(file *os.File) (*os.File, error) {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dup int
+	var dupErr error
+	err = rc.Control(func(fd uintptr) {
+		dup, dupErr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dup), file.Name()), nil
+}
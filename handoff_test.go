@@ -0,0 +1,117 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/tuntest"
+	"golang.org/x/sys/unix"
+)
+
+// fileTUN is a TUN device with a file to hand over.
+type fileTUN struct {
+	tun.Device
+	file *os.File
+}
+
+func (t fileTUN) File() *os.File { return t.file }
+
+func listenPort(t *testing.T, dev *device.Device) string {
+	t.Helper()
+	config, err := dev.IpcGet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line := range strings.SplitSeq(config, "\n") {
+		if port, ok := strings.CutPrefix(line, "listen_port="); ok {
+			return port
+		}
+	}
+	t.Fatal("no listen port")
+	return ""
+}
+
+func TestHandOverRollback(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	bind := conn.NewDefaultBind()
+	tdev := fileTUN{Device: tuntest.NewChannelTUN().TUN(), file: r}
+	dev := device.NewDevice(tdev, bind, device.NewLogger(device.LogLevelError, ""))
+	defer dev.Close()
+	dev.KeepSessionKeys(true)
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	port := listenPort(t, dev)
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "handoff")
+		c, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	defer conns[1].Close()
+
+	// The successor takes the files, but never acknowledges them, and
+	// holds on to the sockets until the handoff failed.
+	received := make(chan []*os.File, 1)
+	go func() {
+		var header [4]byte
+		oob := make([]byte, unix.CmsgSpace(maxHandoffFiles*4))
+		_, oobn, _, _, err := conns[1].ReadMsgUnix(header[:], oob)
+		if err != nil {
+			received <- nil
+			return
+		}
+		files, _ := parseRights(oob[:oobn])
+		conns[1].CloseWrite()
+		received <- files
+	}()
+	s := &handoffServer{bind: bind, tun: tdev, uapi: w}
+	if err := s.handOver(conns[0], dev); err == nil {
+		t.Fatal("handed over without acknowledgement")
+	} else if strings.Contains(err.Error(), "back up") {
+		t.Fatal(err)
+	}
+	for _, file := range <-received {
+		file.Close()
+	}
+
+	if got := listenPort(t, dev); got != port {
+		t.Errorf("listening on port %s after rollback, want %s", got, port)
+	}
+	// The device still owns the sockets, and binds its port again.
+	if err := dev.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if got := listenPort(t, dev); got != port {
+		t.Errorf("listening on port %s after a restart, want %s", got, port)
+	}
+}
@@ -32,6 +32,51 @@ func sockPath(iface string) string {
 	return fmt.Sprintf("%s/%s.sock", socketDirectory, iface)
 }
 
+func handoffPath(iface string) string {
+	return fmt.Sprintf("%s/%s.handoff", socketDirectory, iface)
+}
+
+// HandoffListen listens on the socket over which the daemon for the
+// interface name hands its tunnel over to a successor.
+func HandoffListen(name string) (*net.UnixListener, error) {
+	if err := os.MkdirAll(socketDirectory, 0o755); err != nil {
+		return nil, err
+	}
+
+	socketPath := handoffPath(name)
+	addr, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	oldUmask := unix.Umask(0o077)
+	defer unix.Umask(oldUmask)
+
+	listener, err := net.ListenUnix("unix", addr)
+	if err == nil {
+		return listener, nil
+	}
+
+	// Test socket, if not in use cleanup and try again.
+	if _, err := net.Dial("unix", socketPath); err == nil {
+		return nil, errors.New("unix socket in use")
+	}
+	if err := os.Remove(socketPath); err != nil {
+		return nil, err
+	}
+	return net.ListenUnix("unix", addr)
+}
+
+// HandoffDial connects to the handoff socket of the daemon running the
+// interface name.
+func HandoffDial(name string) (*net.UnixConn, error) {
+	addr, err := net.ResolveUnixAddr("unix", handoffPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUnix("unix", nil, addr)
+}
+
 func UAPIOpen(name string) (*os.File, error) {
 	if err := os.MkdirAll(socketDirectory, 0o755); err != nil {
 		return nil, err
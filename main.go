@@ -9,15 +9,25 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/amnezia-vpn/amneziawg-go/v3/conf"
 	"github.com/amnezia-vpn/amneziawg-go/v3/conn"
 	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/dnsforward"
 	"github.com/amnezia-vpn/amneziawg-go/v3/ipc"
 	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/httpproxy"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/portforward"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/socks5"
 	"golang.org/x/sys/unix"
 )
 
@@ -33,7 +43,24 @@ const (
 )
 
 func printUsage() {
-	fmt.Printf("Usage: %s [-f/--foreground] INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("Usage: %s [-f/--foreground] [--config FILE] [--state-file FILE] [--handoff] [--dns-listen [ADDR:]PORT]... [--dns-domain DOMAIN]... [--dns-direct SERVER]... INTERFACE-NAME\n", os.Args[0])
+	fmt.Printf("       %s [-f/--foreground] --config FILE --netstack [--forward RULE]... [--reverse RULE]... [--udp-timeout DURATION] [--socks5 [ADDR:]PORT]... [--http-proxy [ADDR:]PORT]... [--proxy-credentials FILE] [--dns SERVER]... [--dns-search DOMAIN]... [--dns-listen [ADDR:]PORT]... [--dns-domain DOMAIN]... [--dns-direct SERVER]... INTERFACE-NAME\n", os.Args[0])
+}
+
+// flagValue returns the value of the option name at the start of args,
+// given either as a separate argument or after an equals sign, and the
+// arguments following it.
+func flagValue(args []string, name string) (value string, rest []string, ok bool) {
+	if args[0] == name {
+		if len(args) < 2 {
+			return "", nil, false
+		}
+		return args[1], args[2:], true
+	}
+	if value, ok := strings.CutPrefix(args[0], name+"="); ok {
+		return value, args[1:], true
+	}
+	return "", nil, false
 }
 
 func warning() {
@@ -63,33 +90,141 @@ func main() {
 		return
 	}
 
-	warning()
-
-	var foreground bool
-	var interfaceName string
-	if len(os.Args) < 2 || len(os.Args) > 3 {
-		printUsage()
-		return
+	if code, ok := runSubcommand(os.Args[1:]); ok {
+		os.Exit(code)
 	}
 
-	switch os.Args[1] {
+	warning()
 
-	case "-f", "--foreground":
-		foreground = true
-		if len(os.Args) != 3 {
-			printUsage()
-			return
+	var foreground bool
+	var takeOver bool
+	var useNetstack bool
+	var configPath string
+	var statePath string
+	var forwards []portforward.Rule
+	var udpTimeout time.Duration
+	var socksAddrs []string
+	var httpProxyAddrs []string
+	var credentialsPath string
+	var dnsServers, dnsSearch []string
+	var dnsListenAddrs, dnsDomains []string
+	var dnsDirect []netip.AddrPort
+	args := os.Args[1:]
+flags:
+	for len(args) > 0 {
+		arg := args[0]
+		name, _, _ := strings.Cut(arg, "=")
+		switch name {
+		case "-f", "--foreground":
+			foreground = true
+			args = args[1:]
+			continue
+		case "--handoff":
+			takeOver = true
+			args = args[1:]
+			continue
+		case "--netstack":
+			useNetstack = true
+			args = args[1:]
+			continue
+		case "--config", "--state-file", "--forward", "--reverse", "--udp-timeout", "--socks5", "--http-proxy", "--proxy-credentials", "--dns", "--dns-search", "--dns-listen", "--dns-domain", "--dns-direct":
+		default:
+			break flags
 		}
-		interfaceName = os.Args[2]
 
-	default:
-		foreground = false
-		if len(os.Args) != 2 {
+		value, rest, ok := flagValue(args, name)
+		if !ok {
 			printUsage()
 			return
 		}
-		interfaceName = os.Args[1]
+		args = rest
+		var err error
+		switch name {
+		case "--config":
+			configPath = value
+		case "--state-file":
+			statePath = value
+		case "--forward", "--reverse":
+			var rule portforward.Rule
+			rule, err = portforward.ParseRule(value, name == "--reverse")
+			forwards = append(forwards, rule)
+		case "--udp-timeout":
+			udpTimeout, err = time.ParseDuration(value)
+		case "--socks5":
+			socksAddrs = append(socksAddrs, proxyListenAddr(value))
+		case "--http-proxy":
+			httpProxyAddrs = append(httpProxyAddrs, proxyListenAddr(value))
+		case "--proxy-credentials":
+			credentialsPath = value
+		case "--dns":
+			dnsServers = append(dnsServers, value)
+		case "--dns-search":
+			dnsSearch = append(dnsSearch, value)
+		case "--dns-listen":
+			dnsListenAddrs = append(dnsListenAddrs, proxyListenAddr(value))
+		case "--dns-domain":
+			dnsDomains = append(dnsDomains, value)
+		case "--dns-direct":
+			var server netip.AddrPort
+			server, err = parseDNSServer(value)
+			dnsDirect = append(dnsDirect, server)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid %s: %v\n", name, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+	if len(args) != 1 {
+		printUsage()
+		return
+	}
+	if len(forwards) > 0 && !useNetstack {
+		fmt.Fprintln(os.Stderr, "Port forwarding requires --netstack")
+		os.Exit(ExitSetupFailed)
+	}
+	if (len(socksAddrs) > 0 || len(httpProxyAddrs) > 0) && !useNetstack {
+		fmt.Fprintln(os.Stderr, "A proxy server requires --netstack")
+		os.Exit(ExitSetupFailed)
+	}
+	if (len(dnsServers) > 0 || len(dnsSearch) > 0) && !useNetstack {
+		fmt.Fprintln(os.Stderr, "DNS settings require --netstack")
+		os.Exit(ExitSetupFailed)
+	}
+	var credentials map[string]string
+	if credentialsPath != "" {
+		var err error
+		credentials, err = loadCredentials(credentialsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load proxy credentials %s: %v\n", credentialsPath, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+	if useNetstack && takeOver {
+		fmt.Fprintln(os.Stderr, "A userspace network stack cannot be taken over")
+		os.Exit(ExitSetupFailed)
+	}
+	if len(dnsListenAddrs) > 0 && takeOver {
+		fmt.Fprintln(os.Stderr, "A DNS forwarder cannot be taken over")
+		os.Exit(ExitSetupFailed)
+	}
+	if (len(dnsDomains) > 0 || len(dnsDirect) > 0) && len(dnsListenAddrs) == 0 {
+		fmt.Fprintln(os.Stderr, "Split DNS requires --dns-listen")
+		os.Exit(ExitSetupFailed)
+	}
+	// The DNS forwarder sends plain queries, to the --dns servers if any,
+	// so that queries meant to be encrypted are not sent in the clear.
+	var dnsForwardServers []netip.AddrPort
+	if len(dnsListenAddrs) > 0 {
+		for _, s := range dnsServers {
+			server, err := parseDNSServer(s)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "A DNS forwarder sends plain DNS queries and cannot use --dns %s\n", s)
+				os.Exit(ExitSetupFailed)
+			}
+			dnsForwardServers = append(dnsForwardServers, server)
+		}
 	}
+	interfaceName := args[0]
 
 	if !foreground {
 		foreground = os.Getenv(ENV_WG_PROCESS_FOREGROUND) == "1"
@@ -109,12 +244,92 @@ func main() {
 		return device.LogLevelError
 	}()
 
+	// load configuration file, so that errors are reported before daemonizing
+
+	var config *conf.Config
+	if configPath != "" {
+		var err error
+		config, err = conf.Load(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load configuration %s: %v\n", configPath, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+	if useNetstack && (config == nil || len(config.Interface.Addresses) == 0) {
+		fmt.Fprintln(os.Stderr, "A userspace network stack requires a configuration with an Address")
+		os.Exit(ExitSetupFailed)
+	}
+	if len(dnsListenAddrs) > 0 && len(dnsForwardServers) == 0 && (config == nil || len(config.Interface.DNS) == 0) {
+		fmt.Fprintln(os.Stderr, "A DNS forwarder requires a configuration with DNS servers")
+		os.Exit(ExitSetupFailed)
+	}
+	if len(dnsDomains) > 0 && len(dnsDirect) == 0 {
+		dnsDirect = systemDNSServers(dnsListenAddrs)
+		if len(dnsDirect) == 0 {
+			fmt.Fprintln(os.Stderr, "Split DNS requires --dns-direct servers, as none were found in "+resolvConfPath)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	// take the tunnel over from the running daemon
+
+	var h *handoff
+	if takeOver {
+		if !foreground {
+			// The handoff happens in the daemon, which receives the files.
+			if err := daemonize(logLevel, nil, nil); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to daemonize: %v\n", err)
+				os.Exit(ExitSetupFailed)
+			}
+			return
+		}
+		var err error
+		h, err = receiveHandoff(interfaceName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to take over %s: %v\n", interfaceName, err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
 	// open TUN device (or use supplied fd)
 
+	mtu := device.DefaultMTU
+	if config != nil && config.Interface.MTU != 0 {
+		mtu = int(config.Interface.MTU)
+	}
+
+	var tnet *netstack.Net
 	tdev, err := func() (tun.Device, error) {
+		if useNetstack {
+			var addrs []netip.Addr
+			for _, prefix := range config.Interface.Addresses {
+				addrs = append(addrs, prefix.Addr())
+			}
+			tdev, n, err := netstack.CreateNetTUN(addrs, config.Interface.DNS, mtu)
+			if err != nil {
+				return nil, err
+			}
+			tnet = n
+			if len(dnsServers) > 0 || len(dnsSearch) > 0 {
+				dns := netstack.DNSConfig{Servers: dnsServers, Search: dnsSearch}
+				if len(dns.Servers) == 0 {
+					for _, addr := range config.Interface.DNS {
+						dns.Servers = append(dns.Servers, addr.String())
+					}
+				}
+				if err := tnet.SetDNS(dns); err != nil {
+					tdev.Close()
+					return nil, err
+				}
+			}
+			return tdev, nil
+		}
+		if h != nil {
+			return tun.CreateTUNFromFile(h.tun, mtu)
+		}
 		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
 		if tunFdStr == "" {
-			return tun.CreateTUN(interfaceName, device.DefaultMTU)
+			return tun.CreateTUN(interfaceName, mtu)
 		}
 
 		// construct tun device from supplied fd
@@ -130,10 +345,10 @@ func main() {
 		}
 
 		file := os.NewFile(uintptr(fd), "")
-		return tun.CreateTUNFromFile(file, device.DefaultMTU)
+		return tun.CreateTUNFromFile(file, mtu)
 	}()
 
-	if err == nil {
+	if err == nil && tnet == nil {
 		realInterfaceName, err2 := tdev.Name()
 		if err2 == nil {
 			interfaceName = realInterfaceName
@@ -155,6 +370,9 @@ func main() {
 	// open UAPI file (or use supplied fd)
 
 	fileUAPI, err := func() (*os.File, error) {
+		if h != nil {
+			return h.uapi, nil
+		}
 		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
 		if uapiFdStr == "" {
 			return ipc.UAPIOpen(interfaceName)
@@ -169,6 +387,11 @@ func main() {
 
 		return os.NewFile(uintptr(fd), ""), nil
 	}()
+	if err != nil && tnet != nil {
+		// Without privileges, the socket directory may not be writable.
+		logger.Errorf("UAPI listen error, running without a UAPI socket: %v", err)
+		fileUAPI, err = nil, nil
+	}
 	if err != nil {
 		logger.Errorf("UAPI listen error: %v", err)
 		os.Exit(ExitSetupFailed)
@@ -177,92 +400,291 @@ func main() {
 	// daemonize the process
 
 	if !foreground {
-		env := os.Environ()
-		env = append(env, fmt.Sprintf("%s=3", ENV_WG_TUN_FD))
-		env = append(env, fmt.Sprintf("%s=4", ENV_WG_UAPI_FD))
-		env = append(env, fmt.Sprintf("%s=1", ENV_WG_PROCESS_FOREGROUND))
-		files := [3]*os.File{}
-		if os.Getenv("LOG_LEVEL") != "" && logLevel != device.LogLevelSilent {
-			files[0], _ = os.Open(os.DevNull)
-			files[1] = os.Stdout
-			files[2] = os.Stderr
-		} else {
-			files[0], _ = os.Open(os.DevNull)
-			files[1], _ = os.Open(os.DevNull)
-			files[2], _ = os.Open(os.DevNull)
-		}
-		attr := &os.ProcAttr{
-			Files: []*os.File{
-				files[0], // stdin
-				files[1], // stdout
-				files[2], // stderr
-				tdev.File(),
-				fileUAPI,
-			},
-			Dir: ".",
-			Env: env,
-		}
-
-		path, err := os.Executable()
-		if err != nil {
-			logger.Errorf("Failed to determine executable: %v", err)
-			os.Exit(ExitSetupFailed)
+		files := []*os.File{tdev.File(), fileUAPI}
+		env := []string{
+			fmt.Sprintf("%s=3", ENV_WG_TUN_FD),
+			fmt.Sprintf("%s=4", ENV_WG_UAPI_FD),
 		}
-
-		process, err := os.StartProcess(
-			path,
-			os.Args,
-			attr,
-		)
-		if err != nil {
+		if tnet != nil {
+			// The daemon creates its own network stack.
+			files, env = nil, nil
+			if fileUAPI != nil {
+				files = []*os.File{fileUAPI}
+				env = []string{fmt.Sprintf("%s=3", ENV_WG_UAPI_FD)}
+			}
+		}
+		if err := daemonize(logLevel, files, env); err != nil {
 			logger.Errorf("Failed to daemonize: %v", err)
 			os.Exit(ExitSetupFailed)
 		}
-		process.Release()
 		return
 	}
 
-	device := device.NewDevice(tdev, conn.NewDefaultBind(), logger)
+	bind := conn.NewDefaultBind()
+	if h != nil {
+		if err := h.adoptSockets(bind); err != nil {
+			logger.Errorf("Failed to adopt sockets: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	device := device.NewDevice(tdev, bind, logger)
 
 	logger.Verbosef("Device started")
 
-	errs := make(chan error)
-	term := make(chan os.Signal, 1)
+	if tnet != nil {
+		device.SetStackStatsProvider(stackStats{tnet})
+	} else {
+		// Sessions can be handed over to a successor, unless listening on
+		// the handoff socket fails below.
+		device.KeepSessionKeys(true)
+	}
 
-	uapi, err := ipc.UAPIListen(interfaceName, fileUAPI)
-	if err != nil {
-		logger.Errorf("Failed to listen on uapi socket: %v", err)
-		os.Exit(ExitSetupFailed)
+	if h != nil {
+		// The configuration of the running daemon replaces the file, which
+		// is still read on reloads.
+		if err := h.resume(device); err != nil {
+			logger.Errorf("Failed to resume sessions: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Verbosef("Sessions taken over")
+	} else if config != nil {
+		uapiConf, err := config.ToUAPI()
+		if err == nil {
+			err = device.IpcSet(uapiConf)
+		}
+		if err != nil {
+			logger.Errorf("Failed to apply configuration %s: %v", configPath, err)
+			os.Exit(ExitSetupFailed)
+		}
+		logger.Verbosef("Configuration %s applied", configPath)
+	}
+
+	// restore learned peer state after the configured peers exist
+
+	if statePath != "" {
+		if err := device.SetStateFile(statePath); err != nil {
+			logger.Errorf("Failed to load peer state %s: %v", statePath, err)
+		} else {
+			logger.Verbosef("Peer state %s loaded", statePath)
+		}
+	}
+
+	// forward ports over the network stack
+
+	var forwarder *portforward.Forwarder
+	if len(forwards) > 0 {
+		forwarder = portforward.New(tnet, udpTimeout, logger)
+		for _, rule := range forwards {
+			if _, err := forwarder.Start(rule); err != nil {
+				logger.Errorf("Failed to forward %v: %v", rule, err)
+				os.Exit(ExitSetupFailed)
+			}
+		}
 	}
 
-	go func() {
-		for {
-			conn, err := uapi.Accept()
+	// serve SOCKS5 clients over the network stack
+
+	var socksServer *socks5.Server
+	if len(socksAddrs) > 0 {
+		socksServer = socks5.New(tnet, credentials, logger)
+		for _, addr := range socksAddrs {
+			listener, err := net.Listen("tcp", addr)
 			if err != nil {
-				errs <- err
-				return
+				logger.Errorf("Failed to listen for SOCKS5 clients: %v", err)
+				os.Exit(ExitSetupFailed)
 			}
-			go device.IpcHandle(conn)
+			go socksServer.Serve(listener)
+			logger.Verbosef("SOCKS5 server listening on %v", listener.Addr())
 		}
-	}()
+	}
 
-	logger.Verbosef("UAPI listener started")
+	// serve HTTP proxy clients over the network stack
+
+	var httpProxy *httpproxy.Server
+	if len(httpProxyAddrs) > 0 {
+		httpProxy = httpproxy.New(tnet, credentials, logger)
+		for _, addr := range httpProxyAddrs {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				logger.Errorf("Failed to listen for HTTP proxy clients: %v", err)
+				os.Exit(ExitSetupFailed)
+			}
+			go httpProxy.Serve(listener)
+			logger.Verbosef("HTTP proxy listening on %v", listener.Addr())
+		}
+	}
+
+	// forward DNS queries of the host to the servers of the tunnel
+
+	var dnsForwarder *dnsforward.Server
+	if len(dnsListenAddrs) > 0 {
+		dnsConfig := dnsforward.Config{
+			Tunnel:  &net.Dialer{},
+			Domains: dnsDomains,
+			Direct:  dnsDirect,
+		}
+		if tnet != nil {
+			dnsConfig.Tunnel = tnet
+		}
+		dnsConfig.Servers = dnsForwardServers
+		if len(dnsConfig.Servers) == 0 {
+			for _, addr := range config.Interface.DNS {
+				dnsConfig.Servers = append(dnsConfig.Servers, netip.AddrPortFrom(addr, 53))
+			}
+		}
+		dnsForwarder, err = dnsforward.New(dnsConfig, logger)
+		if err != nil {
+			logger.Errorf("Failed to start DNS forwarder: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+		for _, addr := range dnsListenAddrs {
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				logger.Errorf("Failed to listen for DNS clients: %v", err)
+				os.Exit(ExitSetupFailed)
+			}
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				logger.Errorf("Failed to listen for DNS clients: %v", err)
+				os.Exit(ExitSetupFailed)
+			}
+			go dnsForwarder.ServePacket(pc)
+			go dnsForwarder.Serve(listener)
+			logger.Verbosef("DNS forwarder listening on %v", pc.LocalAddr())
+		}
+	}
+
+	errs := make(chan error)
+	term := make(chan os.Signal, 1)
+
+	var uapi net.Listener
+	if fileUAPI != nil {
+		uapi, err = ipc.UAPIListen(interfaceName, fileUAPI)
+		if err != nil {
+			logger.Errorf("Failed to listen on uapi socket: %v", err)
+			os.Exit(ExitSetupFailed)
+		}
+
+		go func() {
+			for {
+				conn, err := uapi.Accept()
+				if err != nil {
+					errs <- err
+					return
+				}
+				go device.IpcHandle(conn)
+			}
+		}()
+
+		logger.Verbosef("UAPI listener started")
+	}
+
+	// hand the tunnel over to a successor on request
+
+	var handoffs chan *net.UnixConn
+	var handoffServer *handoffServer
+	if tnet == nil {
+		handoffServer, err = listenHandoff(interfaceName, bind, tdev, fileUAPI)
+		if err != nil {
+			logger.Errorf("Failed to listen on handoff socket: %v", err)
+			device.KeepSessionKeys(false)
+		} else {
+			handoffs = handoffServer.conns
+			defer handoffServer.Close()
+		}
+	}
 
 	// wait for program to terminate
 
 	signal.Notify(term, unix.SIGTERM)
 	signal.Notify(term, os.Interrupt)
 
-	select {
-	case <-term:
-	case <-errs:
-	case <-device.Wait():
+	// reload configuration file on SIGHUP
+
+	hup := make(chan os.Signal, 1)
+	if configPath != "" {
+		signal.Notify(hup, unix.SIGHUP)
 	}
 
-	// clean up
+	handedOver := false
+wait:
+	for {
+		select {
+		case <-hup:
+			config = reloadConfig(device, configPath, config, logger)
+		case c := <-handoffs:
+			if err := handoffServer.handOver(c, device); err != nil {
+				logger.Errorf("Failed to hand over: %v", err)
+				continue
+			}
+			logger.Verbosef("Handed over to successor")
+			handedOver = true
+			break wait
+		case <-term:
+			break wait
+		case <-errs:
+			break wait
+		case <-device.Wait():
+			break wait
+		}
+	}
 
-	uapi.Close()
+	// clean up, leaving the UAPI socket to a successor
+
+	if uapi != nil && !handedOver {
+		uapi.Close()
+	}
+	if forwarder != nil {
+		forwarder.Close()
+	}
+	if socksServer != nil {
+		socksServer.Close()
+	}
+	if httpProxy != nil {
+		httpProxy.Close()
+	}
+	if dnsForwarder != nil {
+		dnsForwarder.Close()
+	}
 	device.Close()
 
 	logger.Verbosef("Shutting down")
 }
+
+// daemonize starts this program again in the background, with files
+// following stdin, stdout and stderr, and env added to the environment.
+func daemonize(logLevel int, files []*os.File, env []string) error {
+	env = append(os.Environ(), env...)
+	env = append(env, fmt.Sprintf("%s=1", ENV_WG_PROCESS_FOREGROUND))
+	std := [3]*os.File{}
+	if os.Getenv("LOG_LEVEL") != "" && logLevel != device.LogLevelSilent {
+		std[0], _ = os.Open(os.DevNull)
+		std[1] = os.Stdout
+		std[2] = os.Stderr
+	} else {
+		std[0], _ = os.Open(os.DevNull)
+		std[1], _ = os.Open(os.DevNull)
+		std[2], _ = os.Open(os.DevNull)
+	}
+	attr := &os.ProcAttr{
+		Files: append(std[:], files...),
+		Dir:   ".",
+		Env:   env,
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine executable: %w", err)
+	}
+
+	process, err := os.StartProcess(
+		path,
+		os.Args,
+		attr,
+	)
+	if err != nil {
+		return err
+	}
+	return process.Release()
+}
@@ -25,6 +25,10 @@ const (
 )
 
 func main() {
+	if code, ok := runSubcommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	if len(os.Args) != 2 {
 		os.Exit(ExitSetupFailed)
 	}
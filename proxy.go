@@ -0,0 +1,56 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// proxyListenAddr returns the address a proxy given as [ADDR:]PORT listens
+// on, which is the loopback address if only a port is given.
+func proxyListenAddr(s string) string {
+	if !strings.Contains(s, ":") {
+		return "127.0.0.1:" + s
+	}
+	return s
+}
+
+// loadCredentials reads the user names and passwords of proxy clients from
+// the file at path, one USER:PASSWORD per line. Empty lines and lines
+// starting with # are skipped.
+func loadCredentials(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	credentials := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		user, password, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected USER:PASSWORD", line)
+		}
+		credentials[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials in %s", path)
+	}
+	return credentials, nil
+}
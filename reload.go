@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conf"
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+)
+
+// reloadConfig re-reads the configuration file at path and applies only
+// what differs from the running device, so that untouched peers keep
+// their sessions. Only the peers of loaded, the configuration read last,
+// are removed when they are gone from the file. It returns the
+// configuration now in effect.
+func reloadConfig(dev *device.Device, path string, loaded *conf.Config, logger *device.Logger) *conf.Config {
+	desired, err := conf.Load(path)
+	if err != nil {
+		logger.Errorf("Failed to reload configuration %s: %v", path, err)
+		return loaded
+	}
+
+	var diff *conf.Diff
+	err = dev.IpcUpdate(func(state string) (string, error) {
+		live, err := conf.FromUAPI(strings.NewReader(state), desired.Name)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse device configuration: %w", err)
+		}
+		diff, err = conf.Compare(live, loaded, desired)
+		if err != nil {
+			return "", err
+		}
+		return diff.UAPI(), nil
+	})
+	if err != nil {
+		logger.Errorf("Failed to reload configuration %s: %v", path, err)
+		return loaded
+	}
+	for _, key := range diff.AddedPeers {
+		logger.Verbosef("Reload: added peer %s", key)
+	}
+	for _, key := range diff.RemovedPeers {
+		logger.Verbosef("Reload: removed peer %s", key)
+	}
+	for _, key := range diff.ChangedPeers {
+		logger.Verbosef("Reload: updated peer %s", key)
+	}
+	logger.Verbosef("Reloaded configuration %s: %v", path, diff)
+	return desired
+}
@@ -117,3 +117,28 @@ func TestReplay(t *testing.T) {
 	T(0, true)
 	T(windowSize+1, true)
 }
+
+func TestReplayMarshal(t *testing.T) {
+	var filter, restored Filter
+	for _, n := range []uint64{0, 1, 9, 8, 7, 200} {
+		filter.ValidateCounter(n, RejectAfterMessages)
+	}
+	b, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []uint64{0, 1, 9, 8, 7, 200} {
+		if restored.ValidateCounter(n, RejectAfterMessages) {
+			t.Errorf("counter %d accepted after restore", n)
+		}
+	}
+	if !restored.ValidateCounter(2, RejectAfterMessages) || !restored.ValidateCounter(201, RejectAfterMessages) {
+		t.Error("unseen counter rejected after restore")
+	}
+	if restored.UnmarshalBinary(b[1:]) == nil {
+		t.Error("truncated state accepted")
+	}
+}
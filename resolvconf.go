@@ -0,0 +1,65 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const resolvConfPath = "/etc/resolv.conf"
+
+// parseDNSServer parses a DNS server given as an address with an optional
+// port.
+func parseDNSServer(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	server, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid DNS server %q", s)
+	}
+	return server, nil
+}
+
+// systemDNSServers returns the name servers of resolv.conf, except those
+// at one of the exclude addresses, where this daemon answers itself.
+func systemDNSServers(exclude []string) []netip.AddrPort {
+	f, err := os.Open(resolvConfPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []netip.AddrPort
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		server := netip.AddrPortFrom(addr.WithZone(""), 53)
+		excluded := false
+		for _, s := range exclude {
+			if l, err := netip.ParseAddrPort(s); err == nil && l.Port() == 53 && (l.Addr() == server.Addr() || l.Addr().IsUnspecified()) {
+				excluded = true
+			}
+		}
+		if !excluded {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
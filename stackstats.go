@@ -0,0 +1,42 @@
+//go:build !windows
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+)
+
+// stackStats reports the counters and connections of the userspace
+// network stack in the output of a get.
+type stackStats struct {
+	tnet *netstack.Net
+}
+
+func (s stackStats) StackCounters() []device.StackCounter {
+	var counters []device.StackCounter
+	for _, counter := range s.tnet.Stats().Counters() {
+		counters = append(counters, device.StackCounter{Name: counter.Name, Value: counter.Value})
+	}
+	return counters
+}
+
+func (s stackStats) StackConnections() []device.StackConnection {
+	var conns []device.StackConnection
+	for _, conn := range s.tnet.Connections() {
+		conns = append(conns, device.StackConnection{
+			Network: conn.Network,
+			Local:   conn.Local,
+			Remote:  conn.Remote,
+			State:   conn.State,
+			TxBytes: conn.TxBytes,
+			RxBytes: conn.RxBytes,
+		})
+	}
+	return conns
+}
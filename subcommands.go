@@ -0,0 +1,123 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conf"
+)
+
+// runSubcommand runs the configuration helper named by args[0], if any,
+// and returns its exit code. ok is false if args[0] is not a subcommand.
+func runSubcommand(args []string) (code int, ok bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	switch args[0] {
+	case "check":
+		return checkMain(args[1:]), true
+	case "genkey":
+		return genkeyMain(args[1:], conf.NewPrivateKey), true
+	case "genpsk":
+		return genkeyMain(args[1:], conf.NewPresharedKey), true
+	case "pubkey":
+		return pubkeyMain(args[1:]), true
+	case "genobf":
+		return genobfMain(args[1:]), true
+	}
+	return 0, false
+}
+
+func checkMain(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "Usage: %s check CONFIG-FILE\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s check CLIENT-CONFIG-FILE SERVER-CONFIG-FILE\n", os.Args[0])
+		return ExitSetupFailed
+	}
+
+	var configs []*conf.Config
+	for _, path := range args {
+		config, err := conf.Load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return ExitSetupFailed
+		}
+		configs = append(configs, config)
+	}
+
+	var issues []conf.Issue
+	if len(configs) == 1 {
+		issues = configs[0].Check()
+	} else {
+		issues = conf.Check(configs[0], configs[1])
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if conf.HasErrors(issues) {
+		return ExitSetupFailed
+	}
+	return ExitSetupSuccess
+}
+
+func genkeyMain(args []string, generate func() (conf.Key, error)) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s genkey|genpsk\n", os.Args[0])
+		return ExitSetupFailed
+	}
+	key, err := generate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate key: %v\n", err)
+		return ExitSetupFailed
+	}
+	fmt.Println(key)
+	return ExitSetupSuccess
+}
+
+func pubkeyMain(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s pubkey < private.key > public.key\n", os.Args[0])
+		return ExitSetupFailed
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "Failed to read private key: %v\n", err)
+		return ExitSetupFailed
+	}
+	key, err := conf.ParseKey(strings.TrimSpace(line))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid private key: %v\n", err)
+		return ExitSetupFailed
+	}
+	fmt.Println(key.PublicKey())
+	return ExitSetupSuccess
+}
+
+func genobfMain(args []string) int {
+	format := "conf"
+	if len(args) == 1 {
+		format = args[0]
+	}
+	if len(args) > 1 || (format != "conf" && format != "uapi") {
+		fmt.Fprintf(os.Stderr, "Usage: %s genobf [conf|uapi]\n", os.Args[0])
+		return ExitSetupFailed
+	}
+	iface, err := conf.GenerateObfuscation()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate parameters: %v\n", err)
+		return ExitSetupFailed
+	}
+	if format == "uapi" {
+		fmt.Print(iface.ObfuscationUAPI())
+	} else {
+		fmt.Print((&conf.Config{Interface: *iface}).ToWgQuick())
+	}
+	return ExitSetupSuccess
+}
@@ -0,0 +1,520 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// AddrPreference selects the address families that LookupContextHost
+// returns, and their order.
+type AddrPreference int
+
+const (
+	PreferDefault AddrPreference = iota // IPv6 first if the stack has an IPv6 address
+	PreferIPv4
+	PreferIPv6
+	OnlyIPv4
+	OnlyIPv6
+)
+
+// DNSConfig configures how a Net resolves hostnames.
+type DNSConfig struct {
+	// Servers are tried in order. A server is an IP address with an
+	// optional port, a tls://HOST[:PORT] URL for DNS over TLS, or an
+	// https:// URL for DNS over HTTPS. For TLS, a fragment names the server
+	// in the certificate if HOST is an address, as in
+	// tls://1.1.1.1#cloudflare-dns.com. Servers given by hostname are
+	// resolved with the plain servers.
+	Servers []string
+
+	// Search are the domains appended to names without a trailing dot.
+	// They are tried before the name itself if it has no dots, and after
+	// it otherwise.
+	Search []string
+
+	Prefer AddrPreference
+
+	// TLSConfig is used for TLS and HTTPS servers, with ServerName set for
+	// each. Nil verifies servers with the system roots.
+	TLSConfig *tls.Config
+}
+
+const (
+	dnsTimeout         = 5 * time.Second
+	dnsIdleTimeout     = 10 * time.Second // for reusing a connection to a TLS server
+	maxDNSCacheEntries = 4096
+	maxDNSMessageSize  = 65535
+)
+
+// A dnsServer answers queries over one of the DNS transports.
+type dnsServer interface {
+	exchange(ctx context.Context, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error)
+	String() string
+	// close releases the connections kept for later queries.
+	close()
+}
+
+type resolver struct {
+	sync.RWMutex
+	servers   []dnsServer
+	bootstrap []dnsServer // the plain servers, to resolve the others
+	search    []string
+	prefer    AddrPreference
+
+	cache struct {
+		sync.Mutex
+		entries map[dnsCacheKey]dnsCacheEntry
+	}
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// SetDNS replaces the DNS configuration of the network stack, and clears
+// its cache.
+func (net *Net) SetDNS(config DNSConfig) error {
+	var servers, bootstrap []dnsServer
+	for _, s := range config.Servers {
+		server, err := net.parseDNSServer(s, config.TLSConfig)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+		if _, ok := server.(*plainDNSServer); ok {
+			bootstrap = append(bootstrap, server)
+		}
+	}
+	var search []string
+	for _, domain := range config.Search {
+		domain = strings.TrimSuffix(domain, ".")
+		if !isDomainName(domain) {
+			return fmt.Errorf("invalid search domain %q", domain)
+		}
+		search = append(search, domain)
+	}
+
+	r := &net.dns
+	r.Lock()
+	old := r.servers
+	r.servers, r.bootstrap, r.search, r.prefer = servers, bootstrap, search, config.Prefer
+	r.Unlock()
+	for _, server := range old {
+		server.close()
+	}
+	r.cache.Lock()
+	r.cache.entries = nil
+	r.cache.Unlock()
+	return nil
+}
+
+func (tnet *Net) setDNSServers(addrs []netip.Addr) {
+	var servers []dnsServer
+	for _, addr := range addrs {
+		servers = append(servers, &plainDNSServer{tnet, netip.AddrPortFrom(addr, 53)})
+	}
+	tnet.dns.servers, tnet.dns.bootstrap = servers, servers
+}
+
+func (tnet *Net) parseDNSServer(s string, tlsConfig *tls.Config) (dnsServer, error) {
+	if !strings.Contains(s, "://") {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			return &plainDNSServer{tnet, netip.AddrPortFrom(addr, 53)}, nil
+		}
+		addr, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		return &plainDNSServer{tnet, addr}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server %q: %w", s, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.ServerName = u.Hostname()
+	if u.Fragment != "" {
+		tlsConfig.ServerName = u.Fragment
+	}
+	host, port := u.Hostname(), u.Port()
+	switch u.Scheme {
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+		server := &tlsDNSServer{net: tnet, name: s, host: host, config: tlsConfig}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		server.port = uint16(p)
+		return server, nil
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid DNS server %q", s)
+		}
+		u.Fragment = ""
+		server := &httpsDNSServer{name: s, url: u.String()}
+		server.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return tnet.dialDNS(ctx, host, uint16(p))
+			},
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   90 * time.Second,
+		}
+		return server, nil
+	}
+	return nil, fmt.Errorf("invalid DNS server %q: unsupported scheme %s", s, u.Scheme)
+}
+
+// dialDNS connects to a DNS server over TCP, resolving its hostname with
+// the plain servers.
+func (tnet *Net) dialDNS(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(addr, port))
+	}
+	tnet.dns.RLock()
+	config := resolverConfig{servers: tnet.dns.bootstrap, prefer: tnet.dns.prefer}
+	tnet.dns.RUnlock()
+	if len(config.servers) == 0 {
+		return nil, fmt.Errorf("no plain DNS server to resolve %s", host)
+	}
+	addrs, err := tnet.lookupName(ctx, config, host+".")
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		c, err := tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(addr, port))
+		if err == nil {
+			return c, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// A plainDNSServer is queried over UDP, and over TCP for truncated answers.
+type plainDNSServer struct {
+	net  *Net
+	addr netip.AddrPort
+}
+
+func (server *plainDNSServer) String() string {
+	if server.addr.Port() == 53 {
+		return server.addr.Addr().String()
+	}
+	return server.addr.String()
+}
+
+func (server *plainDNSServer) exchange(ctx context.Context, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+	return server.net.exchange(ctx, server.addr, q, timeout)
+}
+
+func (server *plainDNSServer) close() {}
+
+// A tlsDNSServer is queried over TLS, as specified in RFC 7858. It keeps a
+// connection open between queries, as section 3.4 recommends.
+type tlsDNSServer struct {
+	net    *Net
+	name   string
+	host   string
+	port   uint16
+	config *tls.Config
+
+	idle struct {
+		sync.Mutex
+		conn   *tls.Conn
+		since  time.Time
+		closed bool
+	}
+}
+
+func (server *tlsDNSServer) String() string {
+	return server.name
+}
+
+func (server *tlsDNSServer) exchange(ctx context.Context, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	id, _, tcpReq, err := newRequest(q)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
+	}
+	if tc := server.takeIdle(); tc != nil {
+		p, h, err := server.roundTrip(ctx, tc, id, q, tcpReq)
+		if err == nil {
+			return p, h, nil
+		}
+		// The server may have closed the connection in the meantime.
+	}
+	c, err := server.net.dialDNS(ctx, server.host, server.port)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		c.SetDeadline(d)
+	}
+	tc := tls.Client(c, server.config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	return server.roundTrip(ctx, tc, id, q, tcpReq)
+}
+
+// roundTrip sends a query over tc, which is kept for the next query if it
+// is answered, and closed otherwise.
+func (server *tlsDNSServer) roundTrip(ctx context.Context, tc *tls.Conn, id uint16, q dnsmessage.Question, req []byte) (dnsmessage.Parser, dnsmessage.Header, error) {
+	if d, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(d)
+	}
+	p, h, err := dnsStreamRoundTrip(tc, id, q, req)
+	if err == nil && p.SkipQuestion() != dnsmessage.ErrSectionDone {
+		err = errInvalidDNSResponse
+	}
+	if err != nil {
+		tc.Close()
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	server.putIdle(tc)
+	return p, h, nil
+}
+
+// takeIdle returns the connection kept from an earlier query, if any and
+// it has not been idle for too long.
+func (server *tlsDNSServer) takeIdle() *tls.Conn {
+	server.idle.Lock()
+	defer server.idle.Unlock()
+	tc := server.idle.conn
+	server.idle.conn = nil
+	if tc != nil && time.Since(server.idle.since) > dnsIdleTimeout {
+		tc.Close()
+		return nil
+	}
+	return tc
+}
+
+// putIdle keeps tc for the next query, unless another connection is kept
+// already.
+func (server *tlsDNSServer) putIdle(tc *tls.Conn) {
+	tc.SetDeadline(time.Time{})
+	server.idle.Lock()
+	defer server.idle.Unlock()
+	if server.idle.conn != nil || server.idle.closed {
+		tc.Close()
+		return
+	}
+	server.idle.conn, server.idle.since = tc, time.Now()
+}
+
+func (server *tlsDNSServer) close() {
+	server.idle.Lock()
+	defer server.idle.Unlock()
+	if server.idle.conn != nil {
+		server.idle.conn.Close()
+		server.idle.conn = nil
+	}
+	server.idle.closed = true
+}
+
+// An httpsDNSServer is queried over HTTPS, as specified in RFC 8484.
+type httpsDNSServer struct {
+	name   string
+	url    string
+	client http.Client
+}
+
+func (server *httpsDNSServer) String() string {
+	return server.name
+}
+
+func (server *httpsDNSServer) close() {
+	server.client.CloseIdleConnections()
+}
+
+func (server *httpsDNSServer) exchange(ctx context.Context, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	id, udpReq, _, err := newRequest(q)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotMarshalDNSMessage
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.url, bytes.NewReader(udpReq))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := server.client.Do(req)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, fmt.Errorf("%s: %s", errServerMisbehaving, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, err
+	}
+
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	respQ, err := p.Question()
+	if err != nil {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errCannotUnmarshalDNSMessage
+	}
+	if !checkResponse(id, q, h, respQ) {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	if err := p.SkipQuestion(); err != dnsmessage.ErrSectionDone {
+		return dnsmessage.Parser{}, dnsmessage.Header{}, errInvalidDNSResponse
+	}
+	return p, h, nil
+}
+
+// resolverConfig is a snapshot of the configuration a lookup runs with.
+type resolverConfig struct {
+	servers []dnsServer
+	search  []string
+	prefer  AddrPreference
+}
+
+// candidates returns the names to look up for host, in order.
+func (config resolverConfig) candidates(host string) []string {
+	if strings.HasSuffix(host, ".") || len(config.search) == 0 {
+		return []string{strings.TrimSuffix(host, ".") + "."}
+	}
+	var names []string
+	for _, domain := range config.search {
+		names = append(names, host+"."+domain+".")
+	}
+	if strings.Count(host, ".") >= 1 {
+		// Names with dots are more likely complete.
+		return append([]string{host + "."}, names...)
+	}
+	return append(names, host+".")
+}
+
+func (r *resolver) cached(name string, qtype dnsmessage.Type) ([]netip.Addr, bool) {
+	r.cache.Lock()
+	defer r.cache.Unlock()
+	key := dnsCacheKey{strings.ToLower(name), qtype}
+	entry, ok := r.cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(r.cache.entries, key)
+		return nil, false
+	}
+	return slices.Clone(entry.addrs), true
+}
+
+func (r *resolver) store(name string, qtype dnsmessage.Type, addrs []netip.Addr, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	r.cache.Lock()
+	defer r.cache.Unlock()
+	if r.cache.entries == nil {
+		r.cache.entries = make(map[dnsCacheKey]dnsCacheEntry)
+	}
+	now := time.Now()
+	if len(r.cache.entries) >= maxDNSCacheEntries {
+		for key, entry := range r.cache.entries {
+			if !now.Before(entry.expires) {
+				delete(r.cache.entries, key)
+			}
+		}
+		if len(r.cache.entries) >= maxDNSCacheEntries {
+			return
+		}
+	}
+	r.cache.entries[dnsCacheKey{strings.ToLower(name), qtype}] = dnsCacheEntry{
+		addrs:   addrs,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// parseAnswers returns the addresses of type qtype in the answers of p,
+// and the lowest TTL of all answers.
+func parseAnswers(p *dnsmessage.Parser, qtype dnsmessage.Type) ([]netip.Addr, uint32, error) {
+	var addrs []netip.Addr
+	var ttl uint32
+	first := true
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, errCannotUnmarshalDNSMessage
+		}
+		if first || h.TTL < ttl {
+			ttl, first = h.TTL, false
+		}
+		switch {
+		case h.Type == qtype && qtype == dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return nil, 0, errCannotUnmarshalDNSMessage
+			}
+			addrs = append(addrs, netip.AddrFrom4(a.A))
+		case h.Type == qtype && qtype == dnsmessage.TypeAAAA:
+			aaaa, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, errCannotUnmarshalDNSMessage
+			}
+			addrs = append(addrs, netip.AddrFrom16(aaaa.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, errCannotUnmarshalDNSMessage
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errNoSuchHost
+	}
+	return addrs, ttl, nil
+}
@@ -0,0 +1,326 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+var testHosts = map[string][]netip.Addr{
+	"dns.test.":       {netstacktest.Addrs[1]},
+	"web.corp.test.":  {netip.MustParseAddr("10.0.1.1")},
+	"web.":            {netip.MustParseAddr("10.0.1.2")},
+	"a.b.":            {netip.MustParseAddr("10.0.1.3")},
+	"a.b.corp.test.":  {netip.MustParseAddr("10.0.1.4")},
+	"dual.test.":      {netip.MustParseAddr("10.0.1.5"), netip.MustParseAddr("fd00:1::5")},
+	"v6only.test.":    {netip.MustParseAddr("fd00:1::6")},
+	"web.other.test.": {netip.MustParseAddr("10.0.1.8")},
+}
+
+// serveDNS runs a plain DNS server on port 53 of the second stack, and
+// returns the number of queries it has answered.
+func serveDNS(t *testing.T, tnet *netstack.Net) *atomic.Int32 {
+	pc, err := tnet.ListenUDPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			pc.WriteTo(netstacktest.AnswerDNS(buf[:n], testHosts), from)
+		}
+	}()
+	return &queries
+}
+
+func lookup(t *testing.T, tnet *netstack.Net, host string) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := tnet.LookupContextHost(ctx, host)
+	if err != nil {
+		t.Fatalf("%s: %v", host, err)
+	}
+	return addrs
+}
+
+func TestSearchDomains(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	serveDNS(t, nets[1])
+	if err := nets[0].SetDNS(netstack.DNSConfig{
+		Servers: []string{"10.0.0.2"},
+		Search:  []string{"corp.test", "other.test."},
+		Prefer:  netstack.PreferIPv4,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]string{
+		"web":  "10.0.1.1", // search domains first
+		"web.": "10.0.1.2", // absolute
+		"a.b":  "10.0.1.3", // names with dots first
+		"dual": "",
+	} {
+		addrs, err := nets[0].LookupHost(host)
+		if want == "" {
+			var dnsErr *net.DNSError
+			if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+				t.Errorf("%s: %v, %v", host, addrs, err)
+			}
+			continue
+		}
+		if err != nil || len(addrs) != 1 || addrs[0] != want {
+			t.Errorf("%s: %v, %v, want %s", host, addrs, err, want)
+		}
+	}
+
+	if err := nets[0].SetDNS(netstack.DNSConfig{Search: []string{"not a domain"}}); err == nil {
+		t.Error("accepted an invalid search domain")
+	}
+}
+
+func TestPreference(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	serveDNS(t, nets[1])
+	for _, test := range []struct {
+		prefer netstack.AddrPreference
+		host   string
+		want   []string
+	}{
+		{netstack.PreferDefault, "dual.test", []string{"fd00:1::5", "10.0.1.5"}},
+		{netstack.PreferIPv4, "dual.test", []string{"10.0.1.5", "fd00:1::5"}},
+		{netstack.PreferIPv6, "dual.test", []string{"fd00:1::5", "10.0.1.5"}},
+		{netstack.OnlyIPv4, "dual.test", []string{"10.0.1.5"}},
+		{netstack.OnlyIPv6, "dual.test", []string{"fd00:1::5"}},
+		{netstack.PreferIPv4, "v6only.test", []string{"fd00:1::6"}},
+	} {
+		if err := nets[0].SetDNS(netstack.DNSConfig{Servers: []string{"10.0.0.2:53"}, Prefer: test.prefer}); err != nil {
+			t.Fatal(err)
+		}
+		if addrs := lookup(t, nets[0], test.host); !reflect.DeepEqual(addrs, test.want) {
+			t.Errorf("%d %s: %v, want %v", test.prefer, test.host, addrs, test.want)
+		}
+	}
+	if err := nets[0].SetDNS(netstack.DNSConfig{Servers: []string{"10.0.0.2"}, Prefer: netstack.OnlyIPv4}); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := nets[0].LookupHost("v6only.test"); err == nil {
+		t.Errorf("got %v for an IPv6 name with OnlyIPv4", addrs)
+	}
+}
+
+func TestCache(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	queries := serveDNS(t, nets[1])
+
+	lookup(t, nets[0], "dual.test")
+	lookup(t, nets[0], "DUAL.test.")
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries for two lookups of a name, want one per address family", n)
+	}
+	if _, err := nets[0].LookupHost("missing.test"); err == nil {
+		t.Error("resolved an unknown name")
+	}
+
+	// A new configuration starts with an empty cache.
+	if err := nets[0].SetDNS(netstack.DNSConfig{Servers: []string{"10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	queries.Store(0)
+	lookup(t, nets[0], "dual.test")
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries after SetDNS, want 2", n)
+	}
+}
+
+// newCertificate returns a self-signed certificate for dns.test and
+// 10.0.0.2, and a pool trusting it.
+func newCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dns.test"},
+		DNSNames:     []string{"dns.test"},
+		IPAddresses:  []net.IP{netstacktest.Addrs[1].AsSlice()},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// listenTLS returns a TLS listener on port of the second stack.
+func listenTLS(t *testing.T, tnet *netstack.Net, port uint16, cert tls.Certificate) net.Listener {
+	l, err := tnet.ListenTCPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func TestTLS(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	serveDNS(t, nets[1])
+	cert, pool := newCertificate(t)
+	l := listenTLS(t, nets[1], 853, cert)
+	// Only the TLS server knows this name.
+	hosts := map[string][]netip.Addr{
+		"secure.test.": {netip.MustParseAddr("10.0.1.9")},
+		"other.test.":  {netip.MustParseAddr("10.0.1.10")},
+	}
+	var accepted atomic.Int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer c.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(c, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(c, query); err != nil {
+						return
+					}
+					answer := netstacktest.AnswerDNS(query, hosts)
+					c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+				}
+			}()
+		}
+	}()
+
+	for _, server := range []string{"tls://10.0.0.2", "tls://10.0.0.2:853#dns.test", "tls://dns.test"} {
+		err := nets[0].SetDNS(netstack.DNSConfig{
+			Servers:   []string{server, "10.0.0.2"},
+			Prefer:    netstack.OnlyIPv4,
+			TLSConfig: &tls.Config{RootCAs: pool},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs := lookup(t, nets[0], "secure.test"); len(addrs) != 1 || addrs[0] != "10.0.1.9" {
+			t.Errorf("%s: %v", server, addrs)
+		}
+	}
+
+	// Queries share a connection.
+	accepted.Store(0)
+	err := nets[0].SetDNS(netstack.DNSConfig{
+		Servers:   []string{"tls://10.0.0.2"},
+		Prefer:    netstack.OnlyIPv4,
+		TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup(t, nets[0], "secure.test")
+	lookup(t, nets[0], "other.test")
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("%d connections for two queries", n)
+	}
+
+	if err := nets[0].SetDNS(netstack.DNSConfig{Servers: []string{"tls://10.0.0.2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if addrs, err := nets[0].LookupHost("secure.test"); err == nil {
+		t.Errorf("trusted an unknown certificate: %v", addrs)
+	}
+}
+
+func TestHTTPS(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	serveDNS(t, nets[1])
+	cert, pool := newCertificate(t)
+	l := listenTLS(t, nets[1], 443, cert)
+	// Only the HTTPS server knows this name.
+	hosts := map[string][]netip.Addr{"secure.test.": {netstacktest.Addrs[1], netstacktest.Addrs6[1]}}
+	server := &http.Server{ErrorLog: log.New(io.Discard, "", 0)}
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.NotFound(w, r)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(netstacktest.AnswerDNS(query, hosts))
+	})
+	go server.Serve(l)
+
+	err := nets[0].SetDNS(netstack.DNSConfig{
+		Servers:   []string{"https://dns.test/dns-query", "10.0.0.2"},
+		TLSConfig: &tls.Config{RootCAs: pool},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := lookup(t, nets[0], "secure.test"); !reflect.DeepEqual(addrs, []string{"fd00::2", "10.0.0.2"}) {
+		t.Errorf("got %v", addrs)
+	}
+
+	// DialContext resolves with the same servers.
+	netstacktest.ServeEcho(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 7))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := nets[0].DialContext(ctx, "tcp", "secure.test:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for _, server := range []string{"ftp://dns.test", "https://", "tls://dns.test:port", "dns.test"} {
+		if err := nets[0].SetDNS(netstack.DNSConfig{Servers: []string{server}}); err == nil {
+			t.Errorf("accepted %s", server)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A Direction is the way a packet crosses a device of the stack.
+type Direction int
+
+const (
+	// Inbound packets are written to a device by the tunnel, for the
+	// stack.
+	Inbound Direction = iota
+
+	// Outbound packets are sent by the stack, and read from a device by
+	// the tunnel.
+	Outbound
+)
+
+func (dir Direction) String() string {
+	if dir == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// A PacketHook is called with each IP packet crossing the device of NIC
+// nic. It may modify the packet in place, return another packet to
+// replace it, or return nil to drop it. Hooks run on the packet path, so
+// they must not block, and must not keep the packet after returning.
+type PacketHook func(nic int, dir Direction, packet []byte) []byte
+
+type packetHook struct {
+	hook PacketHook
+}
+
+// packetHooks is the chain of hooks of a stack. Adding or removing a hook
+// replaces the chain, so that the packet path reads it without locking.
+type packetHooks struct {
+	mu    sync.Mutex
+	chain atomic.Pointer[[]*packetHook]
+}
+
+// AddPacketHook adds hook to the hooks that see the packets crossing the
+// devices of the stack, after the ones already added, and returns a
+// function that removes it. Inbound packets go through the hooks before
+// the stack sees them, and outbound packets after it sent them, so that
+// counters, ICMP errors and connections are about the packets of the
+// stack.
+func (tnet *Net) AddPacketHook(hook PacketHook) (remove func()) {
+	h := &packetHook{hook}
+	tnet.hooks.mu.Lock()
+	defer tnet.hooks.mu.Unlock()
+	var chain []*packetHook
+	if old := tnet.hooks.chain.Load(); old != nil {
+		chain = append(chain, *old...)
+	}
+	chain = append(chain, h)
+	tnet.hooks.chain.Store(&chain)
+
+	return func() {
+		tnet.hooks.mu.Lock()
+		defer tnet.hooks.mu.Unlock()
+		var chain []*packetHook
+		for _, other := range *tnet.hooks.chain.Load() {
+			if other != h {
+				chain = append(chain, other)
+			}
+		}
+		tnet.hooks.chain.Store(&chain)
+	}
+}
+
+// run passes packet through the hooks, and returns it as they left it, or
+// an empty packet if one dropped it.
+func (hooks *packetHooks) run(nic int, dir Direction, packet []byte) []byte {
+	chain := hooks.chain.Load()
+	if chain == nil {
+		return packet
+	}
+	for _, h := range *chain {
+		if packet = h.hook(nic, dir, packet); len(packet) == 0 {
+			return nil
+		}
+	}
+	return packet
+}
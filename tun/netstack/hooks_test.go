@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+func TestPacketHooks(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	server := netip.AddrPortFrom(netstacktest.Addrs[1], 7)
+	netstacktest.ServeEcho(t, nets[1], server)
+
+	// Hooks see the packets both ways.
+	var inbound, outbound atomic.Int64
+	remove := nets[0].AddPacketHook(func(nic int, dir netstack.Direction, packet []byte) []byte {
+		if nic != netstack.DefaultNIC {
+			t.Errorf("packet on NIC %d", nic)
+		}
+		if dir == netstack.Inbound {
+			inbound.Add(1)
+		} else {
+			outbound.Add(1)
+		}
+		return packet
+	})
+	if err := echo(nets[0], server); err != nil {
+		t.Fatal(err)
+	}
+	remove()
+	if inbound.Load() == 0 || outbound.Load() == 0 {
+		t.Errorf("hook saw %d inbound and %d outbound packets", inbound.Load(), outbound.Load())
+	}
+	seen := outbound.Load()
+	if err := echo(nets[0], server); err != nil {
+		t.Fatal(err)
+	}
+	if outbound.Load() != seen {
+		t.Error("removed hook still called")
+	}
+
+	// Hooks can modify packets, here to mark them with a TOS, and drop
+	// them.
+	defer nets[0].AddPacketHook(func(nic int, dir netstack.Direction, packet []byte) []byte {
+		if ip := header.IPv4(packet); dir == netstack.Outbound && packet[0]>>4 == 4 {
+			ip.SetTOS(0x28, 0)
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+		}
+		return packet
+	})()
+	var marked atomic.Bool
+	removeDrop := nets[1].AddPacketHook(func(nic int, dir netstack.Direction, packet []byte) []byte {
+		if ip := header.IPv4(packet); dir == netstack.Inbound && packet[0]>>4 == 4 {
+			if tos, _ := ip.TOS(); tos == 0x28 {
+				marked.Store(true)
+			}
+			if ip.TransportProtocol() == header.UDPProtocolNumber {
+				return nil
+			}
+		}
+		return packet
+	})
+	if err := echo(nets[0], server); err != nil {
+		t.Fatal(err)
+	}
+	if !marked.Load() {
+		t.Error("packets not marked")
+	}
+
+	c, err := nets[0].DialUDPAddrPort(netip.AddrPort{}, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 4)); err == nil {
+		t.Error("dropped packet answered")
+	}
+	removeDrop()
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 4)); err != nil {
+		t.Error(err)
+	}
+}
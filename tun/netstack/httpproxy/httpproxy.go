@@ -0,0 +1,233 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package httpproxy implements an HTTP proxy, which tunnels CONNECT
+// requests and forwards plain HTTP requests through the userspace network
+// stack of a tunnel.
+package httpproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/internal/relay"
+)
+
+const (
+	// PACPath is where the server answers with a proxy auto-config file
+	// pointing to itself.
+	PACPath = "/proxy.pac"
+
+	dialTimeout       = 30 * time.Second
+	readHeaderTimeout = 30 * time.Second
+	realm             = "amneziawg"
+)
+
+// A Server is an HTTP proxy whose requests go through the network stack of
+// a tunnel, and whose hostnames are resolved with its DNS servers.
+type Server struct {
+	net         *netstack.Net
+	log         *device.Logger
+	credentials map[string]string
+	transport   *http.Transport
+	proxy       *httputil.ReverseProxy
+	server      *http.Server
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[io.Closer]struct{} // hijacked for CONNECT
+}
+
+// New returns a server over tnet. With credentials, a map of user names
+// to passwords, clients must authenticate with one of them using basic
+// authentication; without, no authentication is required. logger may be
+// nil.
+func New(tnet *netstack.Net, credentials map[string]string, logger *device.Logger) *Server {
+	if logger == nil {
+		logger = device.NewLogger(device.LogLevelSilent, "")
+	}
+	s := &Server{
+		net:         tnet,
+		log:         logger,
+		credentials: credentials,
+		conns:       make(map[io.Closer]struct{}),
+	}
+	s.transport = &http.Transport{
+		DialContext:         tnet.DialContext,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	s.proxy = &httputil.ReverseProxy{
+		// The outgoing request keeps the absolute URL of the incoming one,
+		// without hop-by-hop headers such as Proxy-Authorization.
+		Rewrite:   func(*httputil.ProxyRequest) {},
+		Transport: s.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.log.Verbosef("HTTP proxy client %s: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), statusForError(err))
+		},
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	return s
+}
+
+// Serve accepts clients on l until it fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	err := s.server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// Close stops serving and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	err := s.server.Close()
+	s.transport.CloseIdleConnections()
+	return err
+}
+
+// track registers c to be closed with the server, or closes it right away
+// if the server is closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect && r.URL.Host == "" {
+		// Requests for the proxy itself rather than through it.
+		if r.URL.Path == PACPath && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			s.servePAC(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		s.connect(w, r)
+		return
+	}
+	if r.URL.Scheme != "http" {
+		http.Error(w, "unsupported scheme "+r.URL.Scheme, http.StatusBadRequest)
+		return
+	}
+	s.proxy.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.credentials == nil {
+		return true
+	}
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	want, ok := s.credentials[user]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(want)) == 1
+}
+
+// servePAC answers with a proxy auto-config file that sends all requests
+// through the proxy, at the address the client reached it on.
+func (s *Server) servePAC(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n\treturn %q;\n}\n", "PROXY "+r.Host)
+}
+
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), dialTimeout)
+	defer cancel()
+	target, err := s.net.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		s.log.Verbosef("HTTP proxy client %s: %v", r.RemoteAddr, err)
+		http.Error(w, err.Error(), statusForError(err))
+		return
+	}
+	if !s.track(target) {
+		return
+	}
+	defer s.untrack(target)
+
+	c, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !s.track(c) {
+		return
+	}
+	defer s.untrack(c)
+	c.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	// The client may have sent data after its request already.
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		if _, err := target.Write(buffered); err != nil {
+			return
+		}
+	}
+	relay.Splice(c, target)
+}
+
+// statusForError returns the status reporting a failure to reach the
+// target.
+func statusForError(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
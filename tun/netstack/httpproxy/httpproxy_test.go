@@ -0,0 +1,132 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package httpproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+// startServer runs a web server, an echo server and a DNS server in the
+// tunnel, and a proxy with credentials on the host, and returns the
+// address of the proxy.
+func startServer(t *testing.T) string {
+	nets := netstacktest.NewPair(t)
+	netstacktest.ServeEcho(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 7))
+	netstacktest.ServeDNS(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 53), map[string][]netip.Addr{
+		"web.test.": {netstacktest.Addrs[1]},
+	})
+	web, err := nets[1].ListenTCPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(web, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s proxy-authorization=%q", r.Host, r.URL.Path, r.Header.Get("Proxy-Authorization"))
+	}))
+
+	s := New(nets[0], map[string]string{"user": "secret"}, nil)
+	t.Cleanup(func() {
+		s.Close()
+		web.Close()
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestForward(t *testing.T) {
+	addr := startServer(t)
+
+	get := func(proxy *url.URL, target string) (int, string) {
+		t.Helper()
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxy)}, Timeout: 5 * time.Second}
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	proxy := &url.URL{Scheme: "http", Host: addr, User: url.UserPassword("user", "secret")}
+	for _, target := range []string{"http://10.0.0.2/a", "http://web.test/b"} {
+		status, body := get(proxy, target)
+		want := strings.TrimPrefix(target, "http://")
+		want = strings.Replace(want, "/", " /", 1) + ` proxy-authorization=""`
+		if status != http.StatusOK || body != want {
+			t.Errorf("%s: %d %q, want %q", target, status, body, want)
+		}
+	}
+
+	if status, _ := get(&url.URL{Scheme: "http", Host: addr}, "http://10.0.0.2/"); status != http.StatusProxyAuthRequired {
+		t.Errorf("without credentials: %d", status)
+	}
+	proxy.User = url.UserPassword("user", "wrong")
+	if status, _ := get(proxy, "http://10.0.0.2/"); status != http.StatusProxyAuthRequired {
+		t.Errorf("with a wrong password: %d", status)
+	}
+	proxy.User = url.UserPassword("user", "secret")
+	if status, _ := get(proxy, "http://missing.test/"); status != http.StatusBadGateway {
+		t.Errorf("unknown host: %d", status)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	addr := startServer(t)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	// Data following the request is passed on too.
+	fmt.Fprintf(c, "CONNECT web.test:7 HTTP/1.1\r\nHost: web.test:7\r\nProxy-Authorization: Basic dXNlcjpzZWNyZXQ=\r\n\r\nearly ")
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	io.WriteString(c, "late")
+	buf := make([]byte, len("early late"))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "early late" {
+		t.Fatalf("got %q", buf)
+	}
+}
+
+func TestPAC(t *testing.T) {
+	addr := startServer(t)
+
+	resp, err := http.Get("http://" + addr + PACPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"PROXY `+addr+`"`) {
+		t.Fatalf("%d %s", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,328 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"syscall"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// An ICMPError is an ICMP error message about a packet sent by a socket,
+// such as a destination unreachable or time exceeded message. It wraps the
+// errno Linux reports for the message, so that errors.Is(err,
+// syscall.EHOSTUNREACH) works.
+type ICMPError struct {
+	// From is the address of the router or host that sent the message,
+	// and Dst the destination of the packet it is about.
+	From netip.Addr
+	Dst  netip.AddrPort
+
+	// Type and Code are those of the ICMPv4 or ICMPv6 message, by the
+	// family of From.
+	Type, Code uint8
+
+	// MTU is the next-hop MTU of a fragmentation needed or packet too big
+	// message.
+	MTU int
+
+	Err syscall.Errno
+}
+
+func (e *ICMPError) Error() string {
+	return fmt.Sprintf("%s from %v: %v", e.message(), e.From, e.Err)
+}
+
+func (e *ICMPError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ICMPError) message() string {
+	if e.From.Is6() {
+		switch header.ICMPv6Type(e.Type) {
+		case header.ICMPv6DstUnreachable:
+			return "destination unreachable"
+		case header.ICMPv6PacketTooBig:
+			return "packet too big"
+		case header.ICMPv6TimeExceeded:
+			return "time exceeded"
+		case header.ICMPv6ParamProblem:
+			return "parameter problem"
+		}
+	} else {
+		switch header.ICMPv4Type(e.Type) {
+		case header.ICMPv4DstUnreachable:
+			if header.ICMPv4Code(e.Code) == header.ICMPv4FragmentationNeeded {
+				return "fragmentation needed"
+			}
+			return "destination unreachable"
+		case header.ICMPv4TimeExceeded:
+			return "time exceeded"
+		case header.ICMPv4ParamProblem:
+			return "parameter problem"
+		}
+	}
+	return "ICMP error"
+}
+
+// icmpErrno returns the errno of an ICMP error message as Linux maps it,
+// and whether it is a hard error, which is reported to connected sockets
+// even without asking for all errors.
+func icmpErrno(v6 bool, typ, code uint8) (errno syscall.Errno, hard, ok bool) {
+	if v6 {
+		switch header.ICMPv6Type(typ) {
+		case header.ICMPv6DstUnreachable:
+			switch header.ICMPv6Code(code) {
+			case header.ICMPv6NetworkUnreachable:
+				return syscall.ENETUNREACH, false, true
+			case header.ICMPv6Prohibited, header.ICMPv6Policy, header.ICMPv6RejectRoute:
+				return syscall.EACCES, true, true
+			case header.ICMPv6PortUnreachable:
+				return syscall.ECONNREFUSED, true, true
+			}
+			return syscall.EHOSTUNREACH, false, true
+		case header.ICMPv6PacketTooBig:
+			return syscall.EMSGSIZE, false, true
+		case header.ICMPv6TimeExceeded:
+			return syscall.EHOSTUNREACH, false, true
+		case header.ICMPv6ParamProblem:
+			return syscall.EPROTO, true, true
+		}
+		return 0, false, false
+	}
+	switch header.ICMPv4Type(typ) {
+	case header.ICMPv4DstUnreachable:
+		switch header.ICMPv4Code(code) {
+		case header.ICMPv4NetUnreachable, header.ICMPv4NetUnreachableForTos:
+			return syscall.ENETUNREACH, false, true
+		case header.ICMPv4HostUnreachable, header.ICMPv4HostUnreachableForTos:
+			return syscall.EHOSTUNREACH, false, true
+		case header.ICMPv4ProtoUnreachable:
+			return syscall.ENOPROTOOPT, true, true
+		case header.ICMPv4PortUnreachable:
+			return syscall.ECONNREFUSED, true, true
+		case header.ICMPv4FragmentationNeeded:
+			return syscall.EMSGSIZE, false, true
+		case header.ICMPv4SourceRouteFailed:
+			return syscall.EOPNOTSUPP, false, true
+		case header.ICMPv4DestinationNetworkUnknown, header.ICMPv4NetProhibited:
+			return syscall.ENETUNREACH, true, true
+		case header.ICMPv4DestinationHostUnknown:
+			return syscall.EHOSTDOWN, true, true
+		case header.ICMPv4SourceHostIsolated:
+			return errSourceHostIsolated, true, true
+		}
+		return syscall.EHOSTUNREACH, true, true
+	case header.ICMPv4TimeExceeded:
+		return syscall.EHOSTUNREACH, false, true
+	case header.ICMPv4ParamProblem:
+		return syscall.EPROTO, true, true
+	}
+	return 0, false, false
+}
+
+// parseICMPError parses an ICMP error message received by the stack, and
+// returns the flow of the packet it is about, as seen from the stack.
+func parseICMPError(packet []byte) (key flowKey, icmpErr *ICMPError, hard, ok bool) {
+	if len(packet) == 0 {
+		return
+	}
+	var from netip.Addr
+	var msg []byte
+	v6 := packet[0]>>4 == 6
+	if v6 {
+		h := header.IPv6(packet)
+		if !h.IsValid(len(packet)) || h.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return
+		}
+		from, msg = netip.AddrFrom16(h.SourceAddress().As16()), h.Payload()
+	} else {
+		h := header.IPv4(packet)
+		if !h.IsValid(len(packet)) || h.TransportProtocol() != header.ICMPv4ProtocolNumber || h.More() || h.FragmentOffset() != 0 {
+			return
+		}
+		from, msg = netip.AddrFrom4(h.SourceAddress().As4()), h.Payload()
+	}
+	if len(msg) < 8 {
+		return
+	}
+	icmpErr = &ICMPError{From: from, Type: msg[0], Code: msg[1]}
+	icmpErr.Err, hard, ok = icmpErrno(v6, msg[0], msg[1])
+	if !ok {
+		return
+	}
+	switch {
+	case v6 && header.ICMPv6Type(msg[0]) == header.ICMPv6PacketTooBig:
+		icmpErr.MTU = int(binary.BigEndian.Uint32(msg[4:]))
+	case !v6 && header.ICMPv4Code(msg[1]) == header.ICMPv4FragmentationNeeded && header.ICMPv4Type(msg[0]) == header.ICMPv4DstUnreachable:
+		icmpErr.MTU = int(binary.BigEndian.Uint16(msg[6:]))
+	}
+
+	// The message quotes the IP header of the packet and at least the first
+	// 8 bytes of its payload, which hold the ports or the echo identifier.
+	inner := msg[8:]
+	var src, dst netip.Addr
+	var payload []byte
+	if v6 {
+		if len(inner) < header.IPv6MinimumSize+8 || inner[0]>>4 != 6 {
+			return flowKey{}, nil, false, false
+		}
+		h := header.IPv6(inner)
+		src, dst = netip.AddrFrom16(h.SourceAddress().As16()), netip.AddrFrom16(h.DestinationAddress().As16())
+		key.proto, payload = h.TransportProtocol(), inner[header.IPv6MinimumSize:]
+	} else {
+		if len(inner) < header.IPv4MinimumSize || inner[0]>>4 != 4 {
+			return flowKey{}, nil, false, false
+		}
+		h := header.IPv4(inner)
+		hlen := int(h.HeaderLength())
+		if hlen < header.IPv4MinimumSize || len(inner) < hlen+8 || h.FragmentOffset() != 0 {
+			return flowKey{}, nil, false, false
+		}
+		src, dst = netip.AddrFrom4(h.SourceAddress().As4()), netip.AddrFrom4(h.DestinationAddress().As4())
+		key.proto, payload = h.TransportProtocol(), inner[hlen:]
+	}
+	var srcPort, dstPort uint16
+	switch key.proto {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		srcPort, dstPort = binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+	case header.ICMPv4ProtocolNumber, header.ICMPv6ProtocolNumber:
+		// Echo requests are matched to ping sockets by their identifier.
+		if !(v6 && header.ICMPv6Type(payload[0]) == header.ICMPv6EchoRequest || !v6 && header.ICMPv4Type(payload[0]) == header.ICMPv4Echo) {
+			return flowKey{}, nil, false, false
+		}
+		srcPort = binary.BigEndian.Uint16(payload[4:])
+	default:
+		return flowKey{}, nil, false, false
+	}
+	key.local, key.remote = netip.AddrPortFrom(src, srcPort), netip.AddrPortFrom(dst, dstPort)
+	icmpErr.Dst = key.remote
+	return key, icmpErr, hard, true
+}
+
+// maxQueuedErrors bounds the ICMP errors waiting to be read on a socket.
+const maxQueuedErrors = 16
+
+// An errorQueue holds the ICMP errors reported to a socket until it reads
+// them.
+type errorQueue struct {
+	ep tcpip.Endpoint
+	wq *waiter.Queue
+
+	mu   sync.Mutex
+	errs []*ICMPError
+	all  bool // report soft errors, and errors to unconnected sockets
+}
+
+// push queues err, unless the socket does not want it, and wakes up its
+// readers.
+func (q *errorQueue) push(err *ICMPError, hard, connected bool) {
+	q.mu.Lock()
+	if !q.all && !(hard && connected) || len(q.errs) >= maxQueuedErrors {
+		q.mu.Unlock()
+		return
+	}
+	q.errs = append(q.errs, err)
+	q.mu.Unlock()
+	q.wq.Notify(waiter.ReadableEvents)
+}
+
+// pop returns the oldest queued error, or nil if there is none.
+func (q *errorQueue) pop() *ICMPError {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.errs) == 0 {
+		return nil
+	}
+	err := q.errs[0]
+	q.errs = q.errs[1:]
+	return err
+}
+
+func (q *errorQueue) pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.errs) > 0
+}
+
+func (q *errorQueue) setAll(all bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.all = all
+}
+
+// errorEndpoint fails reads while ICMP errors are queued, so that the
+// gonet connection reading from it returns and lets them be reported. The
+// errors the endpoint keeps itself are dropped, as they are queued too.
+type errorEndpoint struct {
+	tcpip.Endpoint
+	errs *errorQueue
+}
+
+func (ep *errorEndpoint) Read(dst io.Writer, opts tcpip.ReadOptions) (tcpip.ReadResult, tcpip.Error) {
+	ep.Endpoint.LastError()
+	if ep.errs.pending() {
+		return tcpip.ReadResult{}, &tcpip.ErrHostUnreachable{}
+	}
+	return ep.Endpoint.Read(dst, opts)
+}
+
+func (tnet *Net) registerErrors(q *errorQueue) {
+	tnet.errMu.Lock()
+	defer tnet.errMu.Unlock()
+	if tnet.errQueues == nil {
+		tnet.errQueues = make(map[*errorQueue]bool)
+	}
+	tnet.errQueues[q] = true
+}
+
+func (tnet *Net) unregisterErrors(q *errorQueue) {
+	tnet.errMu.Lock()
+	defer tnet.errMu.Unlock()
+	delete(tnet.errQueues, q)
+}
+
+// handleICMPError reports an ICMP error message received by a device to
+// the socket that sent the packet it is about, preferring connected
+// sockets, and learns the path MTU it carries. The stack still handles the
+// message itself, which is how TCP connections learn about it.
+func (tnet *Net) handleICMPError(packet []byte) {
+	key, icmpErr, hard, ok := parseICMPError(packet)
+	if !ok {
+		return
+	}
+	if icmpErr.MTU != 0 {
+		tnet.pathMTUs.learn(key.remote.Addr(), icmpErr.MTU)
+	}
+
+	tnet.errMu.Lock()
+	var match *errorQueue
+	connected := false
+	for q := range tnet.errQueues {
+		qkey, ok := endpointKey(q.ep)
+		if !ok || !qkey.matches(key) {
+			continue
+		}
+		if !qkey.wildcard() {
+			match, connected = q, true
+			break
+		}
+		if match == nil {
+			match = q
+		}
+	}
+	tnet.errMu.Unlock()
+	if match != nil {
+		match.push(icmpErr, hard, connected)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import "syscall"
+
+// errSourceHostIsolated stands in for ENONET, which Linux reports for ICMP
+// source host isolated errors but other systems lack.
+const errSourceHostIsolated = syscall.EHOSTUNREACH
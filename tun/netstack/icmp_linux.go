@@ -0,0 +1,12 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import "syscall"
+
+// errSourceHostIsolated is the errno Linux reports for ICMP source host
+// isolated errors.
+const errSourceHostIsolated = syscall.ENONET
@@ -0,0 +1,239 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/checksum"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+)
+
+var (
+	icmpLocal  = netip.MustParseAddr("10.0.0.1")
+	icmpRouter = netip.MustParseAddr("10.9.9.9")
+	icmpRemote = netip.MustParseAddr("192.0.2.1")
+)
+
+// An icmpTest is a stack whose device is driven by the test, which plays
+// the router on the path to icmpRemote.
+type icmpTest struct {
+	dev     tun.Device
+	tnet    *netstack.Net
+	packets chan header.IPv4
+}
+
+func newICMPTest(t *testing.T, options *netstack.Options) *icmpTest {
+	dev, tnet, err := netstack.CreateNetTUNWithOptions([]netip.Addr{icmpLocal}, nil, 1500, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dev.Close() })
+	test := &icmpTest{dev, tnet, make(chan header.IPv4, 16)}
+	go func() {
+		for {
+			bufs, sizes := [][]byte{make([]byte, 2000)}, []int{0}
+			if _, err := dev.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+			test.packets <- header.IPv4(bufs[0][:sizes[0]])
+		}
+	}()
+	return test
+}
+
+// readPacket returns the next packet the stack sends.
+func (test *icmpTest) readPacket(t *testing.T) header.IPv4 {
+	t.Helper()
+	select {
+	case packet := <-test.packets:
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet sent")
+		return nil
+	}
+}
+
+// writeICMPError makes the router answer packet with an ICMP error.
+func (test *icmpTest) writeICMPError(t *testing.T, packet header.IPv4, typ header.ICMPv4Type, code header.ICMPv4Code, mtu uint16) {
+	t.Helper()
+	quoted := packet[:int(packet.HeaderLength())+8]
+	b := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+len(quoted))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(b)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     tcpip.AddrFrom4(icmpRouter.As4()),
+		DstAddr:     tcpip.AddrFrom4(icmpLocal.As4()),
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(typ)
+	icmp.SetCode(code)
+	binary.BigEndian.PutUint16(icmp[6:], mtu)
+	copy(icmp[header.ICMPv4MinimumSize:], quoted)
+	icmp.SetChecksum(^checksum.Checksum(icmp, 0))
+	if _, err := test.dev.Write([][]byte{b}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func TestUDPICMPErrors(t *testing.T) {
+	test := newICMPTest(t, nil)
+	c, err := test.tnet.DialUDPAddrPortWithErrors(netip.AddrPort{}, netip.AddrPortFrom(icmpRemote, 33434))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Connected sockets get hard errors.
+	if _, err := c.Write([]byte("probe")); err != nil {
+		t.Fatal(err)
+	}
+	test.writeICMPError(t, test.readPacket(t), header.ICMPv4DstUnreachable, header.ICMPv4HostProhibited, 0)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 100))
+	var icmpErr *netstack.ICMPError
+	if !errors.As(err, &icmpErr) || !errors.Is(err, syscall.EHOSTUNREACH) {
+		t.Fatalf("read error %v", err)
+	}
+	if icmpErr.From != icmpRouter || icmpErr.Dst != netip.AddrPortFrom(icmpRemote, 33434) {
+		t.Errorf("ICMP error %+v", icmpErr)
+	}
+
+	// Port unreachable messages, which the stack handles too, are reported
+	// once.
+	if _, err := c.Write([]byte("probe")); err != nil {
+		t.Fatal(err)
+	}
+	test.writeICMPError(t, test.readPacket(t), header.ICMPv4DstUnreachable, header.ICMPv4PortUnreachable, 0)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 100)); !errors.As(err, &icmpErr) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("read error %v", err)
+	}
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 100)); !isTimeout(err) {
+		t.Fatalf("read error %v, want a timeout", err)
+	}
+
+	// Soft errors are only reported when asked for.
+	if _, err := c.Write([]byte("probe")); err != nil {
+		t.Fatal(err)
+	}
+	test.writeICMPError(t, test.readPacket(t), header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded, 0)
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 100)); !isTimeout(err) {
+		t.Fatalf("read error %v, want a timeout", err)
+	}
+	c.SetReceiveErrors(true)
+	if _, err := c.Write([]byte("probe")); err != nil {
+		t.Fatal(err)
+	}
+	test.writeICMPError(t, test.readPacket(t), header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded, 0)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 100))
+	if !errors.As(err, &icmpErr) || icmpErr.Type != uint8(header.ICMPv4TimeExceeded) {
+		t.Fatalf("read error %v", err)
+	}
+}
+
+func TestPingTTL(t *testing.T) {
+	test := newICMPTest(t, nil)
+	pc, err := test.tnet.DialPingAddr(netip.Addr{}, icmpRemote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if err := pc.SetTTL(256); err == nil {
+		t.Error("accepted a TTL of 256")
+	}
+	if err := pc.SetTTL(1); err != nil {
+		t.Fatal(err)
+	}
+
+	request := make([]byte, header.ICMPv4MinimumSize)
+	header.ICMPv4(request).SetType(header.ICMPv4Echo)
+	if _, err := pc.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	packet := test.readPacket(t)
+	if packet.TTL() != 1 {
+		t.Errorf("TTL %d, want 1", packet.TTL())
+	}
+	test.writeICMPError(t, packet, header.ICMPv4TimeExceeded, header.ICMPv4TTLExceeded, 0)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = pc.Read(make([]byte, 100))
+	var icmpErr *netstack.ICMPError
+	if !errors.As(err, &icmpErr) || icmpErr.From != icmpRouter || icmpErr.Type != uint8(header.ICMPv4TimeExceeded) {
+		t.Fatalf("read error %v", err)
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	test := newICMPTest(t, &netstack.Options{EnablePathMTUDiscovery: true})
+	c, err := test.tnet.DialUDPAddrPortWithErrors(netip.AddrPort{}, netip.AddrPortFrom(icmpRemote, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	send := func(n int) header.IPv4 {
+		t.Helper()
+		if _, err := c.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		return test.readPacket(t)
+	}
+	if packet := send(1400); packet.Flags()&header.IPv4FlagDontFragment == 0 || !packet.IsChecksumValid() {
+		t.Error("don't fragment not set without a known path MTU")
+	}
+	test.writeICMPError(t, send(1400), header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, 1280)
+	if mtu := test.tnet.PathMTU(icmpRemote); mtu != 1280 {
+		t.Errorf("path MTU %d, want 1280", mtu)
+	}
+	if mtu := c.PathMTU(); mtu != 1280 {
+		t.Errorf("path MTU of the connection %d, want 1280", mtu)
+	}
+	if packet := send(100); packet.Flags()&header.IPv4FlagDontFragment == 0 {
+		t.Error("don't fragment not set on a small packet")
+	}
+	if packet := send(1400); packet.Flags()&header.IPv4FlagDontFragment != 0 {
+		t.Error("don't fragment set on a packet larger than the path MTU")
+	}
+
+	// The path MTU only shrinks, and not below the minimum.
+	test.writeICMPError(t, send(100), header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, 1400)
+	test.writeICMPError(t, send(100), header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, 68)
+	if mtu := test.tnet.PathMTU(icmpRemote); mtu != 552 {
+		t.Errorf("path MTU %d, want 552", mtu)
+	}
+
+	test = newICMPTest(t, nil)
+	c, err = test.tnet.DialUDPAddrPortWithErrors(netip.AddrPort{}, netip.AddrPortFrom(icmpRemote, 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if packet := send(100); packet.Flags()&header.IPv4FlagDontFragment != 0 {
+		t.Error("don't fragment set without path MTU discovery")
+	}
+}
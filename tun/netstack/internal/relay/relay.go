@@ -0,0 +1,36 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package relay copies streams between connections for the servers that
+// run over the userspace network stack.
+package relay
+
+import (
+	"io"
+	"net"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Splice copies between a and b in both directions, passing on half
+// closes, until both are done.
+func Splice(a, b net.Conn) {
+	done := make(chan struct{})
+	copyHalf := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
@@ -0,0 +1,223 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// An SNATRule rewrites the source of the packets from Source that the
+// stack forwards through the device of NIC to Address, or to the address
+// of that NIC if Address is unset, as masquerading does.
+type SNATRule struct {
+	Source  netip.Prefix
+	NIC     int
+	Address netip.Addr
+}
+
+// SetSNAT replaces the source NAT rules of the stack. With rules, the
+// stack forwards the packets from the source of each rule to its NIC, and
+// the replies back, following the routes set by SetRoutes, so that the
+// clients behind one device reach the tunnel of another one through a
+// single address. Other packets are not forwarded, and forwarding is only
+// enabled on the NICs of the rules and those with routes to their sources.
+// Replies are translated back by connection tracking, ICMP errors
+// included. As forwarded packets cannot be told from its own once
+// translated, the stack leaves their don't fragment flag as it is while it
+// forwards.
+func (tnet *Net) SetSNAT(rules []SNATRule) error {
+	var v4, v6, forward4, forward6 []stack.Rule
+	for _, rule := range rules {
+		if !rule.Source.IsValid() {
+			return fmt.Errorf("invalid SNAT source %v", rule.Source)
+		}
+		if !tnet.stack.HasNIC(tcpip.NICID(rule.NIC)) {
+			return fmt.Errorf("SNAT of %v: no NIC %d", rule.Source, rule.NIC)
+		}
+		if rule.Address.IsValid() && rule.Address.Is4() != rule.Source.Addr().Is4() {
+			return fmt.Errorf("SNAT of %v to %v: mismatched address families", rule.Source, rule.Address)
+		}
+		if rule.Source.Addr().Is4() {
+			v4 = append(v4, snatRule(rule, ipv4.ProtocolNumber))
+			forward4 = append(forward4, forwardRules(rule, ipv4.ProtocolNumber)...)
+		} else {
+			v6 = append(v6, snatRule(rule, ipv6.ProtocolNumber))
+			forward6 = append(forward6, forwardRules(rule, ipv6.ProtocolNumber)...)
+		}
+	}
+
+	tnet.mu.Lock()
+	defer tnet.mu.Unlock()
+	if err := tnet.setForwardingLocked(rules); err != nil {
+		return err
+	}
+	tnet.forwarding.Store(len(rules) != 0)
+	iptables := tnet.stack.IPTables()
+	iptables.ReplaceTable(stack.FilterID, filterTable(forward4, ipv4.ProtocolNumber), false)
+	iptables.ReplaceTable(stack.FilterID, filterTable(forward6, ipv6.ProtocolNumber), true)
+	iptables.ReplaceTable(stack.NATID, natTable(v4, ipv4.ProtocolNumber), false)
+	iptables.ReplaceTable(stack.NATID, natTable(v6, ipv6.ProtocolNumber), true)
+	tnet.snat = append([]SNATRule(nil), rules...)
+	return nil
+}
+
+// setForwardingLocked enables forwarding on the NICs of rules and the NICs
+// with routes to their sources, and disables it on all others.
+//
+// Must hold tnet.mu.
+func (tnet *Net) setForwardingLocked(rules []SNATRule) error {
+	involved := make(map[tcpip.NICID]bool)
+	routes := tnet.Routes()
+	for _, rule := range rules {
+		involved[tcpip.NICID(rule.NIC)] = true
+		for _, route := range routes {
+			if route.Destination.Overlaps(rule.Source) {
+				involved[tcpip.NICID(route.NIC)] = true
+			}
+		}
+	}
+	for nic := range tnet.stack.NICInfo() {
+		for _, proto := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+			if _, tcpipErr := tnet.stack.SetNICForwarding(nic, proto, involved[nic]); tcpipErr != nil {
+				return fmt.Errorf("could not set forwarding on NIC %d: %v", nic, tcpipErr)
+			}
+		}
+	}
+	return nil
+}
+
+// SNAT returns the source NAT rules of the stack.
+func (tnet *Net) SNAT() []SNATRule {
+	tnet.mu.Lock()
+	defer tnet.mu.Unlock()
+	return append([]SNATRule(nil), tnet.snat...)
+}
+
+// snatRule returns the iptables rule of rule, on the postrouting hook.
+func snatRule(rule SNATRule, proto tcpip.NetworkProtocolNumber) stack.Rule {
+	filter := stack.EmptyFilter4()
+	if proto == ipv6.ProtocolNumber {
+		filter = stack.EmptyFilter6()
+	}
+	prefix := rule.Source.Masked()
+	filter.Src = tcpip.AddrFromSlice(prefix.Addr().AsSlice())
+	filter.SrcMask = tcpip.AddrFromSlice(net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()))
+	var target stack.Target = &stack.MasqueradeTarget{NetworkProtocol: proto}
+	if rule.Address.IsValid() {
+		target = &stack.SNATTarget{
+			Addr:            tcpip.AddrFromSlice(rule.Address.AsSlice()),
+			NetworkProtocol: proto,
+			ChangeAddress:   true,
+			ChangePort:      true,
+		}
+	}
+	return stack.Rule{
+		Filter:   filter,
+		Matchers: []stack.Matcher{outputNIC(nicName(tcpip.NICID(rule.NIC)))},
+		Target:   target,
+	}
+}
+
+// forwardRules returns the iptables rules on the forward hook that accept
+// the packets of rule and their replies.
+func forwardRules(rule SNATRule, proto tcpip.NetworkProtocolNumber) []stack.Rule {
+	out, in := stack.EmptyFilter4(), stack.EmptyFilter4()
+	if proto == ipv6.ProtocolNumber {
+		out, in = stack.EmptyFilter6(), stack.EmptyFilter6()
+	}
+	prefix := rule.Source.Masked()
+	addr := tcpip.AddrFromSlice(prefix.Addr().AsSlice())
+	mask := tcpip.AddrFromSlice(net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()))
+	out.Src, out.SrcMask, out.OutputInterface = addr, mask, nicName(tcpip.NICID(rule.NIC))
+	in.Dst, in.DstMask, in.InputInterface = addr, mask, nicName(tcpip.NICID(rule.NIC))
+	return []stack.Rule{
+		{Filter: out, Target: &stack.AcceptTarget{NetworkProtocol: proto}},
+		{Filter: in, Target: &stack.AcceptTarget{NetworkProtocol: proto}},
+	}
+}
+
+// filterTable returns the filter table of a family with the rules on the
+// forward hook, where other packets are dropped, and all other packets
+// accepted.
+func filterTable(rules []stack.Rule, proto tcpip.NetworkProtocolNumber) stack.Table {
+	empty := stack.EmptyFilter4()
+	if proto == ipv6.ProtocolNumber {
+		empty = stack.EmptyFilter6()
+	}
+	accept := stack.Rule{Filter: empty, Target: &stack.AcceptTarget{NetworkProtocol: proto}}
+	drop := stack.Rule{Filter: empty, Target: &stack.DropTarget{NetworkProtocol: proto}}
+	table := stack.Table{
+		Rules: []stack.Rule{accept},
+		BuiltinChains: [stack.NumHooks]int{
+			stack.Prerouting:  stack.HookUnset,
+			stack.Input:       0,
+			stack.Forward:     1,
+			stack.Output:      2 + len(rules),
+			stack.Postrouting: stack.HookUnset,
+		},
+	}
+	table.Rules = append(table.Rules, rules...)
+	table.Rules = append(table.Rules, drop, accept, stack.Rule{Filter: empty, Target: &stack.ErrorTarget{NetworkProtocol: proto}})
+	table.Underflows = [stack.NumHooks]int{
+		stack.Prerouting:  stack.HookUnset,
+		stack.Input:       0,
+		stack.Forward:     1 + len(rules),
+		stack.Output:      2 + len(rules),
+		stack.Postrouting: stack.HookUnset,
+	}
+	return table
+}
+
+// natTable returns the NAT table of a family with the rules on the
+// postrouting hook, and all other packets accepted.
+func natTable(rules []stack.Rule, proto tcpip.NetworkProtocolNumber) stack.Table {
+	empty := stack.EmptyFilter4()
+	if proto == ipv6.ProtocolNumber {
+		empty = stack.EmptyFilter6()
+	}
+	accept := stack.Rule{Filter: empty, Target: &stack.AcceptTarget{NetworkProtocol: proto}}
+	table := stack.Table{
+		Rules: []stack.Rule{accept, accept, accept},
+		BuiltinChains: [stack.NumHooks]int{
+			stack.Prerouting:  0,
+			stack.Input:       1,
+			stack.Forward:     stack.HookUnset,
+			stack.Output:      2,
+			stack.Postrouting: 3,
+		},
+	}
+	table.Rules = append(table.Rules, rules...)
+	table.Rules = append(table.Rules, accept, stack.Rule{Filter: empty, Target: &stack.ErrorTarget{NetworkProtocol: proto}})
+	table.Underflows = [stack.NumHooks]int{
+		stack.Prerouting:  0,
+		stack.Input:       1,
+		stack.Forward:     stack.HookUnset,
+		stack.Output:      2,
+		stack.Postrouting: 3 + len(rules),
+	}
+	return table
+}
+
+// nicName is the name of a NIC, which rules match packets on.
+func nicName(nic tcpip.NICID) string {
+	return fmt.Sprintf("nic%d", nic)
+}
+
+// outputNIC matches the packets sent through the NIC of that name. The
+// header filter of the stack ignores the outgoing NIC on the postrouting
+// hook.
+type outputNIC string
+
+func (name outputNIC) Match(hook stack.Hook, pkt stack.PacketBufferPtr, _, outNIC string) (bool, bool) {
+	return hook == stack.Postrouting && outNIC == string(name), false
+}
@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"context"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+func TestSNAT(t *testing.T) {
+	// The first stack of the pair is a router between its tunnel to the
+	// second one and a LAN of clients on a second NIC.
+	nets := netstacktest.NewPair(t)
+	router := nets[0]
+	lan, nic, err := router.AddNIC([]netip.Addr{netip.MustParseAddr("10.1.0.1")}, device.DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientDev, client, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.1.0.2")}, nil, device.DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netstacktest.Connect(t, [2]tun.Device{clientDev, lan})
+	if err := router.SetRoutes([]netstack.Route{
+		{Destination: netip.MustParsePrefix("0.0.0.0/0"), NIC: netstack.DefaultNIC},
+		{Destination: netip.MustParsePrefix("10.1.0.0/16"), NIC: nic},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server := netip.AddrPortFrom(netstacktest.Addrs[1], 7)
+	netstacktest.ServeEcho(t, nets[1], server)
+
+	// Without SNAT rules, the router does not forward.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if c, err := client.DialContextTCPAddrPort(ctx, server); err == nil {
+		c.Close()
+		t.Fatal("connected through a router that does not forward")
+	}
+
+	if err := router.SetSNAT([]netstack.SNATRule{{Source: netip.MustParsePrefix("10.1.0.2/32"), NIC: 42}}); err == nil {
+		t.Error("accepted a rule for a missing NIC")
+	}
+
+	// Packets from sources without a rule are not forwarded either.
+	if err := router.SetSNAT([]netstack.SNATRule{{Source: netip.MustParsePrefix("10.1.0.3/32"), NIC: netstack.DefaultNIC}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if c, err := client.DialContextTCPAddrPort(ctx, server); err == nil {
+		c.Close()
+		t.Fatal("connected from a source without a rule")
+	}
+
+	rules := []netstack.SNATRule{{Source: netip.MustParsePrefix("10.1.0.0/16"), NIC: netstack.DefaultNIC}}
+	if err := router.SetSNAT(rules); err != nil {
+		t.Fatal(err)
+	}
+	if got := router.SNAT(); !reflect.DeepEqual(got, rules) {
+		t.Errorf("SNAT rules %v, want %v", got, rules)
+	}
+
+	// The server sees the connections of the client as coming from the
+	// tunnel address of the router.
+	if err := echo(client, server); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := nets[1].ListenUDPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c, err := client.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(netstacktest.Addrs[1], 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("query")); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 100)
+	n, addr, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from := netip.MustParseAddrPort(addr.String()).Addr(); from != netstacktest.Addrs[0] {
+		t.Errorf("query from %v, want %v", from, netstacktest.Addrs[0])
+	}
+	if _, err := pc.WriteTo(b[:n], addr); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(b); err != nil || string(b[:n]) != "query" {
+		t.Errorf("answer %q, %v", b[:n], err)
+	}
+
+	if err := router.SetSNAT(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(router.SNAT()) != 0 {
+		t.Error("SNAT rules not cleared")
+	}
+}
@@ -0,0 +1,168 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package netstacktest connects userspace network stacks through
+// in-memory tunnels, for testing code that runs over them.
+package netstacktest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/conn/bindtest"
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Addrs and Addrs6 are the tunnel addresses of the stacks returned by
+// NewPair.
+var (
+	Addrs = [2]netip.Addr{
+		netip.MustParseAddr("10.0.0.1"),
+		netip.MustParseAddr("10.0.0.2"),
+	}
+	Addrs6 = [2]netip.Addr{
+		netip.MustParseAddr("fd00::1"),
+		netip.MustParseAddr("fd00::2"),
+	}
+)
+
+// NewPair returns two network stacks on devices that are peers of each
+// other over a bindtest channel. The devices are closed when the test
+// ends.
+func NewPair(tb testing.TB) [2]*netstack.Net {
+	tb.Helper()
+	var devs [2]tun.Device
+	var nets [2]*netstack.Net
+	for i := range nets {
+		var err error
+		devs[i], nets[i], err = netstack.CreateNetTUN([]netip.Addr{Addrs[i], Addrs6[i]}, []netip.Addr{Addrs[1-i]}, device.DefaultMTU)
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+	Connect(tb, devs)
+	return nets
+}
+
+// Connect runs devices on tuns that are peers of each other over a
+// bindtest channel, with all addresses allowed. The devices are closed
+// when the test ends.
+func Connect(tb testing.TB, tuns [2]tun.Device) {
+	tb.Helper()
+	var keys [2]device.NoisePrivateKey
+	for i := range keys {
+		var err error
+		if keys[i], err = device.NewPrivateKey(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	binds := bindtest.NewChannelBinds()
+	for i := range tuns {
+		dev := device.NewDevice(tuns[i], binds[i], device.NewLogger(device.LogLevelError, fmt.Sprintf("dev%d: ", i)))
+		tb.Cleanup(dev.Close)
+		peer := keys[1-i].PublicKey()
+		config := fmt.Sprintf("private_key=%s\npublic_key=%s\nendpoint=127.0.0.1:%d\nallowed_ip=0.0.0.0/0\nallowed_ip=::/0\n",
+			hex.EncodeToString(keys[i][:]), hex.EncodeToString(peer[:]), i+1)
+		if err := dev.IpcSet(config); err != nil {
+			tb.Fatal(err)
+		}
+		if err := dev.Up(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// ServeEcho runs TCP and UDP echo servers on addr of tnet until the test
+// ends.
+func ServeEcho(tb testing.TB, tnet *netstack.Net, addr netip.AddrPort) {
+	tb.Helper()
+	listener, err := tnet.ListenTCPAddrPort(addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	serveUDP(tb, tnet, addr, func(b []byte) []byte { return b })
+}
+
+// ServeDNS runs a DNS server on addr of tnet until the test ends, which
+// answers A and AAAA queries for the names in hosts, given with their
+// trailing dot.
+func ServeDNS(tb testing.TB, tnet *netstack.Net, addr netip.AddrPort, hosts map[string][]netip.Addr) {
+	tb.Helper()
+	serveUDP(tb, tnet, addr, func(b []byte) []byte { return AnswerDNS(b, hosts) })
+}
+
+// AnswerDNS returns the answer to the DNS query b for the names in hosts,
+// or nil if b is not a valid query.
+func AnswerDNS(b []byte, hosts map[string][]netip.Addr) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(b)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	rcode := dnsmessage.RCodeSuccess
+	if _, ok := hosts[q.Name.String()]; !ok {
+		rcode = dnsmessage.RCodeNameError
+	}
+	reply := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, Authoritative: true, RCode: rcode})
+	reply.StartQuestions()
+	reply.Question(q)
+	reply.StartAnswers()
+	for _, ip := range hosts[q.Name.String()] {
+		header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case ip.Is4() && q.Type == dnsmessage.TypeA:
+			reply.AResource(header, dnsmessage.AResource{A: ip.As4()})
+		case ip.Is6() && q.Type == dnsmessage.TypeAAAA:
+			reply.AAAAResource(header, dnsmessage.AAAAResource{AAAA: ip.As16()})
+		}
+	}
+	b, _ = reply.Finish()
+	return b
+}
+
+// serveUDP answers each datagram received on addr of tnet with the result
+// of handle, if it is not nil.
+func serveUDP(tb testing.TB, tnet *netstack.Net, addr netip.AddrPort, handle func([]byte) []byte) {
+	pc, err := tnet.ListenUDPAddrPort(addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if reply := handle(buf[:n]); reply != nil {
+				pc.WriteTo(reply, from)
+			}
+		}
+	}()
+}
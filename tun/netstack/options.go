@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+)
+
+// Options tune the network stack made by CreateNetTUNWithOptions. Zero
+// fields keep the defaults of gVisor.
+type Options struct {
+	// CongestionControl is the TCP congestion control algorithm, "reno"
+	// (the default) or "cubic".
+	CongestionControl string
+
+	// SendBufferSize and ReceiveBufferSize bound the buffers of TCP
+	// connections, which default to 1 MiB and grow up to 4 MiB.
+	SendBufferSize    BufferSizeRange
+	ReceiveBufferSize BufferSizeRange
+
+	// ModerateReceiveBuffer grows the receive buffers with the
+	// bandwidth-delay product of the connection, up to the maximum size.
+	ModerateReceiveBuffer bool
+
+	// DisableSACK turns off TCP selective acknowledgements, which are on
+	// by default.
+	DisableSACK bool
+
+	// QueueLength is the number of packets the stack queues for the
+	// device to read, 1024 by default.
+	QueueLength int
+
+	// KeepAlive is used for the TCP connections dialed through the stack.
+	KeepAlive KeepAlive
+
+	// ICMPRateLimit is the number of ICMP errors the stack sends per
+	// second, and ICMPBurst the number it may send at once.
+	ICMPRateLimit rate.Limit
+	ICMPBurst     int
+
+	// EnablePathMTUDiscovery sets the don't fragment flag of outgoing IPv4
+	// packets, so that routers report a smaller path MTU instead of
+	// fragmenting them, and starts new TCP connections with the path MTU
+	// already learned for their destination.
+	EnablePathMTUDiscovery bool
+}
+
+// A BufferSizeRange gives the smallest size a buffer may shrink to, its
+// initial size and the largest size it may grow to, in bytes.
+type BufferSizeRange struct {
+	Min, Default, Max int
+}
+
+// KeepAlive configures TCP keepalives. With a zero Idle time, keepalives
+// are not sent.
+type KeepAlive struct {
+	// Idle is how long a connection stays idle before the first
+	// keepalive, and Interval the time between keepalives.
+	Idle, Interval time.Duration
+
+	// Count is the number of unanswered keepalives after which the
+	// connection is closed.
+	Count int
+}
+
+const defaultQueueLength = 1024
+
+// apply sets the options on the TCP protocol and the ICMP rate limits of
+// s.
+func (opts *Options) apply(s *stack.Stack) error {
+	sack := tcpip.TCPSACKEnabled(!opts.DisableSACK)
+	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack); err != nil {
+		return fmt.Errorf("could not set TCP SACK: %v", err)
+	}
+	if opts.CongestionControl != "" {
+		cc := tcpip.CongestionControlOption(opts.CongestionControl)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &cc); err != nil {
+			return fmt.Errorf("unsupported congestion control %q", opts.CongestionControl)
+		}
+	}
+	if opts.SendBufferSize != (BufferSizeRange{}) {
+		size := tcpip.TCPSendBufferSizeRangeOption(opts.SendBufferSize)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &size); err != nil {
+			return fmt.Errorf("invalid send buffer size %v: %v", opts.SendBufferSize, err)
+		}
+	}
+	if opts.ReceiveBufferSize != (BufferSizeRange{}) {
+		size := tcpip.TCPReceiveBufferSizeRangeOption(opts.ReceiveBufferSize)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &size); err != nil {
+			return fmt.Errorf("invalid receive buffer size %v: %v", opts.ReceiveBufferSize, err)
+		}
+	}
+	if opts.ModerateReceiveBuffer {
+		moderate := tcpip.TCPModerateReceiveBufferOption(true)
+		if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, &moderate); err != nil {
+			return fmt.Errorf("could not moderate the receive buffer: %v", err)
+		}
+	}
+	if opts.ICMPRateLimit != 0 {
+		s.SetICMPLimit(opts.ICMPRateLimit)
+	}
+	if opts.ICMPBurst != 0 {
+		s.SetICMPBurst(opts.ICMPBurst)
+	}
+	return nil
+}
+
+// set enables keepalives on the TCP endpoint ep, if configured.
+func (ka KeepAlive) set(ep tcpip.Endpoint) tcpip.Error {
+	if ka.Idle <= 0 {
+		return nil
+	}
+	idle := tcpip.KeepaliveIdleOption(ka.Idle)
+	if err := ep.SetSockOpt(&idle); err != nil {
+		return err
+	}
+	if ka.Interval > 0 {
+		interval := tcpip.KeepaliveIntervalOption(ka.Interval)
+		if err := ep.SetSockOpt(&interval); err != nil {
+			return err
+		}
+	}
+	if ka.Count > 0 {
+		if err := ep.SetSockOptInt(tcpip.KeepaliveCountOption, ka.Count); err != nil {
+			return err
+		}
+	}
+	ep.SocketOptions().SetKeepAlive(true)
+	return nil
+}
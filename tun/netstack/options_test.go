@@ -0,0 +1,73 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func TestOptions(t *testing.T) {
+	addrs := []netip.Addr{netip.MustParseAddr("10.0.0.1")}
+	options := &Options{
+		CongestionControl:     "cubic",
+		ReceiveBufferSize:     BufferSizeRange{Min: 4 << 10, Default: 1 << 20, Max: 32 << 20},
+		ModerateReceiveBuffer: true,
+		DisableSACK:           true,
+		QueueLength:           16,
+		KeepAlive:             KeepAlive{Idle: time.Minute, Interval: 10 * time.Second, Count: 3},
+	}
+	dev, tnet, err := CreateNetTUNWithOptions(addrs, nil, 1420, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	var cc tcpip.CongestionControlOption
+	var rcvBuf tcpip.TCPReceiveBufferSizeRangeOption
+	var moderate tcpip.TCPModerateReceiveBufferOption
+	var sack tcpip.TCPSACKEnabled
+	for _, opt := range []tcpip.GettableTransportProtocolOption{&cc, &rcvBuf, &moderate, &sack} {
+		if err := tnet.stack.TransportProtocolOption(tcp.ProtocolNumber, opt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cc != "cubic" || rcvBuf.Max != 32<<20 || !bool(moderate) || bool(sack) {
+		t.Errorf("got congestion control %s, receive buffer %v, moderate %v, SACK %v", cc, rcvBuf, moderate, sack)
+	}
+
+	var wq waiter.Queue
+	ep, tcpipErr := tnet.stack.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpipErr != nil {
+		t.Fatal(tcpipErr)
+	}
+	defer ep.Close()
+	if err := tnet.keepAlive.set(ep); err != nil {
+		t.Fatal(err)
+	}
+	var idle tcpip.KeepaliveIdleOption
+	ep.GetSockOpt(&idle)
+	count, _ := ep.GetSockOptInt(tcpip.KeepaliveCountOption)
+	if !ep.SocketOptions().GetKeepAlive() || time.Duration(idle) != time.Minute || count != 3 {
+		t.Errorf("keepalive %v, idle %v, count %d", ep.SocketOptions().GetKeepAlive(), time.Duration(idle), count)
+	}
+
+	for _, options := range []*Options{
+		{CongestionControl: "bbr"},
+		{SendBufferSize: BufferSizeRange{Min: 1 << 20, Default: 1 << 10, Max: 1 << 30}},
+	} {
+		if dev, _, err := CreateNetTUNWithOptions(addrs, nil, 1420, options); err == nil {
+			dev.Close()
+			t.Errorf("accepted %+v", options)
+		}
+	}
+}
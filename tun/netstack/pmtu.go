@@ -0,0 +1,143 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// pathMTUExpiry is how long a learned path MTU is used before the
+	// larger MTU of the device is tried again, as RFC 1191 suggests.
+	pathMTUExpiry = 10 * time.Minute
+
+	// maxPathMTUs bounds the number of destinations whose path MTU is
+	// remembered.
+	maxPathMTUs = 4096
+
+	// minPathMTU4 is the smallest path MTU believed for IPv4, as Linux
+	// does, so that forged messages cannot shrink packets to nothing.
+	minPathMTU4 = 552
+)
+
+type pathMTU struct {
+	mtu     int
+	expires time.Time
+}
+
+// A pathMTUCache remembers the path MTUs learned from fragmentation needed
+// and packet too big messages.
+type pathMTUCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]pathMTU
+}
+
+// learn records that the path to dst takes packets of at most mtu bytes.
+// The path MTU of a destination only shrinks until it expires.
+func (c *pathMTUCache) learn(dst netip.Addr, mtu int) {
+	min := minPathMTU4
+	if dst.Is6() {
+		min = header.IPv6MinimumMTU
+	}
+	if mtu < min {
+		mtu = min
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[netip.Addr]pathMTU)
+	}
+	if old, ok := c.entries[dst]; ok && now.Before(old.expires) && old.mtu <= mtu {
+		return
+	}
+	if len(c.entries) >= maxPathMTUs {
+		for addr, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, addr)
+			}
+		}
+		if len(c.entries) >= maxPathMTUs {
+			return
+		}
+	}
+	c.entries[dst] = pathMTU{mtu, now.Add(pathMTUExpiry)}
+}
+
+// lookup returns the path MTU to dst, or 0 if it is not known.
+func (c *pathMTUCache) lookup(dst netip.Addr) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[dst]
+	if !ok {
+		return 0
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, dst)
+		return 0
+	}
+	return entry.mtu
+}
+
+// PathMTU returns the path MTU to dst learned from ICMP fragmentation
+// needed and packet too big messages, or 0 if none was received lately.
+func (tnet *Net) PathMTU(dst netip.Addr) int {
+	return tnet.pathMTUs.lookup(dst.Unmap())
+}
+
+// markDontFragment sets the don't fragment flag of an outgoing IPv4
+// packet, so that routers report a smaller path MTU instead of
+// fragmenting it. Packets larger than the known path MTU are left for
+// routers to fragment, as the stack does not fragment them itself.
+func (tnet *Net) markDontFragment(packet []byte) {
+	if len(packet) < header.IPv4MinimumSize || packet[0]>>4 != 4 {
+		return
+	}
+	h := header.IPv4(packet)
+	if h.Flags() != 0 || h.FragmentOffset() != 0 || int(h.HeaderLength()) < header.IPv4MinimumSize {
+		return
+	}
+	if mtu := tnet.pathMTUs.lookup(netip.AddrFrom4(h.DestinationAddress().As4())); mtu != 0 && len(packet) > mtu {
+		return
+	}
+	h.SetFlagsFragmentOffset(header.IPv4FlagDontFragment, 0)
+	h.SetChecksum(0)
+	h.SetChecksum(^h.CalculateChecksum())
+}
+
+// seedPathMTU lowers the segment size of a new TCP connection to the
+// path MTU already known for its destination.
+func (tnet *Net) seedPathMTU(ep tcpip.Endpoint, dst netip.Addr) {
+	mtu := tnet.pathMTUs.lookup(dst)
+	te, ok := ep.(stack.TransportEndpoint)
+	if mtu == 0 || !ok {
+		return
+	}
+	if dst.Is4() {
+		mtu -= header.IPv4MinimumSize
+	} else {
+		mtu -= header.IPv6MinimumSize
+	}
+	te.HandleError(packetTooBig(mtu), nil)
+}
+
+// packetTooBig is the transport error a network endpoint passes on for a
+// packet too big message, with the MTU left for the transport layer.
+type packetTooBig uint32
+
+func (packetTooBig) Origin() tcpip.SockErrOrigin { return tcpip.SockExtErrorOriginLocal }
+func (packetTooBig) Type() uint8                 { return 0 }
+func (packetTooBig) Code() uint8                 { return 0 }
+func (mtu packetTooBig) Info() uint32            { return uint32(mtu) }
+func (packetTooBig) Kind() stack.TransportErrorKind {
+	return stack.PacketTooBigTransportError
+}
@@ -0,0 +1,362 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package portforward exposes services across the userspace network stack
+// of a tunnel: it forwards host ports into the tunnel, and ports in the
+// tunnel to the host, for TCP and UDP.
+package portforward
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/internal/relay"
+)
+
+const (
+	DefaultUDPIdleTimeout = time.Minute
+	dialTimeout           = 10 * time.Second
+	maxDatagramSize       = 65535
+	maxUDPFlows           = 1024 // clients of a single UDP rule
+	udpFlowQueueSize      = 64   // datagrams waiting for a flow to send them
+)
+
+// A Rule forwards the connections and datagrams received on Listen to
+// Target. Forward rules listen on the host and dial into the tunnel, and
+// reverse rules listen in the tunnel and dial on the host.
+type Rule struct {
+	Network string // "tcp" or "udp"
+	Reverse bool
+	Listen  netip.AddrPort
+	Target  string // host:port, resolved when dialing
+}
+
+func (rule Rule) String() string {
+	direction := "->"
+	if rule.Reverse {
+		direction = "<-"
+	}
+	return fmt.Sprintf("%s %v %s %s", rule.Network, rule.Listen, direction, rule.Target)
+}
+
+// ParseRule parses a rule of the form [tcp:|udp:]LISTEN=TARGET, where
+// LISTEN is an address and port, or only a port, and TARGET is a host and
+// port. Forward rules listening on a port only bind the loopback address,
+// and reverse ones all addresses of the tunnel.
+func ParseRule(s string, reverse bool) (Rule, error) {
+	rule := Rule{Network: "tcp", Reverse: reverse}
+	if network, rest, ok := strings.Cut(s, ":"); ok && (network == "tcp" || network == "udp") {
+		rule.Network, s = network, rest
+	}
+	listen, target, ok := strings.Cut(s, "=")
+	if !ok {
+		return Rule{}, fmt.Errorf("invalid port forward %q: missing target", s)
+	}
+	if port, err := strconv.ParseUint(listen, 10, 16); err == nil {
+		addr := netip.IPv6Unspecified()
+		if !reverse {
+			addr = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+		}
+		rule.Listen = netip.AddrPortFrom(addr, uint16(port))
+	} else {
+		rule.Listen, err = netip.ParseAddrPort(listen)
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid port forward address %q: %w", listen, err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return Rule{}, fmt.Errorf("invalid port forward target %q: %w", target, err)
+	}
+	rule.Target = target
+	return rule, nil
+}
+
+// A Forwarder runs port forwarding rules over the network stack of a
+// tunnel.
+type Forwarder struct {
+	net            *netstack.Net
+	log            *device.Logger
+	udpIdleTimeout time.Duration
+	dialer         net.Dialer
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []io.Closer
+	conns     map[io.Closer]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a forwarder over tnet. UDP flows without any datagram in
+// either direction for udpIdleTimeout are closed, or after
+// DefaultUDPIdleTimeout if it is zero. logger may be nil.
+func New(tnet *netstack.Net, udpIdleTimeout time.Duration, logger *device.Logger) *Forwarder {
+	if udpIdleTimeout <= 0 {
+		udpIdleTimeout = DefaultUDPIdleTimeout
+	}
+	if logger == nil {
+		logger = device.NewLogger(device.LogLevelSilent, "")
+	}
+	return &Forwarder{
+		net:            tnet,
+		log:            logger,
+		udpIdleTimeout: udpIdleTimeout,
+		conns:          make(map[io.Closer]struct{}),
+	}
+}
+
+// Start listens for rule, and returns the address it listens on.
+func (f *Forwarder) Start(rule Rule) (net.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, net.ErrClosed
+	}
+
+	var listener io.Closer
+	var addr net.Addr
+	listen := rule.Listen
+	if rule.Reverse && listen.Addr().IsUnspecified() {
+		// The network stack binds all addresses given none.
+		listen = netip.AddrPortFrom(netip.Addr{}, listen.Port())
+	}
+	switch rule.Network {
+	case "tcp":
+		var l net.Listener
+		var err error
+		if rule.Reverse {
+			l, err = f.net.ListenTCPAddrPort(listen)
+		} else {
+			l, err = net.ListenTCP("tcp", net.TCPAddrFromAddrPort(rule.Listen))
+		}
+		if err != nil {
+			return nil, err
+		}
+		listener, addr = l, l.Addr()
+		f.wg.Add(1)
+		go f.serveTCP(rule, l)
+	case "udp":
+		var pc net.PacketConn
+		var err error
+		if rule.Reverse {
+			pc, err = f.net.ListenUDPAddrPort(listen)
+		} else {
+			pc, err = net.ListenUDP("udp", net.UDPAddrFromAddrPort(rule.Listen))
+		}
+		if err != nil {
+			return nil, err
+		}
+		listener, addr = pc, pc.LocalAddr()
+		f.wg.Add(1)
+		go f.serveUDP(rule, pc)
+	default:
+		return nil, net.UnknownNetworkError(rule.Network)
+	}
+	f.listeners = append(f.listeners, listener)
+	f.log.Verbosef("Forwarding %v on %v", rule, addr)
+	return addr, nil
+}
+
+// Close stops all rules and closes their connections.
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	for _, listener := range f.listeners {
+		listener.Close()
+	}
+	for c := range f.conns {
+		c.Close()
+	}
+	f.listeners = nil
+	f.mu.Unlock()
+	f.wg.Wait()
+	return nil
+}
+
+// track registers c to be closed with the forwarder, or closes it right
+// away if the forwarder is closed.
+func (f *Forwarder) track(c io.Closer) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		c.Close()
+		return false
+	}
+	f.conns[c] = struct{}{}
+	return true
+}
+
+func (f *Forwarder) untrack(c io.Closer) {
+	f.mu.Lock()
+	delete(f.conns, c)
+	f.mu.Unlock()
+	c.Close()
+}
+
+func (f *Forwarder) dial(ctx context.Context, rule Rule) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	if rule.Reverse {
+		return f.dialer.DialContext(ctx, rule.Network, rule.Target)
+	}
+	return f.net.DialContext(ctx, rule.Network, rule.Target)
+}
+
+func (f *Forwarder) serveTCP(rule Rule, listener net.Listener) {
+	defer f.wg.Done()
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !f.isClosed() {
+				f.log.Errorf("Port forward %v: %v", rule, err)
+			}
+			return
+		}
+		if !f.track(c) {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer f.untrack(c)
+			target, err := f.dial(context.Background(), rule)
+			if err != nil {
+				f.log.Verbosef("Port forward %v: %v", rule, err)
+				return
+			}
+			if !f.track(target) {
+				return
+			}
+			defer f.untrack(target)
+			relay.Splice(c, target)
+		}()
+	}
+}
+
+func (f *Forwarder) isClosed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// A udpFlow relays the datagrams of one client of a UDP rule.
+type udpFlow struct {
+	queue      chan []byte
+	done       chan struct{}
+	lastActive atomic.Int64 // nano seconds since epoch
+}
+
+func (f *Forwarder) serveUDP(rule Rule, pc net.PacketConn) {
+	defer f.wg.Done()
+	var mu sync.Mutex
+	flows := make(map[string]*udpFlow)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !f.isClosed() {
+				f.log.Errorf("Port forward %v: %v", rule, err)
+			}
+			return
+		}
+
+		key := client.String()
+		mu.Lock()
+		flow := flows[key]
+		if flow == nil {
+			if len(flows) >= maxUDPFlows {
+				mu.Unlock()
+				f.log.Verbosef("Port forward %v: too many flows, dropping datagram from %v", rule, client)
+				continue
+			}
+			flow = &udpFlow{
+				queue: make(chan []byte, udpFlowQueueSize),
+				done:  make(chan struct{}),
+			}
+			flows[key] = flow
+			f.wg.Add(1)
+			go func() {
+				defer f.wg.Done()
+				f.runUDPFlow(rule, flow, pc, client)
+				mu.Lock()
+				delete(flows, key)
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		flow.lastActive.Store(time.Now().UnixNano())
+		select {
+		case flow.queue <- bytes.Clone(buf[:n]):
+		default:
+			// The flow is still dialing or cannot keep up.
+		}
+	}
+}
+
+// runUDPFlow dials the target of rule for flow, and relays datagrams
+// between it and client until the flow is idle or closed.
+func (f *Forwarder) runUDPFlow(rule Rule, flow *udpFlow, pc net.PacketConn, client net.Addr) {
+	c, err := f.dial(context.Background(), rule)
+	if err != nil {
+		f.log.Verbosef("Port forward %v: %v", rule, err)
+		return
+	}
+	if !f.track(c) {
+		return
+	}
+	defer f.untrack(c)
+	defer close(flow.done)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			select {
+			case datagram := <-flow.queue:
+				c.Write(datagram)
+			case <-flow.done:
+				return
+			}
+		}
+	}()
+	f.relayReplies(flow, c, pc, client)
+}
+
+// relayReplies passes the replies on c to client, until flow is idle or c
+// closed.
+func (f *Forwarder) relayReplies(flow *udpFlow, c net.Conn, pc net.PacketConn, client net.Addr) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		deadline := time.Unix(0, flow.lastActive.Load()).Add(f.udpIdleTimeout)
+		if !time.Now().Before(deadline) {
+			return
+		}
+		c.SetReadDeadline(deadline)
+		n, err := c.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return
+		}
+		flow.lastActive.Store(time.Now().UnixNano())
+		if _, err := pc.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
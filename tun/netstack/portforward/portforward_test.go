@@ -0,0 +1,190 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package portforward
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, test := range []struct {
+		s       string
+		reverse bool
+		want    Rule
+	}{
+		{"8080=10.0.0.2:80", false, Rule{"tcp", false, netip.MustParseAddrPort("127.0.0.1:8080"), "10.0.0.2:80"}},
+		{"udp:[::1]:53=dns.internal:53", false, Rule{"udp", false, netip.MustParseAddrPort("[::1]:53"), "dns.internal:53"}},
+		{"tcp:22=localhost:22", true, Rule{"tcp", true, netip.MustParseAddrPort("[::]:22"), "localhost:22"}},
+	} {
+		got, err := ParseRule(test.s, test.reverse)
+		if err != nil {
+			t.Errorf("%s: %v", test.s, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.s, got, test.want)
+		}
+	}
+	for _, s := range []string{"8080", "sctp:1=a:1", "1=a", "99999=a:1"} {
+		if _, err := ParseRule(s, false); err == nil {
+			t.Errorf("%s: no error", s)
+		}
+	}
+}
+
+func echo(c net.Conn) {
+	defer c.Close()
+	io.Copy(c, c)
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	listener, err := nets[1].ListenTCPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echo(c)
+		}
+	}()
+
+	f := New(nets[0], 0, nil)
+	defer f.Close()
+	addr, err := f.Start(Rule{Network: "tcp", Listen: netip.MustParseAddrPort("127.0.0.1:0"), Target: "10.0.0.2:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "hello through the tunnel")
+
+	// Half closes are passed on, and the echo server closes in turn.
+	c.(*net.TCPConn).CloseWrite()
+	if n, err := c.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("read after close write: %d, %v", n, err)
+	}
+}
+
+func TestReverseTCP(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go echo(c)
+		}
+	}()
+
+	f := New(nets[0], 0, nil)
+	defer f.Close()
+	rule, err := ParseRule("tcp:8080="+listener.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Start(rule); err != nil {
+		t.Fatal(err)
+	}
+	c, err := nets[1].DialTCPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[0], 8080))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "hello from the tunnel")
+
+	// Closing the forwarder closes forwarded connections.
+	f.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after close: %v", err)
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	server, err := nets[1].ListenUDPAddrPort(netip.AddrPortFrom(netstacktest.Addrs[1], 53))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	f := New(nets[0], 200*time.Millisecond, nil)
+	defer f.Close()
+	addr, err := f.Start(Rule{Network: "udp", Listen: netip.MustParseAddrPort("127.0.0.1:0"), Target: "10.0.0.2:53"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roundTrip(t, c, "first")
+	roundTrip(t, c, "second")
+
+	flows := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.conns)
+	}
+	if n := flows(); n != 1 {
+		t.Fatalf("%d flows, want 1", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for flows() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle flow not closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Datagrams after the timeout start a new flow.
+	roundTrip(t, c, "third")
+}
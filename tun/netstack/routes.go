@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// DefaultNIC is the NIC of the device returned by CreateNetTUN, which has
+// the default routes of its address families until SetRoutes replaces
+// them.
+const DefaultNIC = 1
+
+// A Route sends the packets for Destination to the device of a NIC.
+type Route struct {
+	Destination netip.Prefix
+	NIC         int
+}
+
+// SetRoutes replaces the route table of the network stack. The most
+// specific route to a destination is used; connections to destinations
+// without a route fail right away. Forwarding for the SNAT rules follows
+// the routes to their sources.
+func (tnet *Net) SetRoutes(routes []Route) error {
+	table := make([]tcpip.Route, 0, len(routes))
+	for _, route := range routes {
+		if !route.Destination.IsValid() {
+			return fmt.Errorf("invalid route destination %v", route.Destination)
+		}
+		if !tnet.stack.HasNIC(tcpip.NICID(route.NIC)) {
+			return fmt.Errorf("route to %v: no NIC %d", route.Destination, route.NIC)
+		}
+		prefix := route.Destination.Masked()
+		subnet, err := tcpip.NewSubnet(
+			tcpip.AddrFromSlice(prefix.Addr().AsSlice()),
+			tcpip.MaskFromBytes(net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen())),
+		)
+		if err != nil {
+			return fmt.Errorf("invalid route destination %v: %v", route.Destination, err)
+		}
+		table = append(table, tcpip.Route{Destination: subnet, NIC: tcpip.NICID(route.NIC)})
+	}
+	// The stack uses the first route that matches.
+	sort.SliceStable(table, func(i, j int) bool {
+		return table[i].Destination.Prefix() > table[j].Destination.Prefix()
+	})
+	tnet.mu.Lock()
+	defer tnet.mu.Unlock()
+	tnet.stack.SetRouteTable(table)
+	if len(tnet.snat) == 0 {
+		return nil
+	}
+	return tnet.setForwardingLocked(tnet.snat)
+}
+
+// Routes returns the route table of the network stack.
+func (tnet *Net) Routes() []Route {
+	var routes []Route
+	for _, route := range tnet.stack.GetRouteTable() {
+		id := route.Destination.ID()
+		addr, _ := netip.AddrFromSlice(id.AsSlice())
+		routes = append(routes, Route{
+			Destination: netip.PrefixFrom(addr, route.Destination.Prefix()),
+			NIC:         int(route.NIC),
+		})
+	}
+	return routes
+}
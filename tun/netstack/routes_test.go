@@ -0,0 +1,100 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+func echo(tnet *netstack.Net, addr netip.AddrPort) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := tnet.DialContextTCPAddrPort(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, "ping"); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(c, make([]byte, 4))
+	return err
+}
+
+func TestRoutes(t *testing.T) {
+	// The first stack reaches the second one through its default NIC,
+	// and a third one through a second NIC.
+	nets := netstacktest.NewPair(t)
+	second, nic, err := nets[0].AddNIC([]netip.Addr{netip.MustParseAddr("10.1.0.1")}, device.DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third, thirdNet, err := netstack.CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.1.0.2")}, nil, device.DefaultMTU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	netstacktest.Connect(t, [2]tun.Device{second, third})
+	viaDefault := netip.AddrPortFrom(netstacktest.Addrs[1], 7)
+	viaSecond := netip.MustParseAddrPort("10.1.0.2:7")
+	netstacktest.ServeEcho(t, nets[1], viaDefault)
+	netstacktest.ServeEcho(t, thirdNet, viaSecond)
+
+	routes := []netstack.Route{
+		{Destination: netip.MustParsePrefix("10.0.0.0/8"), NIC: netstack.DefaultNIC},
+		{Destination: netip.MustParsePrefix("10.1.0.0/16"), NIC: nic},
+	}
+	if err := nets[0].SetRoutes([]netstack.Route{{Destination: netip.MustParsePrefix("10.0.0.0/24"), NIC: netstack.DefaultNIC}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(nets[0], viaSecond); err == nil {
+		t.Error("reached a destination without a route")
+	}
+	if err := nets[0].SetRoutes(routes); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []netip.AddrPort{viaDefault, viaSecond} {
+		if err := echo(nets[0], addr); err != nil {
+			t.Errorf("%v: %v", addr, err)
+		}
+	}
+	want := []netstack.Route{routes[1], routes[0]}
+	if got := nets[0].Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("routes %v, want %v", got, want)
+	}
+
+	// Destinations without a route fail right away.
+	start := time.Now()
+	if err := echo(nets[0], netip.MustParseAddrPort("192.0.2.1:7")); err == nil {
+		t.Error("reached a destination without a route")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("took %v to fail", d)
+	}
+
+	if err := nets[0].SetRoutes([]netstack.Route{{Destination: netip.MustParsePrefix("0.0.0.0/0"), NIC: 42}}); err == nil {
+		t.Error("accepted a route to a missing NIC")
+	}
+
+	// Closing the second device only detaches it, with its routes.
+	second.Close()
+	if got := nets[0].Routes(); !reflect.DeepEqual(got, routes[:1]) {
+		t.Errorf("routes %v after closing the device", got)
+	}
+	if err := echo(nets[0], viaDefault); err != nil {
+		t.Error(err)
+	}
+}
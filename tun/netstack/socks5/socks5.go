@@ -0,0 +1,371 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+// Package socks5 implements a SOCKS5 server, as specified in RFC 1928 and
+// RFC 1929, whose connections and datagrams go through the userspace
+// network stack of a tunnel.
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/device"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/internal/relay"
+)
+
+const (
+	socksVersion     = 5
+	authVersion      = 1
+	handshakeTimeout = 30 * time.Second
+	dialTimeout      = 30 * time.Second
+	maxDatagramSize  = 65535
+)
+
+const (
+	methodNone         = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+const (
+	cmdConnect      = 1
+	cmdBind         = 2
+	cmdUDPAssociate = 3
+)
+
+const (
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+const (
+	replySucceeded           = 0
+	replyFailure             = 1
+	replyNetworkUnreachable  = 3
+	replyHostUnreachable     = 4
+	replyConnectionRefused   = 5
+	replyCommandNotSupported = 7
+	replyAddressNotSupported = 8
+)
+
+// A Server accepts SOCKS5 clients on host listeners, and connects them
+// through the network stack of a tunnel. Hostnames are resolved with the
+// DNS servers of the network stack.
+type Server struct {
+	net         *netstack.Net
+	log         *device.Logger
+	credentials map[string]string
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[io.Closer]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a server over tnet. With credentials, a map of user names
+// to passwords, clients must authenticate with one of them; without, no
+// authentication is required. logger may be nil.
+func New(tnet *netstack.Net, credentials map[string]string, logger *device.Logger) *Server {
+	if logger == nil {
+		logger = device.NewLogger(device.LogLevelSilent, "")
+	}
+	return &Server{
+		net:         tnet,
+		log:         logger,
+		credentials: credentials,
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[io.Closer]struct{}),
+	}
+}
+
+// Serve accepts clients on l until it fails or the server is closed.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return net.ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	defer s.wg.Done()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return net.ErrClosed
+			}
+			return err
+		}
+		if !s.track(c) {
+			return net.ErrClosed
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(c)
+			if err := s.handle(c); err != nil {
+				s.log.Verbosef("SOCKS5 client %v: %v", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops serving and closes all connections.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers c to be closed with the server, or closes it right away
+// if the server is closed.
+func (s *Server) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		c.Close()
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(c io.Closer) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	c.Close()
+}
+
+func (s *Server) handle(c net.Conn) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := s.negotiate(c); err != nil {
+		return err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	host, port, err := readAddr(c)
+	if err != nil {
+		if errors.Is(err, errAddressType) {
+			writeReply(c, replyAddressNotSupported, nil)
+		}
+		return err
+	}
+
+	switch header[1] {
+	case cmdConnect:
+		return s.connect(c, host, port)
+	case cmdUDPAssociate:
+		return s.associate(c, host, port)
+	}
+	writeReply(c, replyCommandNotSupported, nil)
+	return fmt.Errorf("unsupported command %d", header[1])
+}
+
+// negotiate selects the authentication method, and authenticates the
+// client with it.
+func (s *Server) negotiate(c net.Conn) error {
+	var header [2]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	method := byte(methodNone)
+	if s.credentials != nil {
+		method = methodPassword
+	}
+	for _, m := range methods {
+		if m == method {
+			if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+				return err
+			}
+			if method == methodPassword {
+				return s.authenticate(c)
+			}
+			return nil
+		}
+	}
+	c.Write([]byte{socksVersion, methodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+func (s *Server) authenticate(c net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+	if version[0] != authVersion {
+		return fmt.Errorf("unsupported authentication version %d", version[0])
+	}
+	user, err := readString(c)
+	if err != nil {
+		return err
+	}
+	password, err := readString(c)
+	if err != nil {
+		return err
+	}
+	want, ok := s.credentials[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		c.Write([]byte{authVersion, 1})
+		return fmt.Errorf("authentication failed for user %q", user)
+	}
+	_, err = c.Write([]byte{authVersion, 0})
+	return err
+}
+
+func readString(r io.Reader) (string, error) {
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, n[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+var errAddressType = errors.New("unsupported address type")
+
+// readAddr reads an address as encoded in requests, and returns its host,
+// which is an IP address or a hostname, and port.
+func readAddr(r io.Reader) (host string, port uint16, err error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		b := make([]byte, 4)
+		if atyp[0] == atypIPv6 {
+			b = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", 0, err
+		}
+		addr, _ := netip.AddrFromSlice(b)
+		host = addr.String()
+	case atypDomain:
+		host, err = readString(r)
+		if err != nil {
+			return "", 0, err
+		}
+	default:
+		return "", 0, errAddressType
+	}
+	var p [2]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(p[:]), nil
+}
+
+// appendAddr appends addr as encoded in replies and datagrams.
+func appendAddr(b []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		b = append(b, atypIPv4)
+	} else {
+		b = append(b, atypIPv6)
+	}
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, addr.Port())
+}
+
+func writeReply(w io.Writer, reply byte, bound net.Addr) error {
+	var addr netip.AddrPort
+	if bound != nil {
+		addr, _ = netip.ParseAddrPort(bound.String())
+	}
+	if !addr.IsValid() {
+		addr = netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	_, err := w.Write(appendAddr([]byte{socksVersion, reply, 0}, addr))
+	return err
+}
+
+// replyForError returns the reply reporting a failure to reach the target.
+func replyForError(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr), errors.Is(err, context.DeadlineExceeded):
+		return replyHostUnreachable
+	}
+	// The network stack reports its errors as text.
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection was refused"):
+		return replyConnectionRefused
+	case strings.Contains(msg, "network is unreachable"):
+		return replyNetworkUnreachable
+	case strings.Contains(msg, "no route to host"), strings.Contains(msg, "timed out"):
+		return replyHostUnreachable
+	}
+	return replyFailure
+}
+
+func (s *Server) connect(c net.Conn, host string, port uint16) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	target, err := s.net.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		writeReply(c, replyForError(err), nil)
+		return err
+	}
+	if !s.track(target) {
+		return net.ErrClosed
+	}
+	defer s.untrack(target)
+	if err := writeReply(c, replySucceeded, target.LocalAddr()); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	relay.Splice(c, target)
+	return nil
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+	"golang.org/x/net/proxy"
+)
+
+func startServer(t *testing.T, credentials map[string]string) string {
+	nets := netstacktest.NewPair(t)
+	netstacktest.ServeEcho(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 7))
+	netstacktest.ServeDNS(t, nets[1], netip.AddrPortFrom(netstacktest.Addrs[1], 53), map[string][]netip.Addr{
+		"echo.test.": {netstacktest.Addrs[1]},
+	})
+	s := New(nets[0], credentials, nil)
+	t.Cleanup(func() { s.Close() })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(listener)
+	return listener.Addr().String()
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) {
+	t.Helper()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("got %q, want %q", buf, msg)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	addr := startServer(t, map[string]string{"user": "secret"})
+
+	dialer, err := proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "secret"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"10.0.0.2:7", "echo.test:7"} {
+		c, err := dialer.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		roundTrip(t, c, "hello "+target)
+		c.Close()
+	}
+
+	if _, err := dialer.Dial("tcp", "10.0.0.2:8"); err == nil {
+		t.Error("connected to a closed port")
+	}
+	if _, err := dialer.Dial("tcp", "missing.test:7"); err == nil {
+		t.Error("connected to an unknown host")
+	}
+
+	dialer, err = proxy.SOCKS5("tcp", addr, &proxy.Auth{User: "user", Password: "wrong"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.Dial("tcp", "10.0.0.2:7"); err == nil {
+		t.Error("connected with a wrong password")
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	addr := startServer(t, nil)
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	request := []byte{socksVersion, 1, methodNone, socksVersion, cmdUDPAssociate, 0}
+	request = appendAddr(request, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if _, err := c.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	var method [2]byte
+	if _, err := io.ReadFull(c, method[:]); err != nil || method[1] != methodNone {
+		t.Fatalf("method selection: %v, %v", method, err)
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(c, reply[:]); err != nil || reply[1] != replySucceeded {
+		t.Fatalf("reply: %v, %v", reply, err)
+	}
+	host, port, err := readAddr(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	relay.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, target := range []struct {
+		host string
+		atyp byte
+	}{
+		{"10.0.0.2", atypIPv4},
+		{"echo.test", atypDomain},
+	} {
+		datagram := []byte{0, 0, 0}
+		if target.atyp == atypDomain {
+			datagram = append(datagram, atypDomain, byte(len(target.host)))
+			datagram = append(datagram, target.host...)
+			datagram = append(datagram, 0, 7)
+		} else {
+			datagram = appendAddr(datagram, netip.AddrPortFrom(netip.MustParseAddr(target.host), 7))
+		}
+		payload := []byte("datagram to " + target.host)
+		if _, err := relay.Write(append(datagram, payload...)); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1500)
+		n, err := relay.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", target.host, err)
+		}
+		want := append(appendAddr([]byte{0, 0, 0}, netip.MustParseAddrPort("10.0.0.2:7")), payload...)
+		if !bytes.Equal(buf[:n], want) {
+			t.Fatalf("%s: got %x, want %x", target.host, buf[:n], want)
+		}
+	}
+
+	// Closing the control connection ends the association.
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	relay.Write(appendAddr([]byte{0, 0, 0}, netip.MustParseAddrPort("10.0.0.2:7")))
+	if _, err := relay.Read(make([]byte, 1500)); err == nil {
+		t.Error("association outlived its control connection")
+	}
+}
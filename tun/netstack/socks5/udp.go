@@ -0,0 +1,259 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	maxUDPTargets       = 1024 // destinations, and names, of a single association
+	maxPendingDatagrams = 16   // datagrams held for a name being resolved
+)
+
+// A udpAssociation relays the datagrams of a client between a host UDP
+// socket and the tunnel, for as long as its control connection is open.
+type udpAssociation struct {
+	server *Server
+	relay  *net.UDPConn
+
+	clientAddr netip.Addr     // address the client sends from
+	clientPort uint16         // port the client sends from, 0 until known
+	client     netip.AddrPort // where replies go, set by the first datagram
+
+	mu        sync.Mutex
+	closed    bool
+	targets   map[netip.AddrPort]net.Conn
+	names     map[string]netip.Addr
+	resolving map[string][]pendingDatagram
+	wg        sync.WaitGroup
+}
+
+// A pendingDatagram waits for the name it is sent to to be resolved.
+type pendingDatagram struct {
+	port    uint16
+	payload []byte
+}
+
+func (s *Server) associate(c net.Conn, host string, port uint16) error {
+	local, err := netip.ParseAddrPort(c.LocalAddr().String())
+	if err != nil {
+		writeReply(c, replyFailure, nil)
+		return err
+	}
+	remote, err := netip.ParseAddrPort(c.RemoteAddr().String())
+	if err != nil {
+		writeReply(c, replyFailure, nil)
+		return err
+	}
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(local.Addr(), 0)))
+	if err != nil {
+		writeReply(c, replyFailure, nil)
+		return err
+	}
+	if !s.track(relay) {
+		return net.ErrClosed
+	}
+	defer s.untrack(relay)
+
+	a := &udpAssociation{
+		server:     s,
+		relay:      relay,
+		clientAddr: remote.Addr().Unmap(),
+		targets:    make(map[netip.AddrPort]net.Conn),
+		names:      make(map[string]netip.Addr),
+		resolving:  make(map[string][]pendingDatagram),
+	}
+	// Clients may name the port they send from, but their address is the
+	// one of the control connection either way.
+	if addr, err := netip.ParseAddr(host); err == nil && addr.Unmap() == a.clientAddr {
+		a.clientPort = port
+	}
+	if err := writeReply(c, replySucceeded, relay.LocalAddr()); err != nil {
+		return err
+	}
+
+	// The association ends with its control connection.
+	c.SetDeadline(time.Time{})
+	go func() {
+		io.Copy(io.Discard, c)
+		relay.Close()
+	}()
+	a.relayDatagrams()
+	return nil
+}
+
+func (a *udpAssociation) relayDatagrams() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		a.mu.Lock()
+		a.closed = true
+		for _, target := range a.targets {
+			target.Close()
+		}
+		a.mu.Unlock()
+		a.wg.Wait()
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if from.Addr() != a.clientAddr || (a.clientPort != 0 && from.Port() != a.clientPort) {
+			continue
+		}
+		a.mu.Lock()
+		a.client = from
+		a.mu.Unlock()
+
+		r := bytes.NewReader(buf[:n])
+		var header [3]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil || header[2] != 0 {
+			// Fragments are not supported, and dropped.
+			continue
+		}
+		host, port, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		payload := buf[n-r.Len() : n]
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			var ok bool
+			a.mu.Lock()
+			addr, ok = a.names[host]
+			a.mu.Unlock()
+			if !ok {
+				a.resolve(ctx, from, host, port, payload)
+				continue
+			}
+		}
+		a.send(from, netip.AddrPortFrom(addr.Unmap(), port), payload)
+	}
+}
+
+// send sends payload from the client at from to dst.
+func (a *udpAssociation) send(from, dst netip.AddrPort, payload []byte) {
+	target, err := a.target(dst)
+	if err != nil {
+		a.server.log.Verbosef("SOCKS5 client %v: %v", from, err)
+		return
+	}
+	target.Write(payload)
+}
+
+// target returns the tunnel socket sending to dst, and opens it if needed.
+func (a *udpAssociation) target(dst netip.AddrPort) (net.Conn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, net.ErrClosed
+	}
+	if target := a.targets[dst]; target != nil {
+		return target, nil
+	}
+	if len(a.targets) >= maxUDPTargets {
+		return nil, errors.New("too many UDP destinations")
+	}
+	target, err := a.server.net.DialUDPAddrPort(netip.AddrPort{}, dst)
+	if err != nil {
+		return nil, err
+	}
+	a.targets[dst] = target
+	a.wg.Add(1)
+	go a.relayReplies(dst, target)
+	return target, nil
+}
+
+// resolve sends payload to host and port once host is resolved, which
+// happens in the background so as not to hold up the datagrams to other
+// destinations. Datagrams beyond maxPendingDatagrams for a name still
+// being resolved are dropped.
+func (a *udpAssociation) resolve(ctx context.Context, from netip.AddrPort, host string, port uint16, payload []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending, ok := a.resolving[host]
+	if !ok && len(a.resolving) >= maxUDPTargets {
+		return
+	}
+	if len(pending) < maxPendingDatagrams {
+		a.resolving[host] = append(pending, pendingDatagram{port, bytes.Clone(payload)})
+	}
+	if ok {
+		return
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		addr, err := a.lookup(ctx, host)
+		a.mu.Lock()
+		pending := a.resolving[host]
+		delete(a.resolving, host)
+		if err == nil {
+			if len(a.names) >= maxUDPTargets {
+				// Forget an arbitrary name to make room.
+				for name := range a.names {
+					delete(a.names, name)
+					break
+				}
+			}
+			a.names[host] = addr
+		}
+		a.mu.Unlock()
+		if err != nil {
+			a.server.log.Verbosef("SOCKS5 client %v: %v", from, err)
+			return
+		}
+		for _, datagram := range pending {
+			a.send(from, netip.AddrPortFrom(addr, datagram.port), datagram.payload)
+		}
+	}()
+}
+
+func (a *udpAssociation) lookup(ctx context.Context, host string) (netip.Addr, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+	addrs, err := a.server.net.LookupContextHost(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, s := range addrs {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			return addr.Unmap(), nil
+		}
+	}
+	return netip.Addr{}, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// relayReplies passes the datagrams received from dst on to the client.
+func (a *udpAssociation) relayReplies(dst netip.AddrPort, target net.Conn) {
+	defer a.wg.Done()
+	header := appendAddr([]byte{0, 0, 0}, dst)
+	buf := make([]byte, len(header)+maxDatagramSize)
+	copy(buf, header)
+	for {
+		n, err := target.Read(buf[len(header):])
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		a.mu.Unlock()
+		a.relay.WriteToUDPAddrPort(buf[:len(header)+n], client)
+	}
+}
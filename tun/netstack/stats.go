@@ -0,0 +1,506 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// Stats are the counters of the network stack since it was created.
+type Stats struct {
+	// DroppedPackets is the number of packets dropped by the transport
+	// layer, for instance because no endpoint wanted them.
+	DroppedPackets uint64
+
+	IP  IPStats
+	TCP TCPStats
+	UDP UDPStats
+}
+
+// IPStats are the counters of IPv4 and IPv6 together.
+type IPStats struct {
+	PacketsReceived                     uint64
+	PacketsDelivered                    uint64
+	PacketsSent                         uint64
+	MalformedPacketsReceived            uint64
+	InvalidDestinationAddressesReceived uint64
+	InvalidSourceAddressesReceived      uint64
+	OutgoingPacketErrors                uint64
+}
+
+// TCPStats are the counters of TCP.
+type TCPStats struct {
+	ActiveConnectionOpenings  uint64
+	PassiveConnectionOpenings uint64
+	CurrentEstablished        uint64
+	FailedConnectionAttempts  uint64
+	EstablishedResets         uint64
+	EstablishedTimedout       uint64
+	ListenOverflowSynDrop     uint64
+	ValidSegmentsReceived     uint64
+	InvalidSegmentsReceived   uint64
+	SegmentsSent              uint64
+	SegmentSendErrors         uint64
+	ResetsSent                uint64
+	ResetsReceived            uint64
+	Retransmits               uint64
+	FastRetransmit            uint64
+	Timeouts                  uint64
+	ChecksumErrors            uint64
+}
+
+// UDPStats are the counters of UDP.
+type UDPStats struct {
+	PacketsReceived          uint64
+	PacketsSent              uint64
+	UnknownPortErrors        uint64
+	ReceiveBufferErrors      uint64
+	MalformedPacketsReceived uint64
+	PacketSendErrors         uint64
+	ChecksumErrors           uint64
+}
+
+// A Counter is a named value of Stats.
+type Counter struct {
+	Name  string
+	Value uint64
+}
+
+// Stats returns the counters of the network stack.
+func (tnet *Net) Stats() Stats {
+	s := tnet.stack.Stats()
+	return Stats{
+		DroppedPackets: s.DroppedPackets.Value(),
+		IP: IPStats{
+			PacketsReceived:                     s.IP.PacketsReceived.Value(),
+			PacketsDelivered:                    s.IP.PacketsDelivered.Value(),
+			PacketsSent:                         s.IP.PacketsSent.Value(),
+			MalformedPacketsReceived:            s.IP.MalformedPacketsReceived.Value(),
+			InvalidDestinationAddressesReceived: s.IP.InvalidDestinationAddressesReceived.Value(),
+			InvalidSourceAddressesReceived:      s.IP.InvalidSourceAddressesReceived.Value(),
+			OutgoingPacketErrors:                s.IP.OutgoingPacketErrors.Value(),
+		},
+		TCP: TCPStats{
+			ActiveConnectionOpenings:  s.TCP.ActiveConnectionOpenings.Value(),
+			PassiveConnectionOpenings: s.TCP.PassiveConnectionOpenings.Value(),
+			CurrentEstablished:        s.TCP.CurrentEstablished.Value(),
+			FailedConnectionAttempts:  s.TCP.FailedConnectionAttempts.Value(),
+			EstablishedResets:         s.TCP.EstablishedResets.Value(),
+			EstablishedTimedout:       s.TCP.EstablishedTimedout.Value(),
+			ListenOverflowSynDrop:     s.TCP.ListenOverflowSynDrop.Value(),
+			ValidSegmentsReceived:     s.TCP.ValidSegmentsReceived.Value(),
+			InvalidSegmentsReceived:   s.TCP.InvalidSegmentsReceived.Value(),
+			SegmentsSent:              s.TCP.SegmentsSent.Value(),
+			SegmentSendErrors:         s.TCP.SegmentSendErrors.Value(),
+			ResetsSent:                s.TCP.ResetsSent.Value(),
+			ResetsReceived:            s.TCP.ResetsReceived.Value(),
+			Retransmits:               s.TCP.Retransmits.Value(),
+			FastRetransmit:            s.TCP.FastRetransmit.Value(),
+			Timeouts:                  s.TCP.Timeouts.Value(),
+			ChecksumErrors:            s.TCP.ChecksumErrors.Value(),
+		},
+		UDP: UDPStats{
+			PacketsReceived:          s.UDP.PacketsReceived.Value(),
+			PacketsSent:              s.UDP.PacketsSent.Value(),
+			UnknownPortErrors:        s.UDP.UnknownPortErrors.Value(),
+			ReceiveBufferErrors:      s.UDP.ReceiveBufferErrors.Value(),
+			MalformedPacketsReceived: s.UDP.MalformedPacketsReceived.Value(),
+			PacketSendErrors:         s.UDP.PacketSendErrors.Value(),
+			ChecksumErrors:           s.UDP.ChecksumErrors.Value(),
+		},
+	}
+}
+
+// Counters lists the values of s under names such as "tcp_retransmits",
+// in a fixed order.
+func (s Stats) Counters() []Counter {
+	return []Counter{
+		{"dropped_packets", s.DroppedPackets},
+		{"ip_packets_received", s.IP.PacketsReceived},
+		{"ip_packets_delivered", s.IP.PacketsDelivered},
+		{"ip_packets_sent", s.IP.PacketsSent},
+		{"ip_malformed_packets_received", s.IP.MalformedPacketsReceived},
+		{"ip_invalid_destination_addresses_received", s.IP.InvalidDestinationAddressesReceived},
+		{"ip_invalid_source_addresses_received", s.IP.InvalidSourceAddressesReceived},
+		{"ip_outgoing_packet_errors", s.IP.OutgoingPacketErrors},
+		{"tcp_active_connection_openings", s.TCP.ActiveConnectionOpenings},
+		{"tcp_passive_connection_openings", s.TCP.PassiveConnectionOpenings},
+		{"tcp_current_established", s.TCP.CurrentEstablished},
+		{"tcp_failed_connection_attempts", s.TCP.FailedConnectionAttempts},
+		{"tcp_established_resets", s.TCP.EstablishedResets},
+		{"tcp_established_timedout", s.TCP.EstablishedTimedout},
+		{"tcp_listen_overflow_syn_drop", s.TCP.ListenOverflowSynDrop},
+		{"tcp_valid_segments_received", s.TCP.ValidSegmentsReceived},
+		{"tcp_invalid_segments_received", s.TCP.InvalidSegmentsReceived},
+		{"tcp_segments_sent", s.TCP.SegmentsSent},
+		{"tcp_segment_send_errors", s.TCP.SegmentSendErrors},
+		{"tcp_resets_sent", s.TCP.ResetsSent},
+		{"tcp_resets_received", s.TCP.ResetsReceived},
+		{"tcp_retransmits", s.TCP.Retransmits},
+		{"tcp_fast_retransmit", s.TCP.FastRetransmit},
+		{"tcp_timeouts", s.TCP.Timeouts},
+		{"tcp_checksum_errors", s.TCP.ChecksumErrors},
+		{"udp_packets_received", s.UDP.PacketsReceived},
+		{"udp_packets_sent", s.UDP.PacketsSent},
+		{"udp_unknown_port_errors", s.UDP.UnknownPortErrors},
+		{"udp_receive_buffer_errors", s.UDP.ReceiveBufferErrors},
+		{"udp_malformed_packets_received", s.UDP.MalformedPacketsReceived},
+		{"udp_packet_send_errors", s.UDP.PacketSendErrors},
+		{"udp_checksum_errors", s.UDP.ChecksumErrors},
+	}
+}
+
+// A Connection is a TCP or UDP endpoint of the network stack.
+type Connection struct {
+	Network string // "tcp" or "udp"
+
+	// Local and Remote are the addresses of the endpoint. Unbound and
+	// unconnected endpoints have an unspecified address and port 0.
+	Local, Remote netip.AddrPort
+
+	// State is the TCP state, such as "ESTABLISHED" or "LISTEN", or for
+	// UDP "BOUND" or "CONNECTED".
+	State string
+
+	// TxBytes and RxBytes count the TCP or UDP payload of the packets of
+	// the endpoint that crossed the devices of the stack, TCP
+	// retransmissions included. Packets for an unconnected UDP endpoint
+	// are counted by it, unless a connected endpoint claims them.
+	TxBytes, RxBytes uint64
+}
+
+// Connections lists the TCP and UDP endpoints of the network stack, ordered
+// by network and local address.
+func (tnet *Net) Connections() []Connection {
+	conns, keys := tnet.endpoints()
+	tnet.flows.collect(keys, func(i int, tx, rx uint64) {
+		conns[i].TxBytes += tx
+		conns[i].RxBytes += rx
+	})
+	sort.SliceStable(conns, func(i, j int) bool {
+		if conns[i].Network != conns[j].Network {
+			return conns[i].Network < conns[j].Network
+		}
+		if c := conns[i].Local.Compare(conns[j].Local); c != 0 {
+			return c < 0
+		}
+		return conns[i].Remote.Compare(conns[j].Remote) < 0
+	})
+	return conns
+}
+
+// endpoints returns the TCP and UDP endpoints of the stack, along with the
+// keys of their flows.
+func (tnet *Net) endpoints() (conns []Connection, keys []flowKey) {
+	// Dual-stack endpoints are registered for both IPv4 and IPv6.
+	seen := make(map[uint64]bool)
+	for _, ep := range tnet.stack.RegisteredEndpoints() {
+		if seen[ep.UniqueID()] {
+			continue
+		}
+		seen[ep.UniqueID()] = true
+		conn, key, ok := connection(ep)
+		if ok {
+			conns = append(conns, conn)
+			keys = append(keys, key)
+		}
+	}
+	return conns, keys
+}
+
+// connection describes the endpoint ep, along with the key of its flow.
+func connection(ep stack.TransportEndpoint) (Connection, flowKey, bool) {
+	endpoint, ok := ep.(tcpip.Endpoint)
+	if !ok {
+		return Connection{}, flowKey{}, false
+	}
+	key, ok := endpointKey(endpoint)
+	if !ok {
+		return Connection{}, flowKey{}, false
+	}
+	conn := Connection{Local: key.local, Remote: key.remote}
+	switch key.proto {
+	case tcp.ProtocolNumber:
+		conn.Network = "tcp"
+		conn.State = tcp.EndpointState(endpoint.State()).String()
+	case udp.ProtocolNumber:
+		conn.Network = "udp"
+		conn.State = transport.DatagramEndpointState(endpoint.State()).String()
+	default:
+		return Connection{}, flowKey{}, false
+	}
+	return conn, key, true
+}
+
+// endpointKey returns the key of the flow of the endpoint ep. The local
+// port of an ICMP endpoint is its echo identifier.
+func endpointKey(ep tcpip.Endpoint) (flowKey, bool) {
+	info, ok := ep.Info().(*stack.TransportEndpointInfo)
+	if !ok {
+		return flowKey{}, false
+	}
+	return flowKey{
+		proto:  info.TransProto,
+		local:  netip.AddrPortFrom(endpointAddr(info.ID.LocalAddress, info.NetProto), info.ID.LocalPort),
+		remote: netip.AddrPortFrom(endpointAddr(info.ID.RemoteAddress, info.NetProto), info.ID.RemotePort),
+	}, true
+}
+
+// endpointAddr converts the address of an endpoint, which is empty if it
+// is unspecified.
+func endpointAddr(addr tcpip.Address, proto tcpip.NetworkProtocolNumber) netip.Addr {
+	switch {
+	case addr.Len() != 0:
+		ip, _ := netip.AddrFromSlice(addr.AsSlice())
+		return ip
+	case proto == ipv4.ProtocolNumber:
+		return netip.IPv4Unspecified()
+	default:
+		return netip.IPv6Unspecified()
+	}
+}
+
+// maxFlows bounds the number of flows whose bytes are counted. The flows
+// of unconnected endpoints, which can have any number of them, are folded
+// into their endpoints by age once there are more than half as many.
+const maxFlows = 4096
+
+// A flowKey identifies the packets of a connection, from the point of
+// view of the stack.
+type flowKey struct {
+	proto         tcpip.TransportProtocolNumber
+	local, remote netip.AddrPort
+}
+
+// wildcard reports whether the endpoint of key is unconnected, and so
+// receives the packets of any remote address.
+func (key flowKey) wildcard() bool {
+	return key.remote.Port() == 0
+}
+
+// matches reports whether the packets of the flow go to the endpoint of
+// key.
+func (key flowKey) matches(flow flowKey) bool {
+	if key.proto != flow.proto || key.local.Port() != flow.local.Port() {
+		return false
+	}
+	if !key.local.Addr().IsUnspecified() && key.local.Addr() != flow.local.Addr() {
+		return false
+	}
+	return key.wildcard() || key.remote == flow.remote
+}
+
+type flowCounters struct {
+	tx, rx   atomic.Uint64
+	lastSeen atomic.Int64 // nano seconds since epoch
+}
+
+type flowCount struct {
+	tx, rx uint64
+}
+
+// A flowTable counts the payload bytes of the TCP and UDP flows crossing
+// the devices. Flows are forgotten when their endpoints are gone, which is
+// looked at when connections are listed or the table is full.
+type flowTable struct {
+	mu        sync.RWMutex
+	flows     map[flowKey]*flowCounters
+	folded    map[flowKey]flowCount // by key of the unconnected endpoint
+	lastPrune time.Time
+	pruning   bool
+	live      func() []flowKey // keys of the endpoints of the stack
+}
+
+// count adds the payload of the IP packet to its flow, which was sent by
+// the stack if outbound and received otherwise.
+func (t *flowTable) count(packet []byte, outbound bool) {
+	key, n, ok := parseFlow(packet, outbound)
+	if !ok {
+		return
+	}
+	t.mu.RLock()
+	counters := t.flows[key]
+	t.mu.RUnlock()
+	if counters == nil {
+		if counters = t.add(key); counters == nil {
+			return
+		}
+	}
+	if outbound {
+		counters.tx.Add(uint64(n))
+	} else {
+		counters.rx.Add(uint64(n))
+	}
+	counters.lastSeen.Store(time.Now().UnixNano())
+}
+
+// add returns the counters of a new flow, or nil if the table is full.
+func (t *flowTable) add(key flowKey) *flowCounters {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if counters := t.flows[key]; counters != nil {
+		return counters
+	}
+	if t.flows == nil {
+		t.flows = make(map[flowKey]*flowCounters)
+	}
+	if len(t.flows) >= maxFlows {
+		// Packets are counted with endpoint locks held, which listing the
+		// endpoints takes too, so the table is pruned on its own
+		// goroutine, and at most once a second in case of a flood of new
+		// flows.
+		if !t.pruning && time.Since(t.lastPrune) >= time.Second {
+			t.pruning = true
+			go t.prune()
+		}
+		return nil
+	}
+	counters := new(flowCounters)
+	counters.lastSeen.Store(time.Now().UnixNano())
+	t.flows[key] = counters
+	return counters
+}
+
+func (t *flowTable) prune() {
+	keys := t.live()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.collectLocked(keys, func(int, uint64, uint64) {})
+	t.pruning = false
+	t.lastPrune = time.Now()
+}
+
+// collect calls add with the counts of each flow and the index in keys of
+// its endpoint, preferring connected endpoints to unconnected ones, and
+// forgets the flows without one. The oldest flows of unconnected endpoints
+// are folded into them if there are too many.
+func (t *flowTable) collect(keys []flowKey, add func(i int, tx, rx uint64)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.collectLocked(keys, add)
+}
+
+func (t *flowTable) collectLocked(keys []flowKey, add func(i int, tx, rx uint64)) {
+	exact := make(map[flowKey]int, len(keys))
+	var wildcards []int
+	for i, key := range keys {
+		if key.wildcard() {
+			wildcards = append(wildcards, i)
+		} else {
+			exact[key] = i
+		}
+	}
+	type wildcardFlow struct {
+		key      flowKey
+		endpoint int
+		lastSeen int64
+	}
+	var wildcardFlows []wildcardFlow
+	for flow, counters := range t.flows {
+		i, ok := exact[flow]
+		if !ok {
+			for _, j := range wildcards {
+				if keys[j].matches(flow) {
+					i, ok = j, true
+					wildcardFlows = append(wildcardFlows, wildcardFlow{flow, j, counters.lastSeen.Load()})
+					break
+				}
+			}
+		}
+		if !ok {
+			delete(t.flows, flow)
+			continue
+		}
+		add(i, counters.tx.Load(), counters.rx.Load())
+	}
+
+	folded := make(map[flowKey]flowCount)
+	for _, j := range wildcards {
+		if count, ok := t.folded[keys[j]]; ok {
+			folded[keys[j]] = count
+			add(j, count.tx, count.rx)
+		}
+	}
+	t.folded = folded
+	excess := len(t.flows) - maxFlows/2
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(wildcardFlows, func(i, j int) bool {
+		return wildcardFlows[i].lastSeen < wildcardFlows[j].lastSeen
+	})
+	for _, flow := range wildcardFlows[:min(excess, len(wildcardFlows))] {
+		counters := t.flows[flow.key]
+		endpoint := keys[flow.endpoint]
+		count := t.folded[endpoint]
+		count.tx += counters.tx.Load()
+		count.rx += counters.rx.Load()
+		t.folded[endpoint] = count
+		delete(t.flows, flow.key)
+	}
+}
+
+// parseFlow returns the flow of a TCP or UDP packet and the length of its
+// payload. Fragments and IPv6 extension headers are not looked into.
+func parseFlow(packet []byte, outbound bool) (key flowKey, n int, ok bool) {
+	if len(packet) == 0 {
+		return
+	}
+	var src, dst netip.Addr
+	var payload []byte
+	switch packet[0] >> 4 {
+	case 4:
+		h := header.IPv4(packet)
+		if !h.IsValid(len(packet)) || h.More() || h.FragmentOffset() != 0 {
+			return
+		}
+		src, dst = netip.AddrFrom4(h.SourceAddress().As4()), netip.AddrFrom4(h.DestinationAddress().As4())
+		key.proto, payload = h.TransportProtocol(), h.Payload()
+	case 6:
+		h := header.IPv6(packet)
+		if !h.IsValid(len(packet)) {
+			return
+		}
+		src, dst = netip.AddrFrom16(h.SourceAddress().As16()), netip.AddrFrom16(h.DestinationAddress().As16())
+		key.proto, payload = h.TransportProtocol(), h.Payload()
+	default:
+		return
+	}
+	var srcPort, dstPort uint16
+	switch key.proto {
+	case header.TCPProtocolNumber:
+		h := header.TCP(payload)
+		if len(h) < header.TCPMinimumSize || int(h.DataOffset()) > len(h) {
+			return
+		}
+		srcPort, dstPort, n = h.SourcePort(), h.DestinationPort(), len(h)-int(h.DataOffset())
+	case header.UDPProtocolNumber:
+		h := header.UDP(payload)
+		if len(h) < header.UDPMinimumSize {
+			return
+		}
+		srcPort, dstPort, n = h.SourcePort(), h.DestinationPort(), len(h)-header.UDPMinimumSize
+	default:
+		return
+	}
+	key.local, key.remote = netip.AddrPortFrom(dst, dstPort), netip.AddrPortFrom(src, srcPort)
+	if outbound {
+		key.local, key.remote = key.remote, key.local
+	}
+	return key, n, true
+}
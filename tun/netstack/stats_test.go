@@ -0,0 +1,126 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack_test
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack"
+	"github.com/amnezia-vpn/amneziawg-go/v3/tun/netstack/netstacktest"
+)
+
+func findConnection(conns []netstack.Connection, network string, local netip.AddrPort) *netstack.Connection {
+	for i := range conns {
+		if conns[i].Network == network && conns[i].Local == local {
+			return &conns[i]
+		}
+	}
+	return nil
+}
+
+func TestStats(t *testing.T) {
+	nets := netstacktest.NewPair(t)
+	server := netip.AddrPortFrom(netstacktest.Addrs[1], 7)
+	netstacktest.ServeEcho(t, nets[1], server)
+
+	c, err := nets[0].DialTCPAddrPort(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 10; i++ {
+		if _, err := io.WriteString(c, "ping"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := nets[0].Stats()
+	if stats.TCP.ActiveConnectionOpenings != 1 || stats.TCP.CurrentEstablished != 1 || stats.TCP.SegmentsSent == 0 || stats.IP.PacketsReceived == 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	var retransmits *netstack.Counter
+	counters := stats.Counters()
+	for i := range counters {
+		if counters[i].Name == "tcp_retransmits" {
+			retransmits = &counters[i]
+		}
+	}
+	if retransmits == nil || retransmits.Value != stats.TCP.Retransmits {
+		t.Errorf("tcp_retransmits %v", retransmits)
+	}
+
+	local := netip.MustParseAddrPort(c.LocalAddr().String())
+	conn := findConnection(nets[0].Connections(), "tcp", local)
+	if conn == nil {
+		t.Fatalf("no connection from %v in %v", local, nets[0].Connections())
+	}
+	if conn.Remote != server || conn.State != "ESTABLISHED" || conn.TxBytes != 40 || conn.RxBytes != 40 {
+		t.Errorf("connection %+v", conn)
+	}
+	if conn := findConnection(nets[1].Connections(), "tcp", server); conn == nil || conn.State != "LISTEN" {
+		t.Errorf("listener %+v", conn)
+	}
+
+	// The packets of an unconnected UDP endpoint are counted by it, which
+	// is listed once although it takes both IPv4 and IPv6.
+	pc, err := nets[1].ListenUDPAddrPort(netip.AddrPortFrom(netip.Addr{}, 5353))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	uc, err := nets[0].DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(netstacktest.Addrs[1], 5353))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if _, err := uc.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := pc.ReadFrom(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	conn = findConnection(nets[1].Connections(), "udp", netip.MustParseAddrPort("[::]:5353"))
+	if conn == nil || conn.State != "BOUND" || conn.RxBytes != 100 || conn.Remote.Port() != 0 {
+		t.Errorf("UDP endpoint %+v", conn)
+	}
+
+	// Flows of unconnected endpoints beyond what the table holds are
+	// folded into them, without losing bytes.
+	const clients = 2500
+	for i := 0; i < clients; i++ {
+		c, err := nets[0].DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(netstacktest.Addrs[1], 5353))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte{0})
+		c.Close()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn = findConnection(nets[1].Connections(), "udp", netip.MustParseAddrPort("[::]:5353"))
+		if conn != nil && conn.RxBytes == 100+clients {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("UDP endpoint %+v, want %d bytes received", conn, 100+clients)
+		}
+	}
+
+	c.Close()
+	uc.Close()
+	for _, conn := range nets[0].Connections() {
+		if conn.Local == local && conn.State == "ESTABLISHED" {
+			t.Errorf("closed connection still listed: %+v", conn)
+		}
+	}
+}
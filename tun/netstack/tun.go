@@ -17,8 +17,11 @@ import (
 	"net/netip"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -40,41 +43,117 @@ import (
 )
 
 type netTun struct {
+	net            *Net
+	nic            tcpip.NICID
+	primary        bool // closing it closes the stack
 	ep             *channel.Endpoint
-	stack          *stack.Stack
 	events         chan tun.Event
 	notifyHandle   *channel.NotificationHandle
 	incomingPacket chan *buffer.View
 	mtu            int
-	dnsServers     []netip.Addr
-	hasV4, hasV6   bool
+	closeOnce      sync.Once
 }
 
-type Net netTun
+type Net struct {
+	stack       *stack.Stack
+	dns         resolver
+	keepAlive   KeepAlive
+	queueLength int
+	flows       flowTable
+	pathMTUs    pathMTUCache
+	hooks       packetHooks
+	forwarding  atomic.Bool
+	pmtud       bool
+
+	mu      sync.Mutex
+	nextNIC tcpip.NICID
+	snat    []SNATRule
+
+	errMu     sync.Mutex
+	errQueues map[*errorQueue]bool
+}
 
 func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device, *Net, error) {
+	return CreateNetTUNWithOptions(localAddresses, dnsServers, mtu, nil)
+}
+
+// CreateNetTUNWithOptions is like CreateNetTUN, with the network stack
+// tuned by options, which may be nil.
+func CreateNetTUNWithOptions(localAddresses, dnsServers []netip.Addr, mtu int, options *Options) (tun.Device, *Net, error) {
+	if options == nil {
+		options = &Options{}
+	}
 	opts := stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4},
 		HandleLocal:        true,
 	}
+	tnet := &Net{
+		stack:       stack.New(opts),
+		keepAlive:   options.KeepAlive,
+		queueLength: options.QueueLength,
+		pmtud:       options.EnablePathMTUDiscovery,
+		nextNIC:     DefaultNIC,
+	}
+	if tnet.queueLength <= 0 {
+		tnet.queueLength = defaultQueueLength
+	}
+	tnet.flows.live = func() []flowKey {
+		_, keys := tnet.endpoints()
+		return keys
+	}
+	tnet.setDNSServers(dnsServers)
+	if err := options.apply(tnet.stack); err != nil {
+		tnet.stack.Close()
+		return nil, nil, err
+	}
+	dev, err := tnet.addNIC(localAddresses, mtu)
+	if err != nil {
+		tnet.stack.Close()
+		return nil, nil, err
+	}
+	dev.primary = true
+	hasV4, hasV6 := tnet.families()
+	if hasV4 {
+		tnet.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: DefaultNIC})
+	}
+	if hasV6 {
+		tnet.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: DefaultNIC})
+	}
+	return dev, tnet, nil
+}
+
+// AddNIC attaches another device to the network stack, with the given
+// local addresses, and returns it with the number of its NIC. No packets
+// are routed to it until SetRoutes says so. Closing the device only
+// detaches it; closing the device returned by CreateNetTUN closes the
+// whole stack.
+func (net *Net) AddNIC(localAddresses []netip.Addr, mtu int) (tun.Device, int, error) {
+	dev, err := net.addNIC(localAddresses, mtu)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dev, int(dev.nic), nil
+}
+
+func (net *Net) addNIC(localAddresses []netip.Addr, mtu int) (*netTun, error) {
+	net.mu.Lock()
+	nic := net.nextNIC
+	net.nextNIC++
+	net.mu.Unlock()
+
 	dev := &netTun{
-		ep:             channel.New(1024, uint32(mtu), ""),
-		stack:          stack.New(opts),
+		net:            net,
+		nic:            nic,
+		ep:             channel.New(net.queueLength, uint32(mtu), ""),
 		events:         make(chan tun.Event, 10),
 		incomingPacket: make(chan *buffer.View),
-		dnsServers:     dnsServers,
 		mtu:            mtu,
 	}
-	sackEnabledOpt := tcpip.TCPSACKEnabled(true) // TCP SACK is disabled by default
-	tcpipErr := dev.stack.SetTransportProtocolOption(tcp.ProtocolNumber, &sackEnabledOpt)
-	if tcpipErr != nil {
-		return nil, nil, fmt.Errorf("could not enable TCP SACK: %v", tcpipErr)
-	}
 	dev.notifyHandle = dev.ep.AddNotify(dev)
-	tcpipErr = dev.stack.CreateNIC(1, dev.ep)
+	tcpipErr := net.stack.CreateNICWithOptions(nic, dev.ep, stack.NICOptions{Name: nicName(nic)})
 	if tcpipErr != nil {
-		return nil, nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
+		return nil, fmt.Errorf("CreateNIC: %v", tcpipErr)
 	}
 	for _, ip := range localAddresses {
 		var protoNumber tcpip.NetworkProtocolNumber
@@ -87,25 +166,30 @@ func CreateNetTUN(localAddresses, dnsServers []netip.Addr, mtu int) (tun.Device,
 			Protocol:          protoNumber,
 			AddressWithPrefix: tcpip.AddrFromSlice(ip.AsSlice()).WithPrefix(),
 		}
-		tcpipErr := dev.stack.AddProtocolAddress(1, protoAddr, stack.AddressProperties{})
+		tcpipErr := net.stack.AddProtocolAddress(nic, protoAddr, stack.AddressProperties{})
 		if tcpipErr != nil {
-			return nil, nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
+			net.stack.RemoveNIC(nic)
+			return nil, fmt.Errorf("AddProtocolAddress(%v): %v", ip, tcpipErr)
 		}
-		if ip.Is4() {
-			dev.hasV4 = true
-		} else if ip.Is6() {
-			dev.hasV6 = true
-		}
-	}
-	if dev.hasV4 {
-		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: 1})
-	}
-	if dev.hasV6 {
-		dev.stack.AddRoute(tcpip.Route{Destination: header.IPv6EmptySubnet, NIC: 1})
 	}
 
 	dev.events <- tun.EventUp
-	return dev, (*Net)(dev), nil
+	return dev, nil
+}
+
+// families reports whether the stack has IPv4 and IPv6 addresses.
+func (net *Net) families() (hasV4, hasV6 bool) {
+	for _, addrs := range net.stack.AllAddresses() {
+		for _, addr := range addrs {
+			switch addr.Protocol {
+			case ipv4.ProtocolNumber:
+				hasV4 = true
+			case ipv6.ProtocolNumber:
+				hasV6 = true
+			}
+		}
+	}
+	return
 }
 
 func (tun *netTun) Name() (string, error) {
@@ -121,17 +205,23 @@ func (tun *netTun) Events() <-chan tun.Event {
 }
 
 func (tun *netTun) Read(buf [][]byte, sizes []int, offset int) (int, error) {
-	view, ok := <-tun.incomingPacket
-	if !ok {
-		return 0, os.ErrClosed
-	}
+	for {
+		view, ok := <-tun.incomingPacket
+		if !ok {
+			return 0, os.ErrClosed
+		}
 
-	n, err := view.Read(buf[0][offset:])
-	if err != nil {
-		return 0, err
+		// Packets dropped by the hooks, or grown by them past the buffer,
+		// are not read.
+		packet := tun.net.hooks.run(int(tun.nic), Outbound, view.AsSlice())
+		if len(packet) == 0 || len(packet) > len(buf[0])-offset {
+			view.Release()
+			continue
+		}
+		sizes[0] = copy(buf[0][offset:], packet)
+		view.Release()
+		return 1, nil
 	}
-	sizes[0] = n
-	return 1, nil
 }
 
 func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
@@ -140,7 +230,12 @@ func (tun *netTun) Write(buf [][]byte, offset int) (int, error) {
 		if len(packet) == 0 {
 			continue
 		}
+		if packet = tun.net.hooks.run(int(tun.nic), Inbound, packet); len(packet) == 0 {
+			continue
+		}
 
+		tun.net.flows.count(packet, false)
+		tun.net.handleICMPError(packet)
 		pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{Payload: buffer.MakeWithData(packet)})
 		switch packet[0] >> 4 {
 		case 4:
@@ -162,24 +257,31 @@ func (tun *netTun) WriteNotify() {
 
 	view := pkt.ToView()
 	pkt.DecRef()
+	tun.net.flows.count(view.AsSlice(), true)
+	if tun.net.pmtud && !tun.net.forwarding.Load() {
+		tun.net.markDontFragment(view.AsSlice())
+	}
 
 	tun.incomingPacket <- view
 }
 
 func (tun *netTun) Close() error {
-	tun.stack.RemoveNIC(1)
-	tun.stack.Close()
-	tun.ep.RemoveNotify(tun.notifyHandle)
-	tun.ep.Close()
-
-	if tun.events != nil {
-		close(tun.events)
-	}
+	tun.closeOnce.Do(func() {
+		tun.net.stack.RemoveNIC(tun.nic)
+		if tun.primary {
+			tun.net.stack.Close()
+		}
+		tun.ep.RemoveNotify(tun.notifyHandle)
+		tun.ep.Close()
 
-	if tun.incomingPacket != nil {
-		close(tun.incomingPacket)
-	}
+		if tun.events != nil {
+			close(tun.events)
+		}
 
+		if tun.incomingPacket != nil {
+			close(tun.incomingPacket)
+		}
+	})
 	return nil
 }
 
@@ -199,7 +301,6 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 		protoNumber = ipv6.ProtocolNumber
 	}
 	return tcpip.FullAddress{
-		NIC:  1,
 		Addr: tcpip.AddrFromSlice(endpoint.Addr().AsSlice()),
 		Port: endpoint.Port(),
 	}, protoNumber
@@ -207,7 +308,58 @@ func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.Networ
 
 func (net *Net) DialContextTCPAddrPort(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
 	fa, pn := convertToFullAddr(addr)
-	return gonet.DialContextTCP(ctx, net.stack, fa, pn)
+	return net.dialTCP(ctx, fa, pn)
+}
+
+// dialTCP is gonet.DialContextTCP, with the keepalive options of the
+// stack set before connecting and the path MTU already learned for addr
+// set after.
+func (tnet *Net) dialTCP(ctx context.Context, addr tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*gonet.TCPConn, error) {
+	var wq waiter.Queue
+	ep, tcpipErr := tnet.stack.NewEndpoint(tcp.ProtocolNumber, pn, &wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+	if tcpipErr := tnet.keepAlive.set(ep); tcpipErr != nil {
+		ep.Close()
+		return nil, errors.New(tcpipErr.String())
+	}
+
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+
+	select {
+	case <-ctx.Done():
+		ep.Close()
+		return nil, ctx.Err()
+	default:
+	}
+
+	tcpipErr = ep.Connect(addr)
+	if _, ok := tcpipErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpipErr = ep.LastError()
+	}
+	if tcpipErr != nil {
+		ep.Close()
+		return nil, &net.OpError{
+			Op:   "connect",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IP(addr.Addr.AsSlice()), Port: int(addr.Port)},
+			Err:  errors.New(tcpipErr.String()),
+		}
+	}
+	if tnet.pmtud {
+		dst, _ := netip.AddrFromSlice(addr.Addr.AsSlice())
+		tnet.seedPathMTU(ep, dst)
+	}
+	return gonet.NewTCPConn(&wq, ep), nil
 }
 
 func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -220,7 +372,7 @@ func (net *Net) DialContextTCP(ctx context.Context, addr *net.TCPAddr) (*gonet.T
 
 func (net *Net) DialTCPAddrPort(addr netip.AddrPort) (*gonet.TCPConn, error) {
 	fa, pn := convertToFullAddr(addr)
-	return gonet.DialTCP(net.stack, fa, pn)
+	return net.dialTCP(context.Background(), fa, pn)
 }
 
 func (net *Net) DialTCP(addr *net.TCPAddr) (*gonet.TCPConn, error) {
@@ -245,8 +397,50 @@ func (net *Net) ListenTCP(addr *net.TCPAddr) (*gonet.TCPListener, error) {
 }
 
 func (net *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, error) {
-	var lfa, rfa *tcpip.FullAddress
-	var pn tcpip.NetworkProtocolNumber
+	lfa, rfa, pn := convertUDPAddrs(laddr, raddr)
+	return gonet.DialUDP(net.stack, lfa, rfa, pn)
+}
+
+func (net *Net) ListenUDPAddrPort(laddr netip.AddrPort) (*gonet.UDPConn, error) {
+	return net.DialUDPAddrPort(laddr, netip.AddrPort{})
+}
+
+func (net *Net) DialUDP(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	la, ra := convertUDPAddrPorts(laddr, raddr)
+	return net.DialUDPAddrPort(la, ra)
+}
+
+func (net *Net) ListenUDP(laddr *net.UDPAddr) (*gonet.UDPConn, error) {
+	return net.DialUDP(laddr, nil)
+}
+
+// DialUDPAddrPortWithErrors is like DialUDPAddrPort, but the reads of the
+// returned connection also report the ICMP errors received for it.
+func (net *Net) DialUDPAddrPortWithErrors(laddr, raddr netip.AddrPort) (*UDPConn, error) {
+	lfa, rfa, pn := convertUDPAddrs(laddr, raddr)
+	return net.dialUDP(lfa, rfa, pn)
+}
+
+// ListenUDPAddrPortWithErrors is like ListenUDPAddrPort, but the reads of
+// the returned connection also report the ICMP errors received for it.
+func (net *Net) ListenUDPAddrPortWithErrors(laddr netip.AddrPort) (*UDPConn, error) {
+	return net.DialUDPAddrPortWithErrors(laddr, netip.AddrPort{})
+}
+
+// DialUDPWithErrors is like DialUDP, but the reads of the returned
+// connection also report the ICMP errors received for it.
+func (net *Net) DialUDPWithErrors(laddr, raddr *net.UDPAddr) (*UDPConn, error) {
+	la, ra := convertUDPAddrPorts(laddr, raddr)
+	return net.DialUDPAddrPortWithErrors(la, ra)
+}
+
+// ListenUDPWithErrors is like ListenUDP, but the reads of the returned
+// connection also report the ICMP errors received for it.
+func (net *Net) ListenUDPWithErrors(laddr *net.UDPAddr) (*UDPConn, error) {
+	return net.DialUDPWithErrors(laddr, nil)
+}
+
+func convertUDPAddrs(laddr, raddr netip.AddrPort) (lfa, rfa *tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) {
 	if laddr.IsValid() || laddr.Port() > 0 {
 		var addr tcpip.FullAddress
 		addr, pn = convertToFullAddr(laddr)
@@ -257,15 +451,10 @@ func (net *Net) DialUDPAddrPort(laddr, raddr netip.AddrPort) (*gonet.UDPConn, er
 		addr, pn = convertToFullAddr(raddr)
 		rfa = &addr
 	}
-	return gonet.DialUDP(net.stack, lfa, rfa, pn)
-}
-
-func (net *Net) ListenUDPAddrPort(laddr netip.AddrPort) (*gonet.UDPConn, error) {
-	return net.DialUDPAddrPort(laddr, netip.AddrPort{})
+	return lfa, rfa, pn
 }
 
-func (net *Net) DialUDP(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
-	var la, ra netip.AddrPort
+func convertUDPAddrPorts(laddr, raddr *net.UDPAddr) (la, ra netip.AddrPort) {
 	if laddr != nil {
 		ip, _ := netip.AddrFromSlice(laddr.IP)
 		la = netip.AddrPortFrom(ip, uint16(laddr.Port))
@@ -274,11 +463,7 @@ func (net *Net) DialUDP(laddr, raddr *net.UDPAddr) (*gonet.UDPConn, error) {
 		ip, _ := netip.AddrFromSlice(raddr.IP)
 		ra = netip.AddrPortFrom(ip, uint16(raddr.Port))
 	}
-	return net.DialUDPAddrPort(la, ra)
-}
-
-func (net *Net) ListenUDP(laddr *net.UDPAddr) (*gonet.UDPConn, error) {
-	return net.DialUDP(laddr, nil)
+	return la, ra
 }
 
 type PingConn struct {
@@ -287,6 +472,8 @@ type PingConn struct {
 	wq       waiter.Queue
 	ep       tcpip.Endpoint
 	deadline *time.Timer
+	net      *Net
+	errs     *errorQueue
 }
 
 type PingAddr struct{ addr netip.Addr }
@@ -336,6 +523,7 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 	pc := &PingConn{
 		laddr:    PingAddr{laddr},
 		deadline: time.NewTimer(time.Hour << 10),
+		net:      net,
 	}
 	pc.deadline.Stop()
 
@@ -360,6 +548,10 @@ func (net *Net) DialPingAddr(laddr, raddr netip.Addr) (*PingConn, error) {
 		}
 	}
 
+	// Like ping sockets on Linux, all the ICMP errors for the echo
+	// requests are reported, which is what traceroute needs.
+	pc.errs = &errorQueue{ep: pc.ep, wq: &pc.wq, all: true}
+	net.registerErrors(pc.errs)
 	return pc, nil
 }
 
@@ -395,6 +587,9 @@ func (pc *PingConn) RemoteAddr() net.Addr {
 }
 
 func (pc *PingConn) Close() error {
+	if pc.errs != nil {
+		pc.net.unregisterErrors(pc.errs)
+	}
 	pc.deadline.Reset(0)
 	pc.ep.Close()
 	return nil
@@ -440,11 +635,17 @@ func (pc *PingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	pc.wq.EventRegister(&e)
 	defer pc.wq.EventUnregister(&e)
 
+	if icmpErr := pc.errs.pop(); icmpErr != nil {
+		return 0, nil, fmt.Errorf("ping read: %w", icmpErr)
+	}
 	select {
 	case <-pc.deadline.C:
 		return 0, nil, os.ErrDeadlineExceeded
 	case <-notifyCh:
 	}
+	if icmpErr := pc.errs.pop(); icmpErr != nil {
+		return 0, nil, fmt.Errorf("ping read: %w", icmpErr)
+	}
 
 	w := tcpip.SliceWriter(p)
 
@@ -464,6 +665,12 @@ func (pc *PingConn) Read(p []byte) (n int, err error) {
 	return
 }
 
+// SetTTL sets the TTL, or IPv6 hop limit, of the echo requests. A TTL of
+// 0 restores the default of the stack.
+func (pc *PingConn) SetTTL(ttl int) error {
+	return setTTL(pc.ep, ttl)
+}
+
 func (pc *PingConn) SetDeadline(t time.Time) error {
 	// pc.SetWriteDeadline is unimplemented
 
@@ -650,7 +857,7 @@ func dnsStreamRoundTrip(c net.Conn, id uint16, query dnsmessage.Question, b []by
 	return p, h, nil
 }
 
-func (tnet *Net) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
+func (tnet *Net) exchange(ctx context.Context, server netip.AddrPort, q dnsmessage.Question, timeout time.Duration) (dnsmessage.Parser, dnsmessage.Header, error) {
 	q.Class = dnsmessage.ClassINET
 	id, udpReq, tcpReq, err := newRequest(q)
 	if err != nil {
@@ -664,9 +871,9 @@ func (tnet *Net) exchange(ctx context.Context, server netip.Addr, q dnsmessage.Q
 		var c net.Conn
 		var err error
 		if useUDP {
-			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, netip.AddrPortFrom(server, 53))
+			c, err = tnet.DialUDPAddrPort(netip.AddrPort{}, server)
 		} else {
-			c, err = tnet.DialContextTCPAddrPort(ctx, netip.AddrPortFrom(server, 53))
+			c, err = tnet.DialContextTCPAddrPort(ctx, server)
 		}
 
 		if err != nil {
@@ -725,30 +932,12 @@ func checkHeader(p *dnsmessage.Parser, h dnsmessage.Header) error {
 	return nil
 }
 
-func skipToAnswer(p *dnsmessage.Parser, qtype dnsmessage.Type) error {
-	for {
-		h, err := p.AnswerHeader()
-		if err == dnsmessage.ErrSectionDone {
-			return errNoSuchHost
-		}
-		if err != nil {
-			return errCannotUnmarshalDNSMessage
-		}
-		if h.Type == qtype {
-			return nil
-		}
-		if err := p.SkipAnswer(); err != nil {
-			return errCannotUnmarshalDNSMessage
-		}
-	}
-}
-
-func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.Type) (dnsmessage.Parser, string, error) {
+func (tnet *Net) tryOneName(ctx context.Context, servers []dnsServer, name string, qtype dnsmessage.Type) ([]netip.Addr, uint32, error) {
 	var lastErr error
 
 	n, err := dnsmessage.NewName(name)
 	if err != nil {
-		return dnsmessage.Parser{}, "", errCannotMarshalDNSMessage
+		return nil, 0, errCannotMarshalDNSMessage
 	}
 	q := dnsmessage.Question{
 		Name:  n,
@@ -757,8 +946,8 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 	}
 
 	for i := 0; i < 2; i++ {
-		for _, server := range tnet.dnsServers {
-			p, h, err := tnet.exchange(ctx, server, q, time.Second*5)
+		for _, server := range servers {
+			p, h, err := server.exchange(ctx, q, dnsTimeout)
 			if err != nil {
 				dnsErr := &net.DNSError{
 					Err:    err.Error(),
@@ -786,15 +975,15 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 				}
 				if err == errNoSuchHost {
 					dnsErr.IsNotFound = true
-					return p, server.String(), dnsErr
+					return nil, 0, dnsErr
 				}
 				lastErr = dnsErr
 				continue
 			}
 
-			err = skipToAnswer(&p, qtype)
+			addrs, ttl, err := parseAnswers(&p, qtype)
 			if err == nil {
-				return p, server.String(), nil
+				return addrs, ttl, nil
 			}
 			lastErr = &net.DNSError{
 				Err:    err.Error(),
@@ -803,58 +992,61 @@ func (tnet *Net) tryOneName(ctx context.Context, name string, qtype dnsmessage.T
 			}
 			if err == errNoSuchHost {
 				lastErr.(*net.DNSError).IsNotFound = true
-				return p, server.String(), lastErr
+				return nil, 0, lastErr
 			}
 		}
 	}
-	return dnsmessage.Parser{}, "", lastErr
+	if lastErr == nil {
+		lastErr = &net.DNSError{Err: "no DNS servers", Name: name}
+	}
+	return nil, 0, lastErr
 }
 
-func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
-	if host == "" || (!tnet.hasV6 && !tnet.hasV4) {
-		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
-	}
-	zlen := len(host)
-	if strings.IndexByte(host, ':') != -1 {
-		if zidx := strings.LastIndexByte(host, '%'); zidx != -1 {
-			zlen = zidx
-		}
+// lookupType returns the addresses of type qtype of name, from the cache
+// if possible.
+func (tnet *Net) lookupType(ctx context.Context, servers []dnsServer, name string, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	if addrs, ok := tnet.dns.cached(name, qtype); ok {
+		return addrs, nil
 	}
-	if ip, err := netip.ParseAddr(host[:zlen]); err == nil {
-		return []string{ip.String()}, nil
+	addrs, ttl, err := tnet.tryOneName(ctx, servers, name, qtype)
+	if err != nil {
+		return nil, err
 	}
+	tnet.dns.store(name, qtype, addrs, ttl)
+	return addrs, nil
+}
 
-	if !isDomainName(host) {
-		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
-	}
+// lookupName returns the addresses of the fully qualified name, in the
+// order of the address preference.
+func (tnet *Net) lookupName(ctx context.Context, config resolverConfig, name string) ([]netip.Addr, error) {
+	hasV4, hasV6 := tnet.families()
+	wantV4 := hasV4 && config.prefer != OnlyIPv6
+	wantV6 := hasV6 && config.prefer != OnlyIPv4
 	type result struct {
-		p      dnsmessage.Parser
-		server string
+		addrs []netip.Addr
 		error
 	}
-	var addrsV4, addrsV6 []netip.Addr
-	lanes := 0
-	if tnet.hasV4 {
-		lanes++
-	}
-	if tnet.hasV6 {
-		lanes++
-	}
-	lane := make(chan result, lanes)
-	var lastErr error
-	if tnet.hasV4 {
+	var v4, v6 chan result
+	if wantV4 {
+		v4 = make(chan result, 1)
 		go func() {
-			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeA)
-			lane <- result{p, server, err}
+			addrs, err := tnet.lookupType(ctx, config.servers, name, dnsmessage.TypeA)
+			v4 <- result{addrs, err}
 		}()
 	}
-	if tnet.hasV6 {
+	if wantV6 {
+		v6 = make(chan result, 1)
 		go func() {
-			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeAAAA)
-			lane <- result{p, server, err}
+			addrs, err := tnet.lookupType(ctx, config.servers, name, dnsmessage.TypeAAAA)
+			v6 <- result{addrs, err}
 		}()
 	}
-	for l := 0; l < lanes; l++ {
+	var addrsV4, addrsV6 []netip.Addr
+	var lastErr error
+	for _, lane := range []chan result{v4, v6} {
+		if lane == nil {
+			continue
+		}
 		result := <-lane
 		if result.error != nil {
 			if lastErr == nil {
@@ -862,74 +1054,65 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 			}
 			continue
 		}
-
-	loop:
-		for {
-			h, err := result.p.AnswerHeader()
-			if err != nil && err != dnsmessage.ErrSectionDone {
-				lastErr = &net.DNSError{
-					Err:    errCannotMarshalDNSMessage.Error(),
-					Name:   host,
-					Server: result.server,
-				}
-			}
-			if err != nil {
-				break
-			}
-			switch h.Type {
-			case dnsmessage.TypeA:
-				a, err := result.p.AResource()
-				if err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				addrsV4 = append(addrsV4, netip.AddrFrom4(a.A))
-
-			case dnsmessage.TypeAAAA:
-				aaaa, err := result.p.AAAAResource()
-				if err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				addrsV6 = append(addrsV6, netip.AddrFrom16(aaaa.AAAA))
-
-			default:
-				if err := result.p.SkipAnswer(); err != nil {
-					lastErr = &net.DNSError{
-						Err:    errCannotMarshalDNSMessage.Error(),
-						Name:   host,
-						Server: result.server,
-					}
-					break loop
-				}
-				continue
-			}
+		if lane == v4 {
+			addrsV4 = result.addrs
+		} else {
+			addrsV6 = result.addrs
 		}
 	}
-	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled
+
+	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled,
+	// unless configured otherwise.
 	var addrs []netip.Addr
-	if tnet.hasV6 {
-		addrs = append(addrsV6, addrsV4...)
+	if config.prefer == PreferIPv6 || (config.prefer == PreferDefault && hasV6) {
+		addrs = slices.Concat(addrsV6, addrsV4)
 	} else {
-		addrs = append(addrsV4, addrsV6...)
+		addrs = slices.Concat(addrsV4, addrsV6)
 	}
-
 	if len(addrs) == 0 && lastErr != nil {
 		return nil, lastErr
 	}
-	saddrs := make([]string, 0, len(addrs))
-	for _, ip := range addrs {
-		saddrs = append(saddrs, ip.String())
+	return addrs, nil
+}
+
+func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string, error) {
+	if hasV4, hasV6 := tnet.families(); host == "" || (!hasV6 && !hasV4) {
+		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
+	zlen := len(host)
+	if strings.IndexByte(host, ':') != -1 {
+		if zidx := strings.LastIndexByte(host, '%'); zidx != -1 {
+			zlen = zidx
+		}
+	}
+	if ip, err := netip.ParseAddr(host[:zlen]); err == nil {
+		return []string{ip.String()}, nil
+	}
+
+	if !isDomainName(host) {
+		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
+	tnet.dns.RLock()
+	config := resolverConfig{servers: tnet.dns.servers, search: tnet.dns.search, prefer: tnet.dns.prefer}
+	tnet.dns.RUnlock()
+
+	var lastErr error
+	for _, name := range config.candidates(host) {
+		addrs, err := tnet.lookupName(ctx, config, name)
+		if err == nil {
+			saddrs := make([]string, 0, len(addrs))
+			for _, ip := range addrs {
+				saddrs = append(saddrs, ip.String())
+			}
+			return saddrs, nil
+		}
+		lastErr = err
+		// Only names that do not exist fall through to the next candidate.
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			break
+		}
 	}
-	return saddrs, nil
+	return nil, lastErr
 }
 
 func partialDeadline(now, deadline time.Time, addrsRemaining int) (time.Time, error) {
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2025 WireGuard LLC. All Rights Reserved.
+ */
+
+package netstack
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// A UDPConn is a gonet.UDPConn whose reads also report the ICMP errors
+// received for it, as *ICMPError. Like on Linux, a connected UDPConn gets
+// hard errors such as port unreachable, and SetReceiveErrors asks for the
+// rest.
+type UDPConn struct {
+	*gonet.UDPConn
+	net  *Net
+	ep   tcpip.Endpoint
+	errs *errorQueue
+}
+
+// dialUDP is gonet.DialUDP, with the ICMP errors for the endpoint queued
+// on the connection.
+func (tnet *Net) dialUDP(laddr, raddr *tcpip.FullAddress, pn tcpip.NetworkProtocolNumber) (*UDPConn, error) {
+	wq := new(waiter.Queue)
+	ep, tcpipErr := tnet.stack.NewEndpoint(udp.ProtocolNumber, pn, wq)
+	if tcpipErr != nil {
+		return nil, errors.New(tcpipErr.String())
+	}
+
+	if laddr != nil {
+		if tcpipErr := ep.Bind(*laddr); tcpipErr != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "bind",
+				Net:  "udp",
+				Addr: &net.UDPAddr{IP: net.IP(laddr.Addr.AsSlice()), Port: int(laddr.Port)},
+				Err:  errors.New(tcpipErr.String()),
+			}
+		}
+	}
+
+	if raddr != nil {
+		if tcpipErr := ep.Connect(*raddr); tcpipErr != nil {
+			ep.Close()
+			return nil, &net.OpError{
+				Op:   "connect",
+				Net:  "udp",
+				Addr: &net.UDPAddr{IP: net.IP(raddr.Addr.AsSlice()), Port: int(raddr.Port)},
+				Err:  errors.New(tcpipErr.String()),
+			}
+		}
+	}
+
+	c := &UDPConn{
+		net:  tnet,
+		ep:   ep,
+		errs: &errorQueue{ep: ep, wq: wq},
+	}
+	c.UDPConn = gonet.NewUDPConn(tnet.stack, wq, &errorEndpoint{ep, c.errs})
+	tnet.registerErrors(c.errs)
+	return c, nil
+}
+
+// ReadFrom implements net.PacketConn.ReadFrom.
+func (c *UDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	if err != nil {
+		err = c.icmpError(err)
+	}
+	return n, addr, err
+}
+
+// Read implements net.Conn.Read.
+func (c *UDPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// icmpError replaces the error of a read failed by errorEndpoint with the
+// queued ICMP error.
+func (c *UDPConn) icmpError(err error) error {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		return err
+	}
+	icmpErr := c.errs.pop()
+	if icmpErr == nil {
+		return err
+	}
+	e := *opErr
+	e.Err = icmpErr
+	return &e
+}
+
+// SetReceiveErrors reports whether reads return all the ICMP errors
+// received for the connection, including time exceeded messages and those
+// for unconnected connections, like IP_RECVERR does.
+func (c *UDPConn) SetReceiveErrors(on bool) {
+	c.errs.setAll(on)
+}
+
+// SetTTL sets the TTL, or IPv6 hop limit, of the packets sent by the
+// connection. A TTL of 0 restores the default of the stack.
+func (c *UDPConn) SetTTL(ttl int) error {
+	return setTTL(c.ep, ttl)
+}
+
+// PathMTU returns the path MTU learned for the remote address of the
+// connection, or 0 if none is known.
+func (c *UDPConn) PathMTU() int {
+	ua, ok := c.RemoteAddr().(*net.UDPAddr)
+	if !ok || ua == nil {
+		return 0
+	}
+	return c.net.PathMTU(ua.AddrPort().Addr())
+}
+
+// Close implements net.Conn.Close.
+func (c *UDPConn) Close() error {
+	c.net.unregisterErrors(c.errs)
+	return c.UDPConn.Close()
+}
+
+// setTTL sets the TTL and the IPv6 hop limit of ep, which both go back to
+// their defaults with a TTL of 0.
+func setTTL(ep tcpip.Endpoint, ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("invalid TTL %d", ttl)
+	}
+	hopLimit := ttl
+	if ttl == 0 {
+		hopLimit = tcpip.UseDefaultIPv6HopLimit
+	}
+	var v4, v6 bool
+	if tcpipErr := ep.SetSockOptInt(tcpip.IPv4TTLOption, ttl); tcpipErr == nil {
+		v4 = true
+	}
+	if tcpipErr := ep.SetSockOptInt(tcpip.IPv6HopLimitOption, hopLimit); tcpipErr == nil {
+		v6 = true
+	}
+	if !v4 && !v6 {
+		return fmt.Errorf("could not set TTL %d", ttl)
+	}
+	return nil
+}